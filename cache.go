@@ -0,0 +1,454 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// Cache stores resolved response messages keyed by question
+type Cache interface {
+	// Get returns the message if it has not expired
+	Get(key string) (*dns.Msg, bool)
+
+	// GetStale returns the message even if it has expired, as long as it is still retained
+	GetStale(key string) (*dns.Msg, bool)
+
+	// Set stores the message for ttl and retains it for stale longer after it expires
+	Set(key string, responseM *dns.Msg, ttl time.Duration, stale time.Duration)
+
+	Delete(key string)
+}
+
+// expiredCache is implemented by caches which report how long ago an entry expired
+type expiredCache interface {
+	// GetExpired returns a retained message which has expired and how long ago
+	GetExpired(key string) (*dns.Msg, time.Duration, bool)
+}
+
+// REVALIDATE_ANSWER_TTL is the ttl of records served while their entry is refreshed
+const REVALIDATE_ANSWER_TTL uint32 = 0
+
+// STALE_ANSWER_TTL is the ttl of records served from an expired cache entry (RFC 8767)
+const STALE_ANSWER_TTL uint32 = 30
+
+// cacheKey builds the cache key of the first question of a query
+// names are lowercased so that differently cased queries share the same entry
+// the DO and CD bits change the answer, DNSSEC records and unvalidated data, so they are part of the key
+func cacheKey(queryM *dns.Msg) string {
+	question := queryM.Question[0]
+	key := strings.ToLower(dns.Fqdn(question.Name)) + "/" + dns.TypeToString[question.Qtype] + "/" + dns.ClassToString[question.Qclass]
+	if wantsDNSSEC(queryM) {
+		key += "/DO"
+	}
+	if queryM.CheckingDisabled {
+		key += "/CD"
+	}
+	return key
+}
+
+// responseTTL returns the lowest ttl among the answer and authority records
+// Returns 0 if the response should not be cached
+func responseTTL(responseM *dns.Msg) time.Duration {
+	if responseM.Rcode != dns.RcodeSuccess && responseM.Rcode != dns.RcodeNameError {
+		return 0
+	}
+
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dns.RR{responseM.Answer, responseM.Ns} {
+		for _, rr := range rrs {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// ageResponse decrements the ttl of every record by the time the message spent in the cache
+// Authority and additional records whose ttl ran out are dropped
+// Returns false if an answer record expired, the message should then not be served
+func ageResponse(responseM *dns.Msg, elapsed time.Duration) bool {
+	age := uint32(elapsed / time.Second)
+	if age == 0 {
+		return true
+	}
+
+	valid := true
+	// filters in place, responseM is the caller's own copy of the cached message
+	decrement := func(rrs []dns.RR, answer bool) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				// the ttl of OPT carries flags
+				kept = append(kept, rr)
+				continue
+			}
+			if header.Ttl <= age {
+				if answer {
+					valid = false
+				}
+				continue
+			}
+			header.Ttl -= age
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+
+	responseM.Answer = decrement(responseM.Answer, true)
+	responseM.Ns = decrement(responseM.Ns, false)
+	responseM.Extra = decrement(responseM.Extra, false)
+	return valid
+}
+
+// jitterTTL shortens ttl by a random amount of up to percent of it
+// so that entries cached together do not all expire at the same moment
+func jitterTTL(ttl time.Duration, percent int) time.Duration {
+	if percent <= 0 || ttl <= 0 {
+		return ttl
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	window := int64(ttl) * int64(percent) / 100
+	if window <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Int63n(window+1))
+}
+
+// Memory cache
+
+// default maximum number of entries of a memory cache
+var MEMORY_CACHE_MAX_ENTRIES int = 10000
+
+// memoryEntry is a cached message with its expiration
+type memoryEntry struct {
+	key string
+	msg *dns.Msg
+
+	// time the message was cached, record ttls are decremented from it
+	stored time.Time
+
+	// original expiration of the message
+	expire time.Time
+
+	// time until which the entry is kept for serving stale
+	retain time.Time
+
+	// packed size of the message, counted against the byte budget
+	size int
+}
+
+// CacheStats is a snapshot of the memory cache usage
+type CacheStats struct {
+	Entries  int     `json:"entries"`
+	Bytes    int     `json:"bytes"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// MemoryCache is an in process Cache evicting the least recently used entries
+type MemoryCache struct {
+	lock sync.Mutex
+
+	// entries by key, and in recently used order, most recent first
+	entries map[string]*list.Element
+	order   *list.List
+
+	// maximum number of entries, unlimited when 0
+	MaxEntries int
+
+	// maximum total packed size of the entries, unlimited when 0
+	MaxBytes int
+
+	// total packed size of the entries
+	bytes int
+
+	hits   uint64
+	misses uint64
+}
+
+// NewMemoryCache creates an empty in memory cache holding up to MEMORY_CACHE_MAX_ENTRIES entries
+func NewMemoryCache() *MemoryCache {
+	return NewMemoryCacheSize(MEMORY_CACHE_MAX_ENTRIES, 0)
+}
+
+// NewMemoryCacheSize creates an empty in memory cache bounded by maxEntries and maxBytes
+// 0 leaves the bound unlimited
+func NewMemoryCacheSize(maxEntries int, maxBytes int) *MemoryCache {
+	return &MemoryCache{
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+	}
+}
+
+// Get returns a copy of the cached message if it has not expired
+func (cache *MemoryCache) Get(key string) (*dns.Msg, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		cache.misses++
+		return nil, false
+	}
+	entry := element.Value.(*memoryEntry)
+
+	now := time.Now()
+	if now.After(entry.expire) {
+		if now.After(entry.retain) {
+			cache.remove(element)
+		}
+		cache.misses++
+		return nil, false
+	}
+
+	responseM := entry.msg.Copy()
+	if !ageResponse(responseM, now.Sub(entry.stored)) {
+		cache.misses++
+		return nil, false
+	}
+
+	cache.order.MoveToFront(element)
+	cache.hits++
+	return responseM, true
+}
+
+// GetStale returns a copy of the cached message if it is still retained
+func (cache *MemoryCache) GetStale(key string) (*dns.Msg, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*memoryEntry)
+
+	if time.Now().After(entry.retain) {
+		cache.remove(element)
+		return nil, false
+	}
+
+	cache.order.MoveToFront(element)
+	return entry.msg.Copy(), true
+}
+
+// GetExpired returns a copy of the message if it has expired but is still retained, and how long ago it expired
+func (cache *MemoryCache) GetExpired(key string) (*dns.Msg, time.Duration, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	entry := element.Value.(*memoryEntry)
+
+	now := time.Now()
+	if !now.After(entry.expire) || now.After(entry.retain) {
+		return nil, 0, false
+	}
+	cache.order.MoveToFront(element)
+	return entry.msg.Copy(), now.Sub(entry.expire), true
+}
+
+// Set stores a copy of the message for ttl, retaining it for stale after expiry
+// The least recently used entries are evicted to stay within the bounds
+func (cache *MemoryCache) Set(key string, responseM *dns.Msg, ttl time.Duration, stale time.Duration) {
+	now := time.Now()
+	expire := now.Add(ttl)
+	entry := &memoryEntry{
+		key:    key,
+		msg:    responseM.Copy(),
+		stored: now,
+		expire: expire,
+		retain: expire.Add(stale),
+		size:   responseM.Len(),
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+	cache.entries[key] = cache.order.PushFront(entry)
+	cache.bytes += entry.size
+
+	for cache.order.Len() > 1 && cache.overBudget() {
+		cache.remove(cache.order.Back())
+	}
+}
+
+// overBudget reports whether the cache exceeds its bounds
+func (cache *MemoryCache) overBudget() bool {
+	if cache.MaxEntries > 0 && cache.order.Len() > cache.MaxEntries {
+		return true
+	}
+	return cache.MaxBytes > 0 && cache.bytes > cache.MaxBytes
+}
+
+// remove drops an entry, the lock must be held
+func (cache *MemoryCache) remove(element *list.Element) {
+	entry := cache.order.Remove(element).(*memoryEntry)
+	delete(cache.entries, entry.key)
+	cache.bytes -= entry.size
+}
+
+// Len returns the number of entries, including expired ones not yet removed
+func (cache *MemoryCache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.order.Len()
+}
+
+// Stats returns the current size and hit rate of the cache
+func (cache *MemoryCache) Stats() CacheStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	stats := CacheStats{
+		Entries: cache.order.Len(),
+		Bytes:   cache.bytes,
+		Hits:    cache.hits,
+		Misses:  cache.misses,
+	}
+	if lookups := cache.hits + cache.misses; lookups > 0 {
+		stats.HitRatio = float64(cache.hits) / float64(lookups)
+	}
+	return stats
+}
+
+// Delete removes the entry of key
+func (cache *MemoryCache) Delete(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+}
+
+// Redis cache
+
+// RedisCache is a Cache shared between processes through redis
+// messages are stored in wire format, prefixed by the time they were cached and their original expiration
+type RedisCache struct {
+	// redis client
+	Client *redis.Client
+
+	// prefix prepended to every key
+	Prefix string
+}
+
+// NewRedisCache creates a cache backed by the redis server at addr
+func NewRedisCache(addr string, password string, db int) *RedisCache {
+	return &RedisCache{
+		Client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+			DB:       db,
+		}),
+		Prefix: "doh_proxy:",
+	}
+}
+
+// Get fetches and unpacks the cached message if it has not expired
+func (cache *RedisCache) Get(key string) (*dns.Msg, bool) {
+	responseM, stored, expire, ok := cache.get(key)
+	now := time.Now()
+	if !ok || now.After(expire) {
+		return nil, false
+	}
+	if !ageResponse(responseM, now.Sub(stored)) {
+		return nil, false
+	}
+	return responseM, true
+}
+
+// GetStale fetches and unpacks the cached message even if it has expired
+func (cache *RedisCache) GetStale(key string) (*dns.Msg, bool) {
+	responseM, _, _, ok := cache.get(key)
+	return responseM, ok
+}
+
+// GetExpired fetches the message if it has expired, and how long ago it expired
+func (cache *RedisCache) GetExpired(key string) (*dns.Msg, time.Duration, bool) {
+	responseM, _, expire, ok := cache.get(key)
+	now := time.Now()
+	if !ok || !now.After(expire) {
+		return nil, 0, false
+	}
+	return responseM, now.Sub(expire), true
+}
+
+// get fetches the cached message, the time it was cached and its original expiration
+func (cache *RedisCache) get(key string) (*dns.Msg, time.Time, time.Time, bool) {
+	data, err := cache.Client.Get(context.Background(), cache.Prefix+key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Failed to get from redis cache")
+		}
+		return nil, time.Time{}, time.Time{}, false
+	}
+
+	if len(data) < 16 {
+		log.WithFields(log.Fields{"Error": errors.New("Entry too short")}).Error("Failed to unpack cached message")
+		return nil, time.Time{}, time.Time{}, false
+	}
+	stored := time.Unix(0, int64(binary.BigEndian.Uint64(data[:8])))
+	expire := time.Unix(0, int64(binary.BigEndian.Uint64(data[8:16])))
+
+	var responseM *dns.Msg = new(dns.Msg)
+	err = responseM.Unpack(data[16:])
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Failed to unpack cached message")
+		return nil, time.Time{}, time.Time{}, false
+	}
+	return responseM, stored, expire, true
+}
+
+// Set packs and stores the message for ttl, retaining it for stale after expiry
+func (cache *RedisCache) Set(key string, responseM *dns.Msg, ttl time.Duration, stale time.Duration) {
+	packed, err := responseM.Pack()
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Failed to pack message for redis cache")
+		return
+	}
+
+	now := time.Now()
+	data := make([]byte, 16, 16+len(packed))
+	binary.BigEndian.PutUint64(data[:8], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint64(data[8:16], uint64(now.Add(ttl).UnixNano()))
+	data = append(data, packed...)
+
+	err = cache.Client.Set(context.Background(), cache.Prefix+key, data, ttl+stale).Err()
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Failed to set redis cache")
+	}
+}
+
+// Delete removes the entry of key
+func (cache *RedisCache) Delete(key string) {
+	err := cache.Client.Del(context.Background(), cache.Prefix+key).Err()
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Failed to delete from redis cache")
+	}
+}
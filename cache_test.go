@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
+)
+
+func TestCacheKeyBits(t *testing.T) {
+	plainM := newQuery("Example.com", dns.TypeA)
+	doM := newQuery("example.com", dns.TypeA)
+	doM.SetEdns0(1232, true)
+	cdM := newQuery("example.com", dns.TypeA)
+	cdM.CheckingDisabled = true
+
+	if cacheKey(plainM) != cacheKey(newQuery("example.COM", dns.TypeA)) {
+		t.Error("differently cased names have different keys")
+	}
+	keys := map[string]bool{cacheKey(plainM): true, cacheKey(doM): true, cacheKey(cdM): true}
+	if len(keys) != 3 {
+		t.Errorf("DO and CD queries share keys: %v", keys)
+	}
+}
+
+func TestResolveCachesByDO(t *testing.T) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+
+	doM := newQuery("example.com", dns.TypeA)
+	doM.SetEdns0(1232, true)
+	for _, queryM := range []*dns.Msg{newQuery("example.com", dns.TypeA), doM, doM.Copy()} {
+		_, err := client.Resolve(queryM)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := client.Stats()
+	if stats.CacheHits != 1 || stats.CacheMisses != 2 {
+		t.Errorf("%d hits and %d misses, want the DO query to miss the plain entry", stats.CacheHits, stats.CacheMisses)
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := NewRedisCache(server.Addr(), "", 0)
+
+	key := cacheKey(newQuery("example.com", dns.TypeA))
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("empty cache hit")
+	}
+
+	responseM := answerA(newQuery("example.com", dns.TypeA), "192.0.2.1")
+	cache.Set(key, responseM, time.Minute, time.Hour)
+	cachedM, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("stored entry missed")
+	}
+	if len(cachedM.Answer) != 1 || cachedM.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("cached answer %v", cachedM.Answer)
+	}
+	if ttl := server.TTL(cache.Prefix + key); ttl != time.Minute+time.Hour {
+		t.Errorf("redis ttl %v, want the ttl and the stale retention", ttl)
+	}
+
+	cache.Delete(key)
+	if _, ok := cache.Get(key); ok {
+		t.Error("deleted entry hit")
+	}
+}
+
+// cachedAnswer returns a response to an A query for name
+func cachedAnswer(name string) (string, *dns.Msg) {
+	queryM := newQuery(name, dns.TypeA)
+	return cacheKey(queryM), answerA(queryM, "192.0.2.1")
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewMemoryCacheSize(2, 0)
+	keyA, responseA := cachedAnswer("a.example.com")
+	keyB, responseB := cachedAnswer("b.example.com")
+	keyC, responseC := cachedAnswer("c.example.com")
+
+	cache.Set(keyA, responseA, time.Minute, 0)
+	cache.Set(keyB, responseB, time.Minute, 0)
+	// a becomes the most recently used, b is evicted to make room for c
+	cache.Get(keyA)
+	cache.Set(keyC, responseC, time.Minute, 0)
+
+	if _, ok := cache.Get(keyB); ok {
+		t.Error("least recently used entry was kept")
+	}
+	for _, key := range []string{keyA, keyC} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("stats %+v, want 2 entries, 3 hits and 1 miss", stats)
+	}
+}
+
+func TestMemoryCacheByteBudget(t *testing.T) {
+	key, responseM := cachedAnswer("a.example.com")
+	cache := NewMemoryCacheSize(0, 3*responseM.Len())
+	for i := 0; i < 10; i++ {
+		key, responseM = cachedAnswer(fmt.Sprintf("host%d.example.com", i))
+		cache.Set(key, responseM, time.Minute, 0)
+	}
+	stats := cache.Stats()
+	if stats.Bytes > cache.MaxBytes || stats.Entries == 0 {
+		t.Errorf("%d entries of %d bytes, budget %d", stats.Entries, stats.Bytes, cache.MaxBytes)
+	}
+	if _, ok := cache.Get(key); !ok {
+		t.Error("the entry just stored was evicted")
+	}
+}
+
+func TestMemoryCacheConcurrent(t *testing.T) {
+	cache := NewMemoryCacheSize(50, 0)
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for j := 0; j < 200; j++ {
+				key, responseM := cachedAnswer(fmt.Sprintf("host%d.example.com", (worker*200+j)%100))
+				cache.Set(key, responseM, time.Minute, 0)
+				cache.Get(key)
+			}
+		}(i)
+	}
+	wait.Wait()
+	if entries := cache.Len(); entries > 50 {
+		t.Errorf("%d entries, want at most 50", entries)
+	}
+}
+
+func TestJitterTTLWithinWindow(t *testing.T) {
+	ttl := 100 * time.Second
+	low, high := ttl, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		jittered := jitterTTL(ttl, 10)
+		if jittered < 90*time.Second || jittered > ttl {
+			t.Fatalf("jittered ttl %v outside [90s, 100s]", jittered)
+		}
+		if jittered < low {
+			low = jittered
+		}
+		if jittered > high {
+			high = jittered
+		}
+	}
+	// expiries spread over most of the window instead of one instant
+	if high-low < 8*time.Second {
+		t.Errorf("jittered ttls span %v, want most of the 10s window", high-low)
+	}
+	if jittered := jitterTTL(ttl, 0); jittered != ttl {
+		t.Errorf("ttl without jitter %v, want %v", jittered, ttl)
+	}
+}
+
+func TestAgeResponseMixedTTLs(t *testing.T) {
+	record := func(name string, ttl uint32) dns.RR {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A 192.0.2.1", name, ttl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	responseM := new(dns.Msg)
+	responseM.Answer = []dns.RR{record("a.example.com.", 300), record("a.example.com.", 100)}
+	responseM.Ns = []dns.RR{record("ns.example.com.", 30)}
+	responseM.Extra = []dns.RR{record("glue.example.com.", 60), record("glue.example.com.", 3600)}
+	responseM.SetEdns0(1232, false)
+
+	if !ageResponse(responseM, 45*time.Second) {
+		t.Fatal("response expired, want the answers still valid")
+	}
+	if ttls := []uint32{responseM.Answer[0].Header().Ttl, responseM.Answer[1].Header().Ttl}; ttls[0] != 255 || ttls[1] != 55 {
+		t.Errorf("answer ttls %v, want [255 55]", ttls)
+	}
+	if len(responseM.Ns) != 0 {
+		t.Errorf("authority %v, want the expired record dropped", responseM.Ns)
+	}
+	if len(responseM.Extra) != 3 || responseM.Extra[0].Header().Ttl != 15 || responseM.Extra[1].Header().Ttl != 3555 || responseM.IsEdns0() == nil {
+		t.Errorf("additional %v, want both records decremented and OPT kept", responseM.Extra)
+	}
+
+	// a single expired answer invalidates the message
+	if ageResponse(responseM, 60*time.Second) {
+		t.Error("response valid, want it expired with an answer past its ttl")
+	}
+}
+
+// benchmarkAnswer answers packed queries for example.com through the full per query path
+func benchmarkAnswer(b *testing.B, client *Client) {
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5300}
+	query, err := newQuery("example.com", dns.TypeA).Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+	// fills the cache, if any
+	_, err = client.answer(addr, query, time.Now())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = client.answer(addr, query, time.Now())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the hit path skips the upstream, compare its allocs/op with BenchmarkCacheMiss
+func BenchmarkCacheHit(b *testing.B) {
+	client := newTestClient(b)
+	client.Cache = NewMemoryCache()
+	benchmarkAnswer(b, client)
+}
+
+func BenchmarkCacheMiss(b *testing.B) {
+	client := newTestClient(b)
+	benchmarkAnswer(b, client)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// name queried to check each upstream
+var CHECK_QUERY_NAME string = "example.com."
+
+// time budget of each upstream check
+var CHECK_TIMEOUT time.Duration = 5 * time.Second
+
+// UpstreamResult is the outcome of a test query to one upstream
+type UpstreamResult struct {
+	Name     string        `json:"name"`
+	Upstream string        `json:"upstream"`
+	Port     int           `json:"port"`
+	Fallback bool          `json:"fallback"`
+	OK       bool          `json:"ok"`
+	Latency  time.Duration `json:"latency"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Validate loads ConfigFile, if set, and sends one test query to every upstream and fallback
+// The listener is not started, so it can be used to check a config before deploying it
+func (client *Client) Validate() []UpstreamResult {
+	var results []UpstreamResult
+
+	if client.ConfigFile != "" {
+		err := client.LoadConfig(client.ConfigFile)
+		if err != nil {
+			return append(results, UpstreamResult{Name: client.ConfigFile, Error: err.Error()})
+		}
+	}
+
+	resolvers := client.resolverList()
+	client.applyUpstreamProxy(resolvers)
+	client.applyUpstreamProxy(client.fallbackList())
+	detectMethods(resolvers)
+	for i := range resolvers {
+		results = append(results, client.check(&resolvers[i], false))
+	}
+	fallbacks := client.fallbackList()
+	for i := range fallbacks {
+		results = append(results, client.check(&fallbacks[i], true))
+	}
+	return results
+}
+
+// check sends a test query to a single upstream
+func (client *Client) check(resolver *Server, fallback bool) UpstreamResult {
+	result := UpstreamResult{
+		Name:     resolver.Name,
+		Upstream: resolver.Upstream,
+		Port:     resolver.Port,
+		Fallback: fallback,
+	}
+
+	var queryM *dns.Msg = new(dns.Msg)
+	queryM.SetQuestion(CHECK_QUERY_NAME, dns.TypeA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+
+	start := time.Now()
+	responseM, err := client.exchange(ctx, resolver, queryM)
+	result.Latency = time.Since(start)
+
+	if err == nil && responseM.Rcode != dns.RcodeSuccess {
+		err = &rcodeError{rcode: responseM.Rcode}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		log.WithFields(log.Fields{"Resolver": resolver.Name, "Upstream": resolver.Upstream, "Error": err}).Error("Upstream check failed")
+		return result
+	}
+
+	result.OK = true
+	log.WithFields(log.Fields{"Resolver": resolver.Name, "Upstream": resolver.Upstream, "Latency": result.Latency}).Info("Upstream check passed")
+	return result
+}
+
+// readyKey marks the context of a readiness probe
+type readyKey struct{}
+
+// isReadyProbe reports whether ctx belongs to a readiness probe
+// probes must reach the upstream instead of being answered from the cache
+func isReadyProbe(ctx context.Context) bool {
+	probe, _ := ctx.Value(readyKey{}).(bool)
+	return probe
+}
+
+// Ready sends a query for CHECK_QUERY_NAME through the normal resolution path, middlewares and upstream selection included
+// Returns nil if it is answered with NOERROR within CHECK_TIMEOUT, for readiness probes
+func (client *Client) Ready() error {
+	var queryM *dns.Msg = new(dns.Msg)
+	queryM.SetQuestion(CHECK_QUERY_NAME, dns.TypeA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+	ctx = context.WithValue(ctx, readyKey{}, true)
+
+	start := time.Now()
+	responseM, err := client.ResolveContext(ctx, queryM)
+	if err == nil && responseM.Rcode != dns.RcodeSuccess {
+		err = &rcodeError{rcode: responseM.Rcode}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"Name": CHECK_QUERY_NAME, "Error": err}).Warn("Readiness check failed")
+		return err
+	}
+	log.WithFields(log.Fields{"Name": CHECK_QUERY_NAME, "Latency": time.Since(start)}).Debug("Readiness check passed")
+	return nil
+}
+
+// rcodeError reports an unexpected response code
+type rcodeError struct {
+	rcode int
+}
+
+func (err *rcodeError) Error() string {
+	return "Unexpected rcode " + dns.RcodeToString[err.rcode]
+}
+
+// detectMethods probes the DoH resolvers without a configured method
+// Resolvers must not be in use yet, their Method is set in place
+func detectMethods(resolvers []Server) {
+	var wg sync.WaitGroup
+	for i := range resolvers {
+		if resolvers[i].Port != 443 || resolvers[i].Method != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(server *Server) {
+			defer wg.Done()
+			server.Method = probeMethod(server)
+		}(&resolvers[i])
+	}
+	wg.Wait()
+}
+
+// probeMethod finds the DoH method the upstream supports, preferring wire format
+// Returns an empty method, handled as json, if the upstream answered neither
+func probeMethod(server *Server) string {
+	var queryM *dns.Msg = new(dns.Msg)
+	queryM.SetQuestion(CHECK_QUERY_NAME, dns.TypeA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+
+	_, err := DoHGetWireContext(ctx, server, queryM)
+	if err == nil {
+		log.WithFields(log.Fields{"Resolver": server.Name, "Method": DOH_WIRE_GET}).Info("Detected DoH method")
+		return DOH_WIRE_GET
+	}
+	log.WithFields(log.Fields{"Resolver": server.Name, "Error": err}).Debug("Upstream does not support wire format")
+
+	responseMap, err := DoHContext(ctx, server, queryM.Question[0])
+	if err == nil {
+		err = constructResponseMessage(new(dns.Msg), responseMap)
+	}
+	if err == nil {
+		log.WithFields(log.Fields{"Resolver": server.Name, "Method": DOH_JSON}).Info("Detected DoH method")
+		return DOH_JSON
+	}
+
+	log.WithFields(log.Fields{"Resolver": server.Name, "Error": err}).Warn("Failed to detect DoH method, using json")
+	return ""
+}
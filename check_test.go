@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidate(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("up", staticTransport("192.0.2.1")))
+	client.AddServer(stubServer("down", failingTransport(errors.New("Upstream unreachable"))))
+
+	results := client.Validate()
+	if len(results) != 2 {
+		t.Fatalf("%d results, want one per upstream", len(results))
+	}
+	if !results[0].OK || results[0].Name != "up" || results[0].Error != "" {
+		t.Errorf("result %+v, want up to pass", results[0])
+	}
+	if results[1].OK || results[1].Name != "down" || results[1].Error == "" {
+		t.Errorf("result %+v, want down to fail with its error", results[1])
+	}
+}
+
+func TestValidateInvalidConfig(t *testing.T) {
+	client := newTestClient(t)
+	client.ConfigFile = writeConfig(t, `{"upstreams": [{"name": "broken"}]}`)
+
+	results := client.Validate()
+	if len(results) != 1 || results[0].OK || results[0].Name != client.ConfigFile {
+		t.Errorf("results %+v, want the config file reported as failing", results)
+	}
+}
+
+func TestDetectMethods(t *testing.T) {
+	broken := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unsupported", http.StatusNotFound)
+	})
+	resolvers := []Server{
+		dohServer("wire", startStubDoH(t, wireAnswer)),
+		dohServer("json", startStubDoH(t, jsonAnswer)),
+		dohServer("broken", broken),
+		dohServer("configured", broken),
+	}
+	resolvers[3].Method = DOH_JSON
+
+	detectMethods(resolvers)
+	for i, want := range []string{DOH_WIRE_GET, DOH_JSON, "", DOH_JSON} {
+		if resolvers[i].Method != want {
+			t.Errorf("%s detected %q, want %q", resolvers[i].Name, resolvers[i].Method, want)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	var broken int32
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		if atomic.LoadInt32(&broken) == 1 {
+			return nil, errors.New("Upstream unreachable")
+		}
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+	addr := freeAddr(t, "tcp")
+	err := client.StartAdmin(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.stopStatusServer)
+
+	probe := func() int {
+		resp, err := http.Get("http://" + addr + "/ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if err := client.Ready(); err != nil {
+		t.Errorf("working upstream not ready: %v", err)
+	}
+	if status := probe(); status != http.StatusOK {
+		t.Errorf("/ready answered %d, want 200", status)
+	}
+
+	// the answer cached by the probes must not hide the broken upstream
+	atomic.StoreInt32(&broken, 1)
+	if err := client.Ready(); err == nil {
+		t.Error("broken upstream reported ready")
+	}
+	if status := probe(); status != http.StatusServiceUnavailable {
+		t.Errorf("/ready answered %d, want 503", status)
+	}
+}
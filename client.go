@@ -1,18 +1,25 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
+	"runtime/debug"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // Resolution job
@@ -20,8 +27,14 @@ type job struct {
 	// ip address associated to client
 	Addr net.Addr
 
+	// socket the query was received on and the response is written to
+	PC net.PacketConn
+
 	// data in bytes
 	Data []byte
+
+	// time the query was received from the client
+	Time time.Time
 }
 
 // Client serves client side traffics
@@ -30,6 +43,22 @@ type Client struct {
 	// each maintains a persistent HTTPS connection with the upstream
 	Resolvers []Server
 
+	// plain DNS resolvers tried in order when DoH resolution fails
+	Fallbacks []Server
+
+	// guards swapping Resolvers and Fallbacks while running
+	resolversLock sync.RWMutex
+
+	// resolvers and fallbacks added in code, kept when the config file is loaded or reloaded
+	addedResolvers []Server
+	addedFallbacks []Server
+
+	// json config file the resolvers are loaded from
+	ConfigFile string
+
+	// signal channel for reloading the config file
+	ReloadChan chan os.Signal
+
 	// ip on the client side
 	// 127.0.0.1 by default
 	IP string
@@ -38,6 +67,9 @@ type Client struct {
 	// 53 for DNS, 443 for DoH
 	Port int
 
+	// additional host:port addresses served besides IP and Port
+	Listen []string
+
 	// signal channel for shutting down the client
 	ShutDownChan chan os.Signal
 
@@ -45,10 +77,16 @@ type Client struct {
 	ResolverExitChan chan bool
 	ListenerExitChan chan bool
 	WriterExitChan   chan bool
+	ReloaderExitChan chan bool
 
 	// finish shut down
 	ExitChan chan bool
 
+	// number of resolver workers running, 0 before StartProxy and after Stop
+	// guards worker restarts against shutdown
+	workers     int
+	workersLock sync.Mutex
+
 	// lookup channel and result channel
 	// passing data for multi processing
 	LookUpChan chan job
@@ -57,29 +95,257 @@ type Client struct {
 	// number of workers
 	Num int
 
-	// PacketConn for listening udp packets
-	PC net.PacketConn
+	// capacity of LookUpChan, Num when 0
+	QueueDepth int
+
+	// QUEUE_DROP_OLDEST or QUEUE_SERVFAIL, applied when a query arrives with LookUpChan full
+	QueuePolicy string
+
+	// number of listener goroutines reading from each PacketConn
+	// 1 by default
+	ListenerCount int
+
+	// PacketConns for listening udp packets, one per listen address
+	PCs []net.PacketConn
+
+	// size of the kernel receive buffer of each PacketConn
+	// system default when 0
+	UDPReadBufferBytes int
+
+	// set SO_REUSEPORT on each PacketConn so several processes can share the port
+	ReusePort bool
 
 	// latest error message
 	Err error
 
 	// error log output file
 	ErrLogFile *os.File
+
+	// unix socket path of a dnstap collector
+	// queries and responses are not logged when empty
+	DnstapSocket string
+
+	// dnstap frame stream output
+	dnstapOutput *dnstap.FrameStreamSockOutput
+
+	// path of the json query log, one line per resolution
+	// queries are not logged when empty
+	QueryLogFile string
+
+	// query log rotation policy
+	// size in megabytes, age in days, backups and age unlimited when 0
+	QueryLogMaxSize    int
+	QueryLogMaxBackups int
+	QueryLogMaxAge     int
+
+	// rotate the query log on a schedule as well as by size
+	// disabled when 0
+	QueryLogRotateInterval time.Duration
+
+	// query log output
+	queryLog     *log.Logger
+	queryLogFile *lumberjack.Logger
+	queryLogDone chan bool
+
+	// tracer for resolution spans
+	// tracing is disabled when nil
+	Tracer Tracer
+
+	// response cache
+	// caching is disabled when nil
+	Cache Cache
+
+	// serve expired cache entries when upstream resolution fails (RFC 8767)
+	ServeStale bool
+
+	// how long expired entries are retained for serving stale
+	StaleTTL time.Duration
+
+	// entries expired for less than this are served right away while they are refreshed in the background (RFC 5861)
+	// disabled when 0
+	StaleWhileRevalidate time.Duration
+
+	// cache keys being refreshed in the background
+	revalidating sync.Map
+
+	// percentage of the ttl randomly taken off cache expiries
+	// spreads out refreshes of entries cached together, disabled when 0
+	CacheJitter int
+
+	// algorithm used by shard to select a resolver
+	// SHARD_RANDOM by default
+	ShardStrategy int
+
+	// counter for round robin sharding
+	roundRobin uint32
+
+	// hash ring for consistent hash sharding
+	// guarded by resolversLock, reset whenever the resolvers change and rebuilt on first use
+	ring *hashRing
+
+	// validate DNSSEC signatures before returning responses
+	// bogus responses are answered with SERVFAIL
+	ValidateDNSSEC bool
+
+	// DS records trusted as the start of the DNSSEC chain
+	// the root zone key signing keys by default
+	TrustAnchors []*dns.DS
+
+	// verified DNSKEYs by zone
+	dnssecKeys keyCache
+
+	// names answered locally, matched case insensitively with or without the trailing dot
+	// AddStaticHost keys them by lowercase fqdn
+	StaticHosts map[string][]net.IP
+	hostsLock   sync.RWMutex
+
+	// hosts file loaded by StartProxy and reloaded on SIGHUP
+	// not loaded when empty
+	HostsFile string
+
+	// names loaded from the hosts file, replaced on every load
+	fileHosts map[string][]net.IP
+
+	// ttl of locally answered records
+	StaticTTL uint32
+
+	// zone file answered authoritatively, loaded by StartProxy and reloaded on SIGHUP
+	// not loaded when empty
+	ZoneFile string
+
+	// origin of relative names in ZoneFile when it has no $ORIGIN
+	ZoneOrigin string
+
+	// zone loaded from ZoneFile, replaced on every load
+	zone *Zone
+
+	// pad responses to clients that send an EDNS padding option (RFC 7830)
+	// only useful when the listener sits behind an encrypted transport, e.g. a DoT terminator
+	PadResponses bool
+
+	// key server cookies are derived from (RFC 7873)
+	cookieSecret []byte
+
+	// strip the authority and additional sections from responses
+	MinimalResponses bool
+
+	// clear the AD bit of responses to queries which set neither AD nor DO (RFC 6840 section 5.7)
+	// for stub resolvers which misbehave on an AD bit they did not ask for, passed through when false
+	StripAD bool
+
+	// randomize the order of A and AAAA answers on every response, cached ones included
+	// spreads clients which use the first address over all of them
+	ShuffleAnswers bool
+
+	// attach the upstream which answered and the query latency to responses, for troubleshooting
+	// sent as EDNS option EDNS_DEBUG_OPTION, or a CHAOS TXT record to clients without EDNS
+	DebugAnnotate bool
+
+	// overall time budget of a query, answered with SERVFAIL when exceeded
+	// unlimited when 0
+	QueryTimeout time.Duration
+
+	// maximum number of queries sent upstream at the same time, across all resolvers
+	// unlimited when 0, set with SetMaxConcurrentUpstream
+	MaxConcurrentUpstream int
+
+	// semaphore enforcing MaxConcurrentUpstream
+	upstreamSlots chan struct{}
+
+	// send the ancestors of the question name as NS queries before the full name (RFC 7816)
+	// only applies to plain DNS upstreams
+	QNameMinimization bool
+
+	// http, https or socks5 proxy url all upstreams are reached through, e.g. socks5://127.0.0.1:9050 for Tor
+	// upstreams with their own proxy keep it, plain udp upstreams cannot use one
+	UpstreamProxy string
+
+	// randomize the case of question names sent to plaintext DNS upstreams (DNS 0x20)
+	// responses not echoing the same casing are rejected as likely spoofed
+	Use0x20 bool
+
+	// refuse plaintext DNS upstreams and fallbacks, only DoH, DNS over TLS and DNSCrypt ones are used
+	// checked when resolvers are added, when the config is loaded and when the proxy starts
+	DoHOnly bool
+
+	// drop answers pointing public names at private addresses
+	RebindProtection bool
+
+	// names, and their subdomains, allowed to resolve to private addresses
+	RebindAllowlist []string
+
+	// REBIND_STRIP or REBIND_SERVFAIL, strip when empty
+	RebindAction string
+
+	// resolve CNAME chains the upstream left incomplete with follow-up queries
+	// the chain is flattened onto the question name unless KeepCNAME is set
+	FlattenCNAME bool
+
+	// keep the CNAME records of chains completed by FlattenCNAME
+	KeepCNAME bool
+
+	// rewriters applied to upstream answers before they are cached
+	Rewriters []ResponseRewriter
+
+	// middlewares wrapping every resolution, in the order they were added
+	Middlewares []Middleware
+
+	// names answered with a forced address or remapped, set with SetRewriteRules
+	rewriteRules     []RewriteRule
+	rewriteRulesLock sync.RWMutex
+
+	// address of the json status endpoint, e.g. "127.0.0.1:8053"
+	// disabled when empty
+	StatusAddr string
+
+	// upstream resolutions in progress, shared by identical queries
+	flights flightGroup
+
+	// send each query to RaceCount resolvers at once and answer with the first success
+	// trades upstream bandwidth for latency
+	RaceUpstreams bool
+
+	// number of resolvers raced, 2 by default
+	RaceCount int
+
+	// upstream exchanges a query may make in total, each failure moving on to another resolver
+	// a single resolver is tried when 0 or 1
+	AttemptBudget int
+
+	// http server of the status endpoint
+	statusServer *http.Server
+
+	// query and cache counters
+	stats clientStats
 }
 
 // Init initialize client
-func (client *Client) Init(ip string, port int) {
+// cache can be nil to disable caching
+func (client *Client) Init(ip string, port int, cache Cache) {
 
 	client.IP = ip
 	client.Port = port
+	client.Cache = cache
+	client.StaleTTL = 24 * time.Hour
+	client.TrustAnchors = defaultTrustAnchors()
+	client.StaticTTL = 300
+	client.cookieSecret = newCookieSecret()
+	client.QueryLogMaxSize = QUERY_LOG_MAX_SIZE
+	client.QueryLogMaxBackups = QUERY_LOG_MAX_BACKUPS
+	client.QueryLogMaxAge = QUERY_LOG_MAX_AGE
 
 	client.Num = runtime.NumCPU()
+	client.QueuePolicy = QUEUE_DROP_OLDEST
+	client.ListenerCount = 1
+	client.RaceCount = 2
 
 	client.ShutDownChan = make(chan os.Signal, 1)
 	client.ResolverExitChan = make(chan bool, client.Num)
 	client.ListenerExitChan = make(chan bool, 1)
 	client.WriterExitChan = make(chan bool, 1)
-	client.ExitChan = make(chan bool, client.Num+2)
+	client.ReloaderExitChan = make(chan bool, 1)
+	client.ExitChan = make(chan bool, client.Num+3)
+	client.ReloadChan = make(chan os.Signal, 1)
 
 	client.LookUpChan = make(chan job, client.Num)
 	client.ResultChan = make(chan job, client.Num)
@@ -100,127 +366,550 @@ func (client *Client) AddUpstream(name string, ip string, port int) {
 	var server Server
 	server.Name = name
 	server.Init(ip, port)
+	client.addResolver(server)
+}
+
+// AddWeightedUpstream adds upstream server to client resolvers with a weight
+// the random shard strategy sends it weight times the queries of an upstream of weight 1
+func (client *Client) AddWeightedUpstream(name string, ip string, port int, weight int) {
+	var server Server
+	server.Name = name
+	server.Init(ip, port)
+	server.SetWeight(weight)
+	client.addResolver(server)
+}
+
+// AddUpstreamWithHeaders adds upstream server sending extra headers with every DoH request
+// e.g. {"Authorization": "Bearer <token>"} for private endpoints
+func (client *Client) AddUpstreamWithHeaders(name string, ip string, port int, headers map[string]string) {
+	var server Server
+	server.Name = name
+	server.Init(ip, port)
+	for key, value := range headers {
+		server.SetHeader(key, value)
+	}
+	client.addResolver(server)
+}
+
+// AddDNSUpstream adds a DNS upstream server using the given transport to client resolvers
+// network is one of "udp", "tcp" or "tcp-tls"
+func (client *Client) AddDNSUpstream(name string, ip string, port int, network string) {
+	var server Server
+	server.Name = name
+	server.Init(ip, port)
+	server.SetNet(network)
+	client.addResolver(server)
+}
+
+// AddDNSCryptUpstream adds a DNSCrypt resolver described by an sdns:// stamp to client resolvers
+func (client *Client) AddDNSCryptUpstream(name string, stamp string) error {
+	transport, err := NewDNSCryptTransport(stamp)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Resolver": name}).Error("Invalid DNSCrypt stamp")
+		return err
+	}
+	var server Server
+	server.Name = name
+	server.Init(transport.Addr, 0)
+	server.Transport = transport
+	client.addResolver(server)
+	return nil
+}
+
+// AddServer adds an initialized server to client resolvers
+// use it for upstreams needing settings the other Add functions do not cover
+func (client *Client) AddServer(server Server) {
+	client.addResolver(server)
+}
+
+// addResolver appends server to client resolvers
+// With DoHOnly set a plaintext server is not added, the error is kept in client.Err
+func (client *Client) addResolver(server Server) {
+	err := client.checkEncrypted([]Server{server})
+	if err != nil {
+		client.Err = err
+		return
+	}
+	client.resolversLock.Lock()
 	client.Resolvers = append(client.Resolvers, server)
+	client.addedResolvers = append(client.addedResolvers, server)
+	client.ring = nil
+	client.resolversLock.Unlock()
+}
+
+// applyUpstreamProxy routes the resolvers without a proxy of their own through UpstreamProxy
+// Resolvers which cannot use it, udp ones or tcp ones with an http proxy, are left direct
+func (client *Client) applyUpstreamProxy(resolvers []Server) {
+	if client.UpstreamProxy == "" {
+		return
+	}
+	for i := range resolvers {
+		resolver := &resolvers[i]
+		for resolver != nil {
+			if resolver.ProxyURL == nil && resolver.Transport == nil && (resolver.Port == 443 || resolver.pool != nil) {
+				err := resolver.SetProxy(client.UpstreamProxy)
+				if err != nil {
+					log.WithFields(log.Fields{"Resolver": resolver.Name, "Error": err}).Warn("Upstream cannot use the upstream proxy, connecting directly")
+				}
+			} else if resolver.ProxyURL == nil {
+				log.WithFields(log.Fields{"Resolver": resolver.Name}).Warn("Upstream cannot use the upstream proxy, connecting directly")
+			}
+			resolver = resolver.Fallback
+		}
+	}
+}
+
+// RemoveUpstream removes all upstream servers with name from client resolvers
+func (client *Client) RemoveUpstream(name string) {
+	client.resolversLock.Lock()
+	var resolvers, removed []Server
+	for _, resolver := range client.Resolvers {
+		if resolver.Name != name {
+			resolvers = append(resolvers, resolver)
+		} else {
+			removed = append(removed, resolver)
+		}
+	}
+	var added []Server
+	for _, resolver := range client.addedResolvers {
+		if resolver.Name != name {
+			added = append(added, resolver)
+		}
+	}
+	client.Resolvers = resolvers
+	client.addedResolvers = added
+	client.ring = nil
+	client.resolversLock.Unlock()
+
+	for i := range removed {
+		removed[i].retire()
+	}
+}
+
+// AddFallback adds a plain DNS server to the client fallback resolvers
+// fallbacks are tried in the order they are added
+// With DoHOnly set plain DNS fallbacks are not added, the error is kept in client.Err
+func (client *Client) AddFallback(name string, ip string, port int) {
+	var server Server
+	server.Name = name
+	server.Init(ip, port)
+	err := client.checkEncrypted([]Server{server})
+	if err != nil {
+		client.Err = err
+		return
+	}
+	client.resolversLock.Lock()
+	client.Fallbacks = append(client.Fallbacks, server)
+	client.addedFallbacks = append(client.addedFallbacks, server)
+	client.resolversLock.Unlock()
 }
 
 // StartProxy starts client side network service and waiting for packet
-func (client *Client) StartProxy() {
-	host := client.IP + ":" + strconv.Itoa(client.Port)
+// Returns an error if the client is not ready to serve
+func (client *Client) StartProxy() error {
+	if client.ConfigFile != "" {
+		err := client.LoadConfig(client.ConfigFile)
+		if err != nil {
+			return err
+		}
+	}
 
-	client.PC, client.Err = net.ListenPacket("udp", host)
-	if client.Err != nil {
-		log.WithFields(log.Fields{"Error": client.Err}).Fatal("Client failed to listen UDP")
+	if client.MaxConcurrentUpstream > 0 && client.upstreamSlots == nil {
+		client.SetMaxConcurrentUpstream(client.MaxConcurrentUpstream)
 	}
 
+	if client.HostsFile != "" {
+		err := client.LoadHosts(client.HostsFile)
+		if err != nil {
+			return err
+		}
+	}
+	if client.ZoneFile != "" {
+		err := client.LoadZoneFile(client.ZoneFile, client.ZoneOrigin)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(client.resolverList()) == 0 {
+		log.Error("Client has no upstream resolver")
+		return ErrNoResolvers
+	}
+	// DoHOnly may have been set after the resolvers were added
+	err := client.checkEncrypted(append(client.resolverList(), client.fallbackList()...))
+	if err != nil {
+		return err
+	}
+	// No query is served yet, so the resolvers can be updated in place
+	client.applyUpstreamProxy(client.resolverList())
+	client.applyUpstreamProxy(client.fallbackList())
+	detectMethods(client.resolverList())
+
+	client.PCs = nil
+	for _, host := range client.listenAddrs() {
+		pc, err := client.listenPacket(host)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Addr": host}).Error("Client failed to listen UDP")
+			// the addresses already bound are released so that StartProxy can be retried
+			for _, opened := range client.PCs {
+				opened.Close()
+			}
+			client.PCs = nil
+			client.Err = err
+			return err
+		}
+		client.PCs = append(client.PCs, pc)
+	}
+
+	if client.DnstapSocket != "" {
+		client.Err = client.startDnstap()
+		if client.Err != nil {
+			log.WithFields(log.Fields{"Error": client.Err}).Error("Client failed to start dnstap output")
+		}
+	}
+
+	if client.QueryLogFile != "" {
+		client.startQueryLog()
+	}
+
+	if client.ListenerCount < 1 {
+		client.ListenerCount = 1
+	}
+	depth := client.QueueDepth
+	if depth < 1 {
+		depth = client.Num
+	}
+	client.LookUpChan = make(chan job, depth)
+
+	listeners := client.ListenerCount * len(client.PCs)
+	client.ListenerExitChan = make(chan bool, listeners)
+	client.ExitChan = make(chan bool, client.Num+listeners+2)
+
+	client.stats.start = time.Now()
+	if client.StatusAddr != "" && client.statusServer == nil {
+		client.Err = client.startStatusServer()
+		if client.Err != nil {
+			log.WithFields(log.Fields{"Error": client.Err}).Error("Client failed to start status server")
+		}
+	}
+
+	client.workersLock.Lock()
+	client.workers = client.Num
 	for i := 0; i < client.Num; i++ {
-		go client.runResolver(i)
+		go client.runResolver(i, client.ResolverExitChan)
+	}
+	client.workersLock.Unlock()
+	for i, pc := range client.PCs {
+		for j := 0; j < client.ListenerCount; j++ {
+			go client.runListener(i*client.ListenerCount+j, pc)
+		}
 	}
-	go client.runListener()
 	go client.runWriter()
+	go client.runReloader()
 
 	client.Stop()
+	return nil
+}
+
+// AddListen serves DNS on an additional address besides IP and Port
+// Must be called before StartProxy
+func (client *Client) AddListen(ip string, port int) {
+	client.Listen = append(client.Listen, net.JoinHostPort(ip, strconv.Itoa(port)))
 }
 
-// Stop closes all channels and shuts down the client
+// listenAddrs returns every address the client listens on
+func (client *Client) listenAddrs() []string {
+	return append([]string{client.IP + ":" + strconv.Itoa(client.Port)}, client.Listen...)
+}
+
+// Stop shuts down the client without losing queries already received
+// Listeners stop first, workers drain the queue, the writer flushes the responses and only then the sockets close
 func (client *Client) Stop() {
 	// Wait until shutdown
 	<-client.ShutDownChan
 	log.Info("Client exiting")
 
-	client.ListenerExitChan <- true
-	err := client.PC.Close()
-	if err != nil {
-		log.WithFields(log.Fields{"Error": err}).Error("Client failed to close UDP connection")
+	// waits for a worker restart in progress, whose exits share ExitChan
+	client.workersLock.Lock()
+	workers := client.workers
+	client.workers = 0
+	client.workersLock.Unlock()
+
+	// Stop accepting queries, the expired read deadline wakes up the listeners without closing the sockets
+	listeners := client.ListenerCount * len(client.PCs)
+	for i := 0; i < listeners; i++ {
+		client.ListenerExitChan <- true
 	}
-	for i := 0; i < client.Num; i++ {
-		client.ResolverExitChan <- true
+	for _, pc := range client.PCs {
+		pc.SetReadDeadline(time.Now())
+	}
+	for i := 0; i < listeners; i++ {
+		<-client.ExitChan
 	}
-	client.WriterExitChan <- true
 
-	close(client.ShutDownChan)
+	// Resolve the queued queries, workers exit once LookUpChan is empty
 	close(client.LookUpChan)
-	close(client.ResultChan)
-	for i := 0; i < client.Num+2; i++ {
+	for i := 0; i < workers; i++ {
 		<-client.ExitChan
 	}
+
+	// Write the pending responses, the writer exits once ResultChan is empty
+	close(client.ResultChan)
+	<-client.ExitChan
+
+	// Only now nothing is left to send
+	for _, pc := range client.PCs {
+		err := pc.Close()
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Addr": pc.LocalAddr()}).Error("Client failed to close UDP connection")
+		}
+	}
+	client.ReloaderExitChan <- true
+	<-client.ExitChan
+
+	close(client.ShutDownChan)
 	close(client.ExitChan)
 
+	client.stopDnstap()
+	client.stopQueryLog()
+	client.stopStatusServer()
+
+	resolvers := append(append([]Server(nil), client.resolverList()...), client.fallbackList()...)
+	for i := range resolvers {
+		resolvers[i].retire()
+	}
+
 	log.Info("Client shut down")
 
 	client.ErrLogFile.Close()
 }
 
+// RestartWorkers replaces the resolver workers without closing the listeners
+// Workers hold no configuration, each query reads the current resolvers, so a restart drops no query
+// Fresh workers get a new ResolverExitChan, closing the previous one stops every old worker after its current query
+// Queued queries stay in LookUpChan and are served by the fresh workers
+func (client *Client) RestartWorkers() {
+	client.workersLock.Lock()
+	defer client.workersLock.Unlock()
+	if client.workers == 0 {
+		return
+	}
+
+	previous := client.ResolverExitChan
+	client.ResolverExitChan = make(chan bool, client.workers)
+	for i := 0; i < client.workers; i++ {
+		go client.runResolver(i, client.ResolverExitChan)
+	}
+	close(previous)
+	// only exiting workers report on ExitChan until Stop
+	for i := 0; i < client.workers; i++ {
+		<-client.ExitChan
+	}
+	log.WithFields(log.Fields{"Workers": client.workers}).Info("Client resolvers restarted")
+}
+
 // runResolver manages requests to perform DoH lookup via upstream servers
-func (client *Client) runResolver(id int) {
+// The worker exits when exit is signalled or closed, or once LookUpChan is closed and drained
+func (client *Client) runResolver(id int, exit chan bool) {
 	log.WithFields(log.Fields{"ID": id}).Info("Client resolver running")
 	for {
 		select {
-		case <-client.ResolverExitChan:
+		case <-exit:
 			log.WithFields(log.Fields{"ID": id}).Info("Client resolver exited")
 			client.ExitChan <- true
 			return
-		case newJob := <-client.LookUpChan:
-			addr := newJob.Addr
-			buffer := newJob.Data
-
-			// Parse the message
-			var queryM *dns.Msg = new(dns.Msg)
-			err := queryM.Unpack(buffer)
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err}).Error("Parsing error")
-				continue
+		case newJob, ok := <-client.LookUpChan:
+			if !ok {
+				// Stop closes LookUpChan once the queue is drained
+				log.WithFields(log.Fields{"ID": id}).Info("Client resolver exited")
+				client.ExitChan <- true
+				return
 			}
+			client.handleJob(newJob)
+		}
+	}
+}
 
-			responseBytes := make([]byte, 1024)
+// handleJob resolves one query and hands the response to the writer
+func (client *Client) handleJob(newJob job) {
+	responseBytes, err := client.answer(newJob.Addr, newJob.Data, newJob.Time)
+	if err != nil || responseBytes == nil {
+		return
+	}
 
-			responseM, err := client.Resolve(queryM)
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err}).Error("Client failed to resolve")
-				continue
-			}
+	newResult := job{
+		Addr: newJob.Addr,
+		PC:   newJob.PC,
+		Data: responseBytes,
+		Time: newJob.Time,
+	}
+	client.ResultChan <- newResult
+}
 
-			responseBytes, err = responseM.Pack()
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err, "Response": responseM}).Error("Client failed to packing response")
-				continue
-			}
+// ResolveSync resolves a wire format query and returns the wire format response
+// It goes through the same steps as queries received by the listeners, without LookUpChan and ResultChan,
+// for benchmarks and servers managing their own concurrency
+// Returns an error if the query is too malformed to be answered
+func (client *Client) ResolveSync(query []byte) ([]byte, error) {
+	received := time.Now()
+	responseBytes, err := client.answer(nil, query, received)
+	if err != nil {
+		return nil, err
+	}
+	if responseBytes == nil {
+		return nil, errors.New("Query too short to be answered")
+	}
+	client.emitDnstap(dnstap.Message_CLIENT_RESPONSE, nil, responseBytes, received)
+	return responseBytes, nil
+}
 
-			newResult := job{
-				Addr: addr,
-				Data: responseBytes,
+// answer resolves a wire format query received from addr at received and packs the response
+// addr may be nil when the query did not come from a listener
+// Returns nil without an error if the query cannot even be answered with FORMERR
+// A panic while handling the query is logged and answered with SERVFAIL so that the worker keeps serving
+func (client *Client) answer(addr net.Addr, buffer []byte, received time.Time) (responseBytes []byte, err error) {
+	var queryM *dns.Msg
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		log.WithFields(log.Fields{"Panic": r, "Query": queryM, "Stack": string(debug.Stack())}).Error("Recovered from panic while resolving")
+		atomic.AddUint64(&client.stats.panics, 1)
+		if queryM == nil {
+			return
+		}
+		var failM *dns.Msg = new(dns.Msg)
+		failM.SetRcode(queryM, dns.RcodeServerFailure)
+		responseBytes, err = failM.Pack()
+	}()
+
+	client.emitDnstap(dnstap.Message_CLIENT_QUERY, addr, buffer, received)
+
+	// Parse the message
+	ctx, unpackSpan := client.tracer().Start(context.Background(), "Unpack")
+	queryM = new(dns.Msg)
+	err = queryM.Unpack(buffer)
+	if err != nil {
+		unpackSpan.RecordError(err)
+		unpackSpan.End()
+		log.WithFields(log.Fields{"Error": err}).Error("Parsing error")
+		// Let the client fail fast instead of timing out
+		formErrM := formatErrorResponse(buffer)
+		if formErrM == nil {
+			return nil, nil
+		}
+		return formErrM.Pack()
+	}
+	unpackSpan.End()
+
+	var responseM *dns.Msg
+	// the entry records the upstream for the query log and debug annotations, attach it only when either is on
+	var entry *queryLogEntry
+	if client.queryLog != nil || client.DebugAnnotate {
+		entry = new(queryLogEntry)
+		ctx = withQueryLogEntry(ctx, entry)
+	}
+	options, err := stripEDNS(queryM)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Warn("Client sent invalid EDNS options")
+		responseM = new(dns.Msg)
+		responseM.SetRcode(queryM, dns.RcodeFormatError)
+	} else {
+		responseM, err = client.ResolveContext(ctx, queryM)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Client failed to resolve")
+			responseM = new(dns.Msg)
+			responseM.SetRcode(queryM, dns.RcodeServerFailure)
+			if queryM.IsEdns0() != nil {
+				setEDE(responseM, dns.ExtendedErrorCodeNetworkError, err.Error())
 			}
-			client.ResultChan <- newResult
 		}
 	}
+	upstream := ""
+	if entry != nil {
+		upstream = entry.Upstream
+	}
+	client.logQuery(addr, queryM, responseM, upstream, received)
+	client.stats.countResponse(queryM, responseM)
+	client.applyEDNS(responseM, options, addr)
+
+	if client.MinimalResponses {
+		minimizeResponse(responseM)
+	}
+	if client.ShuffleAnswers {
+		shuffleAnswers(responseM)
+	}
+	if client.StripAD && !queryM.AuthenticatedData && !wantsDNSSEC(queryM) {
+		responseM.AuthenticatedData = false
+	}
+	if client.DebugAnnotate {
+		annotateResponse(queryM, responseM, upstream, time.Since(received))
+	}
+
+	// Fit the response into the client's UDP buffer
+	// truncated responses make the client retry over TCP
+	size := udpSize(queryM)
+	if responseM.Len() > size {
+		log.WithFields(log.Fields{"Size": responseM.Len(), "Limit": size}).Debug("Truncating response")
+		responseM.Truncate(size)
+	}
+	if client.PadResponses && options.padding {
+		padResponse(responseM, size)
+	}
+
+	responseBytes, err = packResponse(responseM, size)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Response": responseM}).Error("Client failed to packing response")
+		return nil, err
+	}
+	return responseBytes, nil
 }
 
 // runListener listens for requests from the downstream DNS requests for processing
-func (client *Client) runListener() {
-	log.Info("Client listener running")
+// several listeners can read from the same PacketConn concurrently
+func (client *Client) runListener(id int, pc net.PacketConn) {
+	log.WithFields(log.Fields{"ID": id}).Info("Client listener running")
 	for {
 		select {
 		case <-client.ListenerExitChan:
-			log.Info("Client listener exited")
+			log.WithFields(log.Fields{"ID": id}).Info("Client listener exited")
 			client.ExitChan <- true
 			return
 		default:
 			buffer := make([]byte, 1024)
-			size, addr, err := client.PC.ReadFrom(buffer)
+			size, addr, err := pc.ReadFrom(buffer)
+			if errors.Is(err, net.ErrClosed) {
+				// Stop closed the connection
+				log.WithFields(log.Fields{"ID": id}).Info("Client listener exited")
+				client.ExitChan <- true
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// Stop is waking the listener up
+				continue
+			}
 			if err != nil {
 				log.WithFields(log.Fields{"Error": err}).Error("Client failed to read packet")
 				continue
 			}
 			newJob := job{
 				Addr: addr,
-				Data: buffer,
+				PC:   pc,
+				Data: buffer[:size],
+				Time: time.Now(),
 			}
-			client.LookUpChan <- newJob
+			client.enqueue(newJob)
 			log.WithFields(log.Fields{"Size": size}).Info("Message received")
 		}
 	}
 }
 
+// how long the writer waits for a response to be written before dropping it
+var RESPONSE_WRITE_TIMEOUT time.Duration = time.Second
+
 // runWriter takes results from upstream lookup and send back to the downstream
+// responses which cannot be written are logged and dropped, the writer keeps running until ResultChan is closed or WriterExitChan
 func (client *Client) runWriter() {
 	log.Info("Client writer running")
 	for {
@@ -229,12 +918,39 @@ func (client *Client) runWriter() {
 			log.Info("Client writer exited")
 			client.ExitChan <- true
 			return
-		case newResult := <-client.ResultChan:
+		case newResult, ok := <-client.ResultChan:
+			if !ok {
+				// Stop closes ResultChan once every response was handed over
+				log.Info("Client writer exited")
+				client.ExitChan <- true
+				return
+			}
 			responseAddr := newResult.Addr
 			responseBytes := newResult.Data
 
 			// Reply back to the client
-			client.PC.WriteTo(responseBytes, responseAddr)
+			// a conn which stops accepting writes must not stall ResultChan and, behind it, the resolvers
+			err := newResult.PC.SetWriteDeadline(time.Now().Add(RESPONSE_WRITE_TIMEOUT))
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.WithFields(log.Fields{"Error": err}).Debug("Client failed to set write deadline")
+			}
+			_, err = newResult.PC.WriteTo(responseBytes, responseAddr)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.WithFields(log.Fields{"Addr": responseAddr, "Timeout": RESPONSE_WRITE_TIMEOUT}).Warn("Dropped response, write timed out")
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				// Stop closed the connection, keep draining ResultChan so no worker blocks
+				// until the exit signal which follows
+				log.WithFields(log.Fields{"Addr": responseAddr}).Debug("Dropped response on closed connection")
+				continue
+			}
+			if err != nil {
+				log.WithFields(log.Fields{"Error": err, "Addr": responseAddr}).Warn("Client failed to write response")
+				continue
+			}
+
+			client.emitDnstap(dnstap.Message_CLIENT_RESPONSE, responseAddr, responseBytes, newResult.Time)
 		}
 	}
 }
@@ -245,162 +961,585 @@ func (client *Client) runWriter() {
 // If one resolver provided, then use the one provided
 // Returns a dns message object
 func (client *Client) Resolve(queryM *dns.Msg, resolvers ...Server) (*dns.Msg, error) {
+	return client.ResolveContext(context.Background(), queryM, resolvers...)
+}
+
+// ResolveWith resolves the query through the resolver named resolverName
+// Returns ErrUnknownResolver if no resolver has that name
+func (client *Client) ResolveWith(queryM *dns.Msg, resolverName string) (*dns.Msg, error) {
+	resolver, ok := client.resolverByName(resolverName)
+	if !ok {
+		log.WithFields(log.Fields{"Resolver": resolverName}).Error("Unknown resolver")
+		return nil, ErrUnknownResolver
+	}
+	return client.ResolveContext(context.Background(), queryM, resolver)
+}
+
+// ResolveContext is Resolve with a context carrying the parent trace span
+// The query runs through the middleware chain before it is resolved
+func (client *Client) ResolveContext(ctx context.Context, queryM *dns.Msg, resolvers ...Server) (*dns.Msg, error) {
+	if len(client.Middlewares) == 0 && !client.hasRewriteRules() {
+		return client.resolveContext(ctx, queryM, resolvers...)
+	}
+	return client.handler(ctx, resolvers)(queryM)
+}
+
+// resolveContext resolves the query from local data, the cache or the upstreams
+func (client *Client) resolveContext(ctx context.Context, queryM *dns.Msg, resolvers ...Server) (*dns.Msg, error) {
+	ctx, span := client.tracer().Start(ctx, "Resolve")
+	defer span.End()
+
+	if client.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.QueryTimeout)
+		defer cancel()
+	}
+
+	atomic.AddUint64(&client.stats.queries, 1)
+
 	if len(resolvers) > 1 {
 		log.Error("Should only be given zero or one resolver")
-		return nil, errors.New("Invalid number of resolvers provided")
+		err := errors.New("Invalid number of resolvers provided")
+		span.RecordError(err)
+		return nil, err
 	}
 
-	var resolver *Server
-
 	questions := queryM.Question
 	header := queryM.MsgHdr
 	id := header.Id
 	opcode := header.Opcode
 
-	log.WithFields(log.Fields{
-		"ID":     id,
-		"OpCode": opcode,
-	}).Debug("Query Parsed")
+	// building the fields costs allocations on every query, even with debug logs off
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.WithFields(log.Fields{
+			"ID":     id,
+			"OpCode": opcode,
+		}).Debug("Query Parsed")
+	}
 
-	// responseBytes := make([]byte, 1024)
+	if opcode != dns.OpcodeQuery {
+		log.WithFields(log.Fields{"OpCode": opcode}).Info("Unsupported opcode")
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetRcode(queryM, dns.RcodeNotImplemented)
+		return responseM, nil
+	}
 
-	// Construct response message
-	var responseM *dns.Msg = new(dns.Msg)
+	if len(questions) == 0 {
+		log.Info("Query has no question")
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetRcode(queryM, dns.RcodeFormatError)
+		return responseM, nil
+	}
 
+	// Reject malformed names before contacting upstream
 	for _, question := range questions {
-		log.WithFields(log.Fields{"Question": question}).Info("Question received")
+		err := validateQuestion(question)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Name": question.Name}).Info("Invalid question")
+			span.RecordError(err)
+			var responseM *dns.Msg = new(dns.Msg)
+			responseM.SetRcode(queryM, dns.RcodeFormatError)
+			return responseM, nil
+		}
+		// names keep the client's casing, the cache and flight keys are lowercased
+		// boxing the attributes allocates, skip it when nothing records them
+		if client.Tracer != nil {
+			span.SetAttribute("dns.qname", question.Name)
+			span.SetAttribute("dns.qtype", dns.TypeToString[question.Qtype])
+		}
+	}
 
-		questionString := question.String()
+	staticM, ok := client.staticAnswer(queryM)
+	if ok {
+		log.WithFields(log.Fields{"Name": questions[0].Name, "Type": dns.TypeToString[questions[0].Qtype], "Answers": len(staticM.Answer)}).Info("Static host override")
+		span.SetAttribute("dns.static", true)
+		return staticM, nil
+	}
 
-		if len(resolvers) == 0 {
-			// No resolver provided
-			resolver = client.shard(questionString)
+	zoneM, ok := client.zoneAnswer(queryM)
+	if ok {
+		log.WithFields(log.Fields{"Name": questions[0].Name, "Type": dns.TypeToString[questions[0].Qtype], "Rcode": dns.RcodeToString[zoneM.Rcode]}).Info("Answered from zone")
+		span.SetAttribute("dns.zone", true)
+		return zoneM, nil
+	}
+
+	// Only single question queries are cached
+	var key string
+	if client.Cache != nil && len(questions) == 1 {
+		key = cacheKey(queryM)
+
+		_, cacheSpan := client.tracer().Start(ctx, "CacheLookup")
+		cachedM, ok := client.Cache.Get(key)
+		if ok && isReadyProbe(ctx) {
+			ok = false
+		}
+		cacheSpan.SetAttribute("dns.cache_hit", ok)
+		cacheSpan.End()
+		span.SetAttribute("dns.cache_hit", ok)
+
+		if ok {
+			atomic.AddUint64(&client.stats.cacheHits, 1)
 		} else {
-			resolver = &resolvers[0]
+			atomic.AddUint64(&client.stats.cacheMisses, 1)
 		}
 
-		log.WithFields(log.Fields{"Resolver selected": resolver.Name}).Debug("Selected Resolver")
+		if ok {
+			if log.IsLevelEnabled(log.DebugLevel) {
+				log.WithFields(log.Fields{"Key": key}).Debug("Cache hit")
+			}
+			replyTo(cachedM, queryM)
+			return cachedM, nil
+		}
 
-		if resolver.Port == 443 {
-			responseMap, err := DoH(resolver, question)
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err}).Error("Failed performing DoH")
-				return nil, err
+		if client.StaleWhileRevalidate > 0 && !isRevalidation(ctx) && !isReadyProbe(ctx) {
+			staleM, ok := client.serveRevalidating(key, queryM)
+			if ok {
+				span.SetAttribute("dns.stale", true)
+				replyTo(staleM, queryM)
+				return staleM, nil
 			}
+		}
+	}
+
+	if len(resolvers) == 0 && len(client.resolverList()) == 0 {
+		err := ErrNoResolvers
+		log.WithFields(log.Fields{"Error": err}).Error("Client failed to resolve")
+		span.RecordError(err)
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetRcode(queryM, dns.RcodeServerFailure)
+		if queryM.IsEdns0() != nil {
+			setEDE(responseM, dns.ExtendedErrorCodeNotReady, err.Error())
+		}
+		return responseM, nil
+	}
 
-			log.WithFields(log.Fields(responseMap)).Info("Response from DoH")
+	upstreamM := queryM
+	if client.ValidateDNSSEC && !wantsDNSSEC(queryM) {
+		// Signatures are needed for validation even if the client did not ask for them
+		upstreamM = queryM.Copy()
+		setDO(upstreamM)
+	}
 
-			responseM.Compress = true
-			responseM.SetReply(queryM)
-			err = constructResponseMessage(responseM, responseMap)
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err}).Debug("Failed construct response message")
-				return nil, err
+	upstreamResolve := func() (*dns.Msg, error) {
+		err := client.acquireUpstream(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer client.releaseUpstream()
+		return client.resolve(ctx, upstreamM, resolvers...)
+	}
+
+	var responseM *dns.Msg
+	var err error
+	if key != "" && len(resolvers) == 0 {
+		// Identical queries arriving together share one upstream request
+		responseM, err = client.coalesce(ctx, key, upstreamResolve)
+		if err == nil {
+			replyTo(responseM, queryM)
+		}
+	} else {
+		responseM, err = upstreamResolve()
+	}
+	if err == nil && client.ValidateDNSSEC {
+		var secure bool
+		secure, err = client.validate(ctx, responseM)
+		if err != nil {
+			var bogusM *dns.Msg = new(dns.Msg)
+			bogusM.SetRcode(queryM, dns.RcodeServerFailure)
+			if queryM.IsEdns0() != nil {
+				setEDE(bogusM, dns.ExtendedErrorCodeDNSBogus, err.Error())
 			}
-		} else if resolver.Port == 53 {
-			responseMsg, err := DNS(resolver, queryM)
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err}).Error("Failed performing DNS")
-				return nil, err
+			return bogusM, nil
+		}
+		responseM.AuthenticatedData = secure
+	}
+	if err == nil && client.FlattenCNAME && !isCNAMEFollow(ctx) {
+		responseM = client.followCNAME(ctx, queryM, responseM)
+	}
+	if err == nil && client.RebindProtection {
+		client.filterRebind(queryM, responseM)
+	}
+	if err == nil {
+		responseM = client.rewrite(queryM, responseM)
+	}
+	if err != nil {
+		span.RecordError(err)
+		if client.ServeStale && key != "" {
+			staleM, ok := client.Cache.GetStale(key)
+			if ok {
+				log.WithFields(log.Fields{"Key": key, "Error": err}).Warn("Upstream failed, serving stale answer")
+				atomic.AddUint64(&client.stats.staleServed, 1)
+				span.SetAttribute("dns.stale", true)
+				replyTo(staleM, queryM)
+				setTTL(staleM, STALE_ANSWER_TTL)
+				if queryM.IsEdns0() != nil {
+					setEDE(staleM, dns.ExtendedErrorCodeStaleAnswer, "Upstream unreachable")
+				}
+				return staleM, nil
 			}
-			responseM = responseMsg
-			break
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			log.WithFields(log.Fields{"Timeout": client.QueryTimeout}).Warn("Query timed out")
+			var timeoutM *dns.Msg = new(dns.Msg)
+			timeoutM.SetRcode(queryM, dns.RcodeServerFailure)
+			if queryM.IsEdns0() != nil {
+				setEDE(timeoutM, dns.ExtendedErrorCodeNoReachableAuthority, "Query timed out")
+			}
+			return timeoutM, nil
+		}
+		return nil, err
+	}
+
+	if upstreamM != queryM {
+		// entries are keyed by the client's DO bit, so signatures it did not ask for are not cached either
+		stripDNSSEC(responseM)
+	}
+
+	if key != "" {
+		ttl := jitterTTL(responseTTL(responseM), client.CacheJitter)
+		if ttl > 0 {
+			var stale time.Duration
+			if client.ServeStale {
+				stale = client.StaleTTL
+			}
+			if stale < client.StaleWhileRevalidate {
+				stale = client.StaleWhileRevalidate
+			}
+			client.Cache.Set(key, responseM, ttl, stale)
 		}
 	}
 
 	return responseM, nil
 }
 
-// shard takes applies an algorithm to select one of the resolver for resolution
-func (client *Client) shard(questionString string) (resolver *Server) {
-	return &client.Resolvers[rand.Intn(len(client.Resolvers))]
+// SetMaxConcurrentUpstream limits the number of queries sent upstream at the same time
+// 0 removes the limit
+func (client *Client) SetMaxConcurrentUpstream(limit int) {
+	client.MaxConcurrentUpstream = limit
+	if limit > 0 {
+		client.upstreamSlots = make(chan struct{}, limit)
+	} else {
+		client.upstreamSlots = nil
+	}
 }
 
-// Utils
+// acquireUpstream takes an upstream slot, waiting at most UPSTREAM_QUEUE_WAIT
+func (client *Client) acquireUpstream(ctx context.Context) error {
+	if client.upstreamSlots == nil {
+		return nil
+	}
+	select {
+	case client.upstreamSlots <- struct{}{}:
+		return nil
+	default:
+	}
 
-// construct takes a response map and construct a dns response message using miekg/dns package
-// the constructed dns message will be stored in responseM, as a argument passed by reference
-func constructResponseMessage(responseM *dns.Msg, responseMap map[string]interface{}) error {
-	// Construct response packet using responseMap
-	var responseAnswers []dns.RR
-	var responseAuthorities []dns.RR
-	var responseAdditionals []dns.RR
+	timer := time.NewTimer(UPSTREAM_QUEUE_WAIT)
+	defer timer.Stop()
+	select {
+	case client.upstreamSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		log.WithFields(log.Fields{"Limit": client.MaxConcurrentUpstream}).Warn("Too many upstream queries")
+		return ErrTooManyUpstream
+	}
+}
 
-	// Answers
-	answerMap, ok := responseMap["Answer"]
-	if ok {
-		for _, answerInterface := range answerMap.([]interface{}) {
-			answer := answerInterface.(map[string]interface{})
+// releaseUpstream frees the upstream slot taken by acquireUpstream
+func (client *Client) releaseUpstream() {
+	if client.upstreamSlots == nil {
+		return
+	}
+	<-client.upstreamSlots
+}
 
-			resourceBody, err := constructResource(answer)
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err}).Debug("Failed constructing DNS response")
-				return err
-			}
+// resolve sends the query to the selected or given upstream resolver
+func (client *Client) resolve(ctx context.Context, queryM *dns.Msg, resolvers ...Server) (*dns.Msg, error) {
+	var resolver *Server
 
-			responseAnswers = append(responseAnswers, resourceBody)
+	if client.RaceUpstreams && len(resolvers) == 0 && len(queryM.Question) == 1 {
+		return client.race(ctx, queryM)
+	}
+
+	for _, question := range queryM.Question {
+		log.WithFields(log.Fields{"Question": question}).Info("Question received")
+	}
+
+	if len(resolvers) == 0 {
+		// No resolver provided
+		_, shardSpan := client.tracer().Start(ctx, "Shard")
+		resolver = client.shard(queryM.Question[0].Name)
+		shardSpan.End()
+		if resolver == nil {
+			// the resolvers were removed since the query was accepted
+			log.WithFields(log.Fields{"Error": ErrNoResolvers}).Error("Client failed to resolve")
+			return nil, ErrNoResolvers
 		}
+		shardSpan.SetAttribute("dns.resolver", resolver.Name)
+	} else {
+		resolver = &resolvers[0]
 	}
 
-	// Authorities
-	authorityMap, ok := responseMap["Authority"]
-	if ok {
-		for _, authorityInterface := range authorityMap.([]interface{}) {
-			authority := authorityInterface.(map[string]interface{})
+	log.WithFields(log.Fields{"Resolver selected": resolver.Name}).Debug("Selected Resolver")
+
+	tried := []*Server{resolver}
+	responseM, err := client.exchange(ctx, resolver, queryM)
+	if err == ErrUpstreamBusy && len(resolvers) == 0 {
+		// Let a healthy upstream serve instead of waiting for the busy one
+		other := client.alternate(resolver)
+		if other != nil {
+			log.WithFields(log.Fields{"Busy": resolver.Name, "Resolver selected": other.Name}).Info("Upstream busy, failing over")
+			resolver = other
+			tried = append(tried, resolver)
+			responseM, err = client.exchange(ctx, resolver, queryM)
+		}
+	}
+	if (err != nil || retryable(responseM)) && len(resolvers) == 0 && len(tried) < client.AttemptBudget {
+		// the fallbacks below depend on the resolver which failed last
+		responseM, resolver, err = client.retryUpstreams(ctx, queryM, tried, responseM, err)
+	}
+	if err != nil && resolver.Port == 443 && resolver.Fallback != nil && connectionError(err) {
+		// HTTPS may be blocked while the same resolver is reachable over plain DNS
+		log.WithFields(log.Fields{"Resolver": resolver.Name, "Fallback": resolver.Fallback.Upstream, "Error": err}).Warn("DoH unreachable, retrying over DNS")
+		responseM, err = client.exchange(ctx, resolver.Fallback, queryM)
+	}
+	if err != nil {
+		if resolver.Port == 443 && len(client.fallbackList()) > 0 {
+			return client.fallback(ctx, queryM)
+		}
+		return nil, err
+	}
 
-			resourceBody, err := constructResource(authority)
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err}).Debug("Failed constructing DNS response")
-				return err
-			}
+	return responseM, nil
+}
+
+// exchange resolves the query with a single upstream resolver and records the outcome
+func (client *Client) exchange(ctx context.Context, resolver *Server, queryM *dns.Msg) (*dns.Msg, error) {
+	recordUpstream(ctx, resolver)
+	start := time.Now()
 
-			responseAuthorities = append(responseAuthorities, resourceBody)
+	spanName := "DoH"
+	if resolver.Transport != nil {
+		spanName = "Transport"
+	} else if resolver.isDNS() {
+		spanName = "DNS"
+	}
+	_, span := client.tracer().Start(ctx, spanName)
+	defer span.End()
+	span.SetAttribute("dns.resolver", resolver.Name)
+
+	sentM := queryM
+	if client.Use0x20 && resolver.Transport == nil && resolver.isDNS() && resolver.Net != "tcp-tls" {
+		sentM = randomizeCase(queryM)
+	}
+
+	var responseM *dns.Msg
+	var err error
+	if client.QNameMinimization && resolver.Transport == nil && resolver.isDNS() {
+		responseM, err = client.minimizedExchange(ctx, resolver, sentM)
+		if err == nil && responseM == nil {
+			err = errors.New("No response from DNS resolver")
 		}
+	} else {
+		client.emitResolverDnstap(dnstap.Message_RESOLVER_QUERY, resolver, sentM, start)
+		responseM, err = resolver.Query(ctx, sentM)
+		if err == nil {
+			client.emitResolverDnstap(dnstap.Message_RESOLVER_RESPONSE, resolver, responseM, start)
+		}
+	}
+	if err == nil && sentM != queryM {
+		err = checkCase(queryM, sentM, responseM)
 	}
+	if err != ErrUpstreamBusy {
+		resolver.stats.record(err, time.Since(start))
+	}
+	if err != nil {
+		span.RecordError(err)
+		log.WithFields(log.Fields{"Resolver": resolver.Name, "Error": err}).Error("Failed performing " + spanName)
+		return nil, err
+	}
+	return responseM, nil
+}
 
-	// Additionals
-	additionalMap, ok := responseMap["Additional"]
-	if ok {
-		for _, additionalInterface := range additionalMap.([]interface{}) {
-			additional := additionalInterface.(map[string]interface{})
+// retryable reports whether the response is a failure another resolver may not share
+func retryable(responseM *dns.Msg) bool {
+	return responseM != nil && (responseM.Rcode == dns.RcodeServerFailure || responseM.Rcode == dns.RcodeRefused)
+}
 
-			resourceBody, err := constructResource(additional)
-			if err != nil {
-				log.WithFields(log.Fields{"Error": err}).Debug("Failed constructing DNS response")
-				return err
-			}
+// retryUpstreams resolves the query through the resolvers not tried yet, until one answers
+// or AttemptBudget exchanges were made in total
+// Returns the last response or error if every attempt failed, with the resolver it came from
+func (client *Client) retryUpstreams(ctx context.Context, queryM *dns.Msg, tried []*Server, responseM *dns.Msg, err error) (*dns.Msg, *Server, error) {
+	failed := tried[len(tried)-1]
+	attempts := len(tried)
+	for _, resolver := range client.retryOrder(tried) {
+		if attempts >= client.AttemptBudget || ctx.Err() != nil {
+			break
+		}
+		attempts++
+		log.WithFields(log.Fields{"Failed": tried[len(tried)-1].Name, "Resolver selected": resolver.Name, "Attempt": attempts, "Error": err}).Warn("Upstream failed, retrying on another one")
+		tried = append(tried, resolver)
+
+		retryM, retryErr := client.exchange(ctx, resolver, queryM)
+		if retryErr == nil && !retryable(retryM) {
+			return retryM, resolver, nil
+		}
+		if retryErr == nil {
+			responseM, failed, err = retryM, resolver, nil
+		} else if responseM == nil {
+			// a SERVFAIL or REFUSED answer is returned rather than a later error
+			failed, err = resolver, retryErr
+		}
+	}
+	return responseM, failed, err
+}
 
-			responseAdditionals = append(responseAdditionals, resourceBody)
+// retryOrder lists the resolvers not tried yet, in order from the last one tried
+// Usable resolvers come first, unhealthy ones are only tried once the usable ones failed
+func (client *Client) retryOrder(tried []*Server) []*Server {
+	resolvers := client.resolverList()
+	last := tried[len(tried)-1]
+	start := 0
+	for i := range resolvers {
+		if sameUpstream(&resolvers[i], last) {
+			start = i + 1
+			break
 		}
 	}
 
-	truncated, ok := responseMap["TC"]
-	if ok {
-		responseM.MsgHdr.Truncated = truncated.(bool)
-	} else {
-		// default false
-		responseM.MsgHdr.Truncated = false
+	var usable, unusable []*Server
+	for i := 0; i < len(resolvers); i++ {
+		resolver := &resolvers[(start+i)%len(resolvers)]
+		done := false
+		for _, previous := range tried {
+			done = done || sameUpstream(resolver, previous)
+		}
+		if done {
+			continue
+		}
+		if resolver.stats.usable() {
+			usable = append(usable, resolver)
+		} else {
+			unusable = append(unusable, resolver)
+		}
 	}
+	return append(usable, unusable...)
+}
 
-	recursionDesired, ok := responseMap["RD"]
-	if ok {
-		responseM.MsgHdr.RecursionDesired = recursionDesired.(bool)
-	} else {
-		// default true
-		responseM.MsgHdr.RecursionDesired = true
+// sameUpstream reports whether both resolvers send queries to the same address
+func sameUpstream(a *Server, b *Server) bool {
+	return a.Upstream == b.Upstream && a.Port == b.Port
+}
+
+// alternate picks a resolver other than the busy one
+// Returns nil if there is no other resolver
+func (client *Client) alternate(busy *Server) *Server {
+	resolvers := client.resolverList()
+	if len(resolvers) == 0 {
+		return nil
+	}
+	start := rand.Intn(len(resolvers))
+	for i := 0; i < len(resolvers); i++ {
+		resolver := &resolvers[(start+i)%len(resolvers)]
+		if resolver.Upstream != busy.Upstream || resolver.Port != busy.Port {
+			return resolver
+		}
+	}
+	return nil
+}
+
+// fallback resolves the query through the fallback resolvers in order
+// Returns the first successful response
+func (client *Client) fallback(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	err := errors.New("No fallback resolver available")
+	fallbacks := client.fallbackList()
+	for i := range fallbacks {
+		resolver := &fallbacks[i]
+		if resolver.Transport == nil && !resolver.isDNS() {
+			log.WithFields(log.Fields{"Resolver": resolver.Name, "Port": resolver.Port}).Error("Fallback resolver is not a DNS server")
+			continue
+		}
+
+		log.WithFields(log.Fields{"Resolver": resolver.Name}).Warn("DoH failed, falling back to DNS")
+		responseM, fallbackErr := client.exchange(ctx, resolver, queryM)
+		if fallbackErr != nil {
+			err = fallbackErr
+			continue
+		}
+		if responseM == nil {
+			err = errors.New("No response from fallback resolver")
+			continue
+		}
+		return responseM, nil
 	}
 
-	recursionAvailable, ok := responseMap["RA"]
+	log.WithFields(log.Fields{"Error": err}).Error("All fallback resolvers failed")
+	return nil, err
+}
+
+// Utils
+
+// construct takes a response map and construct a dns response message using miekg/dns package
+// the constructed dns message will be stored in responseM, as a argument passed by reference
+func constructResponseMessage(responseM *dns.Msg, responseMap map[string]interface{}) error {
+	// Construct response packet using responseMap
+	responseAnswers, err := constructSection(responseMap, "Answer")
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Debug("Failed constructing DNS response")
+		return err
+	}
+	responseAuthorities, err := constructSection(responseMap, "Authority")
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Debug("Failed constructing DNS response")
+		return err
+	}
+	responseAdditionals, err := constructSection(responseMap, "Additional")
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Debug("Failed constructing DNS response")
+		return err
+	}
+
+	// Status is the rcode of the upstream answer, NOERROR when missing
+	status, ok := responseMap["Status"]
 	if ok {
-		responseM.MsgHdr.RecursionAvailable = recursionAvailable.(bool)
-	} else {
-		// default true
-		responseM.MsgHdr.RecursionAvailable = true
+		rcode, ok := status.(float64)
+		if !ok || rcode < 0 || rcode > 0xFFF {
+			return fmt.Errorf("Response Status is %v, expected rcode", status)
+		}
+		responseM.Rcode = int(rcode)
+	}
+
+	// explanations of the answer, e.g. why a name was blocked, and the subnet geo answers were chosen for
+	comment, hasComment := responseMap["Comment"]
+	subnet, hasSubnet := responseMap["edns_client_subnet"]
+	if hasComment || hasSubnet {
+		log.WithFields(log.Fields{"Comment": comment, "Subnet": subnet, "Status": dns.RcodeToString[responseM.Rcode]}).Debug("Upstream comment")
 	}
 
+	// a missing or non boolean TC defaults to false
+	truncated, _ := responseMap["TC"].(bool)
+	responseM.MsgHdr.Truncated = truncated
+
+	// RD is copied from the query by SetReply
+	// json upstreams do not take an RD parameter, so the client's intent is only forwarded on the DNS path
+
+	// do not claim recursion the upstream did not report
+	recursionAvailable, _ := responseMap["RA"].(bool)
+	responseM.MsgHdr.RecursionAvailable = recursionAvailable
+
+	// nor data the upstream did not validate
+	authenticated, _ := responseMap["AD"].(bool)
+	responseM.MsgHdr.AuthenticatedData = authenticated
+
 	responseM.Answer = responseAnswers
 	responseM.Ns = responseAuthorities
 	responseM.Extra = responseAdditionals
+	if responseM.Rcode > 0xF && responseM.IsEdns0() == nil {
+		// the upper bits of an extended rcode travel in the OPT record, without one the message cannot be packed
+		responseM.SetEdns0(dns.DefaultMsgSize, false)
+	}
 
 	return nil
 }
@@ -409,7 +1548,7 @@ func constructResponseMessage(responseM *dns.Msg, responseMap map[string]interfa
 
 // PrintInfo prints all resolvers ip and ports
 func (client *Client) PrintInfo() {
-	for k, v := range client.Resolvers {
+	for k, v := range client.resolverList() {
 		fmt.Printf("%d: \n", k)
 		v.PrintInfo()
 	}
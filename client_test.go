@@ -0,0 +1,956 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// failingTransport fails every query with err
+func failingTransport(err error) transportFunc {
+	return func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		return nil, err
+	}
+}
+
+// extendedError returns the EDE option of m, nil if it has none
+func extendedError(m *dns.Msg) *dns.EDNS0_EDE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+func TestServeStaleOnUpstreamFailure(t *testing.T) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	client.ServeStale = true
+	client.AddServer(stubServer("down", failingTransport(errors.New("Upstream unreachable"))))
+
+	queryM := newQuery("example.com", dns.TypeA)
+	queryM.SetEdns0(1232, false)
+	client.Cache.Set(cacheKey(queryM), answerA(queryM, "192.0.2.1"), time.Millisecond, time.Hour)
+	time.Sleep(10 * time.Millisecond)
+
+	responseM, err := client.Resolve(queryM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("answer %v, want the stale entry", responseM.Answer)
+	}
+	if ttl := responseM.Answer[0].Header().Ttl; ttl != STALE_ANSWER_TTL {
+		t.Errorf("stale ttl %d, want %d", ttl, STALE_ANSWER_TTL)
+	}
+	if ede := extendedError(responseM); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("EDE %v, want stale answer", ede)
+	}
+	if client.Stats().StaleServed != 1 {
+		t.Error("stale answer not counted")
+	}
+}
+
+func TestNoStaleEntryFails(t *testing.T) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	client.ServeStale = true
+	client.AddServer(stubServer("down", failingTransport(errors.New("Upstream unreachable"))))
+
+	_, err := client.Resolve(newQuery("example.com", dns.TypeA))
+	if err == nil {
+		t.Error("failed resolution without a stale entry succeeded")
+	}
+}
+
+func TestStartProxyWithoutUpstreams(t *testing.T) {
+	client := newTestClient(t)
+	err := client.StartProxy()
+	if err != ErrNoResolvers {
+		t.Fatalf("StartProxy returned %v, want ErrNoResolvers", err)
+	}
+}
+
+func TestStartProxyListenFailure(t *testing.T) {
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	addr := freeAddr(t, "udp")
+	host, port, _ := net.SplitHostPort(addr)
+	client.IP = host
+	client.Port, _ = strconv.Atoi(port)
+	client.Listen = []string{taken.LocalAddr().String()}
+
+	err = client.StartProxy()
+	if err == nil || client.Err != err {
+		t.Fatalf("StartProxy returned %v with Err %v, want the listen error", err, client.Err)
+	}
+	// the address bound before the failure was released
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("%s still bound: %v", addr, err)
+	}
+	pc.Close()
+}
+
+func TestResolveWithoutUpstreams(t *testing.T) {
+	client := newTestClient(t)
+	queryM := newQuery("example.com", dns.TypeA)
+	queryM.SetEdns0(1232, false)
+	responseM, err := client.Resolve(queryM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("answered %s, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+	}
+	if ede := extendedError(responseM); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNotReady {
+		t.Errorf("EDE %v, want not ready", ede)
+	}
+	for _, strategy := range []int{SHARD_RANDOM, SHARD_ROUND_ROBIN, SHARD_CONSISTENT_HASH} {
+		client.ShardStrategy = strategy
+		_, err = client.resolve(context.Background(), queryM)
+		if err != ErrNoResolvers {
+			t.Errorf("strategy %d returned %v, want ErrNoResolvers", strategy, err)
+		}
+	}
+}
+
+// manyAnswers answers with count A records, too many to fit 512 bytes from about 35
+func manyAnswers(count int) transportFunc {
+	return func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetReply(queryM)
+		for i := 0; i < count; i++ {
+			responseM.Answer = append(responseM.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: queryM.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(10, 0, byte(i/256), byte(i%256)).To4(),
+			})
+		}
+		return responseM, nil
+	}
+}
+
+func TestTruncateOversizedUDPResponse(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("big", manyAnswers(100)))
+
+	responseM := resolveWire(t, client, newQuery("big.example.com", dns.TypeA))
+	if !responseM.Truncated {
+		t.Error("response over 512 bytes without EDNS is not truncated")
+	}
+	responseM.Compress = true
+	if responseM.Len() > dns.MinMsgSize {
+		t.Errorf("truncated response is %d bytes, want at most %d", responseM.Len(), dns.MinMsgSize)
+	}
+
+	// the same answers fit the buffer advertised with EDNS
+	queryM := newQuery("big.example.com", dns.TypeA)
+	queryM.SetEdns0(4096, false)
+	responseM = resolveWire(t, client, queryM)
+	if responseM.Truncated || len(responseM.Answer) != 100 {
+		t.Errorf("truncated %v with %d answers, want all 100 answers", responseM.Truncated, len(responseM.Answer))
+	}
+}
+
+func TestFailureRcodes(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("down", failingTransport(errors.New("Upstream unreachable"))))
+
+	// a header followed by a question cut short
+	query, _ := newQuery("example.com", dns.TypeA).Pack()
+	response, err := client.ResolveSync(query[:len(query)-3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseM dns.Msg
+	err = responseM.Unpack(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeFormatError {
+		t.Errorf("unparsable query answered %s, want FORMERR", dns.RcodeToString[responseM.Rcode])
+	}
+
+	notifyM := newQuery("example.com", dns.TypeSOA)
+	notifyM.Opcode = dns.OpcodeNotify
+	if rcode := resolveWire(t, client, notifyM).Rcode; rcode != dns.RcodeNotImplemented {
+		t.Errorf("NOTIFY answered %s, want NOTIMP", dns.RcodeToString[rcode])
+	}
+
+	if rcode := resolveWire(t, client, newQuery("example.com", dns.TypeA)).Rcode; rcode != dns.RcodeServerFailure {
+		t.Errorf("upstream failure answered %s, want SERVFAIL", dns.RcodeToString[rcode])
+	}
+
+	// too short for a header, nothing can be answered
+	_, err = client.ResolveSync(query[:5])
+	if err == nil {
+		t.Error("query shorter than a header was answered")
+	}
+}
+
+// benchmarkListeners measures queries answered per second with count listeners reading the socket
+func benchmarkListeners(b *testing.B, count int) {
+	client := newTestClient(b)
+	client.ListenerCount = count
+	// room for every query in flight, so none is dropped
+	client.QueueDepth = 1024
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	addr := startProxy(b, client)
+	// per query logs would dominate the measurement
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+	query, _ := newQuery("example.com", dns.TypeA).Pack()
+
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		buffer := make([]byte, 1024)
+		for pb.Next() {
+			conn.Write(query)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(buffer)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSingleListener(b *testing.B) {
+	benchmarkListeners(b, 1)
+}
+
+func BenchmarkMultipleListeners(b *testing.B) {
+	benchmarkListeners(b, 4)
+}
+
+// tcpUpstream returns a tcp DNS upstream for the stub listening on addr
+func tcpUpstream(t testing.TB, name string, addr string) Server {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server Server
+	server.Name = name
+	portNumber, _ := strconv.Atoi(port)
+	server.Init(host, portNumber)
+	server.SetNet("tcp")
+	t.Cleanup(server.retire)
+	return server
+}
+
+func TestRecursionDesired(t *testing.T) {
+	// the stub only recurses when asked to
+	var sent atomic.Value
+	addr, _ := startStubTCP(t, func(w dns.ResponseWriter, queryM *dns.Msg) {
+		sent.Store(queryM.RecursionDesired)
+		responseM := answerA(queryM, "192.0.2.1")
+		responseM.RecursionAvailable = queryM.RecursionDesired
+		w.WriteMsg(responseM)
+	})
+	client := newTestClient(t)
+	client.AddServer(tcpUpstream(t, "stub", addr))
+
+	for _, rd := range []bool{false, true} {
+		queryM := newQuery("example.com", dns.TypeA)
+		queryM.RecursionDesired = rd
+		responseM, err := client.Resolve(queryM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent.Load() != rd {
+			t.Errorf("RD=%v forwarded as %v", rd, sent.Load())
+		}
+		if responseM.RecursionDesired != rd {
+			t.Errorf("RD=%v answered with RD=%v", rd, responseM.RecursionDesired)
+		}
+		if responseM.RecursionAvailable != rd {
+			t.Errorf("RD=%v answered with RA=%v, want the upstream's", rd, responseM.RecursionAvailable)
+		}
+	}
+}
+
+func TestRecursionAvailableFromJSON(t *testing.T) {
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprint(w, `{"Status":0,"RA":false,"Answer":[]}`)
+	})
+	client := newTestClient(t)
+	client.AddServer(dohServer("doh", stub))
+
+	for _, rd := range []bool{false, true} {
+		queryM := newQuery("example.com", dns.TypeA)
+		queryM.RecursionDesired = rd
+		responseM, err := client.Resolve(queryM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseM.RecursionDesired != rd {
+			t.Errorf("RD=%v answered with RD=%v", rd, responseM.RecursionDesired)
+		}
+		if responseM.RecursionAvailable {
+			t.Error("RA set although the upstream did not report recursion")
+		}
+	}
+}
+
+func TestStatusFromJSON(t *testing.T) {
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprint(w, `{"Status":3,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,`+
+			`"Question":[{"name":"missing.example.com.","type":1}],`+
+			`"Authority":[{"name":"example.com.","type":6,"TTL":900,"data":"ns.example.com. admin.example.com. 1 7200 3600 1209600 3600"}],`+
+			`"Comment":"Response from 192.0.2.53.","edns_client_subnet":"198.51.100.0/0"}`)
+	})
+	client := newTestClient(t)
+	client.AddServer(dohServer("doh", stub))
+
+	responseM := resolveWire(t, client, newQuery("missing.example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode %s, want NXDOMAIN", dns.RcodeToString[responseM.Rcode])
+	}
+	if len(responseM.Ns) != 1 || responseM.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("authority %v, want the SOA record", responseM.Ns)
+	}
+}
+
+func TestExtendedStatusFromJSON(t *testing.T) {
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprint(w, `{"Status":23,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,`+
+			`"Question":[{"name":"example.com.","type":1}]}`)
+	})
+	client := newTestClient(t)
+	client.AddServer(dohServer("doh", stub))
+
+	// the upper bits of the rcode need an OPT record, which is added when the client sent none
+	for _, edns := range []bool{false, true} {
+		queryM := newQuery("example.com", dns.TypeA)
+		if edns {
+			queryM.SetEdns0(1232, false)
+		}
+		responseM, err := client.Resolve(queryM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseM.Rcode != dns.RcodeBadCookie {
+			t.Errorf("rcode %s, want BADCOOKIE", dns.RcodeToString[responseM.Rcode])
+		}
+		_, err = responseM.Pack()
+		if err != nil {
+			t.Errorf("extended rcode response with edns %t not packable: %v", edns, err)
+		}
+	}
+}
+
+func TestAuthenticatedDataFromJSON(t *testing.T) {
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprint(w, `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":true,"CD":false,`+
+			`"Question":[{"name":"example.com.","type":1}],`+
+			`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.1"}]}`)
+	})
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5300}
+	plain := newQuery("example.com", dns.TypeA)
+	withAD := newQuery("example.com", dns.TypeA)
+	withAD.AuthenticatedData = true
+	withDO := newQuery("example.com", dns.TypeA)
+	withDO.SetEdns0(1232, true)
+
+	tests := []struct {
+		stripAD bool
+		queryM  *dns.Msg
+		want    bool
+	}{
+		{false, plain, true},
+		{true, plain, false},
+		{true, withAD, true},
+		{true, withDO, true},
+	}
+	for _, test := range tests {
+		client := newTestClient(t)
+		client.StripAD = test.stripAD
+		client.AddServer(dohServer("doh", stub))
+		_, responseM := answerFrom(t, client, test.queryM, addr)
+		if responseM.AuthenticatedData != test.want {
+			t.Errorf("StripAD %t query AD %t DO %t: AD %t, want %t", test.stripAD, test.queryM.AuthenticatedData,
+				wantsDNSSEC(test.queryM), responseM.AuthenticatedData, test.want)
+		}
+	}
+}
+
+func TestUnknownFieldsFromJSON(t *testing.T) {
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprint(w, `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,`+
+			`"Question":[{"name":"example.com.","type":1}],`+
+			`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.1"}],`+
+			`"Comment":"Response from 192.0.2.53.","edns_client_subnet":"198.51.100.0/24",`+
+			`"Extra":{"nested":[1,2,{"deep":null}]},"Version":2,"Flags":"unexpected"}`)
+	})
+	client := newTestClient(t)
+	client.AddServer(dohServer("doh", stub))
+	hook := logtest.NewGlobal()
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	t.Cleanup(func() {
+		log.SetLevel(level)
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	})
+
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 1 {
+		t.Fatalf("response %v, want the answer despite unknown fields", responseM)
+	}
+
+	logged := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.DebugLevel && entry.Data["Comment"] == "Response from 192.0.2.53." && entry.Data["Subnet"] == "198.51.100.0/24" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Error("Comment and client subnet not logged at debug level")
+	}
+
+	upstreams := client.Status().Upstreams
+	if len(upstreams) != 1 || upstreams[0].Comment != "Response from 192.0.2.53." || upstreams[0].ClientSubnet != "198.51.100.0/24" {
+		t.Errorf("upstreams %+v, want the comment and client subnet in the status", upstreams)
+	}
+}
+
+func TestResolveWith(t *testing.T) {
+	client := newTestClient(t)
+	first := stubServer("first", staticTransport("192.0.2.1"))
+	second := stubServer("second", staticTransport("192.0.2.2"))
+	second.Upstream = "192.0.2.2"
+	client.AddServer(first)
+	client.AddServer(second)
+
+	for i := 0; i < 3; i++ {
+		responseM, err := client.ResolveWith(newQuery(fmt.Sprintf("host%d.example.com", i), dns.TypeA), "second")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responseM.Answer) != 1 || !responseM.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.2")) {
+			t.Errorf("answers %v, want 192.0.2.2 from second", responseM.Answer)
+		}
+	}
+	_, err := client.ResolveWith(newQuery("example.com", dns.TypeA), "third")
+	if err != ErrUnknownResolver {
+		t.Errorf("unknown resolver returned %v, want ErrUnknownResolver", err)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	client := newTestClient(t)
+	client.QueryTimeout = 50 * time.Millisecond
+	cancelled := make(chan bool, 1)
+	client.AddServer(stubServer("slow", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		<-ctx.Done()
+		cancelled <- true
+		return nil, ctx.Err()
+	}))
+
+	start := time.Now()
+	responseM, err := client.Resolve(newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("timed out query answered %s, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("answered after %v", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("upstream request not cancelled")
+	}
+}
+
+func TestMultipleListenAddresses(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	extra := freeAddr(t, "udp")
+	host, port, _ := net.SplitHostPort(extra)
+	portNumber, _ := strconv.Atoi(port)
+	client.AddListen(host, portNumber)
+	addr := startProxy(t, client)
+
+	exchanger := dns.Client{Timeout: time.Second}
+	for _, target := range []string{addr, extra} {
+		responseM, _, err := exchanger.Exchange(newQuery("example.com", dns.TypeA), target)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		if len(responseM.Answer) != 1 {
+			t.Errorf("%s answered %v", target, responseM.Answer)
+		}
+	}
+}
+
+func TestMaxConcurrentUpstream(t *testing.T) {
+	client := newTestClient(t)
+	client.SetMaxConcurrentUpstream(3)
+	var inFlight, peak int32
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(&peak)
+			if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+
+	done := make(chan wireResult, 30)
+	for i := 0; i < 30; i++ {
+		go func(i int) {
+			done <- exchangeWire(client, newQuery(fmt.Sprintf("host%d.example.com", i), dns.TypeA))
+		}(i)
+	}
+	for i := 0; i < 30; i++ {
+		result := <-done
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		if result.msg.Rcode != dns.RcodeSuccess {
+			t.Errorf("rcode %s, want NOERROR", dns.RcodeToString[result.msg.Rcode])
+		}
+	}
+	if peak != 3 {
+		t.Errorf("%d concurrent upstream queries, want at most 3 and the limit reached", peak)
+	}
+}
+
+func TestMaxConcurrentUpstreamTimeout(t *testing.T) {
+	defer func(wait time.Duration) { UPSTREAM_QUEUE_WAIT = wait }(UPSTREAM_QUEUE_WAIT)
+	UPSTREAM_QUEUE_WAIT = 20 * time.Millisecond
+	client := newTestClient(t)
+	client.SetMaxConcurrentUpstream(1)
+	release := make(chan struct{})
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		<-release
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+
+	blocked := make(chan wireResult, 1)
+	go func() { blocked <- exchangeWire(client, newQuery("slow.example.com", dns.TypeA)) }()
+	for len(client.upstreamSlots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if responseM := resolveWire(t, client, newQuery("queued.example.com", dns.TypeA)); responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode %s while the limit is reached, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+	}
+	close(release)
+	result := <-blocked
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if result.msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("rcode %s, want NOERROR", dns.RcodeToString[result.msg.Rcode])
+	}
+}
+
+func TestWorkerSurvivesPanic(t *testing.T) {
+	client := newTestClient(t)
+	// a single worker has to survive for the later queries to be answered
+	client.Num = 1
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		if queryM.Question[0].Name == "panic.example.com." {
+			var m map[string]interface{}
+			_ = m["data"].(string)
+		}
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+	addr := startProxy(t, client)
+
+	exchanger := dns.Client{Timeout: time.Second}
+	for i := 0; i < 3; i++ {
+		responseM, _, err := exchanger.Exchange(newQuery("panic.example.com", dns.TypeA), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseM.Rcode != dns.RcodeServerFailure {
+			t.Errorf("panicking query answered %s, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+		}
+		responseM, _, err = exchanger.Exchange(newQuery(fmt.Sprintf("host%d.example.com", i), dns.TypeA), addr)
+		if err != nil {
+			t.Fatalf("no answer after a panic: %v", err)
+		}
+		if len(responseM.Answer) != 1 {
+			t.Errorf("answers %v after a panic", responseM.Answer)
+		}
+	}
+	if panics := client.Status().Panics; panics != 3 {
+		t.Errorf("%d panics counted, want 3", panics)
+	}
+}
+
+// countingConn counts the writes made to the wrapped conn
+type countingConn struct {
+	net.PacketConn
+	writes int32
+}
+
+func (conn *countingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	atomic.AddInt32(&conn.writes, 1)
+	return conn.PacketConn.WriteTo(p, addr)
+}
+
+// startWriter runs the writer of client and returns a channel closed once it exits
+func startWriter(client *Client) chan struct{} {
+	exited := make(chan struct{})
+	go func() {
+		client.runWriter()
+		<-client.ExitChan
+		close(exited)
+	}()
+	return exited
+}
+
+func TestWriterOnClosedConn(t *testing.T) {
+	client := newTestClient(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &countingConn{PacketConn: pc}
+	pc.Close()
+	exited := startWriter(client)
+
+	const responses = 20
+	for i := 0; i < responses; i++ {
+		client.ResultChan <- job{Addr: pc.LocalAddr(), PC: conn, Data: []byte{0}, Time: time.Now()}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(client.ResultChan) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writer stopped draining results on a closed conn")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if writes := atomic.LoadInt32(&conn.writes); writes != responses {
+		t.Errorf("%d writes for %d responses, want each dropped after one attempt", writes, responses)
+	}
+
+	client.WriterExitChan <- true
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer did not exit")
+	}
+}
+
+// blockingConn never accepts a write, WriteTo blocks until the write deadline passes
+type blockingConn struct {
+	net.PacketConn
+	lock     sync.Mutex
+	deadline time.Time
+}
+
+func (conn *blockingConn) SetWriteDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.deadline = t
+	return nil
+}
+
+func (conn *blockingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	conn.lock.Lock()
+	deadline := conn.deadline
+	conn.lock.Unlock()
+	if deadline.IsZero() {
+		select {}
+	}
+	time.Sleep(time.Until(deadline))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestWriterOnBlockingConn(t *testing.T) {
+	original := RESPONSE_WRITE_TIMEOUT
+	RESPONSE_WRITE_TIMEOUT = 50 * time.Millisecond
+	t.Cleanup(func() { RESPONSE_WRITE_TIMEOUT = original })
+
+	client := newTestClient(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	reader, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	exited := startWriter(client)
+
+	// responses to the stalled client are dropped, the one after them still goes out
+	blocked := &blockingConn{PacketConn: pc}
+	for i := 0; i < 3; i++ {
+		client.ResultChan <- job{Addr: reader.LocalAddr(), PC: blocked, Data: []byte{1}, Time: time.Now()}
+	}
+	client.ResultChan <- job{Addr: reader.LocalAddr(), PC: pc, Data: []byte{2}, Time: time.Now()}
+
+	buffer := make([]byte, 16)
+	reader.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := reader.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("response after the stalled ones not written: %v", err)
+	}
+	if n != 1 || buffer[0] != 2 {
+		t.Errorf("read %v, want the response written after the stalled ones", buffer[:n])
+	}
+
+	client.WriterExitChan <- true
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer did not exit")
+	}
+}
+
+func TestShutdownAnswersQueryInFlight(t *testing.T) {
+	client := newTestClient(t)
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		if queryM.Question[0].Name == "slow.example.com." {
+			close(arrived)
+			<-release
+		}
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+	addr := freeAddr(t, "udp")
+	host, port, _ := net.SplitHostPort(addr)
+	client.IP = host
+	client.Port, _ = strconv.Atoi(port)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.StartProxy()
+	}()
+	exchanger := dns.Client{Timeout: 100 * time.Millisecond}
+	for i := 0; ; i++ {
+		_, _, err := exchanger.Exchange(newQuery("ready.test", dns.TypeA), addr)
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("proxy not answering: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	answered := make(chan *dns.Msg, 1)
+	go func() {
+		slow := dns.Client{Timeout: 5 * time.Second}
+		responseM, _, err := slow.Exchange(newQuery("slow.example.com", dns.TypeA), addr)
+		if err != nil {
+			t.Errorf("query in flight at shutdown: %v", err)
+		}
+		answered <- responseM
+	}()
+	<-arrived
+
+	// shut down while the upstream still holds the query, then let it answer
+	client.ShutDownChan <- os.Interrupt
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	responseM := <-answered
+	if responseM == nil || len(responseM.Answer) != 1 {
+		t.Errorf("response %v, want the answer of the upstream", responseM)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not stop")
+	}
+}
+
+// newBudgetClient returns a round robin client whose resolvers r0 and r1 fail and r2 answers
+// the name of every resolver queried is sent to tried
+func newBudgetClient(t *testing.T, budget int, tried chan string) *Client {
+	client := newTestClient(t)
+	client.ShardStrategy = SHARD_ROUND_ROBIN
+	client.AttemptBudget = budget
+	failures := []transportFunc{
+		failingTransport(errors.New("Upstream unreachable")),
+		func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+			var responseM *dns.Msg = new(dns.Msg)
+			responseM.SetRcode(queryM, dns.RcodeServerFailure)
+			return responseM, nil
+		},
+		staticTransport("192.0.2.3"),
+	}
+	for i, transport := range failures {
+		name := fmt.Sprintf("r%d", i)
+		transport := transport
+		server := stubServer(name, func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+			tried <- name
+			return transport(ctx, queryM)
+		})
+		server.Upstream = fmt.Sprintf("192.0.2.%d", i+1)
+		client.AddServer(server)
+	}
+	return client
+}
+
+func TestAttemptBudget(t *testing.T) {
+	tried := make(chan string, 16)
+	client := newBudgetClient(t, 3, tried)
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.3" {
+		t.Errorf("response %v, want the answer of r2", responseM)
+	}
+	close(tried)
+	var order []string
+	for name := range tried {
+		if len(order) == 0 || order[len(order)-1] != name {
+			order = append(order, name)
+		}
+	}
+	if fmt.Sprint(order) != "[r0 r1 r2]" {
+		t.Errorf("resolvers tried in order %v, want [r0 r1 r2]", order)
+	}
+
+	// the budget runs out before r2
+	tried = make(chan string, 16)
+	client = newBudgetClient(t, 2, tried)
+	responseM = resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode %s, want SERVFAIL once the budget is spent", dns.RcodeToString[responseM.Rcode])
+	}
+	close(tried)
+	for name := range tried {
+		if name == "r2" {
+			t.Error("r2 queried beyond the budget")
+		}
+	}
+}
+
+func TestRetriedUpstreamFallback(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	newClient := func(ports ...int) (*Client, *int32) {
+		client := newTestClient(t)
+		client.ShardStrategy = SHARD_ROUND_ROBIN
+		client.AttemptBudget = len(ports)
+		var fallbacks int32
+		for i, port := range ports {
+			server := stubServer(fmt.Sprintf("r%d", i), failingTransport(refused))
+			server.Upstream = fmt.Sprintf("192.0.2.%d", i+1)
+			server.Port = port
+			if port == 443 {
+				fallback := stubServer("plain", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+					atomic.AddInt32(&fallbacks, 1)
+					return answerA(queryM, "192.0.2.53"), nil
+				})
+				server.Fallback = &fallback
+			}
+			client.AddServer(server)
+		}
+		return client, &fallbacks
+	}
+
+	// the DoH upstream failed last, its DNS fallback answers
+	client, fallbacks := newClient(53, 443)
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 1 || atomic.LoadInt32(fallbacks) != 1 {
+		t.Errorf("response %v, want the answer of the fallback of the retried DoH upstream", responseM)
+	}
+
+	// the DNS upstream failed last, the fallback of the first one is not used
+	client, fallbacks = newClient(443, 53)
+	responseM = resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeServerFailure || atomic.LoadInt32(fallbacks) != 0 {
+		t.Errorf("rcode %s after %d fallback queries, want SERVFAIL from the DNS upstream", dns.RcodeToString[responseM.Rcode], atomic.LoadInt32(fallbacks))
+	}
+}
+
+func TestResolveSyncWithoutChannels(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	// a send on either channel would block forever
+	client.LookUpChan = nil
+	client.ResultChan = nil
+
+	queryM := newQuery("Example.com", dns.TypeA)
+	queryM.Id = 4242
+	query, err := queryM.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []byte, 1)
+	go func() {
+		response, err := client.ResolveSync(query)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- response
+	}()
+
+	var response []byte
+	select {
+	case response = <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ResolveSync went through the worker channels")
+	}
+	var responseM dns.Msg
+	err = responseM.Unpack(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Id != 4242 || responseM.Question[0].Name != "Example.com." || len(responseM.Answer) != 1 {
+		t.Errorf("response %v, want the answer to query 4242", &responseM)
+	}
+}
+
+func BenchmarkResolveSync(b *testing.B) {
+	client := newTestClient(b)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	query, _ := newQuery("example.com", dns.TypeA).Pack()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.ResolveSync(query)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// maximum number of follow-up queries made to complete one CNAME chain
+var MAX_CNAME_DEPTH int = 8
+
+// cnameFollowKey marks the context of a follow-up query
+type cnameFollowKey struct{}
+
+// isCNAMEFollow reports whether ctx belongs to a follow-up query
+// follow-ups are completed by the query that made them, not recursively
+func isCNAMEFollow(ctx context.Context) bool {
+	follow, _ := ctx.Value(cnameFollowKey{}).(bool)
+	return follow
+}
+
+// chainEnd follows the CNAME chain of answers from name
+// Returns the name the chain ends at, and whether answers hold records of type qtype for it
+func chainEnd(answers []dns.RR, name string, qtype uint16) (string, bool) {
+	target := strings.ToLower(name)
+	for hops := 0; hops <= len(answers); hops++ {
+		next := ""
+		for _, rr := range answers {
+			header := rr.Header()
+			if strings.ToLower(header.Name) != target {
+				continue
+			}
+			if header.Rrtype == qtype {
+				return target, true
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = strings.ToLower(cname.Target)
+			}
+		}
+		if next == "" || next == target {
+			break
+		}
+		target = next
+	}
+	return target, false
+}
+
+// followCNAME completes an answer whose CNAME chain leaves the records the upstream returned
+// by querying the target until records of the question type are found
+// The chain is kept unless KeepCNAME is false, in which case it is flattened onto the question name
+// Chains longer than MAX_CNAME_DEPTH follow-ups or looping are returned as they are
+func (client *Client) followCNAME(ctx context.Context, queryM *dns.Msg, responseM *dns.Msg) *dns.Msg {
+	q := queryM.Question[0]
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY || responseM.Rcode != dns.RcodeSuccess {
+		return responseM
+	}
+
+	ctx = context.WithValue(ctx, cnameFollowKey{}, true)
+	visited := map[string]bool{strings.ToLower(q.Name): true}
+	followed := 0
+	for {
+		target, complete := chainEnd(responseM.Answer, q.Name, q.Qtype)
+		if complete || target == strings.ToLower(q.Name) {
+			break
+		}
+		if visited[target] {
+			log.WithFields(log.Fields{"Name": q.Name, "Target": target}).Warn("CNAME loop")
+			return responseM
+		}
+		if followed == MAX_CNAME_DEPTH {
+			log.WithFields(log.Fields{"Name": q.Name, "Depth": followed}).Warn("CNAME chain too long")
+			return responseM
+		}
+		visited[target] = true
+		followed++
+
+		followM := new(dns.Msg)
+		followM.SetQuestion(target, q.Qtype)
+		followM.RecursionDesired = true
+		followM.CheckingDisabled = queryM.CheckingDisabled
+		if wantsDNSSEC(queryM) {
+			setDO(followM)
+		}
+		targetM, err := client.resolveContext(ctx, followM)
+		if err != nil {
+			log.WithFields(log.Fields{"Name": q.Name, "Target": target, "Error": err}).Warn("Failed to follow CNAME")
+			return responseM
+		}
+		log.WithFields(log.Fields{"Name": q.Name, "Target": target, "Answers": len(targetM.Answer)}).Debug("Followed CNAME")
+
+		responseM.Answer = append(responseM.Answer, targetM.Answer...)
+		responseM.AuthenticatedData = responseM.AuthenticatedData && targetM.AuthenticatedData
+		if targetM.Rcode != dns.RcodeSuccess || len(targetM.Answer) == 0 {
+			// the negative answer of the last name is the answer to the question (RFC 6604)
+			responseM.Rcode = targetM.Rcode
+			responseM.Ns = targetM.Ns
+			break
+		}
+	}
+
+	if followed > 0 && !client.KeepCNAME {
+		(&CNAMEFlattener{}).Rewrite(q, responseM)
+	}
+	return responseM
+}
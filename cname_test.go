@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// hopTransport answers names of chain with a CNAME to the value, other names with 192.0.2.7
+// Only one hop is answered per query, so every further hop needs a follow-up
+func hopTransport(chain map[string]string, queries *int32) transportFunc {
+	return func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(queries, 1)
+		name := strings.ToLower(queryM.Question[0].Name)
+		target, ok := chain[name]
+		if !ok {
+			return answerA(queryM, "192.0.2.7"), nil
+		}
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetReply(queryM)
+		responseM.Answer = append(responseM.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: queryM.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: target,
+		})
+		return responseM, nil
+	}
+}
+
+var twoHops = map[string]string{
+	"www.example.com.":  "edge.example.net.",
+	"edge.example.net.": "pop.example.org.",
+}
+
+func TestFollowCNAMETwoHops(t *testing.T) {
+	client := newTestClient(t)
+	client.FlattenCNAME = true
+	var queries int32
+	client.AddServer(stubServer("stub", hopTransport(twoHops, &queries)))
+
+	responseM := resolveWire(t, client, newQuery("www.example.com", dns.TypeA))
+	if len(responseM.Answer) != 1 {
+		t.Fatalf("answers %v, want the flattened address", responseM.Answer)
+	}
+	a, ok := responseM.Answer[0].(*dns.A)
+	if !ok || a.Hdr.Name != "www.example.com." || a.A.String() != "192.0.2.7" {
+		t.Errorf("answer %v, want 192.0.2.7 for the question name", responseM.Answer[0])
+	}
+	if queries != 3 {
+		t.Errorf("%d upstream queries, want the question and two follow-ups", queries)
+	}
+}
+
+func TestFollowCNAMEKeepsChain(t *testing.T) {
+	client := newTestClient(t)
+	client.FlattenCNAME = true
+	client.KeepCNAME = true
+	var queries int32
+	client.AddServer(stubServer("stub", hopTransport(twoHops, &queries)))
+
+	responseM := resolveWire(t, client, newQuery("www.example.com", dns.TypeA))
+	want := []uint16{dns.TypeCNAME, dns.TypeCNAME, dns.TypeA}
+	if len(responseM.Answer) != len(want) {
+		t.Fatalf("answers %v, want the chain and the address", responseM.Answer)
+	}
+	for i, rrtype := range want {
+		if responseM.Answer[i].Header().Rrtype != rrtype {
+			t.Errorf("answer %d is %v, want %s", i, responseM.Answer[i], dns.TypeToString[rrtype])
+		}
+	}
+	if name := responseM.Answer[2].Header().Name; name != "pop.example.org." {
+		t.Errorf("address owned by %s, want the end of the chain", name)
+	}
+}
+
+func TestFollowCNAMELoopAndDepth(t *testing.T) {
+	client := newTestClient(t)
+	client.FlattenCNAME = true
+	var queries int32
+	loop := map[string]string{
+		"www.example.com.": "a.example.net.",
+		"a.example.net.":   "b.example.net.",
+		"b.example.net.":   "a.example.net.",
+	}
+	client.AddServer(stubServer("stub", hopTransport(loop, &queries)))
+
+	responseM := resolveWire(t, client, newQuery("www.example.com", dns.TypeA))
+	for _, rr := range responseM.Answer {
+		if rr.Header().Rrtype == dns.TypeA {
+			t.Errorf("answer %v from a looping chain", rr)
+		}
+	}
+	if queries != 3 {
+		t.Errorf("%d upstream queries, want the loop to stop at the first repeated name", queries)
+	}
+
+	original := MAX_CNAME_DEPTH
+	MAX_CNAME_DEPTH = 1
+	t.Cleanup(func() { MAX_CNAME_DEPTH = original })
+	client = newTestClient(t)
+	client.FlattenCNAME = true
+	queries = 0
+	client.AddServer(stubServer("stub", hopTransport(twoHops, &queries)))
+
+	responseM = resolveWire(t, client, newQuery("www.example.com", dns.TypeA))
+	if len(responseM.Answer) != 2 || queries != 2 {
+		t.Errorf("answers %v after %d queries, want the chain cut after one follow-up", responseM.Answer, queries)
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrFlightFailed is returned to the waiters of a resolution which did not complete
+var ErrFlightFailed = errors.New("Shared resolution failed")
+
+// flight is an upstream resolution shared by identical concurrent queries
+type flight struct {
+	// closed when the resolution finished
+	done chan struct{}
+
+	// result of the resolution, copied by every waiter
+	responseM *dns.Msg
+	err       error
+}
+
+// flightGroup tracks the upstream resolutions in progress by key
+type flightGroup struct {
+	flights map[string]*flight
+	lock    sync.Mutex
+}
+
+// coalesce resolves key once for all concurrent callers
+// The first caller runs resolve, the others wait for its result
+func (client *Client) coalesce(ctx context.Context, key string, resolve func() (*dns.Msg, error)) (*dns.Msg, error) {
+	group := &client.flights
+	group.lock.Lock()
+	if group.flights == nil {
+		group.flights = make(map[string]*flight)
+	}
+	if current, ok := group.flights[key]; ok {
+		group.lock.Unlock()
+		atomic.AddUint64(&client.stats.coalesced, 1)
+		log.WithFields(log.Fields{"Key": key}).Debug("Joined resolution in flight")
+
+		select {
+		case <-current.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if current.err != nil {
+			return nil, current.err
+		}
+		return current.responseM.Copy(), nil
+	}
+
+	current := &flight{done: make(chan struct{})}
+	group.flights[key] = current
+	group.lock.Unlock()
+
+	// waiters are released even if resolve panics
+	current.err = ErrFlightFailed
+	defer func() {
+		group.lock.Lock()
+		delete(group.flights, key)
+		group.lock.Unlock()
+		close(current.done)
+	}()
+
+	responseM, err := resolve()
+	current.err = err
+	if err == nil {
+		// the caller modifies its response, waiters get an untouched copy
+		current.responseM = responseM.Copy()
+	}
+	return responseM, err
+}
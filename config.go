@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// upstreamConfig describes one upstream server in the config file
+type upstreamConfig struct {
+	// name of the resolver
+	Name string `json:"name"`
+
+	// IP for DNS, url for DoH
+	Upstream string `json:"upstream"`
+
+	// 53 for DNS, 443 for DoH
+	Port int `json:"port"`
+
+	// "udp", "tcp" or "tcp-tls" for DNS upstreams
+	Net string `json:"net,omitempty"`
+
+	// http, https or socks5 proxy url
+	Proxy string `json:"proxy,omitempty"`
+
+	// maximum number of requests in flight, unlimited when 0
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// share of queries sent to the upstream by the random shard strategy, 1 when 0
+	Weight int `json:"weight,omitempty"`
+
+	// virtual host of a DoH upstream addressed by IP
+	Host string `json:"host,omitempty"`
+
+	// extra headers of DoH requests, e.g. Authorization
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// extra parameters of DoH json urls, e.g. {"ct": "application/dns-json"}
+	QueryParams map[string]string `json:"query_params,omitempty"`
+
+	// DoH request method, "json" or "wire-get"
+	Method string `json:"method,omitempty"`
+
+	// send DoH requests over HTTP/3, falling back to HTTP/2
+	HTTP3 bool `json:"http3,omitempty"`
+
+	// adapter parsing json responses, "google", "cloudflare", "quad9" or one registered with RegisterJSONAdapter
+	JSONProvider string `json:"json_provider,omitempty"`
+
+	// plain DNS address of the same resolver, retried when DoH cannot connect
+	Fallback *upstreamConfig `json:"fallback,omitempty"`
+
+	// local address DNS exchanges are sent from, "ip", ":port" or "ip:port"
+	LocalAddr string `json:"local_addr,omitempty"`
+
+	// add a random_padding parameter to DoH json urls
+	RandomPadding bool `json:"random_padding,omitempty"`
+
+	// dial, read and write timeout of plain DNS exchanges, e.g. "500ms"
+	Timeout string `json:"timeout,omitempty"`
+
+	// block size wire format DoH queries are padded to, 128 recommended, not padded when 0
+	Padding int `json:"padding,omitempty"`
+
+	// sdns:// stamp of a DNSCrypt resolver, replaces upstream and port
+	DNSCrypt string `json:"dnscrypt,omitempty"`
+}
+
+// Config is the content of the client config file
+type Config struct {
+	// upstream resolvers selected by shard
+	Upstreams []upstreamConfig `json:"upstreams"`
+
+	// plain DNS resolvers tried in order when DoH fails
+	Fallbacks []upstreamConfig `json:"fallbacks"`
+
+	// names answered with a forced address or remapped, replacing the current rules when present
+	Rewrites []RewriteRule `json:"rewrites,omitempty"`
+}
+
+// ReadConfig parses the json config file at path
+func ReadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// newServer creates and initializes a server from its config
+func newServer(upstream upstreamConfig) (Server, error) {
+	var server Server
+	if upstream.DNSCrypt != "" {
+		if upstream.Proxy != "" {
+			return server, ErrProxyUnsupported
+		}
+		transport, err := NewDNSCryptTransport(upstream.DNSCrypt)
+		if err != nil {
+			return server, err
+		}
+		transport.Net = upstream.Net
+		server.Name = upstream.Name
+		server.Init(transport.Addr, 0)
+		server.Transport = transport
+		if upstream.MaxInFlight > 0 {
+			server.SetMaxInFlight(upstream.MaxInFlight)
+		}
+		server.SetWeight(upstream.Weight)
+		return server, nil
+	}
+	if upstream.Upstream == "" || upstream.Port == 0 {
+		return server, errors.New("Upstream " + upstream.Name + " requires an upstream and a port")
+	}
+	server.Name = upstream.Name
+	server.Init(upstream.Upstream, upstream.Port)
+	if upstream.Net != "" {
+		server.SetNet(upstream.Net)
+	}
+	if upstream.Host != "" {
+		server.SetHost(upstream.Host)
+	}
+	err := server.SetMethod(upstream.Method)
+	if err != nil {
+		return server, err
+	}
+	if upstream.HTTP3 {
+		server.SetHTTP3(true)
+	}
+	if upstream.JSONProvider != "" {
+		err = server.SetJSONProvider(upstream.JSONProvider)
+		if err != nil {
+			return server, err
+		}
+	}
+	if upstream.Timeout != "" {
+		timeout, err := time.ParseDuration(upstream.Timeout)
+		if err != nil {
+			return server, errors.New("Upstream " + upstream.Name + " has an invalid timeout " + upstream.Timeout)
+		}
+		server.SetTimeouts(timeout, timeout, timeout)
+	}
+	server.RandomPadding = upstream.RandomPadding
+	if upstream.Padding > 0 {
+		server.SetPadding(upstream.Padding)
+	}
+	for key, value := range upstream.Headers {
+		server.SetHeader(key, value)
+	}
+	for key, value := range upstream.QueryParams {
+		server.SetQueryParam(key, value)
+	}
+	if upstream.MaxInFlight > 0 {
+		server.SetMaxInFlight(upstream.MaxInFlight)
+	}
+	server.SetWeight(upstream.Weight)
+	if upstream.LocalAddr != "" {
+		err = server.SetLocalAddr(upstream.LocalAddr)
+		if err != nil {
+			return server, err
+		}
+	}
+	if upstream.Proxy != "" {
+		err = server.SetProxy(upstream.Proxy)
+		if err != nil {
+			return server, err
+		}
+	}
+	if upstream.Fallback != nil {
+		fallback, err := newServer(*upstream.Fallback)
+		if err != nil {
+			return server, err
+		}
+		server.Fallback = &fallback
+	}
+	return server, nil
+}
+
+// LoadConfig reads the config file at path and replaces the client resolvers
+// Resolvers are swapped atomically so that it is safe to call while the proxy is running
+func (client *Client) LoadConfig(path string) error {
+	config, err := ReadConfig(path)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Path": path}).Error("Failed to read config")
+		return err
+	}
+
+	var resolvers []Server
+	for _, upstream := range config.Upstreams {
+		server, err := newServer(upstream)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Invalid upstream in config")
+			return err
+		}
+		resolvers = append(resolvers, server)
+	}
+	// upstreams added in code are kept alongside those of the file
+	client.resolversLock.RLock()
+	resolvers = append(resolvers, client.addedResolvers...)
+	client.resolversLock.RUnlock()
+	if len(resolvers) == 0 {
+		err = ErrNoResolvers
+		log.WithFields(log.Fields{"Error": err, "Path": path}).Error("Invalid config")
+		return err
+	}
+	err = client.checkEncrypted(resolvers)
+	if err != nil {
+		return err
+	}
+
+	// probes go through the upstream proxy as well
+	client.applyUpstreamProxy(resolvers)
+	detectMethods(resolvers)
+
+	var fallbacks []Server
+	for _, upstream := range config.Fallbacks {
+		server, err := newServer(upstream)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Invalid fallback in config")
+			return err
+		}
+		fallbacks = append(fallbacks, server)
+	}
+	client.resolversLock.RLock()
+	fallbacks = append(fallbacks, client.addedFallbacks...)
+	client.resolversLock.RUnlock()
+	err = client.checkEncrypted(fallbacks)
+	if err != nil {
+		return err
+	}
+
+	// rules set in code are kept by configs without a rewrites list
+	if config.Rewrites != nil {
+		err = client.SetRewriteRules(config.Rewrites)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.SetResolvers(resolvers, fallbacks)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"Path": path, "Upstreams": len(resolvers), "Fallbacks": len(fallbacks), "Rewrites": len(config.Rewrites)}).Info("Config loaded")
+	return nil
+}
+
+// SetResolvers replaces the upstream and fallback resolvers
+// Queries in flight keep using the resolver they already selected, the connections of replaced resolvers are closed once they are idle
+// Returns ErrNoResolvers and keeps the current resolvers if resolvers is empty
+func (client *Client) SetResolvers(resolvers []Server, fallbacks []Server) error {
+	if len(resolvers) == 0 {
+		log.WithFields(log.Fields{"Error": ErrNoResolvers}).Error("Refused to replace the resolvers")
+		return ErrNoResolvers
+	}
+	client.applyUpstreamProxy(resolvers)
+	client.applyUpstreamProxy(fallbacks)
+
+	client.resolversLock.Lock()
+	replaced := append(append([]Server(nil), client.Resolvers...), client.Fallbacks...)
+	client.Resolvers = resolvers
+	client.Fallbacks = fallbacks
+	client.ring = nil
+	client.resolversLock.Unlock()
+
+	// resolvers kept across the swap, e.g. those added in code, share their usage with the new copies
+	kept := make(map[*upstreamUsage]bool)
+	for _, resolver := range append(resolvers, fallbacks...) {
+		kept[resolver.usage] = true
+	}
+	for i := range replaced {
+		if replaced[i].usage == nil || !kept[replaced[i].usage] {
+			replaced[i].retire()
+		}
+	}
+	return nil
+}
+
+// resolverList returns the current upstream resolvers
+func (client *Client) resolverList() []Server {
+	client.resolversLock.RLock()
+	defer client.resolversLock.RUnlock()
+	return client.Resolvers
+}
+
+// resolverByName returns the resolver named name
+func (client *Client) resolverByName(name string) (Server, bool) {
+	for _, resolver := range client.resolverList() {
+		if resolver.Name == name {
+			return resolver, true
+		}
+	}
+	return Server{}, false
+}
+
+// fallbackList returns the current fallback resolvers
+func (client *Client) fallbackList() []Server {
+	client.resolversLock.RLock()
+	defer client.resolversLock.RUnlock()
+	return client.Fallbacks
+}
+
+// runReloader reloads the config file whenever a signal is received on ReloadChan
+func (client *Client) runReloader() {
+	log.Info("Client reloader running")
+	for {
+		select {
+		case <-client.ReloaderExitChan:
+			log.Info("Client reloader exited")
+			client.ExitChan <- true
+			return
+		case <-client.ReloadChan:
+			client.Reload()
+		}
+	}
+}
+
+// Reload re-reads HostsFile, ZoneFile and ConfigFile and swaps in their hosts, records and resolvers
+// The current hosts and resolvers are kept if a file is invalid
+// After a config change the resolver workers are restarted, the listeners keep running
+func (client *Client) Reload() error {
+	if client.ConfigFile == "" && client.HostsFile == "" && client.ZoneFile == "" {
+		log.Warn("Reload requested but no config, hosts or zone file is set")
+		return errors.New("No config, hosts or zone file set")
+	}
+
+	if client.HostsFile != "" {
+		err := client.LoadHosts(client.HostsFile)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Path": client.HostsFile}).Error("Hosts reload failed, keeping current hosts")
+			return err
+		}
+	}
+	if client.ZoneFile != "" {
+		err := client.LoadZoneFile(client.ZoneFile, client.ZoneOrigin)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Path": client.ZoneFile}).Error("Zone reload failed, keeping current zone")
+			return err
+		}
+	}
+	if client.ConfigFile == "" {
+		return nil
+	}
+
+	log.WithFields(log.Fields{"Path": client.ConfigFile}).Info("Reloading config")
+	err := client.LoadConfig(client.ConfigFile)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Path": client.ConfigFile}).Error("Config reload failed, keeping current resolvers")
+		return err
+	}
+
+	log.WithFields(log.Fields{"Path": client.ConfigFile, "Upstreams": len(client.resolverList())}).Info("Config reloaded")
+	client.RestartWorkers()
+	return nil
+}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeConfig writes a config file and returns its path
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSetResolversRejectsEmpty(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	if client.SetResolvers(nil, nil) != ErrNoResolvers {
+		t.Error("empty resolver set accepted")
+	}
+	if len(client.resolverList()) != 1 {
+		t.Error("resolvers replaced by an empty set")
+	}
+}
+
+func TestLoadConfigKeepsAddedUpstreams(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("code", staticTransport("192.0.2.1")))
+	client.AddFallback("code-fallback", "192.0.2.53", 53)
+
+	path := writeConfig(t, `{"upstreams": [{"name": "file", "upstream": "dns.example/resolve", "port": 443, "method": "json"}],
+		"fallbacks": [{"name": "file-fallback", "upstream": "192.0.2.54", "port": 53}]}`)
+	for i := 0; i < 2; i++ {
+		err := client.LoadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for _, resolver := range client.resolverList() {
+		names = append(names, resolver.Name)
+	}
+	if len(names) != 2 || names[0] != "file" || names[1] != "code" {
+		t.Errorf("resolvers %v, want the file and code ones once each", names)
+	}
+	if fallbacks := client.fallbackList(); len(fallbacks) != 2 {
+		t.Errorf("%d fallbacks, want the file and code ones", len(fallbacks))
+	}
+}
+
+func TestSetResolversWaitsForQueriesInFlight(t *testing.T) {
+	addr, _ := startStubTCP(t, answerHandler)
+	client := newTestClient(t)
+
+	release := make(chan bool)
+	close(release)
+	var old Server
+	old.Name = "old"
+	old.Init("192.0.2.1", 0)
+	old.pool = newConnPool("tcp", addr)
+	// a query holds the old upstream while the resolvers are replaced
+	old.Transport = transportFunc(func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		<-release
+		return old.pool.exchange(ctx, queryM)
+	})
+	client.AddServer(old)
+	var fallback Server
+	fallback.Init("192.0.2.53", 53)
+	fallback.SetNet("tcp")
+	client.AddFallback("fallback", "192.0.2.53", 53)
+	client.Fallbacks[0] = fallback
+
+	// the first query leaves an idle connection in the pool
+	_, err := client.Resolve(newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release = make(chan bool)
+	done := make(chan error)
+	go func() {
+		_, err := client.Resolve(newQuery("example.com", dns.TypeA))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	err = client.SetResolvers([]Server{stubServer("new", staticTransport("192.0.2.2"))}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.pool.lock.Lock()
+	idle := len(old.pool.idle)
+	old.pool.lock.Unlock()
+	if idle != 1 {
+		t.Fatal("connections of the replaced upstream closed while a query still uses it")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("query in flight during the swap failed: %v", err)
+	}
+
+	// the old pool is closed now that its query finished
+	old.pool.lock.Lock()
+	idle = len(old.pool.idle)
+	old.pool.lock.Unlock()
+	if idle != 0 {
+		t.Errorf("%d idle connections left on the replaced upstream", idle)
+	}
+	if retired := fallback.usage.retire; retired == nil {
+		t.Error("replaced fallback was not retired")
+	}
+}
+
+// tcpUpstreamConfig returns the config entry of a tcp DNS upstream listening on addr
+func tcpUpstreamConfig(t *testing.T, name string, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf(`{"name": %q, "upstream": %q, "port": %s, "net": "tcp"}`, name, host, port)
+}
+
+func TestReloadAddsUpstream(t *testing.T) {
+	first, _ := startStubTCP(t, answerHandler)
+	second, _ := startStubTCP(t, answerHandler)
+	client := newTestClient(t)
+	client.ConfigFile = writeConfig(t, `{"upstreams": [`+tcpUpstreamConfig(t, "first", first)+`]}`)
+	err := client.LoadConfig(client.ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, resolver := range client.resolverList() {
+			resolver.retire()
+		}
+	})
+
+	err = os.WriteFile(client.ConfigFile, []byte(`{"upstreams": [`+tcpUpstreamConfig(t, "first", first)+`, `+tcpUpstreamConfig(t, "second", second)+`]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.runReloader()
+	client.ReloadChan <- syscall.SIGHUP
+	for i := 0; len(client.resolverList()) != 2; i++ {
+		if i == 100 {
+			t.Fatal("config not reloaded after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.ReloaderExitChan <- true
+	<-client.ExitChan
+
+	for _, name := range []string{"first", "second"} {
+		responseM, err := client.ResolveWith(newQuery("example.com", dns.TypeA), name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(responseM.Answer) != 1 {
+			t.Errorf("%s answered %v", name, responseM.Answer)
+		}
+	}
+
+	// an invalid config keeps the current upstreams
+	err = os.WriteFile(client.ConfigFile, []byte(`{"upstreams": [{"name": "broken"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Reload() == nil {
+		t.Error("invalid config reloaded")
+	}
+	if len(client.resolverList()) != 2 {
+		t.Errorf("%d upstreams after a failed reload, want 2", len(client.resolverList()))
+	}
+}
+
+func TestReloadDuringTraffic(t *testing.T) {
+	answering := func(ip string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, queryM *dns.Msg) {
+			w.WriteMsg(answerA(queryM, ip))
+		}
+	}
+	first, _ := startStubTCP(t, answering("192.0.2.1"))
+	second, _ := startStubTCP(t, answering("192.0.2.2"))
+	configs := []string{
+		`{"upstreams": [` + tcpUpstreamConfig(t, "first", first) + `]}`,
+		`{"upstreams": [` + tcpUpstreamConfig(t, "second", second) + `]}`,
+	}
+	client := newTestClient(t)
+	client.Num = 4
+	client.ConfigFile = writeConfig(t, configs[0])
+	addr := startProxy(t, client)
+
+	// clients query without pause while the config flips between the upstreams
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	answered := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			exchanger := dns.Client{Timeout: 2 * time.Second}
+			count := 0
+			for {
+				select {
+				case <-stop:
+					answered <- count
+					errs <- nil
+					return
+				default:
+				}
+				responseM, _, err := exchanger.Exchange(newQuery(fmt.Sprintf("host%d-%d.example.com", i, count), dns.TypeA), addr)
+				if err == nil && (responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 1) {
+					err = fmt.Errorf("answered %s with %v", dns.RcodeToString[responseM.Rcode], responseM.Answer)
+				}
+				if err != nil {
+					answered <- count
+					errs <- err
+					return
+				}
+				count++
+			}
+		}(i)
+	}
+
+	var goroutines int
+	for i := 0; i < 20; i++ {
+		err := os.WriteFile(client.ConfigFile, []byte(configs[(i+1)%2]), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous := client.ResolverExitChan
+		err = client.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the whole previous generation is told to exit, not any worker
+		select {
+		case _, ok := <-previous:
+			if ok {
+				t.Fatal("previous workers signalled one by one")
+			}
+		default:
+			t.Fatal("previous workers not signalled")
+		}
+		if i == 0 {
+			goroutines = runtime.NumGoroutine()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// no worker is leaked by the restarts
+	if grown := runtime.NumGoroutine() - goroutines; grown >= client.Num {
+		t.Errorf("%d more goroutines after 19 reloads, old workers kept running", grown)
+	}
+	close(stop)
+	total := 0
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("query lost during reloads: %v", err)
+		}
+		total += <-answered
+	}
+	if total == 0 {
+		t.Error("no query answered during reloads")
+	}
+	if dropped := client.Status().Dropped; dropped != 0 {
+		t.Errorf("%d queries dropped or refused during reloads", dropped)
+	}
+}
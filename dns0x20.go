@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCaseMismatch is returned when a response does not echo the randomized question name
+var ErrCaseMismatch = errors.New("Response question does not match the query casing")
+
+// randomizeCase returns a copy of the query with the letters of its question names in random case
+// Resolvers echo the name as sent, which a spoofer has to guess (DNS 0x20)
+func randomizeCase(queryM *dns.Msg) *dns.Msg {
+	sentM := queryM.Copy()
+	for i := range sentM.Question {
+		name := []byte(sentM.Question[i].Name)
+		for j, c := range name {
+			if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+				if rand.Intn(2) == 0 {
+					name[j] = c | 0x20
+				} else {
+					name[j] = c &^ 0x20
+				}
+			}
+		}
+		sentM.Question[i].Name = string(name)
+	}
+	return sentM
+}
+
+// checkCase verifies the response echoes the randomized names of sentM
+// and restores the names of the original query in the response
+func checkCase(queryM *dns.Msg, sentM *dns.Msg, responseM *dns.Msg) error {
+	if len(responseM.Question) != len(sentM.Question) {
+		log.WithFields(log.Fields{"Question": sentM.Question}).Error("Response question count does not match the query")
+		return ErrCaseMismatch
+	}
+	for i, question := range responseM.Question {
+		if question.Name != sentM.Question[i].Name {
+			log.WithFields(log.Fields{"Sent": sentM.Question[i].Name, "Received": question.Name}).Error("Response casing mismatch, possibly spoofed")
+			return ErrCaseMismatch
+		}
+		original := queryM.Question[i].Name
+		responseM.Question[i].Name = original
+		for _, section := range [][]dns.RR{responseM.Answer, responseM.Ns, responseM.Extra} {
+			for _, rr := range section {
+				if strings.EqualFold(rr.Header().Name, original) {
+					rr.Header().Name = original
+				}
+			}
+		}
+	}
+	return nil
+}
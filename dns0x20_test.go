@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRandomizedCase(t *testing.T) {
+	var lock sync.Mutex
+	var sent []string
+	var spoof atomic.Value
+	spoof.Store(false)
+	addr, _ := startStubTCP(t, func(w dns.ResponseWriter, queryM *dns.Msg) {
+		lock.Lock()
+		sent = append(sent, queryM.Question[0].Name)
+		lock.Unlock()
+		responseM := answerA(queryM, "192.0.2.1")
+		if spoof.Load().(bool) {
+			// a spoofer does not know the casing of the query
+			responseM.Question[0].Name = strings.ToLower(responseM.Question[0].Name)
+		}
+		w.WriteMsg(responseM)
+	})
+	client := newTestClient(t)
+	client.Use0x20 = true
+	client.AddServer(tcpUpstream(t, "stub", addr))
+
+	name := "randomized.case.example.com."
+	for i := 0; i < 4; i++ {
+		responseM := resolveWire(t, client, newQuery(name, dns.TypeA))
+		if responseM.Rcode != dns.RcodeSuccess || responseM.Question[0].Name != name || responseM.Answer[0].Header().Name != name {
+			t.Fatalf("response %v, want an answer with the casing of the query", responseM)
+		}
+	}
+	lock.Lock()
+	randomized := false
+	for _, sentName := range sent {
+		if !strings.EqualFold(sentName, name) {
+			t.Errorf("sent %s for %s", sentName, name)
+		}
+		randomized = randomized || sentName != name
+	}
+	lock.Unlock()
+	if !randomized {
+		t.Errorf("sent names %v, want random casing", sent)
+	}
+
+	spoof.Store(true)
+	responseM := resolveWire(t, client, newQuery("Spoofed.Example.COM", dns.TypeA))
+	if responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode %s for a response with the wrong casing, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+	}
+}
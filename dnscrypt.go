@@ -0,0 +1,431 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// DNSCrypt encryption systems
+const DNSCRYPT_XSALSA20POLY1305 uint16 = 1
+const DNSCRYPT_XCHACHA20POLY1305 uint16 = 2
+
+// minimum size of a padded query sent over udp
+var DNSCRYPT_MIN_QUERY_SIZE int = 256
+
+// how long a DNSCrypt exchange may take when the context has no deadline
+var DNSCRYPT_TIMEOUT time.Duration = 5 * time.Second
+
+// magic prefixing every DNSCrypt response
+var dnscryptResolverMagic = []byte("r6fnvWj8")
+
+// ErrDNSCryptCert is returned when the resolver offers no valid certificate
+var ErrDNSCryptCert = errors.New("No valid DNSCrypt certificate")
+
+// dnscryptCert is a verified resolver certificate with the keys derived from it
+type dnscryptCert struct {
+	esVersion   uint16
+	clientMagic [8]byte
+	serial      uint32
+	notAfter    time.Time
+
+	// client key pair, regenerated with every certificate
+	publicKey [32]byte
+	sharedKey [32]byte
+}
+
+// DNSCryptTransport sends queries to a DNSCrypt v2 resolver
+type DNSCryptTransport struct {
+	// address of the resolver, ip:port
+	Addr string
+
+	// provider name and signing key of the resolver certificates
+	ProviderName string
+	ProviderKey  ed25519.PublicKey
+
+	// "udp" or "tcp", udp when empty
+	Net string
+
+	// current certificate, fetched on first use and when it expires
+	cert *dnscryptCert
+	lock sync.Mutex
+}
+
+// NewDNSCryptTransport creates a transport from an sdns:// DNSCrypt stamp
+func NewDNSCryptTransport(stamp string) (*DNSCryptTransport, error) {
+	if !strings.HasPrefix(stamp, "sdns://") {
+		return nil, errors.New("DNSCrypt stamp must start with sdns://")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, "sdns://"))
+	if err != nil {
+		return nil, err
+	}
+	// protocol, 8 bytes of properties, then length prefixed address, public key and provider name
+	if len(data) < 9 || data[0] != 0x01 {
+		return nil, errors.New("Not a DNSCrypt stamp")
+	}
+	fields := make([][]byte, 0, 3)
+	rest := data[9:]
+	for i := 0; i < 3; i++ {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, errors.New("Truncated DNSCrypt stamp")
+		}
+		fields = append(fields, rest[1:1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+	}
+	if len(fields[1]) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid DNSCrypt provider key")
+	}
+
+	addr := string(fields[0])
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "443")
+	}
+	return &DNSCryptTransport{
+		Addr:         addr,
+		ProviderName: dns.Fqdn(string(fields[2])),
+		ProviderKey:  ed25519.PublicKey(fields[1]),
+	}, nil
+}
+
+// Query encrypts the query, sends it to the resolver and decrypts its answer
+func (transport *DNSCryptTransport) Query(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	cert, err := transport.certificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	responseM, err := transport.exchange(ctx, cert, queryM)
+	if err != nil && ctx.Err() == nil {
+		// the resolver may have rotated its keys
+		log.WithFields(log.Fields{"Error": err, "Provider": transport.ProviderName}).Debug("DNSCrypt exchange failed, refreshing certificate")
+		transport.lock.Lock()
+		transport.cert = nil
+		transport.lock.Unlock()
+
+		cert, err = transport.certificate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		responseM, err = transport.exchange(ctx, cert, queryM)
+	}
+	return responseM, err
+}
+
+// certificate returns the current certificate, fetching a new one when needed
+func (transport *DNSCryptTransport) certificate(ctx context.Context) (*dnscryptCert, error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	if transport.cert != nil && time.Now().Before(transport.cert.notAfter) {
+		return transport.cert, nil
+	}
+
+	cert, err := transport.fetchCertificate(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Provider": transport.ProviderName}).Error("Failed to fetch DNSCrypt certificate")
+		return nil, err
+	}
+	transport.cert = cert
+	return cert, nil
+}
+
+// fetchCertificate queries the certificates of the provider and keeps the newest valid one
+func (transport *DNSCryptTransport) fetchCertificate(ctx context.Context) (*dnscryptCert, error) {
+	var queryM *dns.Msg = new(dns.Msg)
+	queryM.SetQuestion("2.dnscrypt-cert."+transport.ProviderName, dns.TypeTXT)
+
+	network := transport.Net
+	if network == "" {
+		network = "udp"
+	}
+	dnsClient := &dns.Client{Net: network}
+	responseM, _, err := dnsClient.ExchangeContext(ctx, queryM, transport.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *dnscryptCert
+	now := time.Now()
+	for _, rr := range responseM.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := transport.parseCertificate(unescapeTXT(strings.Join(txt.Txt, "")), now)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Provider": transport.ProviderName}).Debug("Skipped DNSCrypt certificate")
+			continue
+		}
+		if best == nil || cert.serial > best.serial {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, ErrDNSCryptCert
+	}
+	return best, nil
+}
+
+// parseCertificate verifies a certificate and derives the shared key from it
+func (transport *DNSCryptTransport) parseCertificate(data []byte, now time.Time) (*dnscryptCert, error) {
+	// magic, es version, minor version, signature, then the signed resolver key, client magic, serial and validity
+	if len(data) < 124 || !bytes.Equal(data[:4], []byte("DNSC")) {
+		return nil, errors.New("Invalid certificate")
+	}
+	if !ed25519.Verify(transport.ProviderKey, data[72:], data[8:72]) {
+		return nil, errors.New("Invalid certificate signature")
+	}
+
+	cert := &dnscryptCert{
+		esVersion: binary.BigEndian.Uint16(data[4:6]),
+		serial:    binary.BigEndian.Uint32(data[112:116]),
+	}
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(data[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(data[120:124])), 0)
+	if now.Before(notBefore) || now.After(cert.notAfter) {
+		return nil, errors.New("Expired certificate")
+	}
+	copy(cert.clientMagic[:], data[104:112])
+
+	var resolverKey [32]byte
+	copy(resolverKey[:], data[72:104])
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cert.publicKey = *publicKey
+
+	switch cert.esVersion {
+	case DNSCRYPT_XSALSA20POLY1305:
+		box.Precompute(&cert.sharedKey, &resolverKey, secretKey)
+	case DNSCRYPT_XCHACHA20POLY1305:
+		dhKey, err := curve25519.X25519(secretKey[:], resolverKey[:])
+		if err != nil {
+			return nil, err
+		}
+		sharedKey, err := chacha20.HChaCha20(dhKey, make([]byte, 16))
+		if err != nil {
+			return nil, err
+		}
+		copy(cert.sharedKey[:], sharedKey)
+	default:
+		return nil, errors.New("Unsupported encryption system " + strconv.Itoa(int(cert.esVersion)))
+	}
+	return cert, nil
+}
+
+// exchange sends one encrypted query and decrypts the response
+func (transport *DNSCryptTransport) exchange(ctx context.Context, cert *dnscryptCert, queryM *dns.Msg) (*dns.Msg, error) {
+	query, err := queryM.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:12])
+	if err != nil {
+		return nil, err
+	}
+
+	network := transport.Net
+	if network == "" {
+		network = "udp"
+	}
+	minSize := 0
+	if network == "udp" {
+		minSize = DNSCRYPT_MIN_QUERY_SIZE
+	}
+
+	packet := make([]byte, 0, 8+32+12+len(query)+64+secretbox.Overhead)
+	packet = append(packet, cert.clientMagic[:]...)
+	packet = append(packet, cert.publicKey[:]...)
+	packet = append(packet, nonce[:12]...)
+	packet = dnscryptSeal(packet, cert, &nonce, dnscryptPad(query, minSize))
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DNSCRYPT_TIMEOUT)
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, transport.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	var response []byte
+	if network == "udp" {
+		_, err = conn.Write(packet)
+		if err != nil {
+			return nil, err
+		}
+		response = make([]byte, dns.MaxMsgSize)
+		size, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		response = response[:size]
+	} else {
+		prefixed := make([]byte, 2, 2+len(packet))
+		binary.BigEndian.PutUint16(prefixed, uint16(len(packet)))
+		_, err = conn.Write(append(prefixed, packet...))
+		if err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return nil, err
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(conn, response)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// resolver magic, client nonce followed by the resolver nonce, then the encrypted response
+	if len(response) < 8+24+secretbox.Overhead || !bytes.Equal(response[:8], dnscryptResolverMagic) {
+		return nil, errors.New("Invalid DNSCrypt response")
+	}
+	if !bytes.Equal(response[8:20], nonce[:12]) {
+		return nil, errors.New("DNSCrypt response nonce mismatch")
+	}
+	copy(nonce[12:], response[20:32])
+
+	padded, ok := dnscryptOpen(cert, &nonce, response[32:])
+	if !ok {
+		return nil, errors.New("Failed to decrypt DNSCrypt response")
+	}
+	plain, err := dnscryptUnpad(padded)
+	if err != nil {
+		return nil, err
+	}
+
+	var responseM *dns.Msg = new(dns.Msg)
+	err = responseM.Unpack(plain)
+	if err != nil {
+		return nil, err
+	}
+	return responseM, nil
+}
+
+// dnscryptPad pads the query with 0x80 and zeros to a multiple of 64 bytes of at least minSize
+func dnscryptPad(query []byte, minSize int) []byte {
+	size := (len(query) + 1 + 63) / 64 * 64
+	if size < minSize {
+		size = minSize
+	}
+	padded := make([]byte, size)
+	copy(padded, query)
+	padded[len(query)] = 0x80
+	return padded
+}
+
+// dnscryptUnpad removes the padding of a decrypted response
+func dnscryptUnpad(padded []byte) ([]byte, error) {
+	end := bytes.LastIndexByte(padded, 0x80)
+	if end < 0 {
+		return nil, errors.New("Invalid DNSCrypt padding")
+	}
+	for _, b := range padded[end+1:] {
+		if b != 0 {
+			return nil, errors.New("Invalid DNSCrypt padding")
+		}
+	}
+	return padded[:end], nil
+}
+
+// dnscryptSeal appends the encrypted message to out, tag first
+func dnscryptSeal(out []byte, cert *dnscryptCert, nonce *[24]byte, message []byte) []byte {
+	if cert.esVersion == DNSCRYPT_XSALSA20POLY1305 {
+		return secretbox.Seal(out, message, nonce, &cert.sharedKey)
+	}
+
+	cipher, polyKey := xchachaCipher(cert, nonce)
+	sealed := make([]byte, poly1305.TagSize+len(message))
+	ciphertext := sealed[poly1305.TagSize:]
+	cipher.XORKeyStream(ciphertext, message)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, ciphertext, &polyKey)
+	copy(sealed, tag[:])
+	return append(out, sealed...)
+}
+
+// dnscryptOpen authenticates and decrypts a sealed message
+func dnscryptOpen(cert *dnscryptCert, nonce *[24]byte, sealed []byte) ([]byte, bool) {
+	if cert.esVersion == DNSCRYPT_XSALSA20POLY1305 {
+		return secretbox.Open(nil, sealed, nonce, &cert.sharedKey)
+	}
+
+	if len(sealed) < poly1305.TagSize {
+		return nil, false
+	}
+	cipher, polyKey := xchachaCipher(cert, nonce)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, sealed[poly1305.TagSize:], &polyKey)
+	if subtle.ConstantTimeCompare(tag[:], sealed[:poly1305.TagSize]) != 1 {
+		return nil, false
+	}
+	message := make([]byte, len(sealed)-poly1305.TagSize)
+	cipher.XORKeyStream(message, sealed[poly1305.TagSize:])
+	return message, true
+}
+
+// xchachaCipher sets up XChaCha20 in the secretbox construction used by DNSCrypt
+// The first 32 bytes of keystream are the poly1305 key, the message is encrypted from byte 32
+func xchachaCipher(cert *dnscryptCert, nonce *[24]byte) (*chacha20.Cipher, [32]byte) {
+	subKey, _ := chacha20.HChaCha20(cert.sharedKey[:], nonce[:16])
+	var subNonce [chacha20.NonceSize]byte
+	copy(subNonce[4:], nonce[16:])
+	cipher, _ := chacha20.NewUnauthenticatedCipher(subKey, subNonce[:])
+
+	var polyKey [32]byte
+	cipher.XORKeyStream(polyKey[:], polyKey[:])
+	return cipher, polyKey
+}
+
+// unescapeTXT decodes the \DDD and \X escapes of TXT data in presentation format
+func unescapeTXT(text string) []byte {
+	var data []byte
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 >= len(text) {
+			data = append(data, text[i])
+			continue
+		}
+		if i+3 < len(text) && isDigit(text[i+1]) && isDigit(text[i+2]) && isDigit(text[i+3]) {
+			value, _ := strconv.Atoi(text[i+1 : i+4])
+			data = append(data, byte(value))
+			i += 3
+			continue
+		}
+		data = append(data, text[i+1])
+		i++
+	}
+	return data
+}
+
+// isDigit reports whether b is an ascii digit
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
@@ -0,0 +1,491 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ROOT_TRUST_ANCHORS are the DS records of the root zone key signing keys
+var ROOT_TRUST_ANCHORS = []string{
+	". 86400 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 86400 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// maximum number of zones walked up while building a chain of trust
+var DNSSEC_MAX_DEPTH int = 16
+
+// validatedKeys are the verified DNSKEYs of a zone with their expiration
+type validatedKeys struct {
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+// keyCache keeps verified zone keys so that the chain is not rebuilt for every query
+type keyCache struct {
+	lock  sync.Mutex
+	zones map[string]validatedKeys
+
+	// delegations proven unsigned, by child zone, with the expiration of the proof
+	insecure map[string]time.Time
+}
+
+// defaultTrustAnchors parses ROOT_TRUST_ANCHORS
+func defaultTrustAnchors() []*dns.DS {
+	var anchors []*dns.DS
+	for _, anchor := range ROOT_TRUST_ANCHORS {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Anchor": anchor}).Error("Failed to parse trust anchor")
+			continue
+		}
+		anchors = append(anchors, rr.(*dns.DS))
+	}
+	return anchors
+}
+
+// setDO sets the DNSSEC OK bit of the message, adding an OPT record if needed
+func setDO(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+		return
+	}
+	opt.SetDo()
+}
+
+// wantsDNSSEC reports whether the DNSSEC OK bit of the message is set
+func wantsDNSSEC(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// stripDNSSEC removes signatures and denial of existence records from a response to a client which did not ask for them
+// records of the question type are kept
+func stripDNSSEC(m *dns.Msg) {
+	var qtype uint16
+	if len(m.Question) > 0 {
+		qtype = m.Question[0].Qtype
+	}
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case qtype:
+				kept = append(kept, rr)
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			default:
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	m.Answer = strip(m.Answer)
+	m.Ns = strip(m.Ns)
+	m.Extra = strip(m.Extra)
+}
+
+// rrsetKey identifies the RRset a record belongs to
+func rrsetKey(name string, rrtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + "/" + dns.TypeToString[rrtype]
+}
+
+// splitRRsets groups records into RRsets and collects the signatures covering each one
+func splitRRsets(rrs []dns.RR) (map[string][]dns.RR, map[string][]*dns.RRSIG) {
+	rrsets := make(map[string][]dns.RR)
+	sigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey(sig.Hdr.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey(rr.Header().Name, rr.Header().Rrtype)
+		rrsets[key] = append(rrsets[key], rr)
+	}
+	return rrsets, sigs
+}
+
+// verifyRRset checks that at least one signature over the RRset is valid for one of the keys
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	now := time.Now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if sig.Verify(key, rrset) == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("No valid signature")
+}
+
+// validate verifies the signatures of the answer and authority sections up to a trust anchor
+// Returns true if at least one RRset verified, every RRset is signed and a negative answer carries a signed denial,
+// false if the unsigned or missing data sits below a proven insecure delegation
+// Returns an error if a signature fails to verify or unsigned data cannot be proven insecure (bogus)
+// NOTE: denial of existence is only checked for valid signatures on the NSEC/NSEC3 records,
+// the NSEC coverage proof of negative answers itself is not verified
+func (client *Client) validate(ctx context.Context, responseM *dns.Msg) (bool, error) {
+	_, span := client.tracer().Start(ctx, "ValidateDNSSEC")
+	defer span.End()
+
+	var verified, unsigned, denied bool
+	for _, section := range [][]dns.RR{responseM.Answer, responseM.Ns} {
+		rrsets, sigs := splitRRsets(section)
+		for key, rrset := range rrsets {
+			owner := rrset[0].Header().Name
+			rrsetSigs, ok := sigs[key]
+			if !ok {
+				// Unsigned data is only acceptable below a delegation proven to be unsigned
+				err := client.provenInsecure(ctx, owner)
+				if err != nil {
+					log.WithFields(log.Fields{"Error": err, "RRset": key}).Error("DNSSEC validation failed")
+					span.RecordError(err)
+					return false, err
+				}
+				unsigned = true
+				continue
+			}
+
+			err := client.verifySigned(ctx, rrset, rrsetSigs, owner, false, 0)
+			if err != nil {
+				log.WithFields(log.Fields{"Error": err, "RRset": key}).Error("DNSSEC validation failed")
+				span.RecordError(err)
+				return false, err
+			}
+			verified = true
+			switch rrset[0].Header().Rrtype {
+			case dns.TypeNSEC, dns.TypeNSEC3:
+				denied = true
+			}
+		}
+	}
+
+	// Nothing verified or a negative answer without a signed denial must be explained by an insecure delegation
+	secure := verified && !unsigned
+	if negativeAnswer(responseM) && !denied {
+		secure = false
+	}
+	if !secure && !unsigned && len(responseM.Question) > 0 &&
+		(responseM.Rcode == dns.RcodeSuccess || responseM.Rcode == dns.RcodeNameError) {
+		err := client.provenInsecure(ctx, responseM.Question[0].Name)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Question": responseM.Question[0]}).Error("DNSSEC validation failed")
+			span.RecordError(err)
+			return false, err
+		}
+	}
+
+	span.SetAttribute("dns.dnssec_secure", secure)
+	return secure, nil
+}
+
+// negativeAnswer reports whether the response is a name error or has no records of the question type (NODATA)
+func negativeAnswer(responseM *dns.Msg) bool {
+	if responseM.Rcode == dns.RcodeNameError {
+		return true
+	}
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Question) == 0 {
+		return false
+	}
+	qtype := responseM.Question[0].Qtype
+	for _, rr := range responseM.Answer {
+		switch rr.Header().Rrtype {
+		case qtype, dns.TypeCNAME, dns.TypeDNAME:
+			return false
+		}
+	}
+	return qtype != dns.TypeANY
+}
+
+// verifySigned verifies the RRset with the keys of each zone which signed it, until one of them succeeds
+// Signatures are only accepted from the owner zone or one of its ancestors, strict ones exclude the owner itself
+func (client *Client) verifySigned(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG, owner string, strict bool, depth int) error {
+	owner = strings.ToLower(dns.Fqdn(owner))
+	bySigner := make(map[string][]*dns.RRSIG)
+	var signers []string
+	for _, sig := range sigs {
+		signer := strings.ToLower(dns.Fqdn(sig.SignerName))
+		if !dns.IsSubDomain(signer, owner) || (strict && signer == owner) {
+			continue
+		}
+		if _, ok := bySigner[signer]; !ok {
+			signers = append(signers, signer)
+		}
+		bySigner[signer] = append(bySigner[signer], sig)
+	}
+	if len(signers) == 0 {
+		return errors.New("No signature over " + owner + " by an ancestor zone")
+	}
+
+	var err error
+	for _, signer := range signers {
+		var keys []*dns.DNSKEY
+		keys, err = client.zoneKeys(ctx, signer, depth)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Zone": signer}).Error("Failed to build DNSSEC chain of trust")
+			continue
+		}
+		err = verifyRRset(rrset, bySigner[signer], keys)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// provenInsecure checks that name lies below a delegation the parent proves to have no DS (RFC 4035 section 5.2)
+// Zones are walked down from the top level one, each must either have a verified DS or a signed denial of it
+// Returns an error if unsigned data for name cannot be explained by an insecure delegation
+func (client *Client) provenInsecure(ctx context.Context, name string) error {
+	labels := dns.SplitDomainName(strings.ToLower(dns.Fqdn(name)))
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		if client.knownInsecure(zone) {
+			return nil
+		}
+		if client.knownSigned(zone) {
+			continue
+		}
+		if client.anchored(zone) {
+			_, err := client.zoneKeys(ctx, zone, 0)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		dsM, err := client.lookup(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return err
+		}
+		dsRRsets, _ := splitRRsets(dsM.Answer)
+		if len(dsRRsets[rrsetKey(zone, dns.TypeDS)]) > 0 {
+			// a signed delegation, its keys must verify through the chain of trust
+			_, err = client.zoneKeys(ctx, zone, 0)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		insecure, ttl, err := client.deniedDS(ctx, zone, dsM.Ns)
+		if err != nil {
+			return err
+		}
+		if insecure {
+			client.dnssecKeys.lock.Lock()
+			if client.dnssecKeys.insecure == nil {
+				client.dnssecKeys.insecure = make(map[string]time.Time)
+			}
+			client.dnssecKeys.insecure[zone] = time.Now().Add(time.Duration(ttl) * time.Second)
+			client.dnssecKeys.lock.Unlock()
+			return nil
+		}
+		// not a zone cut, the parent zone continues below it
+	}
+	return errors.New("Unsigned data for " + name + " in a signed zone")
+}
+
+// deniedDS checks the NSEC or NSEC3 records of a DS query for zone
+// Returns true with the ttl of the proof if zone is a delegation without DS, false if zone is not a zone cut
+// Returns an error if the denial records do not verify
+func (client *Client) deniedDS(ctx context.Context, zone string, authority []dns.RR) (bool, uint32, error) {
+	rrsets, sigs := splitRRsets(authority)
+	for key, rrset := range rrsets {
+		var insecure, matched bool
+		for _, rr := range rrset {
+			switch record := rr.(type) {
+			case *dns.NSEC:
+				if strings.EqualFold(record.Hdr.Name, zone) {
+					matched = true
+					insecure = hasType(record.TypeBitMap, dns.TypeNS) && !hasType(record.TypeBitMap, dns.TypeDS)
+				}
+			case *dns.NSEC3:
+				if record.Match(zone) {
+					matched = true
+					insecure = hasType(record.TypeBitMap, dns.TypeNS) && !hasType(record.TypeBitMap, dns.TypeDS)
+				} else if record.Cover(zone) && record.Flags&0x01 == 0x01 {
+					// opt-out span, it may hold unsigned delegations (RFC 5155 section 6)
+					matched = true
+					insecure = true
+				}
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		// the denial must be signed by an ancestor of zone
+		rrsetSigs := sigs[key]
+		if len(rrsetSigs) == 0 {
+			return false, 0, errors.New("Unsigned denial of DS for zone " + zone)
+		}
+		err := client.verifySigned(ctx, rrset, rrsetSigs, zone, true, 0)
+		if err != nil {
+			return false, 0, err
+		}
+		if insecure {
+			return true, rrset[0].Header().Ttl, nil
+		}
+		return false, 0, nil
+	}
+	return false, 0, nil
+}
+
+// hasType reports whether an NSEC or NSEC3 type bitmap lists rrtype
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// knownInsecure reports whether zone was recently proven to be an unsigned delegation
+func (client *Client) knownInsecure(zone string) bool {
+	client.dnssecKeys.lock.Lock()
+	defer client.dnssecKeys.lock.Unlock()
+	expire, ok := client.dnssecKeys.insecure[zone]
+	return ok && time.Now().Before(expire)
+}
+
+// anchored reports whether a trust anchor is configured for zone
+func (client *Client) anchored(zone string) bool {
+	for _, anchor := range client.TrustAnchors {
+		if strings.EqualFold(anchor.Hdr.Name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownSigned reports whether the keys of zone were recently verified
+func (client *Client) knownSigned(zone string) bool {
+	client.dnssecKeys.lock.Lock()
+	defer client.dnssecKeys.lock.Unlock()
+	cached, ok := client.dnssecKeys.zones[zone]
+	return ok && time.Now().Before(cached.expire)
+}
+
+// zoneKeys returns the DNSKEYs of zone after verifying them against a trust anchor or the parent DS records
+func (client *Client) zoneKeys(ctx context.Context, zone string, depth int) ([]*dns.DNSKEY, error) {
+	if depth > DNSSEC_MAX_DEPTH {
+		return nil, errors.New("DNSSEC chain too long")
+	}
+	zone = dns.Fqdn(zone)
+
+	client.dnssecKeys.lock.Lock()
+	if client.dnssecKeys.zones == nil {
+		client.dnssecKeys.zones = make(map[string]validatedKeys)
+	}
+	cached, ok := client.dnssecKeys.zones[zone]
+	client.dnssecKeys.lock.Unlock()
+	if ok && time.Now().Before(cached.expire) {
+		return cached.keys, nil
+	}
+
+	keyM, err := client.lookup(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	keyRRsets, keySigs := splitRRsets(keyM.Answer)
+	keyRRset := keyRRsets[rrsetKey(zone, dns.TypeDNSKEY)]
+	if len(keyRRset) == 0 {
+		return nil, errors.New("No DNSKEY for zone " + zone)
+	}
+	var keys []*dns.DNSKEY
+	ttl := keyRRset[0].Header().Ttl
+	for _, rr := range keyRRset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	// Find the DS records the key signing keys must match
+	var dsSet []*dns.DS
+	for _, anchor := range client.TrustAnchors {
+		if strings.EqualFold(anchor.Hdr.Name, zone) {
+			dsSet = append(dsSet, anchor)
+		}
+	}
+	if len(dsSet) == 0 {
+		if zone == "." {
+			return nil, errors.New("No trust anchor for the root zone")
+		}
+
+		dsM, err := client.lookup(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		dsRRsets, dsSigs := splitRRsets(dsM.Answer)
+		key := rrsetKey(zone, dns.TypeDS)
+		dsRRset := dsRRsets[key]
+		if len(dsRRset) == 0 || len(dsSigs[key]) == 0 {
+			return nil, errors.New("No signed DS for zone " + zone)
+		}
+
+		// the DS RRset lives in the parent, it must be signed by a strict ancestor of zone
+		err = client.verifySigned(ctx, dsRRset, dsSigs[key], zone, true, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rr := range dsRRset {
+			dsSet = append(dsSet, rr.(*dns.DS))
+		}
+	}
+
+	// Key signing keys are trusted when they match one of the DS records
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, ds := range dsSet {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			keyDS := key.ToDS(ds.DigestType)
+			if keyDS != nil && strings.EqualFold(keyDS.Digest, ds.Digest) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("No DNSKEY matches the DS of zone " + zone)
+	}
+
+	err = verifyRRset(keyRRset, keySigs[rrsetKey(zone, dns.TypeDNSKEY)], trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	client.dnssecKeys.lock.Lock()
+	client.dnssecKeys.zones[zone] = validatedKeys{
+		keys:   keys,
+		expire: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	client.dnssecKeys.lock.Unlock()
+
+	return keys, nil
+}
+
+// lookup queries the upstream resolvers for the DNSSEC records of name
+func (client *Client) lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	var queryM *dns.Msg = new(dns.Msg)
+	queryM.SetQuestion(dns.Fqdn(name), qtype)
+	setDO(queryM)
+	return client.resolve(ctx, queryM)
+}
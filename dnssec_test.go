@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// signedZone is a stub upstream serving a DNSSEC signed zone "example."
+type signedZone struct {
+	key     *dns.DNSKEY
+	signer  crypto.Signer
+	answers map[string]*dns.Msg
+	queries int32
+}
+
+// newSignedZone generates the key of "example." and the answers of the stub
+func newSignedZone(t *testing.T) *signedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := &signedZone{key: key, signer: private.(crypto.Signer), answers: make(map[string]*dns.Msg)}
+
+	zone.add(t, "example.", dns.TypeDNSKEY, []dns.RR{key}, nil, true)
+	zone.add(t, "www.example.", dns.TypeA, []dns.RR{newA("www.example.", "192.0.2.1")}, nil, true)
+	// insecure.example. is delegated without DS
+	zone.add(t, "insecure.example.", dns.TypeDS, nil, []dns.RR{newNSEC("insecure.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)}, true)
+	zone.add(t, "host.insecure.example.", dns.TypeA, []dns.RR{newA("host.insecure.example.", "192.0.2.2")}, nil, false)
+	// unsigned.example. is a name of the signed zone, not a delegation
+	zone.add(t, "unsigned.example.", dns.TypeDS, nil, []dns.RR{newNSEC("unsigned.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)}, true)
+	zone.add(t, "unsigned.example.", dns.TypeA, []dns.RR{newA("unsigned.example.", "192.0.2.3")}, nil, false)
+	// stripped.example. claims to be insecure but its DS denial was removed
+	zone.add(t, "stripped.example.", dns.TypeDS, nil, nil, false)
+	zone.add(t, "host.stripped.example.", dns.TypeA, []dns.RR{newA("host.stripped.example.", "192.0.2.4")}, nil, false)
+	return zone
+}
+
+// newA returns an A record of name
+func newA(name string, ip string) dns.RR {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip).To4()}
+}
+
+// newNSEC returns an NSEC record of name listing types
+func newNSEC(name string, types ...uint16) dns.RR {
+	return &dns.NSEC{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300}, NextDomain: "zzz.example.", TypeBitMap: types}
+}
+
+// sign returns the signature of rrset by the zone key
+func (zone *signedZone) sign(t *testing.T, rrset []dns.RR) *dns.RRSIG {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  zone.key.Algorithm,
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:     zone.key.KeyTag(),
+		SignerName: "example.",
+	}
+	err := sig.Sign(zone.signer, rrset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// add registers the answer of name and qtype, signing both sections when signed
+func (zone *signedZone) add(t *testing.T, name string, qtype uint16, answer []dns.RR, ns []dns.RR, signed bool) {
+	var m *dns.Msg = new(dns.Msg)
+	m.Answer = answer
+	m.Ns = ns
+	if signed && len(answer) > 0 {
+		m.Answer = append(m.Answer, zone.sign(t, answer))
+	}
+	if signed && len(ns) > 0 {
+		m.Ns = append(m.Ns, zone.sign(t, ns))
+	}
+	zone.answers[name+"/"+dns.TypeToString[qtype]] = m
+}
+
+// Query answers from the registered answers
+func (zone *signedZone) Query(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&zone.queries, 1)
+	question := queryM.Question[0]
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.SetReply(queryM)
+	if m, ok := zone.answers[strings.ToLower(question.Name)+"/"+dns.TypeToString[question.Qtype]]; ok {
+		responseM.Answer = append(responseM.Answer, m.Answer...)
+		responseM.Ns = append(responseM.Ns, m.Ns...)
+	}
+	return responseM, nil
+}
+
+// newValidatingClient returns a client validating against the key of zone
+func newValidatingClient(t *testing.T, zone *signedZone) *Client {
+	client := newTestClient(t)
+	client.ValidateDNSSEC = true
+	client.TrustAnchors = []*dns.DS{zone.key.ToDS(dns.SHA256)}
+	client.AddServer(stubServer("signed", zone.Query))
+	return client
+}
+
+func TestValidateSignedAnswer(t *testing.T) {
+	zone := newSignedZone(t)
+	client := newValidatingClient(t, zone)
+
+	queryM := newQuery("www.example", dns.TypeA)
+	queryM.SetEdns0(1232, true)
+	responseM, err := client.Resolve(queryM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeSuccess || !responseM.AuthenticatedData {
+		t.Errorf("answered %s with AD %v, want a secure answer", dns.RcodeToString[responseM.Rcode], responseM.AuthenticatedData)
+	}
+}
+
+func TestValidateTamperedAnswer(t *testing.T) {
+	zone := newSignedZone(t)
+	tampered := zone.answers["www.example./A"]
+	tampered.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.99").To4()
+	client := newValidatingClient(t, zone)
+
+	queryM := newQuery("www.example", dns.TypeA)
+	queryM.SetEdns0(1232, true)
+	responseM, err := client.Resolve(queryM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("tampered answer got %s, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+	}
+	if ede := extendedError(responseM); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeDNSBogus {
+		t.Errorf("EDE %v, want DNSSEC bogus", ede)
+	}
+}
+
+func TestValidateForeignSigner(t *testing.T) {
+	zone := newSignedZone(t)
+	// a record outside example. signed with the keys of example.
+	zone.add(t, "bank.test.", dns.TypeA, []dns.RR{newA("bank.test.", "192.0.2.66")}, nil, true)
+	client := newValidatingClient(t, zone)
+
+	queryM := newQuery("bank.test", dns.TypeA)
+	queryM.SetEdns0(1232, true)
+	responseM, err := client.Resolve(queryM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeServerFailure || responseM.AuthenticatedData {
+		t.Errorf("answered %s with AD %v, want SERVFAIL for a signer outside the owner", dns.RcodeToString[responseM.Rcode], responseM.AuthenticatedData)
+	}
+}
+
+func TestValidateNegativeAnswers(t *testing.T) {
+	zone := newSignedZone(t)
+	zone.add(t, "nodata.example.", dns.TypeAAAA, nil, []dns.RR{newNSEC("nodata.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)}, true)
+	client := newValidatingClient(t, zone)
+
+	tests := []struct {
+		name   string
+		rcode  int
+		secure bool
+		reason string
+	}{
+		{"nodata.example.", dns.RcodeSuccess, true, "with a signed denial"},
+		{"empty.example.", dns.RcodeServerFailure, false, "with empty sections in the signed zone"},
+		{"empty.insecure.example.", dns.RcodeSuccess, false, "with empty sections below a proven insecure delegation"},
+	}
+	for _, test := range tests {
+		responseM, err := client.Resolve(newQuery(test.name, dns.TypeAAAA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseM.Rcode != test.rcode || responseM.AuthenticatedData != test.secure {
+			t.Errorf("%s answered %s with AD %v, want %s with AD %v for a negative answer %s", test.name, dns.RcodeToString[responseM.Rcode],
+				responseM.AuthenticatedData, dns.RcodeToString[test.rcode], test.secure, test.reason)
+		}
+	}
+}
+
+func TestValidateUnsignedAnswers(t *testing.T) {
+	zone := newSignedZone(t)
+	client := newValidatingClient(t, zone)
+
+	tests := []struct {
+		name   string
+		rcode  int
+		reason string
+	}{
+		{"host.insecure.example.", dns.RcodeSuccess, "below a proven insecure delegation"},
+		{"unsigned.example.", dns.RcodeServerFailure, "unsigned inside the signed zone"},
+		{"host.stripped.example.", dns.RcodeServerFailure, "without a denial of DS"},
+	}
+	for _, test := range tests {
+		responseM, err := client.Resolve(newQuery(test.name, dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseM.Rcode != test.rcode {
+			t.Errorf("%s answered %s, want %s for data %s", test.name, dns.RcodeToString[responseM.Rcode], dns.RcodeToString[test.rcode], test.reason)
+		}
+		if responseM.AuthenticatedData {
+			t.Errorf("%s answered as secure", test.name)
+		}
+	}
+
+	// the insecure proof is cached
+	before := atomic.LoadInt32(&zone.queries)
+	client.Resolve(newQuery("host.insecure.example.", dns.TypeA))
+	if queries := atomic.LoadInt32(&zone.queries) - before; queries != 1 {
+		t.Errorf("%d upstream queries, want the insecure proof to be reused", queries)
+	}
+}
+
+func TestValidationStripsSignaturesBeforeCaching(t *testing.T) {
+	zone := newSignedZone(t)
+	client := newValidatingClient(t, zone)
+	client.Cache = NewMemoryCache()
+
+	for i := 0; i < 2; i++ {
+		responseM, err := client.Resolve(newQuery("www.example", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rr := range responseM.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				t.Errorf("query %d without DO got a signature", i)
+			}
+		}
+	}
+	if client.Stats().CacheHits != 1 {
+		t.Fatal("second query was not answered from the cache")
+	}
+
+	queryM := newQuery("www.example", dns.TypeA)
+	queryM.SetEdns0(1232, true)
+	responseM, err := client.Resolve(queryM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := false
+	for _, rr := range responseM.Answer {
+		signed = signed || rr.Header().Rrtype == dns.TypeRRSIG
+	}
+	if !signed {
+		t.Error("DO query was answered from the stripped entry")
+	}
+}
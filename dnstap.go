@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+// startDnstap connects the dnstap output to the unix socket at client.DnstapSocket
+func (client *Client) startDnstap() error {
+	addr, err := net.ResolveUnixAddr("unix", client.DnstapSocket)
+	if err != nil {
+		return err
+	}
+
+	output, err := dnstap.NewFrameStreamSockOutput(addr)
+	if err != nil {
+		return err
+	}
+	client.dnstapOutput = output
+	go client.dnstapOutput.RunOutputLoop()
+
+	log.WithFields(log.Fields{"Socket": client.DnstapSocket}).Info("Client dnstap output running")
+	return nil
+}
+
+// stopDnstap flushes and closes the dnstap output
+func (client *Client) stopDnstap() {
+	if client.dnstapOutput == nil {
+		return
+	}
+	client.dnstapOutput.Close()
+	client.dnstapOutput = nil
+}
+
+// emitDnstap sends a dnstap frame for a message exchanged with a downstream client
+// msgType should be either dnstap.Message_CLIENT_QUERY or dnstap.Message_CLIENT_RESPONSE
+func (client *Client) emitDnstap(msgType dnstap.Message_Type, addr net.Addr, data []byte, queryTime time.Time) {
+	if client.dnstapOutput == nil {
+		return
+	}
+
+	socketProtocol := dnstap.SocketProtocol_UDP
+	message := &dnstap.Message{
+		Type:           &msgType,
+		SocketProtocol: &socketProtocol,
+	}
+
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		socketFamily, ip := dnstapAddress(udpAddr.IP)
+		port := uint32(udpAddr.Port)
+		message.SocketFamily = &socketFamily
+		message.QueryAddress = ip
+		message.QueryPort = &port
+	}
+
+	client.sendDnstap(message, msgType == dnstap.Message_CLIENT_QUERY, data, queryTime)
+}
+
+// emitResolverDnstap sends a dnstap frame for a message exchanged with an upstream resolver
+// msgType should be either dnstap.Message_RESOLVER_QUERY or dnstap.Message_RESOLVER_RESPONSE
+func (client *Client) emitResolverDnstap(msgType dnstap.Message_Type, resolver *Server, m *dns.Msg, queryTime time.Time) {
+	if client.dnstapOutput == nil || m == nil {
+		return
+	}
+	data, err := m.Pack()
+	if err != nil {
+		return
+	}
+
+	var socketProtocol dnstap.SocketProtocol
+	switch resolver.protocol() {
+	case "udp":
+		socketProtocol = dnstap.SocketProtocol_UDP
+	case "tcp":
+		socketProtocol = dnstap.SocketProtocol_TCP
+	case "tcp-tls":
+		socketProtocol = dnstap.SocketProtocol_DOT
+	default:
+		socketProtocol = dnstap.SocketProtocol_DOH
+	}
+	message := &dnstap.Message{
+		Type:           &msgType,
+		SocketProtocol: &socketProtocol,
+	}
+
+	// DoH upstreams are urls, only those addressed by ip have a response address
+	if ip := net.ParseIP(resolver.Upstream); ip != nil {
+		socketFamily, address := dnstapAddress(ip)
+		port := uint32(resolver.Port)
+		message.SocketFamily = &socketFamily
+		message.ResponseAddress = address
+		message.ResponsePort = &port
+	}
+
+	client.sendDnstap(message, msgType == dnstap.Message_RESOLVER_QUERY, data, queryTime)
+}
+
+// dnstapAddress returns the dnstap socket family of ip and its 4 or 16 byte form
+func dnstapAddress(ip net.IP) (dnstap.SocketFamily, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return dnstap.SocketFamily_INET, ip4
+	}
+	return dnstap.SocketFamily_INET6, ip.To16()
+}
+
+// sendDnstap completes message with data and its timestamps and hands the frame to the output
+// Frames are dropped and counted rather than blocking resolution when the collector falls behind
+func (client *Client) sendDnstap(message *dnstap.Message, isQuery bool, data []byte, queryTime time.Time) {
+	querySec := uint64(queryTime.Unix())
+	queryNsec := uint32(queryTime.Nanosecond())
+	message.QueryTimeSec = &querySec
+	message.QueryTimeNsec = &queryNsec
+
+	if isQuery {
+		message.QueryMessage = data
+	} else {
+		now := time.Now()
+		responseSec := uint64(now.Unix())
+		responseNsec := uint32(now.Nanosecond())
+		message.ResponseTimeSec = &responseSec
+		message.ResponseTimeNsec = &responseNsec
+		message.ResponseMessage = data
+	}
+
+	frameType := dnstap.Dnstap_MESSAGE
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Type:    &frameType,
+		Message: message,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Client failed to marshal dnstap frame")
+		return
+	}
+
+	select {
+	case client.dnstapOutput.GetOutputChannel() <- frame:
+	default:
+		atomic.AddUint64(&client.stats.dnstapDropped, 1)
+	}
+}
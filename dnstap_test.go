@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDnstapFrames(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "dnstap.sock")
+	input, err := dnstap.NewFrameStreamSockInputFromPath(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan []byte, 16)
+	go input.ReadInto(frames)
+
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.10")))
+	client.DnstapSocket = socket
+	err = client.startDnstap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, _ := newQuery("example.com", dns.TypeA).Pack()
+	_, err = client.ResolveSync(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.stopDnstap()
+
+	want := []dnstap.Message_Type{
+		dnstap.Message_CLIENT_QUERY,
+		dnstap.Message_RESOLVER_QUERY,
+		dnstap.Message_RESOLVER_RESPONSE,
+		dnstap.Message_CLIENT_RESPONSE,
+	}
+	for _, msgType := range want {
+		select {
+		case frame := <-frames:
+			var tap dnstap.Dnstap
+			err = proto.Unmarshal(frame, &tap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message := tap.GetMessage()
+			if message.GetType() != msgType {
+				t.Fatalf("frame type %v, want %v", message.GetType(), msgType)
+			}
+			if message.QueryTimeSec == nil {
+				t.Errorf("%v frame has no query time", msgType)
+			}
+			data := message.GetQueryMessage()
+			if msgType == dnstap.Message_CLIENT_RESPONSE || msgType == dnstap.Message_RESOLVER_RESPONSE {
+				data = message.GetResponseMessage()
+			}
+			var m dns.Msg
+			if m.Unpack(data) != nil || len(m.Question) != 1 || m.Question[0].Name != "example.com." {
+				t.Errorf("%v frame does not carry the message", msgType)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %v frame", msgType)
+		}
+	}
+}
+
+func TestDnstapDropsWhenCollectorBehind(t *testing.T) {
+	client := newTestClient(t)
+	client.DnstapSocket = filepath.Join(t.TempDir(), "missing.sock")
+	// the output loop is not running, so nothing drains the output channel
+	output, err := dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: client.DnstapSocket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.dnstapOutput = output
+
+	query, _ := newQuery("example.com", dns.TypeA).Pack()
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			client.emitDnstap(dnstap.Message_CLIENT_QUERY, nil, query, time.Now())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("emitDnstap blocked on a full output")
+	}
+	if atomic.LoadUint64(&client.stats.dnstapDropped) == 0 {
+		t.Error("dropped frames were not counted")
+	}
+	if client.Status().DnstapDropped == 0 {
+		t.Error("dropped frames missing from the status")
+	}
+}
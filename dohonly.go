@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPlaintextUpstream is returned when DoHOnly is set and a resolver would send queries unencrypted
+var ErrPlaintextUpstream = errors.New("Plaintext DNS upstream forbidden by DoHOnly")
+
+// plaintext reports whether queries to the server travel unencrypted, i.e. DNS over udp or tcp
+// DoH, DNS over TLS and DNSCrypt upstreams are encrypted
+func (server *Server) plaintext() bool {
+	return server.Transport == nil && server.isDNS() && server.Net != "tcp-tls"
+}
+
+// checkEncrypted returns an error naming the first of the servers, or of their fallbacks, which is plaintext
+// Every server passes when DoHOnly is not set
+func (client *Client) checkEncrypted(servers []Server) error {
+	if !client.DoHOnly {
+		return nil
+	}
+	for i := range servers {
+		for server := &servers[i]; server != nil; server = server.Fallback {
+			if server.plaintext() {
+				err := fmt.Errorf("%w: %s (%s:%d)", ErrPlaintextUpstream, server.Name, server.Upstream, server.Port)
+				log.WithFields(log.Fields{"Resolver": server.Name, "Upstream": server.Upstream, "Port": server.Port}).Error("Rejected plaintext DNS upstream")
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDoHOnlyRejectsPlaintext(t *testing.T) {
+	client := newTestClient(t)
+	client.DoHOnly = true
+	client.AddUpstream("doh", "192.0.2.1", 443)
+	client.AddDNSUpstream("dot", "192.0.2.2", 853, "tcp-tls")
+	if client.Err != nil {
+		t.Fatalf("encrypted upstreams rejected: %v", client.Err)
+	}
+
+	client.AddDNSUpstream("plain", "192.0.2.3", 53, "udp")
+	if !errors.Is(client.Err, ErrPlaintextUpstream) || !strings.Contains(client.Err.Error(), "plain") {
+		t.Errorf("error %v, want ErrPlaintextUpstream naming the resolver", client.Err)
+	}
+	client.Err = nil
+	client.AddFallback("plainfallback", "192.0.2.4", 53)
+	if !errors.Is(client.Err, ErrPlaintextUpstream) || !strings.Contains(client.Err.Error(), "plainfallback") {
+		t.Errorf("error %v, want ErrPlaintextUpstream naming the fallback", client.Err)
+	}
+	if resolvers := client.resolverList(); len(resolvers) != 2 || len(client.fallbackList()) != 0 {
+		t.Errorf("%d resolvers and %d fallbacks, want the plaintext ones left out", len(resolvers), len(client.fallbackList()))
+	}
+}
+
+func TestDoHOnlyConfig(t *testing.T) {
+	client := newTestClient(t)
+	client.DoHOnly = true
+	err := client.LoadConfig(writeConfig(t, `{"upstreams": [
+		{"name": "doh", "upstream": "192.0.2.1", "port": 443},
+		{"name": "leaky", "upstream": "192.0.2.2", "port": 53, "net": "udp"}
+	]}`))
+	if !errors.Is(err, ErrPlaintextUpstream) || !strings.Contains(err.Error(), "leaky") {
+		t.Errorf("error %v, want ErrPlaintextUpstream naming the resolver", err)
+	}
+	if len(client.resolverList()) != 0 {
+		t.Errorf("%d resolvers, want the rejected config not applied", len(client.resolverList()))
+	}
+}
+
+func TestDoHOnlySetAfterAdding(t *testing.T) {
+	client := newTestClient(t)
+	client.AddDNSUpstream("plain", "192.0.2.3", 53, "udp")
+	client.DoHOnly = true
+	err := client.StartProxy()
+	if !errors.Is(err, ErrPlaintextUpstream) {
+		t.Errorf("error %v, want StartProxy to refuse the plaintext resolver", err)
+	}
+}
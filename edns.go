@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// block size responses are padded to (RFC 8467)
+var EDNS_PADDING_BLOCK int = 468
+
+// EDNS option code of the debug annotation, from the local use range (RFC 6891)
+var EDNS_DEBUG_OPTION uint16 = 65001
+
+// owner name of the debug annotation TXT record sent to clients without EDNS
+var DEBUG_ANNOTATION_NAME string = "debug.doh-proxy."
+
+// ErrBadCookie is returned for a query with a malformed COOKIE option (RFC 7873)
+var ErrBadCookie = errors.New("Malformed EDNS cookie")
+
+// ednsOptions are the client EDNS options handled by the proxy instead of the upstream
+type ednsOptions struct {
+	// client cookie in hex, empty when the client sent none
+	clientCookie string
+
+	// the client sent a padding option
+	padding bool
+}
+
+// stripEDNS removes the COOKIE, PADDING and NSID options from the query
+// Cookies are answered by the proxy, the others are not forwarded upstream
+func stripEDNS(queryM *dns.Msg) (ednsOptions, error) {
+	var options ednsOptions
+	opt := queryM.IsEdns0()
+	if opt == nil {
+		return options, nil
+	}
+
+	var kept []dns.EDNS0
+	for _, option := range opt.Option {
+		switch o := option.(type) {
+		case *dns.EDNS0_COOKIE:
+			// 8 bytes of client cookie, optionally followed by 8 to 32 bytes of server cookie
+			cookie, err := hex.DecodeString(o.Cookie)
+			if err != nil || len(cookie) < 8 || (len(cookie) > 8 && len(cookie) < 16) || len(cookie) > 40 {
+				return options, ErrBadCookie
+			}
+			options.clientCookie = hex.EncodeToString(cookie[:8])
+		case *dns.EDNS0_PADDING:
+			options.padding = true
+		case *dns.EDNS0_NSID:
+		default:
+			kept = append(kept, option)
+		}
+	}
+	opt.Option = kept
+	return options, nil
+}
+
+// newCookieSecret generates the key server cookies are derived from
+func newCookieSecret() []byte {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Failed to generate cookie secret")
+	}
+	return secret
+}
+
+// serverCookie derives the server cookie of a client cookie and address
+// The same client always gets the same cookie until the proxy restarts
+func (client *Client) serverCookie(clientCookie string, addr net.Addr) string {
+	mac := hmac.New(sha256.New, client.cookieSecret)
+	mac.Write([]byte(clientCookie))
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		mac.Write(a.IP)
+	case *net.TCPAddr:
+		mac.Write(a.IP)
+	}
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// applyEDNS answers the options stripped from the query
+// The client cookie is echoed with a server cookie, upstream cookies and padding are removed
+func (client *Client) applyEDNS(responseM *dns.Msg, options ednsOptions, addr net.Addr) {
+	opt := responseM.IsEdns0()
+	if opt != nil {
+		var kept []dns.EDNS0
+		for _, option := range opt.Option {
+			switch o := option.(type) {
+			case *dns.EDNS0_COOKIE, *dns.EDNS0_PADDING:
+			case *dns.EDNS0_LOCAL:
+				// an annotation of another proxy upstream
+				if o.Code != EDNS_DEBUG_OPTION {
+					kept = append(kept, option)
+				}
+			default:
+				kept = append(kept, option)
+			}
+		}
+		opt.Option = kept
+	}
+
+	if options.clientCookie == "" {
+		return
+	}
+	if opt == nil {
+		responseM.SetEdns0(dns.DefaultMsgSize, false)
+		opt = responseM.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: options.clientCookie + client.serverCookie(options.clientCookie, addr),
+	})
+}
+
+// annotateResponse attaches the upstream which answered and how long the query took
+// as a local EDNS option, or as a CHAOS TXT record in the additional section for clients without EDNS
+// upstream is empty for answers from the cache or local data
+func annotateResponse(queryM *dns.Msg, responseM *dns.Msg, upstream string, elapsed time.Duration) {
+	if upstream == "" {
+		upstream = "local"
+	}
+	text := fmt.Sprintf("upstream=%s latency=%.3fms", upstream, float64(elapsed.Microseconds())/1000)
+
+	if queryM.IsEdns0() == nil {
+		responseM.Extra = append(responseM.Extra, &dns.TXT{
+			Hdr: dns.RR_Header{Name: DEBUG_ANNOTATION_NAME, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{text},
+		})
+		return
+	}
+	opt := responseM.IsEdns0()
+	if opt == nil {
+		responseM.SetEdns0(dns.DefaultMsgSize, false)
+		opt = responseM.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS_DEBUG_OPTION, Data: []byte(text)})
+}
+
+// padResponse pads the response to a multiple of EDNS_PADDING_BLOCK (RFC 7830)
+// The response is left unpadded if padding would exceed limit
+func padResponse(responseM *dns.Msg, limit int) {
+	if responseM.IsEdns0() == nil {
+		// the client sent an OPT record for the padding option, answer with one
+		responseM.SetEdns0(uint16(limit), false)
+	}
+	padMessage(responseM, EDNS_PADDING_BLOCK, limit)
+}
+
+// padQuery pads an outgoing query to a multiple of block, adding an OPT record if needed
+// Padding already present is replaced
+func padQuery(queryM *dns.Msg, block int) {
+	opt := queryM.IsEdns0()
+	if opt == nil {
+		queryM.SetEdns0(dns.DefaultMsgSize, false)
+		opt = queryM.IsEdns0()
+	}
+	var kept []dns.EDNS0
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_PADDING); !ok {
+			kept = append(kept, option)
+		}
+	}
+	opt.Option = kept
+	padMessage(queryM, block, dns.MaxMsgSize)
+}
+
+// padMessage adds a padding option bringing the message to a multiple of block bytes
+// The message is left unpadded if padding would exceed limit
+func padMessage(m *dns.Msg, block int, limit int) {
+	opt := m.IsEdns0()
+	if opt == nil || block <= 0 {
+		return
+	}
+
+	// the option header takes 4 bytes
+	size := m.Len() + 4
+	padding := 0
+	if size%block != 0 {
+		padding = block - size%block
+	}
+	if size+padding > limit {
+		return
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
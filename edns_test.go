@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// answerFrom resolves queryM as if it was received from addr
+func answerFrom(t *testing.T, client *Client, queryM *dns.Msg, addr net.Addr) ([]byte, *dns.Msg) {
+	t.Helper()
+	query, err := queryM.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.answer(addr, query, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseM *dns.Msg = new(dns.Msg)
+	err = responseM.Unpack(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, responseM
+}
+
+// cookieQuery returns a query carrying cookie as its COOKIE option
+func cookieQuery(cookie string) *dns.Msg {
+	queryM := newQuery("example.com", dns.TypeA)
+	queryM.SetEdns0(1232, false)
+	opt := queryM.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return queryM
+}
+
+// responseCookie returns the COOKIE option of the response, empty without one
+func responseCookie(responseM *dns.Msg) string {
+	opt := responseM.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+			return cookie.Cookie
+		}
+	}
+	return ""
+}
+
+func TestCookieEcho(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	clientCookie := "0102030405060708"
+	udp := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+	tcp := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40000}
+	other := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 40000}
+
+	_, responseM := answerFrom(t, client, cookieQuery(clientCookie), udp)
+	cookie := responseCookie(responseM)
+	if len(cookie) != 32 || !strings.HasPrefix(cookie, clientCookie) {
+		t.Fatalf("cookie %q, want the client cookie followed by an 8 byte server cookie", cookie)
+	}
+
+	// the server cookie depends on the client ip, whatever the transport
+	_, responseM = answerFrom(t, client, cookieQuery(clientCookie), tcp)
+	if tcpCookie := responseCookie(responseM); tcpCookie != cookie {
+		t.Errorf("cookie over tcp %q, want %q as over udp", tcpCookie, cookie)
+	}
+	_, responseM = answerFrom(t, client, cookieQuery(clientCookie), other)
+	if otherCookie := responseCookie(responseM); otherCookie == cookie {
+		t.Error("clients with different ips got the same server cookie")
+	}
+
+	// a returning client sends the server cookie back
+	_, responseM = answerFrom(t, client, cookieQuery(cookie), udp)
+	if responseM.Rcode != dns.RcodeSuccess || responseCookie(responseM) != cookie {
+		t.Errorf("rcode %s cookie %q, want NOERROR and the same cookie", dns.RcodeToString[responseM.Rcode], responseCookie(responseM))
+	}
+}
+
+func TestMalformedCookie(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	addr := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+	// too short a client cookie, and a server cookie shorter than 8 bytes
+	for _, cookie := range []string{"0102", "0102030405060708aabb"} {
+		_, responseM := answerFrom(t, client, cookieQuery(cookie), addr)
+		if responseM.Rcode != dns.RcodeFormatError {
+			t.Errorf("cookie %s answered %s, want FORMERR", cookie, dns.RcodeToString[responseM.Rcode])
+		}
+	}
+}
+
+func TestResponsePadding(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	client.PadResponses = true
+	addr := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40000}
+
+	queryM := newQuery("example.com", dns.TypeA)
+	queryM.SetEdns0(1232, false)
+	opt := queryM.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+	response, _ := answerFrom(t, client, queryM, addr)
+	if len(response)%EDNS_PADDING_BLOCK != 0 {
+		t.Errorf("padded response of %d bytes, want a multiple of %d", len(response), EDNS_PADDING_BLOCK)
+	}
+
+	// clients which did not ask for padding are not padded
+	response, _ = answerFrom(t, client, newQuery("example.com", dns.TypeA), addr)
+	if len(response)%EDNS_PADDING_BLOCK == 0 {
+		t.Errorf("unrequested padding, response of %d bytes", len(response))
+	}
+}
+
+// debugOption returns the debug annotation option of the response, empty without one
+func debugOption(responseM *dns.Msg) string {
+	opt := responseM.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == EDNS_DEBUG_OPTION {
+			return string(local.Data)
+		}
+	}
+	return ""
+}
+
+func TestDebugAnnotate(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		responseM := answerA(queryM, "192.0.2.1")
+		if queryM.IsEdns0() != nil {
+			// an annotation added by another proxy upstream
+			responseM.SetEdns0(1232, false)
+			responseM.IsEdns0().Option = append(responseM.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: EDNS_DEBUG_OPTION, Data: []byte("upstream=other")})
+		}
+		return responseM, nil
+	}))
+	addr := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+	ednsQuery := func() *dns.Msg {
+		queryM := newQuery("example.com", dns.TypeA)
+		queryM.SetEdns0(1232, false)
+		return queryM
+	}
+
+	// nothing is attached unless asked for
+	_, responseM := answerFrom(t, client, ednsQuery(), addr)
+	if annotation := debugOption(responseM); annotation != "" {
+		t.Errorf("annotation %q with DebugAnnotate off", annotation)
+	}
+
+	client.DebugAnnotate = true
+	_, responseM = answerFrom(t, client, ednsQuery(), addr)
+	if annotation := debugOption(responseM); !strings.HasPrefix(annotation, "upstream=stub latency=") || !strings.HasSuffix(annotation, "ms") {
+		t.Errorf("annotation %q, want the upstream and latency", annotation)
+	}
+
+	// clients without EDNS get a CHAOS TXT record
+	_, responseM = answerFrom(t, client, newQuery("example.com", dns.TypeA), addr)
+	if len(responseM.Extra) != 1 {
+		t.Fatalf("additional %v, want the annotation record", responseM.Extra)
+	}
+	txt, ok := responseM.Extra[0].(*dns.TXT)
+	if !ok || txt.Hdr.Name != DEBUG_ANNOTATION_NAME || txt.Hdr.Class != dns.ClassCHAOS || !strings.HasPrefix(txt.Txt[0], "upstream=stub") {
+		t.Errorf("annotation %v, want a CHAOS TXT record", responseM.Extra[0])
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variables read by InitFromEnv
+var ENV_LISTEN_IP string = "DOH_LISTEN_IP"     // listen ip, 127.0.0.1 when unset
+var ENV_LISTEN_PORT string = "DOH_LISTEN_PORT" // listen port, 53 when unset
+var ENV_WORKERS string = "DOH_WORKERS"         // resolver workers, the number of CPUs when unset
+var ENV_UPSTREAMS string = "DOH_UPSTREAMS"     // comma separated name=upstream:port:format entries
+var ENV_REUSE_PORT string = "DOH_REUSE_PORT"   // true to share the listen port with other processes, false when unset
+
+// InitFromEnv initializes the client with a memory cache from environment variables, for container deployments
+// Each DOH_UPSTREAMS entry is name=upstream:port:format, e.g. Google=dns.google/resolve:443:json,Quad9=9.9.9.9:53:udp
+// format is json or wire-get for DoH upstreams and udp, tcp or tcp-tls for DNS upstreams
+// Nothing is changed if a variable is invalid
+func (client *Client) InitFromEnv() error {
+	ip := "127.0.0.1"
+	if value := strings.TrimSpace(os.Getenv(ENV_LISTEN_IP)); value != "" {
+		if net.ParseIP(value) == nil {
+			return envError(ENV_LISTEN_IP, value, "not an ip address")
+		}
+		ip = value
+	}
+
+	port := 53
+	if value := strings.TrimSpace(os.Getenv(ENV_LISTEN_PORT)); value != "" {
+		var err error
+		port, err = strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return envError(ENV_LISTEN_PORT, value, "not a port number")
+		}
+	}
+
+	workers := 0
+	if value := strings.TrimSpace(os.Getenv(ENV_WORKERS)); value != "" {
+		var err error
+		workers, err = strconv.Atoi(value)
+		if err != nil || workers < 1 {
+			return envError(ENV_WORKERS, value, "not a positive number")
+		}
+	}
+
+	reusePort := false
+	if value := strings.TrimSpace(os.Getenv(ENV_REUSE_PORT)); value != "" {
+		var err error
+		reusePort, err = strconv.ParseBool(value)
+		if err != nil {
+			return envError(ENV_REUSE_PORT, value, "not a boolean")
+		}
+	}
+
+	var upstreams []Server
+	for _, entry := range strings.Split(os.Getenv(ENV_UPSTREAMS), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		server, err := parseEnvUpstream(entry)
+		if err != nil {
+			return envError(ENV_UPSTREAMS, entry, err.Error())
+		}
+		upstreams = append(upstreams, server)
+	}
+
+	client.Init(ip, port, NewMemoryCache())
+	if workers > 0 {
+		client.Num = workers
+	}
+	client.ReusePort = reusePort
+	for _, server := range upstreams {
+		client.AddServer(server)
+	}
+	log.WithFields(log.Fields{"IP": ip, "Port": port, "Workers": client.Num, "Upstreams": len(upstreams), "ReusePort": reusePort}).Info("Client initialized from environment")
+	return nil
+}
+
+// parseEnvUpstream parses a name=upstream:port:format entry of DOH_UPSTREAMS
+// upstream may itself contain colons, e.g. https://dns.google/resolve
+func parseEnvUpstream(entry string) (Server, error) {
+	var server Server
+	i := strings.Index(entry, "=")
+	if i <= 0 {
+		return server, errors.New("expected name=upstream:port:format")
+	}
+	name, rest := entry[:i], entry[i+1:]
+
+	j := strings.LastIndex(rest, ":")
+	if j < 0 {
+		return server, errors.New("expected name=upstream:port:format")
+	}
+	format := rest[j+1:]
+	k := strings.LastIndex(rest[:j], ":")
+	if k <= 0 {
+		return server, errors.New("expected name=upstream:port:format")
+	}
+	upstream := rest[:k]
+	port, err := strconv.Atoi(rest[k+1 : j])
+	if err != nil || port < 1 || port > 65535 {
+		return server, errors.New("invalid port " + rest[k+1:j])
+	}
+
+	server.Name = name
+	server.Init(upstream, port)
+	switch format {
+	case DOH_JSON, DOH_WIRE_GET:
+		if port != 443 {
+			return server, errors.New("DoH upstreams must use port 443")
+		}
+		server.SetMethod(format)
+	case "udp":
+		if port != 53 {
+			return server, errors.New("udp upstreams must use port 53")
+		}
+	case "tcp", "tcp-tls":
+		server.SetNet(format)
+	default:
+		return server, errors.New("unknown format " + format)
+	}
+	return server, nil
+}
+
+// envError logs and returns an error for an invalid environment variable
+func envError(name string, value string, reason string) error {
+	log.WithFields(log.Fields{"Variable": name, "Value": value}).Error("Invalid environment variable: " + reason)
+	return errors.New("Invalid " + name + " " + value + ": " + reason)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"io"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// initFromEnv runs InitFromEnv on a fresh client with logging silenced
+func initFromEnv(t *testing.T) (*Client, error) {
+	var client Client
+	err := client.InitFromEnv()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		if client.ErrLogFile != nil {
+			client.ErrLogFile.Close()
+		}
+	})
+	return &client, err
+}
+
+func TestInitFromEnv(t *testing.T) {
+	t.Setenv(ENV_LISTEN_IP, "0.0.0.0")
+	t.Setenv(ENV_LISTEN_PORT, "5353")
+	t.Setenv(ENV_WORKERS, "3")
+	t.Setenv(ENV_REUSE_PORT, "true")
+	t.Setenv(ENV_UPSTREAMS, "Google=https://dns.google/resolve:443:json, Quad9=9.9.9.9:53:udp,Local=127.0.0.1:853:tcp-tls")
+
+	client, err := initFromEnv(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.IP != "0.0.0.0" || client.Port != 5353 || client.Num != 3 || client.Cache == nil || !client.ReusePort {
+		t.Errorf("listening on %s:%d with %d workers, cache %v, reuse port %t", client.IP, client.Port, client.Num, client.Cache, client.ReusePort)
+	}
+	resolvers := client.resolverList()
+	if len(resolvers) != 3 {
+		t.Fatalf("%d upstreams, want 3", len(resolvers))
+	}
+	for i, want := range []struct {
+		name     string
+		upstream string
+		port     int
+		protocol string
+	}{
+		{"Google", "https://dns.google/resolve", 443, "doh-json"},
+		{"Quad9", "9.9.9.9", 53, "udp"},
+		{"Local", "127.0.0.1", 853, "tcp-tls"},
+	} {
+		resolver := resolvers[i]
+		if resolver.Name != want.name || resolver.Upstream != want.upstream || resolver.Port != want.port || resolver.protocol() != want.protocol {
+			t.Errorf("upstream %s %s:%d %s, want %+v", resolver.Name, resolver.Upstream, resolver.Port, resolver.protocol(), want)
+		}
+	}
+	for i := range resolvers {
+		resolvers[i].retire()
+	}
+}
+
+func TestInitFromEnvDefaults(t *testing.T) {
+	for _, name := range []string{ENV_LISTEN_IP, ENV_LISTEN_PORT, ENV_WORKERS, ENV_REUSE_PORT, ENV_UPSTREAMS} {
+		t.Setenv(name, "")
+	}
+	client, err := initFromEnv(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.IP != "127.0.0.1" || client.Port != 53 || client.Num < 1 || len(client.resolverList()) != 0 || client.ReusePort {
+		t.Errorf("listening on %s:%d with %d workers and %d upstreams", client.IP, client.Port, client.Num, len(client.resolverList()))
+	}
+}
+
+func TestInitFromEnvMalformed(t *testing.T) {
+	for _, invalid := range []struct{ name, value string }{
+		{ENV_LISTEN_IP, "localhost"},
+		{ENV_LISTEN_PORT, "70000"},
+		{ENV_LISTEN_PORT, "dns"},
+		{ENV_WORKERS, "0"},
+		{ENV_REUSE_PORT, "maybe"},
+		{ENV_UPSTREAMS, "Google"},
+		{ENV_UPSTREAMS, "=8.8.8.8:53:udp"},
+		{ENV_UPSTREAMS, "Google=8.8.8.8:x:udp"},
+		{ENV_UPSTREAMS, "Google=8.8.8.8:53:quic"},
+		{ENV_UPSTREAMS, "Google=dns.google/resolve:80:json"},
+		{ENV_UPSTREAMS, "Quad9=9.9.9.9:53:udp,broken"},
+	} {
+		t.Run(invalid.name+"="+invalid.value, func(t *testing.T) {
+			for _, name := range []string{ENV_LISTEN_IP, ENV_LISTEN_PORT, ENV_WORKERS, ENV_REUSE_PORT, ENV_UPSTREAMS} {
+				t.Setenv(name, "")
+			}
+			t.Setenv(invalid.name, invalid.value)
+			client, err := initFromEnv(t)
+			if err == nil {
+				t.Fatal("invalid value accepted")
+			}
+			// nothing is changed
+			if client.IP != "" || client.Num != 0 || len(client.resolverList()) != 0 {
+				t.Errorf("client initialized from an invalid environment")
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// AddStaticHost pins name to ips
+// A and AAAA queries for name are answered locally
+func (client *Client) AddStaticHost(name string, ips ...net.IP) {
+	key := strings.ToLower(dns.Fqdn(name))
+
+	client.hostsLock.Lock()
+	defer client.hostsLock.Unlock()
+	if client.StaticHosts == nil {
+		client.StaticHosts = make(map[string][]net.IP)
+	}
+	client.StaticHosts[key] = append(client.StaticHosts[key], ips...)
+}
+
+// LoadHosts reads a hosts file and pins every name in it
+// Each line is an ip followed by one or more names, # starts a comment
+// Names of a previously loaded hosts file are replaced, those added with AddStaticHost are kept
+func (client *Client) LoadHosts(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Path": path}).Error("Failed to open hosts file")
+		return err
+	}
+	defer file.Close()
+
+	hosts := make(map[string][]net.IP)
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			log.WithFields(log.Fields{"Line": line}).Warn("Invalid ip in hosts file")
+			continue
+		}
+		for _, name := range fields[1:] {
+			key := strings.ToLower(dns.Fqdn(name))
+			hosts[key] = append(hosts[key], ip)
+			count++
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Path": path}).Error("Failed to read hosts file")
+		return err
+	}
+
+	client.hostsLock.Lock()
+	client.fileHosts = hosts
+	client.hostsLock.Unlock()
+
+	log.WithFields(log.Fields{"Path": path, "Hosts": count}).Info("Hosts file loaded")
+	return nil
+}
+
+// staticHost returns the ips StaticHosts pins key to, key being a lowercase fqdn
+// StaticHosts may be set in code with names of any case and without the trailing dot,
+// those are matched by comparing every entry once the normalized key misses
+// Must be called with hostsLock held
+func (client *Client) staticHost(key string) []net.IP {
+	ips, ok := client.StaticHosts[key]
+	if ok {
+		return ips
+	}
+	for name, ips := range client.StaticHosts {
+		if strings.EqualFold(dns.Fqdn(name), key) {
+			return ips
+		}
+	}
+	return nil
+}
+
+// staticAnswer answers A and AAAA queries for pinned names
+// Returns false if the query should be sent upstream
+func (client *Client) staticAnswer(queryM *dns.Msg) (*dns.Msg, bool) {
+	if len(queryM.Question) != 1 {
+		return nil, false
+	}
+	question := queryM.Question[0]
+	if question.Qclass != dns.ClassINET || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
+		return nil, false
+	}
+
+	key := strings.ToLower(dns.Fqdn(question.Name))
+	client.hostsLock.RLock()
+	var ips []net.IP
+	ips = append(ips, client.staticHost(key)...)
+	ips = append(ips, client.fileHosts[key]...)
+	client.hostsLock.RUnlock()
+	if len(ips) == 0 {
+		return nil, false
+	}
+
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.SetReply(queryM)
+	responseM.Authoritative = true
+	responseM.RecursionAvailable = true
+	for _, ip := range ips {
+		header := dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: question.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    client.StaticTTL,
+		}
+		if question.Qtype == dns.TypeA && ip.To4() != nil {
+			responseM.Answer = append(responseM.Answer, &dns.A{Hdr: header, A: ip.To4()})
+		} else if question.Qtype == dns.TypeAAAA && ip.To4() == nil {
+			responseM.Answer = append(responseM.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+
+	// Names pinned only to the other address family are resolved upstream
+	if len(responseM.Answer) == 0 {
+		return nil, false
+	}
+	return responseM, true
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticHost(t *testing.T) {
+	client := newTestClient(t)
+	contacted := false
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		contacted = true
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+	client.AddStaticHost("dev.local", net.ParseIP("10.0.0.5"))
+
+	responseM, err := client.Resolve(newQuery("Dev.Local", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "10.0.0.5" {
+		t.Fatalf("answer %v, want 10.0.0.5", responseM.Answer)
+	}
+	if ttl := responseM.Answer[0].Header().Ttl; ttl != client.StaticTTL {
+		t.Errorf("ttl %d, want %d", ttl, client.StaticTTL)
+	}
+	if contacted {
+		t.Error("pinned name was sent upstream")
+	}
+
+	// the name is pinned to an ipv4 address only
+	_, err = client.Resolve(newQuery("dev.local", dns.TypeAAAA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contacted {
+		t.Error("AAAA query for an ipv4 pinned name was not sent upstream")
+	}
+}
+
+func TestStaticHostsSetInCode(t *testing.T) {
+	client := newTestClient(t)
+	client.StaticHosts = map[string][]net.IP{
+		"dev.local":       {net.ParseIP("10.0.0.5")},
+		"Build.Example.":  {net.ParseIP("10.0.0.6")},
+		"v6.example.com.": {net.ParseIP("fd00::1")},
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		ip    string
+	}{
+		{"dev.local.", dns.TypeA, "10.0.0.5"},
+		{"build.example.", dns.TypeA, "10.0.0.6"},
+		{"V6.example.com.", dns.TypeAAAA, "fd00::1"},
+	}
+	for _, test := range tests {
+		responseM, ok := client.staticAnswer(newQuery(test.name, test.qtype))
+		if !ok {
+			t.Errorf("%s is not answered locally", test.name)
+			continue
+		}
+		var ip net.IP
+		switch rr := responseM.Answer[0].(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip.String() != test.ip {
+			t.Errorf("%s answered %s, want %s", test.name, ip, test.ip)
+		}
+	}
+}
+
+func TestLoadHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(path, []byte("# pinned\n10.0.0.5 dev.local api.dev.local\n2001:db8::5 dev.local\nnot-an-ip broken.local\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t)
+	err = client.LoadHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dev.local", "API.dev.local"} {
+		if _, ok := client.staticAnswer(newQuery(name, dns.TypeA)); !ok {
+			t.Errorf("%s from the hosts file is not answered locally", name)
+		}
+	}
+	responseM, ok := client.staticAnswer(newQuery("dev.local", dns.TypeAAAA))
+	if !ok || len(responseM.Answer) != 1 || !responseM.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::5")) {
+		t.Errorf("AAAA answer %v, want 2001:db8::5", responseM)
+	}
+	if _, ok := client.staticAnswer(newQuery("broken.local", dns.TypeA)); ok {
+		t.Error("line with an invalid ip was loaded")
+	}
+
+	// reloading replaces the previous entries
+	err = os.WriteFile(path, []byte("10.0.0.6 new.local\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.LoadHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.staticAnswer(newQuery("dev.local", dns.TypeA)); ok {
+		t.Error("dev.local still answered after reloading without it")
+	}
+	if _, ok := client.staticAnswer(newQuery("new.local", dns.TypeA)); !ok {
+		t.Error("new.local not answered after reloading")
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long DoH requests use HTTP/2 after an HTTP/3 request failed, before QUIC is tried again
+var HTTP3_RETRY time.Duration = 5 * time.Minute
+
+// how long a QUIC handshake may take, blocked udp usually shows as a handshake that never completes
+var HTTP3_HANDSHAKE_TIMEOUT time.Duration = time.Second
+
+// http3State is the HTTP/3 client of a DoH upstream
+// shared between copies of the server
+type http3State struct {
+	transport *http3.Transport
+	client    http.Client
+
+	// time of the last failed HTTP/3 request, in unix nanoseconds
+	lastFailure int64
+}
+
+// SetHTTP3 sends DoH requests over HTTP/3 (QUIC), falling back to HTTP/2 when QUIC fails
+// Upstreams reached through UpstreamProxy or their own proxy keep HTTP/2, QUIC cannot be proxied
+func (server *Server) SetHTTP3(enabled bool) {
+	server.closeHTTP3()
+	server.UseHTTP3 = enabled
+	if !enabled {
+		return
+	}
+	transport := &http3.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName:         server.Host,
+			ClientSessionCache: server.sessionCache,
+		},
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: HTTP3_HANDSHAKE_TIMEOUT,
+		},
+	}
+	server.h3 = &http3State{
+		transport: transport,
+		client:    http.Client{Transport: transport},
+	}
+}
+
+// closeHTTP3 closes the QUIC connections of the server
+func (server *Server) closeHTTP3() {
+	if server.h3 != nil {
+		server.h3.transport.Close()
+		server.h3 = nil
+	}
+}
+
+// do sends a DoH request over HTTP/3 if enabled and QUIC has not failed lately, over HTTP/2 otherwise
+func (server *Server) do(req *http.Request) (*http.Response, error) {
+	h3 := server.h3
+	if h3 == nil || server.ProxyURL != nil {
+		return server.httpClient.Do(req)
+	}
+	lastFailure := atomic.LoadInt64(&h3.lastFailure)
+	if lastFailure != 0 && time.Since(time.Unix(0, lastFailure)) < HTTP3_RETRY {
+		return server.httpClient.Do(req)
+	}
+
+	resp, err := h3.client.Do(req)
+	if err == nil || errors.Is(err, context.Canceled) {
+		// a cancelled request, e.g. the loser of a race, says nothing about QUIC
+		return resp, err
+	}
+	// a query timing out over QUIC counts as a failure too, or blocked udp would time out every query
+	atomic.StoreInt64(&h3.lastFailure, time.Now().UnixNano())
+	log.WithFields(log.Fields{"Error": err, "Upstream": server.Upstream, "Retry": HTTP3_RETRY}).Warn("HTTP/3 request failed, falling back to HTTP/2")
+	if req.Context().Err() != nil {
+		return nil, err
+	}
+	return server.httpClient.Do(req.Clone(req.Context()))
+}
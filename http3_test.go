@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startStubDoH3 serves handler over https on a localhost port, and over HTTP/3 on the same port if quic is set
+// protocols receives the major HTTP version of every request
+func startStubDoH3(t *testing.T, quic bool) (*httptest.Server, chan int) {
+	t.Helper()
+	protocols := make(chan int, 8)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocols <- r.ProtoMajor
+		jsonAnswer(w, r)
+	})
+	stub := startStubDoH(t, handler)
+	if !quic {
+		return stub, protocols
+	}
+
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(stub.URL, "https://"))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Skipf("udp port %s taken: %v", port, err)
+	}
+	h3 := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(stub.TLS.Clone()),
+	}
+	go h3.Serve(pc)
+	t.Cleanup(func() {
+		h3.Close()
+		pc.Close()
+	})
+	return stub, protocols
+}
+
+// http3Server returns a DoH server for stub sending its requests over HTTP/3
+func http3Server(stub *httptest.Server) Server {
+	server := dohServer("doh3", stub)
+	server.SetHTTP3(true)
+	server.h3.transport.TLSClientConfig.InsecureSkipVerify = true
+	return server
+}
+
+func TestHTTP3(t *testing.T) {
+	stub, protocols := startStubDoH3(t, true)
+	server := http3Server(stub)
+	defer server.closeHTTP3()
+	question := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	for i := 0; i < 2; i++ {
+		responseMap, err := DoH(&server, question)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseMap["Status"] != float64(0) {
+			t.Errorf("response %v", responseMap)
+		}
+		if protocol := <-protocols; protocol != 3 {
+			t.Errorf("request %d over HTTP/%d, want HTTP/3", i, protocol)
+		}
+	}
+}
+
+func TestHTTP3FallsBack(t *testing.T) {
+	original := HTTP3_HANDSHAKE_TIMEOUT
+	HTTP3_HANDSHAKE_TIMEOUT = 200 * time.Millisecond
+	t.Cleanup(func() { HTTP3_HANDSHAKE_TIMEOUT = original })
+
+	// nothing answers quic on the port
+	stub, protocols := startStubDoH3(t, false)
+	server := http3Server(stub)
+	defer server.closeHTTP3()
+	question := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	_, err := DoH(&server, question)
+	if err != nil {
+		t.Fatalf("no fallback to HTTP/2: %v", err)
+	}
+	// the stub speaks HTTP/1.1 over tcp, which the HTTP/2 transport falls back to as well
+	if protocol := <-protocols; protocol == 3 {
+		t.Error("request over HTTP/3, want the tcp transport")
+	}
+
+	// quic is not tried again before HTTP3_RETRY
+	start := time.Now()
+	_, err = DoH(&server, question)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= HTTP3_HANDSHAKE_TIMEOUT {
+		t.Errorf("second request took %s, want HTTP/2 without a quic handshake", elapsed)
+	}
+	if protocol := <-protocols; protocol == 3 {
+		t.Error("request over HTTP/3, want the tcp transport")
+	}
+	if atomic.LoadInt64(&server.h3.lastFailure) == 0 {
+		t.Error("quic failure not recorded")
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// JSONAdapter parses the body of a DoH json response into the fields constructResponseMessage reads
+// Status, TC, RA, Answer, Authority, Additional and Comment, as sent by Google
+// Each provider's deviations from that format live in its own adapter
+type JSONAdapter interface {
+	Parse(body []byte) (map[string]interface{}, error)
+}
+
+// JSONAdapterFunc lets an ordinary function be used as a JSONAdapter
+type JSONAdapterFunc func(body []byte) (map[string]interface{}, error)
+
+// Parse calls adapter(body)
+func (adapter JSONAdapterFunc) Parse(body []byte) (map[string]interface{}, error) {
+	return adapter(body)
+}
+
+// providers whose adapters are built in
+var JSON_GOOGLE string = "google"
+var JSON_CLOUDFLARE string = "cloudflare"
+var JSON_QUAD9 string = "quad9"
+
+// ErrUnknownJSONProvider is returned when no adapter is registered under a provider name
+var ErrUnknownJSONProvider = errors.New("No json adapter registered for that provider")
+
+// registered adapters by lowercase provider name
+var jsonAdapters = map[string]JSONAdapter{
+	JSON_GOOGLE:     JSONAdapterFunc(parseGoogleJSON),
+	JSON_CLOUDFLARE: JSONAdapterFunc(parseCloudflareJSON),
+	JSON_QUAD9:      JSONAdapterFunc(parseGoogleJSON),
+}
+var jsonAdaptersLock sync.RWMutex
+
+// RegisterJSONAdapter makes adapter available to servers whose JSONProvider is provider
+// An adapter registered under the same name is replaced
+func RegisterJSONAdapter(provider string, adapter JSONAdapter) {
+	jsonAdaptersLock.Lock()
+	jsonAdapters[strings.ToLower(provider)] = adapter
+	jsonAdaptersLock.Unlock()
+}
+
+// lookupJSONAdapter returns the adapter registered under provider, the google one when provider is empty
+func lookupJSONAdapter(provider string) (JSONAdapter, error) {
+	if provider == "" {
+		provider = JSON_GOOGLE
+	}
+	jsonAdaptersLock.RLock()
+	adapter, ok := jsonAdapters[strings.ToLower(provider)]
+	jsonAdaptersLock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownJSONProvider
+	}
+	return adapter, nil
+}
+
+// parseGoogleJSON parses the reference format
+// Comment and the edns_client_subnet echo are kept for troubleshooting, other unknown fields are ignored
+func parseGoogleJSON(body []byte) (map[string]interface{}, error) {
+	responseMap := make(map[string]interface{})
+	err := json.Unmarshal(body, &responseMap)
+	if err != nil {
+		return nil, err
+	}
+	return responseMap, nil
+}
+
+// parseCloudflareJSON parses the Google format, where Comment may be a list of strings
+func parseCloudflareJSON(body []byte) (map[string]interface{}, error) {
+	responseMap, err := parseGoogleJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	if comments, ok := responseMap["Comment"].([]interface{}); ok {
+		var lines []string
+		for _, comment := range comments {
+			if line, ok := comment.(string); ok {
+				lines = append(lines, line)
+			}
+		}
+		responseMap["Comment"] = strings.Join(lines, "; ")
+	}
+	return responseMap, nil
+}
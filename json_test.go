@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCloudflareJSONComments(t *testing.T) {
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprint(w, `{"Status":0,"Question":[{"name":"example.com.","type":1}],`+
+			`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.1"}],`+
+			`"Comment":["Blocked by policy","See example.net"]}`)
+	})
+	server := dohServer("cloudflare", stub)
+	err := server.SetJSONProvider("Cloudflare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseMap, err := DoH(&server, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseMap["Comment"] != "Blocked by policy; See example.net" {
+		t.Errorf("comment %v, want the lines joined", responseMap["Comment"])
+	}
+}
+
+func TestRegisterJSONAdapter(t *testing.T) {
+	// a provider wrapping the google format in an envelope
+	RegisterJSONAdapter("Wrapped", JSONAdapterFunc(func(body []byte) (map[string]interface{}, error) {
+		responseMap, err := parseGoogleJSON(body)
+		if err != nil {
+			return nil, err
+		}
+		inner, ok := responseMap["result"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("No result")
+		}
+		return inner, nil
+	}))
+	t.Cleanup(func() {
+		jsonAdaptersLock.Lock()
+		delete(jsonAdapters, "wrapped")
+		jsonAdaptersLock.Unlock()
+	})
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprint(w, `{"result":{"Status":0,"Question":[{"name":"example.com.","type":1}],`+
+			`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.7"}]}}`)
+	})
+	server := dohServer("wrapped", stub)
+	err := server.SetJSONProvider("wrapped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t)
+	client.AddServer(server)
+
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.7" {
+		t.Errorf("answers %v, want the record inside the envelope", responseM.Answer)
+	}
+
+	if err := server.SetJSONProvider("unknown"); err != ErrUnknownJSONProvider {
+		t.Errorf("error %v, want ErrUnknownJSONProvider", err)
+	}
+}
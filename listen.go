@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listenPacket opens the client UDP socket with the configured socket options
+func (client *Client) listenPacket(host string) (net.PacketConn, error) {
+	listenConfig := net.ListenConfig{}
+	if client.ReusePort {
+		listenConfig.Control = func(network string, address string, conn syscall.RawConn) error {
+			var sockErr error
+			err := conn.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	pc, err := listenConfig.ListenPacket(context.Background(), "udp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.UDPReadBufferBytes > 0 {
+		udpConn, ok := pc.(*net.UDPConn)
+		if ok {
+			err = udpConn.SetReadBuffer(client.UDPReadBufferBytes)
+			if err != nil {
+				log.WithFields(log.Fields{"Error": err, "Bytes": client.UDPReadBufferBytes}).Error("Client failed to set UDP read buffer")
+			}
+		}
+	}
+
+	return pc, nil
+}
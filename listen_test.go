@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// number of queries sent back to back in each burst
+const udpBurst = 2000
+
+// benchmarkUDPBurst sends bursts of queries to a socket read only once each burst is sent,
+// the kernel drops what does not fit the receive buffer
+func benchmarkUDPBurst(b *testing.B, bufferBytes int) {
+	client := newTestClient(b)
+	client.UDPReadBufferBytes = bufferBytes
+	pc, err := client.listenPacket("127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pc.Close()
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	query, _ := newQuery("example.com", dns.TypeA).Pack()
+
+	buffer := make([]byte, 1024)
+	sent, received := 0, 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < udpBurst; j++ {
+			_, err = conn.Write(query)
+			if err == nil {
+				sent++
+			}
+		}
+		for {
+			pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+			_, _, err = pc.ReadFrom(buffer)
+			if err != nil {
+				break
+			}
+			received++
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(100*float64(sent-received)/float64(sent), "%lost")
+}
+
+func BenchmarkUDPBurstDefaultBuffer(b *testing.B) {
+	benchmarkUDPBurst(b, 0)
+}
+
+func BenchmarkUDPBurstLargeBuffer(b *testing.B) {
+	benchmarkUDPBurst(b, 8<<20)
+}
+
+func TestListenerClosedWithoutError(t *testing.T) {
+	client := newTestClient(t)
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go client.runListener(0, pc)
+	pc.Close()
+	select {
+	case <-client.ExitChan:
+	case <-time.After(time.Second):
+		t.Fatal("listener still running after its conn was closed")
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= log.ErrorLevel {
+			t.Errorf("%s logged on close: %s", entry.Level, entry.Message)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// prefix of every exported metric
+var METRICS_PREFIX string = "doh_proxy_"
+
+// labelEscaper escapes label values in the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+// header writes the help and type lines of a metric
+func (writer *metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(writer.w, "# HELP %s%s %s\n# TYPE %s%s %s\n", METRICS_PREFIX, name, help, METRICS_PREFIX, name, kind)
+}
+
+// value writes one sample, labels are name and value pairs
+func (writer *metricsWriter) value(name string, value interface{}, labels ...string) {
+	fmt.Fprintf(writer.w, "%s%s", METRICS_PREFIX, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+		}
+		fmt.Fprintf(writer.w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(writer.w, " %v\n", value)
+}
+
+// counter writes a metric with a single sample
+func (writer *metricsWriter) counter(name string, help string, value uint64) {
+	writer.header(name, "counter", help)
+	writer.value(name, value)
+}
+
+// labeled writes a counter with one sample per key of counts, in key order
+func (writer *metricsWriter) labeled(name string, help string, label string, counts map[string]uint64) {
+	writer.header(name, "counter", help)
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writer.value(name, counts[key], label, key)
+	}
+}
+
+// writeMetrics writes the client statistics in the Prometheus text format
+func (client *Client) writeMetrics(w io.Writer) error {
+	status := client.Status()
+	writer := &metricsWriter{w: bufio.NewWriter(w)}
+
+	writer.counter("queries_total", "Queries received.", status.Queries)
+	writer.labeled("queries_by_type_total", "Answered queries by question type.", "qtype", status.QueryTypes)
+	writer.labeled("responses_by_rcode_total", "Answered queries by response code.", "rcode", status.Rcodes)
+	writer.counter("cache_hits_total", "Queries answered from the cache.", status.CacheHits)
+	writer.counter("cache_misses_total", "Cache lookups without an entry.", status.CacheMisses)
+	writer.counter("coalesced_total", "Queries joining an identical upstream request in flight.", status.Coalesced)
+	writer.counter("stale_served_total", "Queries answered from expired cache entries.", status.StaleServed)
+	writer.counter("panics_total", "Queries whose resolution panicked.", status.Panics)
+	writer.counter("dropped_total", "Queries dropped or refused because the lookup queue was full.", status.Dropped)
+	writer.counter("dnstap_dropped_total", "Dnstap frames dropped because the collector fell behind.", status.DnstapDropped)
+
+	upstreams := mergeUpstreams(status.Upstreams)
+	writer.header("upstream_requests_total", "counter", "Requests sent to each upstream.")
+	for _, upstream := range upstreams {
+		writer.value("upstream_requests_total", upstream.Requests, upstream.labels()...)
+	}
+	writer.header("upstream_failures_total", "counter", "Failed requests to each upstream.")
+	for _, upstream := range upstreams {
+		writer.value("upstream_failures_total", upstream.Failures, upstream.labels()...)
+	}
+	writer.header("upstream_healthy", "gauge", "Whether the last requests to the upstream succeeded.")
+	for _, upstream := range upstreams {
+		healthy := 0
+		if upstream.Healthy {
+			healthy = 1
+		}
+		writer.value("upstream_healthy", healthy, upstream.labels()...)
+	}
+	return writer.w.Flush()
+}
+
+// labels identifies the upstream in metric samples
+func (upstream *UpstreamStatus) labels() []string {
+	return []string{"upstream", upstream.Name, "protocol", upstream.Protocol, "address", fmt.Sprintf("%s:%d", upstream.Upstream, upstream.Port)}
+}
+
+// mergeUpstreams sums the statistics of upstreams with the same labels, e.g. one added twice,
+// since a series can only be exported once. The merged upstream is healthy if any of them is
+func mergeUpstreams(upstreams []UpstreamStatus) []UpstreamStatus {
+	merged := make([]UpstreamStatus, 0, len(upstreams))
+	index := make(map[string]int, len(upstreams))
+	for _, upstream := range upstreams {
+		key := strings.Join(upstream.labels(), "\x00")
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			merged = append(merged, upstream)
+			continue
+		}
+		merged[i].Requests += upstream.Requests
+		merged[i].Failures += upstream.Failures
+		merged[i].Healthy = merged[i].Healthy || upstream.Healthy
+	}
+	return merged
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// Handler resolves a query into a response
+type Handler func(queryM *dns.Msg) (*dns.Msg, error)
+
+// Middleware wraps the handler resolving a query
+// It can inspect or modify the query before calling next, answer without calling it,
+// or inspect or modify the response next returns
+type Middleware func(next Handler) Handler
+
+// Use appends a middleware around every resolution
+// Middlewares run in the order they were added: the first one sees the query first and the response last.
+// They wrap the whole resolution, so they also see answers from the cache, static hosts and the zone,
+// unlike rewriters which only see upstream answers before they are cached
+func (client *Client) Use(middleware Middleware) {
+	client.Middlewares = append(client.Middlewares, middleware)
+}
+
+// handler builds the middleware chain ending in resolve
+// Rewrite rules are the innermost middleware, so registered middlewares see the rewritten answers
+func (client *Client) handler(ctx context.Context, resolvers []Server) Handler {
+	handler := Handler(func(queryM *dns.Msg) (*dns.Msg, error) {
+		return client.resolveContext(ctx, queryM, resolvers...)
+	})
+	if client.hasRewriteRules() {
+		handler = client.rewriteRulesMiddleware(handler)
+	}
+	for i := len(client.Middlewares) - 1; i >= 0; i-- {
+		handler = client.Middlewares[i](handler)
+	}
+	return handler
+}
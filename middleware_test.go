@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// rewriteA replaces the addresses of A answers by ip
+func rewriteA(ip string) Middleware {
+	return func(next Handler) Handler {
+		return func(queryM *dns.Msg) (*dns.Msg, error) {
+			responseM, err := next(queryM)
+			if err != nil {
+				return nil, err
+			}
+			for _, rr := range responseM.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					a.A = net.ParseIP(ip).To4()
+				}
+			}
+			return responseM, nil
+		}
+	}
+}
+
+func TestMiddlewareRewritesA(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	client.Use(rewriteA("10.0.0.7"))
+
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if len(responseM.Answer) != 1 || !responseM.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.7")) {
+		t.Errorf("answers %v, want the rewritten address", responseM.Answer)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(queryM *dns.Msg) (*dns.Msg, error) {
+				calls = append(calls, name+" query")
+				responseM, err := next(queryM)
+				calls = append(calls, name+" response")
+				return responseM, err
+			}
+		}
+	}
+	client.Use(record("first"))
+	client.Use(record("second"))
+	// the last middleware added rewrites first, the first one sees its result
+	client.Use(rewriteA("10.0.0.7"))
+
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	want := []string{"first query", "second query", "second response", "first response"}
+	if len(calls) != len(want) {
+		t.Fatalf("calls %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("calls %v, want %v", calls, want)
+			break
+		}
+	}
+	if !responseM.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.7")) {
+		t.Errorf("answer %v, want the rewritten address", responseM.Answer[0])
+	}
+
+	// a middleware can answer without calling the next handler
+	client.Use(func(next Handler) Handler {
+		return func(queryM *dns.Msg) (*dns.Msg, error) {
+			var refusedM *dns.Msg = new(dns.Msg)
+			refusedM.SetRcode(queryM, dns.RcodeRefused)
+			return refusedM, nil
+		}
+	})
+	responseM = resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeRefused {
+		t.Errorf("rcode %s, want REFUSED from the middleware", dns.RcodeToString[responseM.Rcode])
+	}
+}
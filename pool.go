@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+// number of idle connections kept per upstream
+var POOL_SIZE int = 4
+
+// how long an idle connection is kept before being closed
+var POOL_IDLE_TIMEOUT time.Duration = 30 * time.Second
+
+// pooledConn is an idle connection with the time it was last used
+type pooledConn struct {
+	conn     *dns.Conn
+	lastUsed time.Time
+}
+
+// connPool keeps persistent connections to a TCP or DoT upstream
+type connPool struct {
+	// address of the upstream
+	addr string
+
+	// client used to dial and exchange
+	dnsClient *dns.Client
+
+	// idle connections, most recently used last
+	idle []pooledConn
+	lock sync.Mutex
+
+	// maximum number of idle connections
+	size int
+
+	// idle connections older than this are closed
+	idleTimeout time.Duration
+
+	// socks5 dialer used instead of dialing the upstream directly
+	proxyDialer proxy.Dialer
+}
+
+// newConnPool creates an empty pool for the upstream at addr
+func newConnPool(network string, addr string) *connPool {
+	return &connPool{
+		addr: addr,
+		dnsClient: &dns.Client{
+			Net: network,
+		},
+		size:        POOL_SIZE,
+		idleTimeout: POOL_IDLE_TIMEOUT,
+	}
+}
+
+// get returns an idle connection or dials a new one
+func (pool *connPool) get() (*dns.Conn, error) {
+	pool.lock.Lock()
+	for len(pool.idle) > 0 {
+		last := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if time.Since(last.lastUsed) < pool.idleTimeout {
+			pool.lock.Unlock()
+			return last.conn, nil
+		}
+		last.conn.Close()
+	}
+	pool.lock.Unlock()
+
+	return pool.dial()
+}
+
+// setProxy makes the pool dial the upstream through a socks5 proxy
+func (pool *connPool) setProxy(proxyURL *url.URL) error {
+	dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+	if err != nil {
+		return err
+	}
+	pool.proxyDialer = dialer
+	return nil
+}
+
+// dial opens a new connection to the upstream
+func (pool *connPool) dial() (*dns.Conn, error) {
+	if pool.proxyDialer == nil {
+		return pool.dnsClient.Dial(pool.addr)
+	}
+
+	conn, err := pool.proxyDialer.Dial("tcp", pool.addr)
+	if err != nil {
+		return nil, err
+	}
+	if pool.dnsClient.Net == "tcp-tls" {
+		host, _, err := net.SplitHostPort(pool.addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config := &tls.Config{}
+		if pool.dnsClient.TLSConfig != nil {
+			config = pool.dnsClient.TLSConfig.Clone()
+		}
+		config.ServerName = host
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// put returns a healthy connection to the pool
+func (pool *connPool) put(conn *dns.Conn) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if len(pool.idle) >= pool.size {
+		conn.Close()
+		return
+	}
+	pool.idle = append(pool.idle, pooledConn{
+		conn:     conn,
+		lastUsed: time.Now(),
+	})
+}
+
+// exchange sends the query over a pooled connection
+// A failed connection is discarded and the query retried once on a new connection
+func (pool *connPool) exchange(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	err := errors.New("No connection available")
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *dns.Conn
+		conn, err = pool.get()
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Upstream": pool.addr}).Error("Failed to dial upstream")
+			continue
+		}
+
+		var responseM *dns.Msg
+		responseM, _, err = pool.dnsClient.ExchangeWithConnContext(ctx, queryM, conn)
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.WithFields(log.Fields{"Error": err, "Upstream": pool.addr}).Debug("Pooled connection failed, reconnecting")
+			continue
+		}
+
+		pool.put(conn)
+		return responseM, nil
+	}
+	return nil, err
+}
+
+// close closes all idle connections
+func (pool *connPool) close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for _, idle := range pool.idle {
+		idle.conn.Close()
+	}
+	pool.idle = nil
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// countingListener counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (listener *countingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&listener.accepted, 1)
+	}
+	return conn, err
+}
+
+// startStubTCP serves handler over tcp on localhost and returns its address and listener
+func startStubTCP(t testing.TB, handler dns.HandlerFunc) (string, *countingListener) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: l}
+	started := make(chan bool)
+	server := &dns.Server{Listener: listener, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return l.Addr().String(), listener
+}
+
+// answerHandler answers every A query with 192.0.2.1
+func answerHandler(w dns.ResponseWriter, queryM *dns.Msg) {
+	w.WriteMsg(answerA(queryM, "192.0.2.1"))
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	addr, listener := startStubTCP(t, answerHandler)
+	pool := newConnPool("tcp", addr)
+	defer pool.close()
+
+	for i := 0; i < 10; i++ {
+		responseM, err := pool.exchange(context.Background(), newQuery("example.com", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responseM.Answer) != 1 {
+			t.Fatalf("answer %v", responseM.Answer)
+		}
+	}
+	if accepted := atomic.LoadInt32(&listener.accepted); accepted != 1 {
+		t.Errorf("%d connections opened for sequential queries, want 1", accepted)
+	}
+}
+
+func TestPoolReconnectsAfterClose(t *testing.T) {
+	addr, listener := startStubTCP(t, answerHandler)
+	pool := newConnPool("tcp", addr)
+	defer pool.close()
+
+	_, err := pool.exchange(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the idle connection is broken from our side
+	pool.lock.Lock()
+	pool.idle[0].conn.Close()
+	pool.lock.Unlock()
+
+	_, err = pool.exchange(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatalf("query on a broken pooled connection failed: %v", err)
+	}
+	if accepted := atomic.LoadInt32(&listener.accepted); accepted != 2 {
+		t.Errorf("%d connections opened, want a reconnection", accepted)
+	}
+}
+
+func BenchmarkTCPPooled(b *testing.B) {
+	addr, _ := startStubTCP(b, answerHandler)
+	pool := newConnPool("tcp", addr)
+	defer pool.close()
+	queryM := newQuery("example.com", dns.TypeA)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := pool.exchange(context.Background(), queryM)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTCPUnpooled(b *testing.B) {
+	addr, _ := startStubTCP(b, answerHandler)
+	dnsClient := &dns.Client{Net: "tcp"}
+	queryM := newQuery("example.com", dns.TypeA)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := dnsClient.ExchangeContext(context.Background(), queryM, addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
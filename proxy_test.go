@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// TestMain runs the tests in a temporary directory, Client.Init creates its error log in the working directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "doh-proxy-test")
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// transportFunc adapts a function to the Transport interface
+type transportFunc func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error)
+
+func (f transportFunc) Query(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	return f(ctx, queryM)
+}
+
+// newTestClient returns an initialized client with logging silenced
+func newTestClient(t testing.TB) *Client {
+	t.Helper()
+	var client Client
+	client.Init("127.0.0.1", 0, nil)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		client.ErrLogFile.Close()
+	})
+	return &client
+}
+
+// stubServer returns an upstream answering through f
+func stubServer(name string, f transportFunc) Server {
+	var server Server
+	server.Name = name
+	server.Init("192.0.2.1", 0)
+	server.Transport = f
+	return server
+}
+
+// answerA answers queryM with an A record of ip
+func answerA(queryM *dns.Msg, ip string) *dns.Msg {
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.SetReply(queryM)
+	responseM.RecursionAvailable = true
+	if len(queryM.Question) > 0 && queryM.Question[0].Qtype == dns.TypeA {
+		responseM.Answer = append(responseM.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: queryM.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(ip).To4(),
+		})
+	}
+	return responseM
+}
+
+// staticTransport answers every A query with ip
+func staticTransport(ip string) transportFunc {
+	return func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		return answerA(queryM, ip), nil
+	}
+}
+
+// startStubDNS serves handler over udp on localhost and returns its ip and port
+func startStubDNS(t testing.TB, handler dns.HandlerFunc) (string, int) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	portNumber, _ := strconv.Atoi(port)
+	return host, portNumber
+}
+
+// freeAddr returns a localhost address with a port free for network, "udp" or "tcp"
+func freeAddr(t testing.TB, network string) string {
+	t.Helper()
+	var addr string
+	if network == "udp" {
+		pc, err := net.ListenPacket(network, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = pc.LocalAddr().String()
+		pc.Close()
+	} else {
+		listener, err := net.Listen(network, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = listener.Addr().String()
+		listener.Close()
+	}
+	return addr
+}
+
+// startProxy serves the client on a free localhost port until the test ends and returns its address
+func startProxy(t testing.TB, client *Client) string {
+	t.Helper()
+	addr := freeAddr(t, "udp")
+	host, port, _ := net.SplitHostPort(addr)
+	client.IP = host
+	client.Port, _ = strconv.Atoi(port)
+
+	var err error
+	done := make(chan error, 1)
+	go func() {
+		done <- client.StartProxy()
+	}()
+	exchanger := dns.Client{Timeout: 100 * time.Millisecond}
+	for i := 0; ; i++ {
+		select {
+		case err = <-done:
+			t.Fatalf("proxy exited: %v", err)
+		default:
+		}
+		_, _, err = exchanger.Exchange(newQuery("ready.test", dns.TypeA), addr)
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("proxy not answering: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Cleanup(func() {
+		client.ShutDownChan <- os.Interrupt
+		<-done
+	})
+	return addr
+}
+
+// newQuery returns a recursive query for name and qtype
+func newQuery(name string, qtype uint16) *dns.Msg {
+	var queryM *dns.Msg = new(dns.Msg)
+	queryM.SetQuestion(dns.Fqdn(name), qtype)
+	return queryM
+}
+
+// resolveWire resolves queryM through ResolveSync, the path of queries received by the listeners
+func resolveWire(t testing.TB, client *Client, queryM *dns.Msg) *dns.Msg {
+	t.Helper()
+	result := exchangeWire(client, queryM)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	return result.msg
+}
+
+// wireResult is the outcome of a query resolved through ResolveSync
+type wireResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// exchangeWire is resolveWire returning the error, for queries sent from other goroutines than the test
+func exchangeWire(client *Client, queryM *dns.Msg) wireResult {
+	query, err := queryM.Pack()
+	if err != nil {
+		return wireResult{err: err}
+	}
+	response, err := client.ResolveSync(query)
+	if err != nil {
+		return wireResult{err: err}
+	}
+	var responseM *dns.Msg = new(dns.Msg)
+	err = responseM.Unpack(response)
+	return wireResult{msg: responseM, err: err}
+}
+
+// jsonAnswer writes a DoH json answer with an A record of 192.0.2.1 for the name parameter
+func jsonAnswer(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	w.Header().Set("Content-Type", "application/dns-json")
+	fmt.Fprintf(w, `{"Status":0,"RD":true,"RA":true,"Question":[{"name":%q,"type":1}],"Answer":[{"name":%q,"type":1,"TTL":300,"data":"192.0.2.1"}]}`, name, name)
+}
+
+// startStubDoH serves handler over https on localhost
+func startStubDoH(t testing.TB, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dohServer returns a DoH upstream for the stub, trusting its certificate
+func dohServer(name string, stub *httptest.Server) Server {
+	var server Server
+	server.Name = name
+	server.Init(strings.TrimPrefix(stub.URL, "https://")+"/resolve", 443)
+	trustStub(&server)
+	return server
+}
+
+// trustStub accepts the self signed certificate of stub servers
+// the transport is rebuilt by SetProxy and SetHost, call it again after them
+func trustStub(server *Server) {
+	server.httpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// minimizedNames returns the ancestors of name queried before the name itself (RFC 7816)
+// from the top level domain down to the parent of name
+func minimizedNames(name string) []string {
+	labels := dns.SplitDomainName(name)
+	var names []string
+	for i := len(labels) - 1; i > 0; i-- {
+		names = append(names, dns.Fqdn(strings.Join(labels[i:], ".")))
+	}
+	return names
+}
+
+// minimizedExchange sends NS queries for each ancestor of the question name before the full query
+// A NXDOMAIN for an ancestor answers the full query as well (RFC 8020)
+// If an ancestor query fails, the full name is sent right away
+func (client *Client) minimizedExchange(ctx context.Context, resolver *Server, queryM *dns.Msg) (*dns.Msg, error) {
+	if len(queryM.Question) != 1 {
+		return DNSContext(ctx, resolver, queryM)
+	}
+
+	for _, name := range minimizedNames(queryM.Question[0].Name) {
+		_, span := client.tracer().Start(ctx, "MinimizedQuery")
+		span.SetAttribute("dns.qname", name)
+
+		var minimizedM *dns.Msg = new(dns.Msg)
+		minimizedM.SetQuestion(name, dns.TypeNS)
+		minimizedM.RecursionDesired = queryM.RecursionDesired
+		log.WithFields(log.Fields{"Name": name}).Debug("Minimized query")
+
+		responseM, err := DNSContext(ctx, resolver, minimizedM)
+		if err != nil && ctx.Err() != nil {
+			span.RecordError(err)
+			span.End()
+			return nil, err
+		}
+		span.End()
+		if err != nil || responseM == nil {
+			// some servers mishandle queries for ancestors, the full name may still resolve
+			log.WithFields(log.Fields{"Name": name, "Error": err}).Debug("Minimized query failed, sending the full name")
+			break
+		}
+
+		if responseM.Rcode == dns.RcodeNameError {
+			var nxM *dns.Msg = new(dns.Msg)
+			nxM.SetRcode(queryM, dns.RcodeNameError)
+			nxM.RecursionAvailable = responseM.RecursionAvailable
+			nxM.Ns = responseM.Ns
+			return nxM, nil
+		}
+	}
+
+	return DNSContext(ctx, resolver, queryM)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// recordingHandler answers like answerHandler and records the questions it was sent
+type recordingHandler struct {
+	lock      sync.Mutex
+	questions []string
+
+	// rcodes answered instead of an A record, by name
+	rcodes map[string]int
+}
+
+func (handler *recordingHandler) ServeDNS(w dns.ResponseWriter, queryM *dns.Msg) {
+	question := queryM.Question[0]
+	handler.lock.Lock()
+	handler.questions = append(handler.questions, fmt.Sprintf("%s %s", question.Name, dns.TypeToString[question.Qtype]))
+	handler.lock.Unlock()
+	if rcode, ok := handler.rcodes[question.Name]; ok {
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetRcode(queryM, rcode)
+		w.WriteMsg(responseM)
+		return
+	}
+	w.WriteMsg(answerA(queryM, "192.0.2.1"))
+}
+
+// sent returns the questions recorded so far
+func (handler *recordingHandler) sent() []string {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	return append([]string(nil), handler.questions...)
+}
+
+// newMinimizingClient returns a client minimizing names sent to a stub served by handler
+func newMinimizingClient(t *testing.T, handler *recordingHandler) *Client {
+	addr, _ := startStubTCP(t, handler.ServeDNS)
+	client := newTestClient(t)
+	client.QNameMinimization = true
+	client.AddServer(tcpUpstream(t, "stub", addr))
+	return client
+}
+
+func TestQNameMinimizationSequence(t *testing.T) {
+	handler := &recordingHandler{}
+	client := newMinimizingClient(t, handler)
+
+	responseM, err := client.Resolve(newQuery("a.b.c.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseM.Answer) != 1 {
+		t.Errorf("answer %v, want the answer to the full name", responseM.Answer)
+	}
+	want := []string{
+		"com. NS",
+		"example.com. NS",
+		"c.example.com. NS",
+		"b.c.example.com. NS",
+		"a.b.c.example.com. A",
+	}
+	if sent := handler.sent(); !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+}
+
+func TestQNameMinimizationNXDOMAIN(t *testing.T) {
+	handler := &recordingHandler{rcodes: map[string]int{"c.example.com.": dns.RcodeNameError}}
+	client := newMinimizingClient(t, handler)
+
+	responseM, err := client.Resolve(newQuery("a.b.c.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeNameError || responseM.Question[0].Name != "a.b.c.example.com." {
+		t.Errorf("response %v, want NXDOMAIN for the full name", responseM)
+	}
+	// nothing exists below a name which does not exist (RFC 8020)
+	want := []string{"com. NS", "example.com. NS", "c.example.com. NS"}
+	if sent := handler.sent(); !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+}
+
+func TestQNameMinimizationFallback(t *testing.T) {
+	handler := &recordingHandler{rcodes: map[string]int{"example.com.": dns.RcodeServerFailure}}
+	client := newMinimizingClient(t, handler)
+
+	responseM, err := client.Resolve(newQuery("a.b.c.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseM.Answer) != 1 {
+		t.Errorf("answer %v, want the answer to the full name", responseM.Answer)
+	}
+	// the full name is sent as soon as an ancestor fails
+	want := []string{"com. NS", "example.com. NS", "a.b.c.example.com. A"}
+	if sent := handler.sent(); !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+}
+
+func TestMinimizedNames(t *testing.T) {
+	for name, want := range map[string][]string{
+		"www.example.com.": {"com.", "example.com."},
+		"com.":             nil,
+		".":                nil,
+	} {
+		if names := minimizedNames(name); !reflect.DeepEqual(names, want) {
+			t.Errorf("%s minimized to %v, want %v", name, names, want)
+		}
+	}
+}
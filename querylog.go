@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// default rotation policy of the query log
+var QUERY_LOG_MAX_SIZE int = 100  // megabytes
+var QUERY_LOG_MAX_BACKUPS int = 5 // rotated files kept
+var QUERY_LOG_MAX_AGE int = 7     // days rotated files are kept
+
+// queryLogKey is the context key of the upstream recorded for the query log
+type queryLogKey struct{}
+
+// queryLogEntry collects what the query log needs from the resolution path
+type queryLogEntry struct {
+	// name of the resolver that answered
+	// empty when answered from cache or static hosts
+	Upstream string
+}
+
+// withQueryLogEntry attaches an entry filled in by exchange and fallback
+func withQueryLogEntry(ctx context.Context, entry *queryLogEntry) context.Context {
+	return context.WithValue(ctx, queryLogKey{}, entry)
+}
+
+// recordUpstream stores the resolver used for the query, if the query is logged
+func recordUpstream(ctx context.Context, resolver *Server) {
+	entry, ok := ctx.Value(queryLogKey{}).(*queryLogEntry)
+	if ok && entry != nil {
+		entry.Upstream = resolver.Name
+	}
+}
+
+// startQueryLog opens the rotating query log at client.QueryLogFile
+func (client *Client) startQueryLog() {
+	client.queryLogFile = &lumberjack.Logger{
+		Filename:   client.QueryLogFile,
+		MaxSize:    client.QueryLogMaxSize,
+		MaxBackups: client.QueryLogMaxBackups,
+		MaxAge:     client.QueryLogMaxAge,
+	}
+
+	client.queryLog = log.New()
+	client.queryLog.SetFormatter(&log.JSONFormatter{})
+	client.queryLog.SetOutput(client.queryLogFile)
+
+	if client.QueryLogRotateInterval > 0 {
+		client.queryLogDone = make(chan bool)
+		go client.runQueryLogRotator(client.queryLogFile, client.queryLogDone)
+	}
+
+	log.WithFields(log.Fields{"Path": client.QueryLogFile}).Info("Client query log running")
+}
+
+// runQueryLogRotator rotates file every QueryLogRotateInterval until done is closed
+// file and done are passed in since stopQueryLog clears the client fields
+func (client *Client) runQueryLogRotator(file *lumberjack.Logger, done chan bool) {
+	ticker := time.NewTicker(client.QueryLogRotateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := file.Rotate()
+			if err != nil {
+				log.WithFields(log.Fields{"Error": err}).Error("Client failed to rotate query log")
+			}
+		}
+	}
+}
+
+// stopQueryLog closes the query log
+func (client *Client) stopQueryLog() {
+	if client.queryLogFile == nil {
+		return
+	}
+	if client.queryLogDone != nil {
+		close(client.queryLogDone)
+		client.queryLogDone = nil
+	}
+	client.queryLogFile.Close()
+	client.queryLogFile = nil
+	client.queryLog = nil
+}
+
+// logQuery writes one line per resolution to the query log
+func (client *Client) logQuery(addr net.Addr, queryM *dns.Msg, responseM *dns.Msg, upstream string, queryTime time.Time) {
+	if client.queryLog == nil || len(queryM.Question) == 0 {
+		return
+	}
+
+	// addr is nil for queries given to ResolveSync
+	clientIP := ""
+	if addr != nil {
+		clientIP = addr.String()
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		clientIP = udpAddr.IP.String()
+	}
+	question := queryM.Question[0]
+
+	client.queryLog.WithFields(log.Fields{
+		"client":     clientIP,
+		"name":       question.Name,
+		"type":       dns.TypeToString[question.Qtype],
+		"upstream":   upstream,
+		"rcode":      dns.RcodeToString[responseM.Rcode],
+		"latency_ms": float64(time.Since(queryTime).Microseconds()) / 1000,
+	}).Info("query")
+}
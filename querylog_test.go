@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// readQueryLog decodes the lines of a query log file
+func readQueryLog(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		err = json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatalf("query log line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestQueryLog(t *testing.T) {
+	dir := t.TempDir()
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	client.QueryLogFile = filepath.Join(dir, "query.log")
+	client.QueryLogRotateInterval = 50 * time.Millisecond
+	client.startQueryLog()
+	defer client.stopQueryLog()
+
+	resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	lines := readQueryLog(t, client.QueryLogFile)
+	if len(lines) != 1 {
+		t.Fatalf("%d query log lines, want 1", len(lines))
+	}
+	line := lines[0]
+	if line["name"] != "example.com." || line["type"] != "A" || line["upstream"] != "stub" || line["rcode"] != "NOERROR" {
+		t.Errorf("query log line %v", line)
+	}
+	if _, ok := line["latency_ms"].(float64); !ok {
+		t.Errorf("latency %v, want milliseconds", line["latency_ms"])
+	}
+
+	// the rotated file keeps the line, the new one starts empty
+	var backups []string
+	for i := 0; len(backups) == 0; i++ {
+		if i == 100 {
+			t.Fatal("query log not rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+		backups, _ = filepath.Glob(filepath.Join(dir, "query-*.log"))
+	}
+	if rotated := readQueryLog(t, backups[0]); len(rotated) != 1 {
+		t.Errorf("%d lines in the rotated log, want 1", len(rotated))
+	}
+	resolveWire(t, client, newQuery("example.org", dns.TypeA))
+	lines = readQueryLog(t, client.QueryLogFile)
+	if len(lines) != 1 || lines[0]["name"] != "example.org." {
+		t.Errorf("query log after rotation %v, want the new query only", lines)
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// What listeners do with a query arriving while LookUpChan is full
+var QUEUE_DROP_OLDEST string = "drop-oldest" // drop the longest waiting query to make room
+var QUEUE_SERVFAIL string = "servfail"       // answer the new query with SERVFAIL right away
+
+// enqueue hands a received query to the resolver workers without blocking the listener
+// A blocked listener stops reading, and the kernel then drops packets without any trace
+func (client *Client) enqueue(newJob job) {
+	select {
+	case client.LookUpChan <- newJob:
+		return
+	default:
+	}
+
+	atomic.AddUint64(&client.stats.dropped, 1)
+	if client.QueuePolicy == QUEUE_SERVFAIL {
+		log.WithFields(log.Fields{"Addr": newJob.Addr}).Warn("Lookup queue full, answering SERVFAIL")
+		client.refuseJob(newJob)
+		return
+	}
+
+	select {
+	case oldJob := <-client.LookUpChan:
+		log.WithFields(log.Fields{"Addr": oldJob.Addr, "Waited": newJob.Time.Sub(oldJob.Time)}).Warn("Lookup queue full, dropped oldest query")
+	default:
+	}
+	select {
+	case client.LookUpChan <- newJob:
+	default:
+		// the workers did not take anything while another listener filled the slot
+		atomic.AddUint64(&client.stats.dropped, 1)
+		log.WithFields(log.Fields{"Addr": newJob.Addr}).Warn("Lookup queue full, dropped query")
+	}
+}
+
+// refuseJob answers a query that could not be queued with SERVFAIL
+func (client *Client) refuseJob(newJob job) {
+	queryM := new(dns.Msg)
+	err := queryM.Unpack(newJob.Data)
+	if err != nil {
+		return
+	}
+	failM := new(dns.Msg)
+	failM.SetRcode(queryM, dns.RcodeServerFailure)
+	responseBytes, err := failM.Pack()
+	if err != nil {
+		return
+	}
+	_, err = newJob.PC.WriteTo(responseBytes, newJob.Addr)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Addr": newJob.Addr}).Warn("Client failed to answer dropped query")
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queuedJob returns a job for a query of name with id, answered on pc
+func queuedJob(t *testing.T, pc net.PacketConn, addr net.Addr, name string, id uint16) job {
+	queryM := newQuery(name, dns.TypeA)
+	queryM.Id = id
+	query, err := queryM.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job{Addr: addr, PC: pc, Data: query, Time: time.Now()}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	client := newTestClient(t)
+	client.QueuePolicy = QUEUE_DROP_OLDEST
+	client.LookUpChan = make(chan job, 2)
+	for i := uint16(1); i <= 4; i++ {
+		client.enqueue(queuedJob(t, nil, nil, "example.com", i))
+	}
+
+	// the two newest queries are kept, in order
+	for _, want := range []uint16{3, 4} {
+		queued := <-client.LookUpChan
+		var queryM dns.Msg
+		if err := queryM.Unpack(queued.Data); err != nil {
+			t.Fatal(err)
+		}
+		if queryM.Id != want {
+			t.Errorf("query %d queued, want %d", queryM.Id, want)
+		}
+	}
+	if dropped := client.Status().Dropped; dropped != 2 {
+		t.Errorf("%d queries counted as dropped, want 2", dropped)
+	}
+}
+
+func TestQueueServFail(t *testing.T) {
+	client := newTestClient(t)
+	client.QueuePolicy = QUEUE_SERVFAIL
+	client.LookUpChan = make(chan job, 1)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	reader, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	client.enqueue(queuedJob(t, pc, reader.LocalAddr(), "first.example.com", 1))
+	client.enqueue(queuedJob(t, pc, reader.LocalAddr(), "second.example.com", 2))
+
+	buffer := make([]byte, dns.MinMsgSize)
+	reader.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := reader.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("query refused by a full queue not answered: %v", err)
+	}
+	var responseM dns.Msg
+	if err := responseM.Unpack(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Id != 2 || responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("response %d with rcode %s, want SERVFAIL for query 2", responseM.Id, dns.RcodeToString[responseM.Rcode])
+	}
+	if len(client.LookUpChan) != 1 || client.Status().Dropped != 1 {
+		t.Errorf("%d queued and %d dropped, want the first query kept", len(client.LookUpChan), client.Status().Dropped)
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// raceResult is the answer of one raced resolver
+type raceResult struct {
+	resolver  *Server
+	responseM *dns.Msg
+	err       error
+}
+
+// raceResolvers picks the resolvers a query is raced on
+// The sharded resolver comes first, followed by healthy ones
+func (client *Client) raceResolvers(name string) []*Server {
+	first := client.shard(name)
+	if first == nil {
+		return nil
+	}
+	count := client.RaceCount
+	if count < 1 {
+		count = 1
+	}
+
+	selected := []*Server{first}
+	resolvers := client.resolverList()
+	for i := range resolvers {
+		if len(selected) >= count {
+			break
+		}
+		resolver := &resolvers[i]
+		if (resolver.Upstream == first.Upstream && resolver.Port == first.Port) || !resolver.stats.healthy() {
+			continue
+		}
+		selected = append(selected, resolver)
+	}
+	return selected
+}
+
+// race sends the query to several resolvers concurrently
+// The first answer which is not SERVFAIL wins and the other requests are cancelled
+func (client *Client) race(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	question := queryM.Question[0]
+	log.WithFields(log.Fields{"Question": question}).Info("Question received")
+
+	resolvers := client.raceResolvers(question.Name)
+	if len(resolvers) == 0 {
+		log.WithFields(log.Fields{"Error": ErrNoResolvers}).Error("Client failed to resolve")
+		return nil, ErrNoResolvers
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// racers must not fill in the query log entry, only the winner does
+	racerCtx := withQueryLogEntry(raceCtx, nil)
+
+	results := make(chan raceResult, len(resolvers))
+	for _, resolver := range resolvers {
+		go func(resolver *Server) {
+			responseM, err := client.exchange(racerCtx, resolver, queryM)
+			if err == nil && responseM.Rcode == dns.RcodeServerFailure {
+				err = errors.New("SERVFAIL from " + resolver.Name)
+			}
+			results <- raceResult{resolver: resolver, responseM: responseM, err: err}
+		}(resolver)
+	}
+
+	err := errors.New("No resolver answered")
+	triedDoH := false
+	for range resolvers {
+		result := <-results
+		if result.err != nil {
+			log.WithFields(log.Fields{"Resolver": result.resolver.Name, "Error": result.err}).Debug("Raced resolver failed")
+			err = result.err
+			triedDoH = triedDoH || result.resolver.Port == 443
+			continue
+		}
+
+		// cancelling the context aborts the requests still in flight
+		log.WithFields(log.Fields{"Resolver": result.resolver.Name}).Debug("Race won")
+		recordUpstream(ctx, result.resolver)
+		return result.responseM, nil
+	}
+
+	if triedDoH && len(client.fallbackList()) > 0 {
+		return client.fallback(ctx, queryM)
+	}
+	return nil, err
+}
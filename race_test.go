@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRaceUpstreamsFastWins(t *testing.T) {
+	client := newTestClient(t)
+	client.RaceUpstreams = true
+	client.RaceCount = 2
+	cancelled := make(chan bool, 10)
+	slow := stubServer("slow", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		select {
+		case <-ctx.Done():
+			cancelled <- true
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return answerA(queryM, "192.0.2.2"), nil
+		}
+	})
+	slow.Upstream = "192.0.2.2"
+	client.AddServer(slow)
+	client.AddServer(stubServer("fast", staticTransport("192.0.2.1")))
+
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("answered after %v, want the fast upstream", elapsed)
+		}
+		if len(responseM.Answer) != 1 || !responseM.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("answers %v, want 192.0.2.1 from the fast upstream", responseM.Answer)
+		}
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("slow upstream request not cancelled")
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// What RebindProtection does with answers pointing public names at private addresses
+var REBIND_STRIP string = "strip"       // drop the private addresses, NXDOMAIN if none is left
+var REBIND_SERVFAIL string = "servfail" // answer SERVFAIL
+
+// privateIP reports whether ip is a private, loopback, link local or unspecified address
+func privateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// rebindAllowed reports whether name may resolve to private addresses
+// name matches an allowlist entry if it is the entry or a subdomain of it
+func (client *Client) rebindAllowed(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, allowed := range client.RebindAllowlist {
+		allowed = strings.ToLower(dns.Fqdn(allowed))
+		if dns.IsSubDomain(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRebind removes A and AAAA answers pointing at private addresses (DNS rebinding protection)
+// If no address is left, the response is turned into NXDOMAIN
+// With RebindAction set to REBIND_SERVFAIL any private address turns the response into SERVFAIL
+// Returns true if the response was modified
+func (client *Client) filterRebind(queryM *dns.Msg, responseM *dns.Msg) bool {
+	if len(queryM.Question) == 0 || client.rebindAllowed(queryM.Question[0].Name) {
+		return false
+	}
+
+	var answers []dns.RR
+	addresses := 0
+	filtered := 0
+	for _, rr := range responseM.Answer {
+		var ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		}
+		if ip != nil {
+			addresses++
+			if privateIP(ip) && !client.rebindAllowed(rr.Header().Name) {
+				log.WithFields(log.Fields{"Name": rr.Header().Name, "IP": ip}).Warn("Dropped private address for public name")
+				filtered++
+				continue
+			}
+		}
+		answers = append(answers, rr)
+	}
+	if filtered == 0 {
+		return false
+	}
+
+	if client.RebindAction == REBIND_SERVFAIL {
+		responseM.Answer = nil
+		responseM.Ns = nil
+		responseM.Rcode = dns.RcodeServerFailure
+		if queryM.IsEdns0() != nil {
+			setEDE(responseM, dns.ExtendedErrorCodeFiltered, "Private address for public name")
+		}
+		return true
+	}
+
+	if filtered == addresses {
+		responseM.Answer = nil
+		responseM.Ns = nil
+		responseM.Rcode = dns.RcodeNameError
+		if queryM.IsEdns0() != nil {
+			setEDE(responseM, dns.ExtendedErrorCodeFiltered, "Private address for public name")
+		}
+		return true
+	}
+	responseM.Answer = answers
+	return true
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newRebindClient returns a client protected against rebinding whose upstream answers ip
+func newRebindClient(t *testing.T, ip string) *Client {
+	client := newTestClient(t)
+	client.RebindProtection = true
+	client.RebindAllowlist = []string{"corp.example"}
+	client.AddServer(stubServer("stub", staticTransport(ip)))
+	return client
+}
+
+func TestRebindProtectionLoopback(t *testing.T) {
+	client := newRebindClient(t, "127.0.0.1")
+
+	responseM, err := client.Resolve(newQuery("attacker.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeNameError || len(responseM.Answer) != 0 {
+		t.Errorf("public name pointing at 127.0.0.1 answered %s with %v, want NXDOMAIN", dns.RcodeToString[responseM.Rcode], responseM.Answer)
+	}
+
+	// allowlisted names and their subdomains may resolve to private addresses
+	for _, name := range []string{"corp.example", "intranet.corp.example"} {
+		responseM, err = client.Resolve(newQuery(name, dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responseM.Answer) != 1 {
+			t.Errorf("allowlisted %s answered %v", name, responseM.Answer)
+		}
+	}
+
+	client.RebindProtection = false
+	responseM, err = client.Resolve(newQuery("attacker.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseM.Answer) != 1 {
+		t.Error("answer filtered with the protection off")
+	}
+}
+
+func TestRebindProtectionPrivateNetwork(t *testing.T) {
+	client := newRebindClient(t, "192.168.1.10")
+	responseM := resolveWire(t, client, newQuery("attacker.example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeNameError {
+		t.Errorf("public name pointing at 192.168.1.10 answered %s, want NXDOMAIN", dns.RcodeToString[responseM.Rcode])
+	}
+
+	client.RebindAction = REBIND_SERVFAIL
+	responseM = resolveWire(t, client, newQuery("attacker.example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeServerFailure || len(responseM.Answer) != 0 {
+		t.Errorf("answered %s with %v, want SERVFAIL", dns.RcodeToString[responseM.Rcode], responseM.Answer)
+	}
+}
+
+func TestRebindProtectionStripsPrivateAnswers(t *testing.T) {
+	client := newTestClient(t)
+	client.RebindProtection = true
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		responseM := answerA(queryM, "192.168.0.1")
+		responseM.Answer = append(responseM.Answer, answerA(queryM, "198.51.100.7").Answer...)
+		return responseM, nil
+	}))
+
+	responseM := resolveWire(t, client, newQuery("mixed.example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 1 || !responseM.Answer[0].(*dns.A).A.Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("answered %s with %v, want only the public address", dns.RcodeToString[responseM.Rcode], responseM.Answer)
+	}
+}
+
+func TestPrivateIP(t *testing.T) {
+	for ip, private := range map[string]bool{
+		"10.1.2.3":      true,
+		"172.16.0.1":    true,
+		"192.168.255.1": true,
+		"127.0.0.1":     true,
+		"169.254.1.1":   true,
+		"0.0.0.0":       true,
+		"::1":           true,
+		"fe80::1":       true,
+		"fd00::1":       true,
+		"8.8.8.8":       false,
+		"172.32.0.1":    false,
+		"2001:db8::1":   false,
+	} {
+		if privateIP(net.ParseIP(ip)) != private {
+			t.Errorf("privateIP(%s) = %v", ip, !private)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package proxy
+
+import (
+	"errors"
+)
+
+// setReusePort is not supported on this platform
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,12 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// setReusePort enables SO_REUSEPORT so several sockets can bind the same port
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,37 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import (
+	"testing"
+)
+
+func TestReusePortSharesPort(t *testing.T) {
+	first := newTestClient(t)
+	first.ReusePort = true
+	firstPC, err := first.listenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer firstPC.Close()
+	addr := firstPC.LocalAddr().String()
+
+	second := newTestClient(t)
+	second.ReusePort = true
+	secondPC, err := second.listenPacket(addr)
+	if err != nil {
+		t.Fatalf("second listener on %s: %v", addr, err)
+	}
+	defer secondPC.Close()
+	if secondPC.LocalAddr().String() != addr {
+		t.Errorf("second listener on %s, want %s", secondPC.LocalAddr(), addr)
+	}
+
+	// without the option the port stays exclusive
+	third := newTestClient(t)
+	thirdPC, err := third.listenPacket(addr)
+	if err == nil {
+		thirdPC.Close()
+		t.Errorf("listener without ReusePort bound %s", addr)
+	}
+}
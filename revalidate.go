@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// revalidationKey marks the context of a background refresh
+type revalidationKey struct{}
+
+// isRevalidation reports whether ctx belongs to a background refresh
+// refreshes must reach the upstream instead of being answered from the expired entry
+func isRevalidation(ctx context.Context) bool {
+	revalidation, _ := ctx.Value(revalidationKey{}).(bool)
+	return revalidation
+}
+
+// serveRevalidating answers from an entry expired less than StaleWhileRevalidate ago (RFC 5861)
+// and refreshes the entry in the background
+// Returns false if there is no such entry
+func (client *Client) serveRevalidating(key string, queryM *dns.Msg) (*dns.Msg, bool) {
+	cache, ok := client.Cache.(expiredCache)
+	if !ok {
+		return nil, false
+	}
+	staleM, expired, ok := cache.GetExpired(key)
+	if !ok || expired > client.StaleWhileRevalidate {
+		return nil, false
+	}
+
+	log.WithFields(log.Fields{"Key": key, "Expired": expired}).Debug("Serving expired entry while revalidating")
+	atomic.AddUint64(&client.stats.staleServed, 1)
+	setTTL(staleM, REVALIDATE_ANSWER_TTL)
+	client.revalidate(key, queryM.Copy())
+	return staleM, true
+}
+
+// revalidate refreshes the cache entry of key in the background
+// Only one refresh runs per key, and it shares its upstream request with identical queries in flight
+func (client *Client) revalidate(key string, queryM *dns.Msg) {
+	if _, running := client.revalidating.LoadOrStore(key, true); running {
+		return
+	}
+	go func() {
+		defer client.revalidating.Delete(key)
+		ctx := context.WithValue(context.Background(), revalidationKey{}, true)
+		_, err := client.resolveContext(ctx, queryM)
+		if err != nil {
+			log.WithFields(log.Fields{"Key": key, "Error": err}).Warn("Background revalidation failed")
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newRevalidatingClient returns a client serving entries expired less than window ago
+// Its upstream answers 192.0.2.1 once release is closed and counts its queries
+func newRevalidatingClient(t *testing.T, window time.Duration) (*Client, *uint64, chan struct{}) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	client.StaleWhileRevalidate = window
+	var queries uint64
+	release := make(chan struct{})
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		atomic.AddUint64(&queries, 1)
+		<-release
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+	return client, &queries, release
+}
+
+// seedCache stores an answer of ip for queryM that expires after ttl, which may be negative
+func seedCache(client *Client, queryM *dns.Msg, ip string, ttl time.Duration) {
+	client.Cache.Set(cacheKey(queryM), answerA(queryM, ip), ttl, time.Hour)
+}
+
+func TestRevalidateWithinWindow(t *testing.T) {
+	client, queries, release := newRevalidatingClient(t, 10*time.Second)
+	queryM := newQuery("example.com", dns.TypeA)
+	seedCache(client, queryM, "192.0.2.9", -time.Second)
+
+	// the upstream is blocked, so every answer must come from the expired entry
+	for i := 0; i < 5; i++ {
+		responseM, err := client.Resolve(queryM.Copy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := responseM.Answer[0].(*dns.A)
+		if !a.A.Equal(net.ParseIP("192.0.2.9")) || a.Hdr.Ttl != REVALIDATE_ANSWER_TTL {
+			t.Fatalf("answer %v, want the expired entry with ttl %d", a, REVALIDATE_ANSWER_TTL)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadUint64(queries); n != 1 {
+		t.Errorf("%d upstream queries, want one background refresh per key", n)
+	}
+	if stats := client.Stats(); stats.StaleServed != 5 {
+		t.Errorf("%d stale answers counted, want 5", stats.StaleServed)
+	}
+
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cachedM, ok := client.Cache.Get(cacheKey(queryM))
+		if ok && cachedM.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the background refresh did not update the entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	responseM, err := client.Resolve(queryM.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := responseM.Answer[0].(*dns.A); !a.A.Equal(net.ParseIP("192.0.2.1")) || a.Hdr.Ttl == REVALIDATE_ANSWER_TTL {
+		t.Errorf("answer %v, want the refreshed entry", a)
+	}
+	if n := atomic.LoadUint64(queries); n != 1 {
+		t.Errorf("%d upstream queries, want the refreshed entry to be a cache hit", n)
+	}
+}
+
+func TestRevalidateOutsideWindow(t *testing.T) {
+	client, queries, release := newRevalidatingClient(t, 10*time.Second)
+	close(release)
+	queryM := newQuery("example.com", dns.TypeA)
+	seedCache(client, queryM, "192.0.2.9", -time.Minute)
+
+	responseM, err := client.Resolve(queryM.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := responseM.Answer[0].(*dns.A); !a.A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("answer %v, want an entry expired past the window to be resolved again", a)
+	}
+	if n := atomic.LoadUint64(queries); n != 1 {
+		t.Errorf("%d upstream queries, want 1", n)
+	}
+	if stats := client.Stats(); stats.StaleServed != 0 {
+		t.Errorf("%d stale answers counted, want 0", stats.StaleServed)
+	}
+}
+
+func TestRevalidateFreshEntry(t *testing.T) {
+	client, queries, release := newRevalidatingClient(t, 10*time.Second)
+	close(release)
+	queryM := newQuery("example.com", dns.TypeA)
+	seedCache(client, queryM, "192.0.2.9", time.Minute)
+
+	responseM, err := client.Resolve(queryM.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := responseM.Answer[0].(*dns.A); !a.A.Equal(net.ParseIP("192.0.2.9")) || a.Hdr.Ttl == REVALIDATE_ANSWER_TTL {
+		t.Errorf("answer %v, want a plain cache hit", a)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadUint64(queries); n != 0 {
+		t.Errorf("%d upstream queries, want no refresh of an unexpired entry", n)
+	}
+}
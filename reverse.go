@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidIP is returned when ReverseLookup is given neither an IPv4 nor an IPv6 address
+var ErrInvalidIP = errors.New("Invalid ip address")
+
+// ReverseLookup resolves the PTR records of ip and returns the names it points to
+// IPv4 addresses, IPv4-mapped IPv6 addresses included, are looked up under in-addr.arpa, IPv6 ones under ip6.arpa
+// Names are fully qualified, an error is returned if the response code is not NOERROR
+func (client *Client) ReverseLookup(ip net.IP) ([]string, error) {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return nil, ErrInvalidIP
+	}
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, ErrInvalidIP
+	}
+
+	var queryM *dns.Msg = new(dns.Msg)
+	queryM.SetQuestion(name, dns.TypePTR)
+	responseM, err := client.Resolve(queryM)
+	if err == nil && responseM.Rcode != dns.RcodeSuccess {
+		err = &rcodeError{rcode: responseM.Rcode}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"IP": ip, "Name": name, "Error": err}).Info("Reverse lookup failed")
+		return nil, err
+	}
+
+	// classless delegations (RFC 2317) answer with a CNAME leading to the PTR records
+	var names []string
+	for _, answer := range responseM.Answer {
+		if ptr, ok := answer.(*dns.PTR); ok {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// ptrAnswer answers PTR questions over DoH json, leaving out trailing dots like some upstreams do
+func ptrAnswer(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(r.URL.Query().Get("name"), ".")
+	w.Header().Set("Content-Type", "application/dns-json")
+	fmt.Fprintf(w, `{"Status":0,"RD":true,"RA":true,"Question":[{"name":%q,"type":12}],"Answer":[{"name":%q,"type":12,"TTL":300,"data":"host.example.com"}]}`, name, name)
+}
+
+func TestReverseLookupOverJSON(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(dohServer("stub", startStubDoH(t, ptrAnswer)))
+
+	for _, ip := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+		names, err := client.ReverseLookup(net.ParseIP(ip))
+		if err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		if len(names) != 1 || names[0] != "host.example.com." {
+			t.Errorf("%s: names %v, want [host.example.com.]", ip, names)
+		}
+	}
+}
+
+func TestReverseLookupNames(t *testing.T) {
+	client := newTestClient(t)
+	asked := make(chan string, 1)
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		asked <- queryM.Question[0].Name
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetReply(queryM)
+		if strings.HasPrefix(queryM.Question[0].Name, "9.") {
+			responseM.Rcode = dns.RcodeNameError
+			return responseM, nil
+		}
+		responseM.Answer = append(responseM.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: queryM.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+			Ptr: "host.example.com.",
+		})
+		return responseM, nil
+	}))
+
+	for _, test := range []struct {
+		ip   string
+		name string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa."},
+		{"::ffff:192.0.2.1", "1.2.0.192.in-addr.arpa."},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	} {
+		names, err := client.ReverseLookup(net.ParseIP(test.ip))
+		if err != nil {
+			t.Fatalf("%s: %v", test.ip, err)
+		}
+		if name := <-asked; name != test.name {
+			t.Errorf("%s looked up as %s, want %s", test.ip, name, test.name)
+		}
+		if len(names) != 1 || names[0] != "host.example.com." {
+			t.Errorf("%s: names %v, want [host.example.com.]", test.ip, names)
+		}
+	}
+
+	_, err := client.ReverseLookup(net.IP{192, 0, 2})
+	if err != ErrInvalidIP {
+		t.Errorf("error %v for a truncated address, want ErrInvalidIP", err)
+	}
+	_, err = client.ReverseLookup(net.ParseIP("192.0.2.9"))
+	<-asked
+	if err == nil {
+		t.Error("NXDOMAIN returned without an error")
+	}
+}
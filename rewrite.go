@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ResponseRewriter modifies upstream answers before they are cached and returned
+type ResponseRewriter interface {
+	// Rewrite returns the message to serve for question q
+	// m can be modified in place and returned, nil keeps m unchanged
+	Rewrite(q dns.Question, m *dns.Msg) *dns.Msg
+}
+
+// AddRewriter appends a rewriter applied to every upstream answer
+// Rewriters run in the order they were added
+func (client *Client) AddRewriter(rewriter ResponseRewriter) {
+	client.Rewriters = append(client.Rewriters, rewriter)
+}
+
+// rewrite runs the response through every rewriter
+func (client *Client) rewrite(queryM *dns.Msg, responseM *dns.Msg) *dns.Msg {
+	if len(queryM.Question) == 0 {
+		return responseM
+	}
+	for _, rewriter := range client.Rewriters {
+		rewrittenM := rewriter.Rewrite(queryM.Question[0], responseM)
+		if rewrittenM != nil {
+			responseM = rewrittenM
+		}
+	}
+	return responseM
+}
+
+// CNAMEFlattener replaces a CNAME chain by the records it ends in, owned by the question name
+// e.g. www.example.com CNAME cdn.example.net A 192.0.2.1 becomes www.example.com A 192.0.2.1
+// The ttl of the flattened records is the lowest ttl along the chain
+type CNAMEFlattener struct {
+	// names, and their subdomains, whose answers are flattened
+	// every name is flattened when empty
+	Names []string
+}
+
+// Rewrite flattens the CNAME chain of the answer section
+func (flattener *CNAMEFlattener) Rewrite(q dns.Question, m *dns.Msg) *dns.Msg {
+	if q.Qtype == dns.TypeCNAME || !flattener.matches(q.Name) {
+		return nil
+	}
+
+	// follow the chain from the question name
+	target := strings.ToLower(q.Name)
+	var ttl uint32
+	chained := false
+	for hops := 0; hops < len(m.Answer); hops++ {
+		next := ""
+		for _, rr := range m.Answer {
+			cname, ok := rr.(*dns.CNAME)
+			if ok && strings.ToLower(cname.Hdr.Name) == target {
+				next = strings.ToLower(cname.Target)
+				if !chained || cname.Hdr.Ttl < ttl {
+					ttl = cname.Hdr.Ttl
+				}
+				chained = true
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if !chained {
+		return nil
+	}
+
+	var answers []dns.RR
+	for _, rr := range m.Answer {
+		header := rr.Header()
+		if header.Rrtype != q.Qtype || strings.ToLower(header.Name) != target {
+			continue
+		}
+		flattened := dns.Copy(rr)
+		flattened.Header().Name = q.Name
+		if flattened.Header().Ttl > ttl {
+			flattened.Header().Ttl = ttl
+		}
+		answers = append(answers, flattened)
+	}
+	if len(answers) == 0 {
+		// the chain does not end in records of the question type, keep it for the client to follow
+		return nil
+	}
+
+	log.WithFields(log.Fields{"Name": q.Name, "Target": target}).Debug("Flattened CNAME chain")
+	m.Answer = answers
+	// the synthesized records no longer match their signatures
+	m.AuthenticatedData = false
+	return m
+}
+
+// matches reports whether answers for name are flattened
+func (flattener *CNAMEFlattener) matches(name string) bool {
+	if len(flattener.Names) == 0 {
+		return true
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, flattened := range flattener.Names {
+		if dns.IsSubDomain(strings.ToLower(dns.Fqdn(flattened)), name) {
+			return true
+		}
+	}
+	return false
+}
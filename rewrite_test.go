@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// cnameTransport answers through a CNAME to cdn.example.net
+func cnameTransport(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.SetReply(queryM)
+	responseM.Answer = []dns.RR{
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: queryM.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "cdn.example.net.",
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1").To4(),
+		},
+	}
+	return responseM, nil
+}
+
+func TestCNAMEFlattener(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("stub", cnameTransport))
+	client.AddRewriter(&CNAMEFlattener{Names: []string{"example.com"}})
+
+	responseM := resolveWire(t, client, newQuery("www.example.com", dns.TypeA))
+	if len(responseM.Answer) != 1 {
+		t.Fatalf("answers %v, want the flattened A record", responseM.Answer)
+	}
+	a, ok := responseM.Answer[0].(*dns.A)
+	if !ok || a.Hdr.Name != "www.example.com." || !a.A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("answer %v, want www.example.com A 192.0.2.1", responseM.Answer[0])
+	}
+	if a.Hdr.Ttl != 60 {
+		t.Errorf("ttl %d, want the lowest ttl of the chain", a.Hdr.Ttl)
+	}
+
+	// names not listed keep their chain
+	responseM = resolveWire(t, client, newQuery("www.example.org", dns.TypeA))
+	if len(responseM.Answer) != 2 {
+		t.Errorf("answers %v, want the CNAME chain", responseM.Answer)
+	}
+}
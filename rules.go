@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidRewriteRule is returned for a rewrite rule without a name or without exactly one of IP and CNAME
+var ErrInvalidRewriteRule = errors.New("Invalid rewrite rule")
+
+// RewriteRule forces the answer of the names matching Name
+// e.g. {"name": "*", "ip": "10.0.0.1"} sends every name to a captive portal,
+// {"name": "old.example.com", "cname": "new.example.com"} remaps a name
+type RewriteRule struct {
+	// "example.com" matches that name, "*.example.com" its subdomains, "*" every name
+	Name string `json:"name"`
+
+	// address answering A or AAAA queries, the other types are answered without records
+	IP string `json:"ip,omitempty"`
+
+	// target the name is aliased to, its records are resolved and returned after the CNAME
+	CNAME string `json:"cname,omitempty"`
+
+	// only replace NXDOMAIN upstream answers with IP, other answers are kept
+	NXDomain bool `json:"nxdomain,omitempty"`
+
+	// ttl of the synthesized records, StaticTTL when 0
+	TTL uint32 `json:"ttl,omitempty"`
+
+	ip net.IP
+}
+
+// SetRewriteRules replaces the rewrite rules, the first rule matching a name applies
+// Returns ErrInvalidRewriteRule and keeps the current rules if one of them is invalid
+func (client *Client) SetRewriteRules(rules []RewriteRule) error {
+	compiled := make([]RewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Name == "" || (rule.IP == "") == (rule.CNAME == "") || (rule.NXDomain && rule.IP == "") {
+			log.WithFields(log.Fields{"Name": rule.Name}).Error("Invalid rewrite rule")
+			return ErrInvalidRewriteRule
+		}
+		if rule.IP != "" {
+			rule.ip = net.ParseIP(rule.IP)
+			if rule.ip == nil {
+				log.WithFields(log.Fields{"Name": rule.Name, "IP": rule.IP}).Error("Invalid rewrite rule ip")
+				return ErrInvalidRewriteRule
+			}
+		}
+		rule.Name = strings.ToLower(rule.Name)
+		if rule.Name != "*" {
+			rule.Name = dns.Fqdn(rule.Name)
+		}
+		if rule.CNAME != "" {
+			rule.CNAME = dns.Fqdn(rule.CNAME)
+		}
+		compiled = append(compiled, rule)
+	}
+
+	client.rewriteRulesLock.Lock()
+	client.rewriteRules = compiled
+	client.rewriteRulesLock.Unlock()
+	return nil
+}
+
+// matchRewriteRule returns the first rewrite rule matching name
+func (client *Client) matchRewriteRule(name string) (RewriteRule, bool) {
+	name = strings.ToLower(name)
+	client.rewriteRulesLock.RLock()
+	defer client.rewriteRulesLock.RUnlock()
+	for _, rule := range client.rewriteRules {
+		switch {
+		case rule.Name == "*",
+			rule.Name == name,
+			strings.HasPrefix(rule.Name, "*.") && dns.IsSubDomain(rule.Name[2:], name) && name != rule.Name[2:]:
+			return rule, true
+		}
+	}
+	return RewriteRule{}, false
+}
+
+// hasRewriteRules reports whether any rewrite rule is set
+func (client *Client) hasRewriteRules() bool {
+	client.rewriteRulesLock.RLock()
+	defer client.rewriteRulesLock.RUnlock()
+	return len(client.rewriteRules) > 0
+}
+
+// rewriteRulesMiddleware answers the names matching a rewrite rule
+// Forced answers skip the upstream, NXDOMAIN rules inspect the answer next returns
+func (client *Client) rewriteRulesMiddleware(next Handler) Handler {
+	return func(queryM *dns.Msg) (*dns.Msg, error) {
+		if len(queryM.Question) != 1 {
+			return next(queryM)
+		}
+		question := queryM.Question[0]
+		rule, ok := client.matchRewriteRule(question.Name)
+		if !ok {
+			return next(queryM)
+		}
+
+		if rule.CNAME != "" {
+			return client.remap(next, queryM, rule)
+		}
+		if rule.NXDomain {
+			responseM, err := next(queryM)
+			if err != nil || responseM.Rcode != dns.RcodeNameError {
+				return responseM, err
+			}
+		}
+		log.WithFields(log.Fields{"Name": question.Name, "Rule": rule.Name, "IP": rule.IP}).Debug("Rewrote answer")
+		return client.forcedAnswer(queryM, rule), nil
+	}
+}
+
+// forcedAnswer answers queryM with the address of rule
+func (client *Client) forcedAnswer(queryM *dns.Msg, rule RewriteRule) *dns.Msg {
+	question := queryM.Question[0]
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.SetReply(queryM)
+	responseM.RecursionAvailable = true
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    client.ruleTTL(rule),
+	}
+	if question.Qtype == dns.TypeA && rule.ip.To4() != nil {
+		responseM.Answer = append(responseM.Answer, &dns.A{Hdr: header, A: rule.ip.To4()})
+	} else if question.Qtype == dns.TypeAAAA && rule.ip.To4() == nil {
+		responseM.Answer = append(responseM.Answer, &dns.AAAA{Hdr: header, AAAA: rule.ip})
+	}
+	return responseM
+}
+
+// remap answers queryM with a CNAME to the target of rule followed by the records of the target
+func (client *Client) remap(next Handler, queryM *dns.Msg, rule RewriteRule) (*dns.Msg, error) {
+	question := queryM.Question[0]
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: client.ruleTTL(rule)},
+		Target: rule.CNAME,
+	}
+	log.WithFields(log.Fields{"Name": question.Name, "Rule": rule.Name, "Target": rule.CNAME}).Debug("Remapped name")
+
+	if question.Qtype == dns.TypeCNAME {
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetReply(queryM)
+		responseM.RecursionAvailable = true
+		responseM.Answer = []dns.RR{cname}
+		return responseM, nil
+	}
+
+	targetQueryM := queryM.Copy()
+	targetQueryM.Question[0].Name = rule.CNAME
+	responseM, err := next(targetQueryM)
+	if err != nil {
+		return nil, err
+	}
+	responseM.Question = queryM.Question
+	responseM.Answer = append([]dns.RR{cname}, responseM.Answer...)
+	// the synthesized CNAME is not signed
+	responseM.AuthenticatedData = false
+	return responseM, nil
+}
+
+// ruleTTL returns the ttl of the records synthesized by rule
+func (client *Client) ruleTTL(rule RewriteRule) uint32 {
+	if rule.TTL > 0 {
+		return rule.TTL
+	}
+	return client.StaticTTL
+}
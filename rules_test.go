@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// nameTransport sends the name of every query to names and answers 192.0.2.1, NXDOMAIN under missing.example
+func nameTransport(names chan string) transportFunc {
+	return func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		names <- queryM.Question[0].Name
+		if dns.IsSubDomain("missing.example.", queryM.Question[0].Name) {
+			var responseM *dns.Msg = new(dns.Msg)
+			responseM.SetRcode(queryM, dns.RcodeNameError)
+			return responseM, nil
+		}
+		return answerA(queryM, "192.0.2.1"), nil
+	}
+}
+
+func TestRewriteRuleFixedA(t *testing.T) {
+	client := newTestClient(t)
+	names := make(chan string, 4)
+	client.AddServer(stubServer("stub", nameTransport(names)))
+	err := client.SetRewriteRules([]RewriteRule{{Name: "Portal.Example.com", IP: "10.1.2.3", TTL: 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responseM := resolveWire(t, client, newQuery("portal.example.com", dns.TypeA))
+	if len(responseM.Answer) != 1 {
+		t.Fatalf("answers %v, want the forced address", responseM.Answer)
+	}
+	a, ok := responseM.Answer[0].(*dns.A)
+	if !ok || a.A.String() != "10.1.2.3" || a.Hdr.Ttl != 60 || a.Hdr.Name != "portal.example.com." {
+		t.Errorf("answer %v, want portal.example.com. 60 A 10.1.2.3", responseM.Answer[0])
+	}
+	responseM = resolveWire(t, client, newQuery("portal.example.com", dns.TypeAAAA))
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 0 {
+		t.Errorf("rcode %s answers %v, want NODATA for AAAA", dns.RcodeToString[responseM.Rcode], responseM.Answer)
+	}
+	if len(names) != 0 {
+		t.Errorf("%d forced queries sent upstream", len(names))
+	}
+
+	// other names are resolved upstream
+	responseM = resolveWire(t, client, newQuery("www.example.com", dns.TypeA))
+	if len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.1" || <-names != "www.example.com." {
+		t.Errorf("answers %v, want the upstream answer", responseM.Answer)
+	}
+}
+
+func TestRewriteRuleRemap(t *testing.T) {
+	client := newTestClient(t)
+	names := make(chan string, 4)
+	client.AddServer(stubServer("stub", nameTransport(names)))
+	err := client.SetRewriteRules([]RewriteRule{
+		{Name: "old.example.com", CNAME: "new.example.com"},
+		{Name: "*.missing.example", IP: "10.9.9.9", NXDomain: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responseM := resolveWire(t, client, newQuery("old.example.com", dns.TypeA))
+	if <-names != "new.example.com." {
+		t.Error("target of the remap not resolved")
+	}
+	if len(responseM.Answer) != 2 || responseM.Question[0].Name != "old.example.com." {
+		t.Fatalf("response %v, want the CNAME and the address of the target", responseM)
+	}
+	if cname, ok := responseM.Answer[0].(*dns.CNAME); !ok || cname.Target != "new.example.com." {
+		t.Errorf("answer %v, want a CNAME to new.example.com.", responseM.Answer[0])
+	}
+
+	// NXDOMAIN rules only replace negative answers
+	responseM = resolveWire(t, client, newQuery("host.missing.example", dns.TypeA))
+	<-names
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "10.9.9.9" {
+		t.Errorf("response %v, want the NXDOMAIN replaced by 10.9.9.9", responseM)
+	}
+}
+
+func TestRewriteRulesFromConfig(t *testing.T) {
+	upstream, _ := startStubTCP(t, answerHandler)
+	client := newTestClient(t)
+	err := client.LoadConfig(writeConfig(t, `{"upstreams": [`+tcpUpstreamConfig(t, "stub", upstream)+`],
+		"rewrites": [{"name": "*.ads.example", "ip": "0.0.0.0"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseM := resolveWire(t, client, newQuery("tracker.ads.example", dns.TypeA))
+	if len(responseM.Answer) != 1 || !responseM.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+		t.Errorf("answers %v, want the address of the rule", responseM.Answer)
+	}
+
+	// an invalid rule rejects the config and keeps the loaded rules
+	for _, rule := range []string{`{"name": "x.example"}`, `{"name": "x.example", "ip": "10.0.0.1", "cname": "y.example"}`, `{"name": "x.example", "ip": "nowhere"}`} {
+		err = client.LoadConfig(writeConfig(t, `{"upstreams": [`+tcpUpstreamConfig(t, "stub", upstream)+`], "rewrites": [`+rule+`]}`))
+		if err != ErrInvalidRewriteRule {
+			t.Errorf("rule %s: error %v, want ErrInvalidRewriteRule", rule, err)
+		}
+	}
+	if _, ok := client.matchRewriteRule("tracker.ads.example."); !ok {
+		t.Error("rules dropped by an invalid config")
+	}
+}
@@ -1,12 +1,21 @@
 package proxy
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
@@ -16,6 +25,52 @@ import (
 var REQ_DNS int = 1 // DNS request
 var REQ_DOH int = 2 // DoH request
 
+// DoH request methods
+var DOH_JSON string = "json"         // GET with name and type, json response
+var DOH_WIRE_GET string = "wire-get" // RFC 8484 GET with a base64url dns parameter
+
+// block size wire format queries are padded to, as recommended by RFC 8467
+var DOH_QUERY_PADDING_BLOCK int = 128
+
+// largest random_padding parameter added to DoH json urls
+var DOH_RANDOM_PADDING_MAX int = 128
+
+// DoH json urls are not padded beyond this length
+var DOH_MAX_URL_LENGTH int = 2048
+
+// characters of the random_padding parameter, unreserved so they are not escaped
+const paddingChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~"
+
+// largest RFC 8484 wire format response body read, in bytes
+// the body is a single DNS message, which can be as large as a TCP answer
+var DOH_MAX_RESPONSE_SIZE int = dns.MaxMsgSize
+
+// largest DoH json response body read, in bytes
+// json has no message size bound of its own, raise it for upstreams sending larger answers
+var DOH_MAX_JSON_RESPONSE_SIZE int = 8192
+
+// ErrResponseTooLarge is returned when a DoH response body exceeds DOH_MAX_RESPONSE_SIZE or DOH_MAX_JSON_RESPONSE_SIZE
+var ErrResponseTooLarge = errors.New("DoH response too large")
+
+// number of TLS sessions kept per upstream for resumption
+var TLS_SESSION_CACHE_SIZE int = 64
+
+// how long a request waits for a free slot on a busy upstream
+var INFLIGHT_WAIT time.Duration = 100 * time.Millisecond
+
+// ErrUpstreamBusy is returned when an upstream has reached its in flight limit
+var ErrUpstreamBusy = errors.New("Upstream has too many requests in flight")
+
+// how long a query waits for a free slot when the client reached MaxConcurrentUpstream
+var UPSTREAM_QUEUE_WAIT time.Duration = 500 * time.Millisecond
+
+// ErrProxyUnsupported is returned when a proxy is set on an upstream whose transport cannot be proxied
+// such upstreams fail rather than connect directly
+var ErrProxyUnsupported = errors.New("Upstream transport cannot use a proxy")
+
+// ErrTooManyUpstream is returned when the client has reached MaxConcurrentUpstream
+var ErrTooManyUpstream = errors.New("Too many queries in flight to upstreams")
+
 // Server serves server side traffics
 type Server struct {
 	// name of the resolver
@@ -25,7 +80,8 @@ type Server struct {
 	// IP for DNS, url for DoH
 	Upstream string
 
-	// header
+	// headers added to every DoH request
+	// accept is set to application/dns-json by Init
 	Header map[string]string
 
 	// port number of the upstream server
@@ -37,6 +93,101 @@ type Server struct {
 
 	// https client set header of get request
 	httpClient http.Client
+
+	// send DoH requests over HTTP/3, falling back to HTTP/2 when QUIC fails
+	// set with SetHTTP3
+	UseHTTP3 bool
+
+	// HTTP/3 client, nil unless UseHTTP3
+	// shared between copies of the server
+	h3 *http3State
+
+	// TLS sessions of DoH and DNS over TLS connections, resumed so that new connections skip the full handshake
+	// shared between copies of the server, nil for servers not created with Init
+	sessionCache tls.ClientSessionCache
+
+	// transport of a DNS upstream: "udp", "tcp" or "tcp-tls"
+	// udp when empty
+	Net string
+
+	// persistent connections for tcp and tcp-tls upstreams
+	// shared between copies of the server
+	pool *connPool
+
+	// request DNSSEC records from a DoH upstream
+	DNSSEC bool
+
+	// ask a DoH json upstream not to validate DNSSEC, sent as cd=1
+	CheckingDisabled bool
+
+	// extra parameters of DoH json urls, e.g. {"ct": "application/dns-json"} or {"edns_client_subnet": "0.0.0.0/0"}
+	// name, type, do and cd are set from the query and cannot be overridden, set with SetQueryParam
+	QueryParams map[string]string
+
+	// maximum number of requests in flight to the upstream
+	// unlimited when 0
+	MaxInFlight int
+
+	// share of queries the random shard strategy sends to the upstream, relative to the others
+	// 1 when below 1, set with SetWeight
+	Weight int
+
+	// semaphore enforcing MaxInFlight
+	// shared between copies of the server
+	inFlight chan struct{}
+
+	// requests in progress, the connections of a replaced server are closed once it is idle
+	// shared between copies of the server
+	usage *upstreamUsage
+
+	// request counters
+	// shared between copies of the server
+	stats *upstreamStats
+
+	// http, https or socks5 proxy used to reach the upstream
+	// direct connection when nil
+	ProxyURL *url.URL
+
+	// virtual host of a DoH upstream addressed by IP, e.g. "dns.google"
+	// sent as the Host header and TLS server name, not overridden when empty
+	Host string
+
+	// DoH request method, DOH_JSON or DOH_WIRE_GET
+	// detected by StartProxy when empty, preferring DOH_WIRE_GET, json until then
+	Method string
+
+	// plain DNS address of the same resolver, e.g. 8.8.8.8:53 for dns.google
+	// retried when a DoH request fails to connect, not used when nil
+	Fallback *Server
+
+	// local address DNS exchanges are sent from, "ip", ":port" or "ip:port"
+	// the OS picks the address and a random port when empty
+	LocalAddr string
+
+	// dialer bound to LocalAddr, nil when LocalAddr is empty
+	dialer *net.Dialer
+
+	// transport used instead of DoH or DNS, e.g. DNSCrypt
+	// chosen from Port and Net when nil
+	Transport Transport
+
+	// timeouts of plain DNS exchanges, the dns library default of 2 seconds when 0
+	// set with SetTimeouts
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// wire format DoH queries are padded to a multiple of PaddingBlock bytes (RFC 7830)
+	// not padded when 0, RFC 8467 recommends DOH_QUERY_PADDING_BLOCK
+	PaddingBlock int
+
+	// add a random_padding parameter of random length to DoH json urls
+	// hides the length of the name asked, ct=application/dns-json is sent with it
+	RandomPadding bool
+
+	// name of the JSONAdapter parsing DoH json responses, e.g. JSON_CLOUDFLARE
+	// JSON_GOOGLE when empty, set with SetJSONProvider
+	JSONProvider string
 }
 
 // Init initialize server
@@ -45,20 +196,440 @@ func (server *Server) Init(upstream string, port int) {
 	server.Upstream = upstream
 	server.Header = make(map[string]string)
 	server.Port = port
+	server.stats = &upstreamStats{}
+	server.usage = &upstreamUsage{}
+	server.sessionCache = tls.NewLRUClientSessionCache(TLS_SESSION_CACHE_SIZE)
+	server.updateTransport()
 	// server.ShutDown = make(chan os.Signal)
 
 	// Initialize Header
-	if server.Name == "Google" {
-		server.Header["accept"] = "application/dns-message"
-	} else {
-		server.Header["accept"] = "application/dns-json"
-	}
+	server.Header["accept"] = "application/dns-json"
 
 	log.SetFormatter(&log.TextFormatter{ForceColors: true})
 	// Only log the Debug level or above.
 	log.SetLevel(log.InfoLevel)
 }
 
+// SetHeader sets a header sent with every DoH request, e.g. Authorization
+// Header names are case insensitive, a new value replaces the previous one
+func (server *Server) SetHeader(key string, value string) {
+	for existing := range server.Header {
+		if strings.EqualFold(existing, key) {
+			delete(server.Header, existing)
+		}
+	}
+	server.Header[key] = value
+}
+
+// redactHeaders returns a copy of the headers safe for logging
+// values of credential headers are replaced
+func redactHeaders(header map[string]string) map[string]string {
+	redacted := make(map[string]string, len(header))
+	for key, value := range header {
+		lower := strings.ToLower(key)
+		if lower == "authorization" || lower == "proxy-authorization" || lower == "cookie" ||
+			strings.Contains(lower, "token") || strings.Contains(lower, "key") || strings.Contains(lower, "secret") {
+			value = "REDACTED"
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
+
+// SetNet sets the transport of a DNS upstream
+// tcp and tcp-tls upstreams reuse connections across queries
+func (server *Server) SetNet(network string) {
+	if server.pool != nil {
+		server.pool.close()
+		server.pool = nil
+	}
+	server.Net = network
+	if network == "tcp" || network == "tcp-tls" {
+		server.pool = newConnPool(network, fmt.Sprintf("%s:%d", server.Upstream, server.Port))
+		if network == "tcp-tls" {
+			server.pool.dnsClient.TLSConfig = &tls.Config{ClientSessionCache: server.sessionCache}
+		}
+		if server.LocalAddr != "" {
+			// the local address type depends on the transport
+			server.SetLocalAddr(server.LocalAddr)
+		}
+		if server.ProxyURL != nil {
+			err := server.pool.setProxy(server.ProxyURL)
+			if err != nil {
+				log.WithFields(log.Fields{"Error": err}).Error("Failed to create proxy dialer")
+			}
+		}
+	}
+}
+
+// SetLocalAddr binds DNS exchanges to a local address and port, e.g. for firewall rules
+// A fixed port can only be bound by one exchange at a time, so it also limits the upstream to one request in flight
+// An empty addr restores the OS assigned address and port
+func (server *Server) SetLocalAddr(addr string) error {
+	if addr == "" {
+		server.LocalAddr = ""
+		server.dialer = nil
+		server.updateDialer()
+		return nil
+	}
+
+	host, portString := addr, "0"
+	if strings.Contains(addr, ":") && net.ParseIP(addr) == nil {
+		var err error
+		host, portString, err = net.SplitHostPort(addr)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "LocalAddr": addr}).Error("Invalid local address")
+			return err
+		}
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		log.WithFields(log.Fields{"LocalAddr": addr}).Error("Invalid local port")
+		return errors.New("Invalid local port " + portString)
+	}
+	var ip net.IP
+	if host != "" {
+		ip = net.ParseIP(host)
+		if ip == nil {
+			log.WithFields(log.Fields{"LocalAddr": addr}).Error("Invalid local ip")
+			return errors.New("Invalid local ip " + host)
+		}
+	}
+
+	server.LocalAddr = addr
+	server.dialer = &net.Dialer{}
+	if server.Net == "tcp" || server.Net == "tcp-tls" {
+		server.dialer.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+	} else {
+		server.dialer.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+	}
+	server.updateDialer()
+
+	if port != 0 && server.MaxInFlight != 1 {
+		server.SetMaxInFlight(1)
+	}
+	return nil
+}
+
+// updateDialer hands the local address dialer and the timeouts to the connection pool
+func (server *Server) updateDialer() {
+	if server.dialer != nil {
+		// the dns library ignores DialTimeout when a dialer is given
+		server.dialer.Timeout = server.DialTimeout
+	}
+	if server.pool != nil {
+		server.pool.dnsClient.Dialer = server.dialer
+		server.pool.dnsClient.DialTimeout = server.DialTimeout
+		server.pool.dnsClient.ReadTimeout = server.ReadTimeout
+		server.pool.dnsClient.WriteTimeout = server.WriteTimeout
+	}
+}
+
+// SetTimeouts sets the dial, read and write timeouts of plain DNS exchanges
+// 0 keeps the dns library default of 2 seconds
+func (server *Server) SetTimeouts(dial time.Duration, read time.Duration, write time.Duration) {
+	server.DialTimeout = dial
+	server.ReadTimeout = read
+	server.WriteTimeout = write
+	server.updateDialer()
+}
+
+// dnsClient returns a client for one exchange over network with the timeouts and local address of the server
+func (server *Server) dnsClient(network string) *dns.Client {
+	dnsClient := &dns.Client{
+		Net:          network,
+		Dialer:       server.dialer,
+		DialTimeout:  server.DialTimeout,
+		ReadTimeout:  server.ReadTimeout,
+		WriteTimeout: server.WriteTimeout,
+	}
+	if server.dialer != nil && network == "tcp" {
+		// the local address was set up for udp
+		if local, ok := server.dialer.LocalAddr.(*net.UDPAddr); ok {
+			dialer := *server.dialer
+			dialer.LocalAddr = &net.TCPAddr{IP: local.IP, Port: local.Port}
+			dnsClient.Dialer = &dialer
+		}
+	}
+	return dnsClient
+}
+
+// SetProxy routes upstream traffic through an http, https or socks5 proxy
+// DoH requests go through any of them, tcp and tcp-tls upstreams require socks5
+// Plain udp upstreams cannot be proxied, ErrProxyUnsupported is returned for them
+func (server *Server) SetProxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Proxy": proxyURL}).Error("Invalid proxy url")
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		log.WithFields(log.Fields{"Proxy": proxyURL}).Error("Unsupported proxy scheme")
+		return errors.New("Unsupported proxy scheme")
+	}
+	if u.Host == "" {
+		log.WithFields(log.Fields{"Proxy": proxyURL}).Error("Proxy url has no host")
+		return errors.New("Proxy url has no host")
+	}
+	if server.pool == nil && server.isDNS() {
+		log.WithFields(log.Fields{"Proxy": proxyURL, "Resolver": server.Name}).Error("Plain udp upstreams cannot use a proxy")
+		return ErrProxyUnsupported
+	}
+	if server.pool != nil && u.Scheme != "socks5" {
+		log.WithFields(log.Fields{"Proxy": proxyURL, "Net": server.Net}).Error("DNS upstream requires a socks5 proxy")
+		return errors.New("DNS upstream requires a socks5 proxy")
+	}
+
+	server.ProxyURL = u
+	server.updateTransport()
+	if server.pool != nil {
+		err = server.pool.setProxy(u)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "Proxy": proxyURL}).Error("Failed to create proxy dialer")
+			return err
+		}
+	}
+	return nil
+}
+
+// SetHost overrides the Host header and TLS server name of DoH requests
+func (server *Server) SetHost(host string) {
+	server.Host = host
+	server.updateTransport()
+	if server.UseHTTP3 {
+		server.SetHTTP3(true)
+	}
+}
+
+// updateTransport rebuilds the https transport from the proxy, host and TLS session settings
+// Go's TLS client does not send 0-RTT early data, resumption saves a round trip on TLS 1.2 only
+// and the certificate exchange on TLS 1.3
+func (server *Server) updateTransport() {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if server.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(server.ProxyURL)
+	}
+	// the server name is taken from the url when Host is empty
+	transport.TLSClientConfig = &tls.Config{
+		ServerName:         server.Host,
+		ClientSessionCache: server.sessionCache,
+	}
+	server.httpClient.Transport = transport
+}
+
+// SetPadding pads wire format queries to a multiple of block bytes
+// 0 disables padding
+func (server *Server) SetPadding(block int) {
+	if block < 0 {
+		block = 0
+	}
+	server.PaddingBlock = block
+}
+
+// SetMethod selects how DoH queries are sent to the upstream
+func (server *Server) SetMethod(method string) error {
+	switch method {
+	case "", DOH_JSON, DOH_WIRE_GET:
+	default:
+		log.WithFields(log.Fields{"Method": method}).Error("Unsupported DoH method")
+		return errors.New("Unsupported DoH method " + method)
+	}
+	server.Method = method
+	return nil
+}
+
+// SetJSONProvider selects the adapter registered with RegisterJSONAdapter which parses DoH json responses
+func (server *Server) SetJSONProvider(provider string) error {
+	_, err := lookupJSONAdapter(provider)
+	if err != nil {
+		log.WithFields(log.Fields{"Provider": provider}).Error("Unknown json provider")
+		return err
+	}
+	server.JSONProvider = provider
+	return nil
+}
+
+// isWire reports whether DoH queries are sent in wire format
+func (server *Server) isWire() bool {
+	return server.Method == DOH_WIRE_GET
+}
+
+// SetQueryParam adds a parameter sent with every DoH json query
+// An empty value removes the parameter
+func (server *Server) SetQueryParam(key string, value string) {
+	if value == "" {
+		delete(server.QueryParams, key)
+		return
+	}
+	if server.QueryParams == nil {
+		server.QueryParams = make(map[string]string)
+	}
+	server.QueryParams[key] = value
+}
+
+// SetWeight sets the share of queries the random shard strategy sends to the upstream, relative to the others
+// values below 1 count as 1
+func (server *Server) SetWeight(weight int) {
+	server.Weight = weight
+}
+
+// weight returns the weight used by the random shard strategy, at least 1
+func (server *Server) weight() int {
+	if server.Weight < 1 {
+		return 1
+	}
+	return server.Weight
+}
+
+// SetMaxInFlight limits the number of concurrent requests to the upstream
+// 0 removes the limit
+func (server *Server) SetMaxInFlight(limit int) {
+	server.MaxInFlight = limit
+	if limit > 0 {
+		server.inFlight = make(chan struct{}, limit)
+	} else {
+		server.inFlight = nil
+	}
+}
+
+// acquire takes an in flight slot, waiting at most INFLIGHT_WAIT
+func (server *Server) acquire(ctx context.Context) error {
+	err := server.waitSlot(ctx)
+	if err != nil {
+		return err
+	}
+	server.usage.begin()
+	return nil
+}
+
+// waitSlot takes a slot of the MaxInFlight semaphore
+func (server *Server) waitSlot(ctx context.Context) error {
+	if server.inFlight == nil {
+		return nil
+	}
+	select {
+	case server.inFlight <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(INFLIGHT_WAIT)
+	defer timer.Stop()
+	select {
+	case server.inFlight <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		log.WithFields(log.Fields{"Upstream": server.Upstream, "Limit": server.MaxInFlight}).Warn("Upstream busy")
+		return ErrUpstreamBusy
+	}
+}
+
+// release frees the in flight slot taken by acquire
+func (server *Server) release() {
+	server.usage.end()
+	if server.inFlight == nil {
+		return
+	}
+	<-server.inFlight
+}
+
+// upstreamUsage counts the requests in progress on an upstream
+// a server replaced by a reload keeps serving the queries which selected it, its connections are closed once they are done
+type upstreamUsage struct {
+	lock   sync.Mutex
+	active int
+
+	// closes the connections of a replaced server, nil while the server is in use
+	retire func()
+}
+
+// begin counts a request starting
+func (usage *upstreamUsage) begin() {
+	if usage == nil {
+		return
+	}
+	usage.lock.Lock()
+	usage.active++
+	usage.lock.Unlock()
+}
+
+// end counts a request finishing and closes the connections of a replaced server left idle
+func (usage *upstreamUsage) end() {
+	if usage == nil {
+		return
+	}
+	usage.lock.Lock()
+	usage.active--
+	retire := usage.retire
+	idle := usage.active == 0
+	usage.lock.Unlock()
+	if idle && retire != nil {
+		retire()
+	}
+}
+
+// retire closes the connections of the server and its fallbacks once no request uses them
+// Requests still holding a copy of the server can use it afterwards, new connections are closed when they finish
+func (server *Server) retire() {
+	for retired := server; retired != nil; retired = retired.Fallback {
+		// the connections are captured now, the close may run later on another goroutine
+		pool, h3 := retired.pool, retired.h3
+		close := func() {
+			if pool != nil {
+				pool.close()
+			}
+			if h3 != nil {
+				h3.transport.Close()
+			}
+		}
+		usage := retired.usage
+		if usage == nil {
+			close()
+			continue
+		}
+		usage.lock.Lock()
+		usage.retire = close
+		idle := usage.active == 0
+		usage.lock.Unlock()
+		if idle {
+			close()
+		}
+	}
+}
+
+// protocol names the transport used to reach the upstream
+func (server *Server) protocol() string {
+	if server.Transport != nil {
+		return "transport"
+	}
+	if server.isDNS() {
+		if server.Net == "" {
+			return "udp"
+		}
+		return server.Net
+	}
+	if server.isWire() {
+		return "doh-wire"
+	}
+	return "doh-json"
+}
+
+// connectionError reports whether err is a network failure rather than a bad answer
+func connectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isDNS reports whether the server is a plain DNS or DoT upstream
+// port 53 defaults to udp, other ports need their transport set with SetNet
+func (server *Server) isDNS() bool {
+	return server.Port == 53 || server.Net == "udp" || server.Net == "tcp" || server.Net == "tcp-tls"
+}
+
 // Resolve as the server funciton will call the corresponding DoH or DNS function based on the requested service
 func (server *Server) Resolve(queryM *dns.Msg, reqType int) (*dns.Msg, error) {
 	questions := queryM.Question
@@ -68,7 +639,14 @@ func (server *Server) Resolve(queryM *dns.Msg, reqType int) (*dns.Msg, error) {
 
 	var responseM *dns.Msg = new(dns.Msg)
 
-	if reqType == REQ_DOH {
+	if reqType == REQ_DOH && server.isWire() {
+		responseMsg, err := DoHGetWire(server, queryM)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Failed performing DoH")
+			return nil, err
+		}
+		responseM = responseMsg
+	} else if reqType == REQ_DOH {
 		for _, question := range questions {
 			log.WithFields(log.Fields{"Question": question}).Debug("Question received")
 
@@ -102,71 +680,293 @@ func (server *Server) Resolve(queryM *dns.Msg, reqType int) (*dns.Msg, error) {
 // DoH makes an https request and resolves the question using miekg/dns
 // NOTE: This function is to be removed, for now it is kept here for compatibilities for older version
 func DoH(server *Server, question dns.Question) (map[string]interface{}, error) {
+	return DoHContext(context.Background(), server, question)
+}
+
+// DoHContext is DoH with a context cancelling the https request
+func DoHContext(ctx context.Context, server *Server, question dns.Question) (map[string]interface{}, error) {
 	log.Debug("This function call will be removed in future version")
 	if server.Port != 443 {
-		log.Fatal("Unable to make https request from a server for other purpose")
+		log.WithFields(log.Fields{"Upstream": server.Upstream, "Port": server.Port}).Error("Unable to make https request from a server for other purpose")
 		return nil, errors.New("Invalid Port Number")
 	}
-	query := question.Name
-	queryType := strconv.Itoa(int(question.Qtype))
-	queryURL := fmt.Sprintf("https://%s?name=%s&type=%s", server.Upstream, query, queryType)
+
+	err := server.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer server.release()
+
+	queryURL, err := server.queryURL(question)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Upstream": server.Upstream}).Error("Error parsing upstream url")
+		return nil, err
+	}
 	log.WithFields(log.Fields{"Url": queryURL}).Info("Constructed Url")
 
-	// contruct http.client for get request with header set for json
-	req, err := http.NewRequest("GET", queryURL, nil)
+	responseBytes, _, err := server.get(ctx, queryURL, "", DOH_MAX_JSON_RESPONSE_SIZE)
 	if err != nil {
-		log.WithFields(log.Fields{"Error": err}).Error("Error creating request")
 		return nil, err
 	}
 
+	adapter, err := lookupJSONAdapter(server.JSONProvider)
+	if err != nil {
+		return nil, err
+	}
+	responseMap, err := adapter.Parse(responseBytes)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Provider": server.JSONProvider}).Error("Error marshaling HTTPS response body")
+		return nil, err
+	}
+	server.stats.recordJSON(responseMap)
+
+	return responseMap, nil
+}
+
+// DoHGetWire resolves the query with an RFC 8484 GET request
+func DoHGetWire(server *Server, queryM *dns.Msg) (*dns.Msg, error) {
+	return DoHGetWireContext(context.Background(), server, queryM)
+}
+
+// DoHGetWireContext is DoHGetWire with a context cancelling the https request
+// The query is sent with id 0 so that responses can be cached by http caches
+func DoHGetWireContext(ctx context.Context, server *Server, queryM *dns.Msg) (*dns.Msg, error) {
+	if server.Port != 443 {
+		log.Error("Unable to make https request from a server for other purpose")
+		return nil, errors.New("Invalid Port Number")
+	}
+
+	err := server.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer server.release()
+
+	wireM := queryM.Copy()
+	wireM.Id = 0
+	if server.DNSSEC {
+		setDO(wireM)
+	}
+	if server.PaddingBlock > 0 {
+		// the padding option is the last one added so that it covers the whole message
+		padQuery(wireM, server.PaddingBlock)
+	}
+	queryBytes, err := wireM.Pack()
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Error packing DoH query")
+		return nil, err
+	}
+
+	queryURL, err := server.wireURL(queryBytes)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Upstream": server.Upstream}).Error("Error parsing upstream url")
+		return nil, err
+	}
+	log.WithFields(log.Fields{"Url": queryURL}).Info("Constructed Url")
+
+	responseBytes, header, err := server.get(ctx, queryURL, "application/dns-message", DOH_MAX_RESPONSE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	responseM := new(dns.Msg)
+	err = responseM.Unpack(responseBytes)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Error unpacking HTTPS response body")
+		return nil, err
+	}
+	responseM.Id = queryM.Id
+
+	// the answer must not be cached longer than the http response
+	if maxAge, ok := freshness(header); ok {
+		clampTTL(responseM, maxAge)
+	}
+
+	return responseM, nil
+}
+
+// get sends a DoH get request and returns the response body and headers
+// accept replaces the accept header when not empty, bodies larger than limit bytes are rejected
+func (server *Server) get(ctx context.Context, queryURL string, accept string, limit int) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL, nil)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Error("Error creating request")
+		return nil, nil, err
+	}
+
 	// Add header fields
 	for key, value := range server.Header {
-		req.Header.Add(key, value)
+		req.Header.Set(key, value)
 	}
+	if accept != "" {
+		req.Header.Set("accept", accept)
+	}
+	log.WithFields(log.Fields{"Headers": redactHeaders(server.Header)}).Debug("Request headers")
 
-	// Special to Google
-	// May need to consider to move to different place
-	if server.Name == "Google" {
-		req.Host = "dns.google"
+	if server.Host != "" {
+		req.Host = server.Host
 	}
 
-	resp, err := server.httpClient.Do(req)
+	resp, err := server.do(req)
 	if err != nil {
 		log.WithFields(log.Fields{"Error": err}).Error("Error during DoH get request")
-		return nil, err
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.WithFields(log.Fields{"Status": resp.Status, "Upstream": server.Upstream}).Error("Unexpected DoH response status")
+		return nil, nil, errors.New("DoH upstream returned " + resp.Status)
 	}
 
-	responseBytes, err := ioutil.ReadAll(resp.Body)
+	// a broken or hostile upstream must not make the proxy buffer an unbounded body
+	if resp.ContentLength > int64(limit) {
+		log.WithFields(log.Fields{"Size": resp.ContentLength, "Limit": limit, "Upstream": server.Upstream}).Error("DoH response too large")
+		return nil, nil, ErrResponseTooLarge
+	}
+	responseBytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
 	if err != nil {
 		log.WithFields(log.Fields{"Error": err}).Error("Error parsing HTTPS response body")
-		return nil, err
+		return nil, nil, err
 	}
+	if len(responseBytes) > limit {
+		log.WithFields(log.Fields{"Limit": limit, "Upstream": server.Upstream}).Error("DoH response too large")
+		return nil, nil, ErrResponseTooLarge
+	}
+	return responseBytes, resp.Header, nil
+}
 
-	responseMap := make(map[string]interface{})
-	err = json.Unmarshal(responseBytes, &responseMap)
+// freshness returns how long the http response may be cached, max-age minus Age (RFC 8484 section 5.1)
+// Returns false if the response has no max-age
+func freshness(header http.Header) (uint32, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(strings.ToLower(directive), "max-age=") {
+			continue
+		}
+		maxAge, err := strconv.ParseUint(strings.Trim(directive[len("max-age="):], `"`), 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		// an invalid Age is ignored
+		age, _ := strconv.ParseUint(header.Get("Age"), 10, 32)
+		if age > maxAge {
+			age = maxAge
+		}
+		return uint32(maxAge - age), true
+	}
+	return 0, false
+}
+
+// wireURL builds the RFC 8484 query url carrying the packed query
+// Upstream may contain a path and query parameters, which are preserved
+func (server *Server) wireURL(query []byte) (string, error) {
+	u, err := server.upstreamURL()
 	if err != nil {
-		log.WithFields(log.Fields{"Error": err}).Error("Error marshaling HTTPS response body")
-		return nil, err
+		return "", err
 	}
 
-	return responseMap, nil
+	values := u.Query()
+	values.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+	u.RawQuery = values.Encode()
+
+	return u.String(), nil
+}
+
+// upstreamURL parses Upstream, defaulting to https when it has no scheme
+func (server *Server) upstreamURL() (*url.URL, error) {
+	upstream := server.Upstream
+	if !strings.Contains(upstream, "://") {
+		upstream = "https://" + upstream
+	}
+	return url.Parse(upstream)
+}
+
+// queryURL builds the DoH json query url for the question
+// Upstream may contain a path and query parameters, which are preserved
+func (server *Server) queryURL(question dns.Question) (string, error) {
+	u, err := server.upstreamURL()
+	if err != nil {
+		return "", err
+	}
+
+	values := u.Query()
+	for key, value := range server.QueryParams {
+		values.Set(key, value)
+	}
+	values.Set("name", question.Name)
+	values.Set("type", strconv.Itoa(int(question.Qtype)))
+	if server.DNSSEC {
+		values.Set("do", "1")
+	}
+	if server.CheckingDisabled {
+		values.Set("cd", "1")
+	}
+	if server.RandomPadding {
+		values.Set("ct", "application/dns-json")
+	}
+	u.RawQuery = values.Encode()
+	if !server.RandomPadding {
+		return u.String(), nil
+	}
+
+	// the url must stay below the length upstreams accept
+	room := DOH_MAX_URL_LENGTH - len(u.String()) - len("&random_padding=")
+	if room > DOH_RANDOM_PADDING_MAX {
+		room = DOH_RANDOM_PADDING_MAX
+	}
+	if room > 0 {
+		values.Set("random_padding", randomPadding(1+rand.Intn(room)))
+		u.RawQuery = values.Encode()
+	}
+	return u.String(), nil
+}
+
+// randomPadding returns length random url safe characters
+func randomPadding(length int) string {
+	padding := make([]byte, length)
+	for i := range padding {
+		padding[i] = paddingChars[rand.Intn(len(paddingChars))]
+	}
+	return string(padding)
 }
 
 // DNS forwards the DNS query and resolve the message
 // NOTE: This function is to be removed, for now it is kept here for compatibilities for older version
 func DNS(server *Server, queryM *dns.Msg) (*dns.Msg, error) {
+	return DNSContext(context.Background(), server, queryM)
+}
+
+// DNSContext is DNS with a context cancelling the exchange
+func DNSContext(ctx context.Context, server *Server, queryM *dns.Msg) (*dns.Msg, error) {
 	log.Debug("This function call will be removed in future version")
-	if server.Port != 53 {
-		log.Fatal("Unable to make https request from a server for other purpose")
+	if !server.isDNS() {
+		log.WithFields(log.Fields{"Upstream": server.Upstream, "Port": server.Port}).Error("Unable to make dns request from a server for other purpose")
 		return nil, errors.New("Invalid Port Number")
 	}
 	resolver := fmt.Sprintf("%s:%d", server.Upstream, server.Port)
 
-	dnsClient := &dns.Client{
-		Net: "udp",
+	err := server.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer server.release()
+
+	var responseM *dns.Msg
+	if server.pool != nil {
+		responseM, err = server.pool.exchange(ctx, queryM)
+	} else if server.ProxyURL != nil {
+		// the proxy was set before the transport was switched to udp, never bypass it
+		log.WithFields(log.Fields{"Resolver": server.Name}).Error("Plain udp upstreams cannot use a proxy")
+		return nil, ErrProxyUnsupported
+	} else {
+		responseM, _, err = server.dnsClient("udp").ExchangeContext(ctx, queryM, resolver)
+		if err == nil && responseM.Truncated {
+			// the answer did not fit in a datagram, tcp has no size limit
+			log.WithFields(log.Fields{"name server": resolver}).Debug("Truncated response, retrying over tcp")
+			responseM, _, err = server.dnsClient("tcp").ExchangeContext(ctx, queryM, resolver)
+		}
 	}
-
-	responseM, _, err := dnsClient.Exchange(queryM, resolver)
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -195,5 +995,5 @@ func DNS(server *Server, queryM *dns.Msg) (*dns.Msg, error) {
 
 // PrintInfo prints server ip and port
 func (server *Server) PrintInfo() {
-	fmt.Printf("IP: %s; Port: %d\n", server.Upstream, server.Port)
+	fmt.Printf("IP: %s; Port: %d; Method: %s; Headers: %v\n", server.Upstream, server.Port, server.Method, redactHeaders(server.Header))
 }
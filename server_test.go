@@ -0,0 +1,905 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// parseQueryURL builds the json url of question and parses it back
+func parseQueryURL(t *testing.T, server *Server, question dns.Question) *url.URL {
+	t.Helper()
+	raw, err := server.queryURL(question)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestQueryURLEscapesName(t *testing.T) {
+	var server Server
+	server.Init("8.8.8.8/resolve?ct=application/dns-json", 443)
+
+	name := `we\ird&name=x#.example.com.`
+	u := parseQueryURL(t, &server, dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if u.Scheme != "https" || u.Host != "8.8.8.8" || u.Path != "/resolve" {
+		t.Errorf("url %s does not keep the upstream path", u)
+	}
+	values := u.Query()
+	if values.Get("name") != name {
+		t.Errorf("name parameter %q, want %q", values.Get("name"), name)
+	}
+	if values.Get("type") != "16" {
+		t.Errorf("type parameter %q", values.Get("type"))
+	}
+	if values.Get("ct") != "application/dns-json" {
+		t.Error("query parameters of the upstream were dropped")
+	}
+	if u.Fragment != "" {
+		t.Errorf("name leaked into the fragment %q", u.Fragment)
+	}
+}
+
+func TestQueryURLParams(t *testing.T) {
+	var server Server
+	server.Init("8.8.8.8/resolve", 443)
+	server.SetQueryParam("ct", "application/dns-json")
+	server.SetQueryParam("edns_client_subnet", "0.0.0.0/0")
+	server.SetQueryParam("name", "override.example.")
+	server.DNSSEC = true
+	server.CheckingDisabled = true
+
+	u := parseQueryURL(t, &server, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	values := u.Query()
+	want := map[string]string{
+		"name":               "example.com.",
+		"type":               "1",
+		"do":                 "1",
+		"cd":                 "1",
+		"ct":                 "application/dns-json",
+		"edns_client_subnet": "0.0.0.0/0",
+	}
+	for key, value := range want {
+		if values.Get(key) != value {
+			t.Errorf("parameter %s is %q, want %q in %s", key, values.Get(key), value, u)
+		}
+	}
+
+	server.SetQueryParam("edns_client_subnet", "")
+	server.DNSSEC = false
+	server.CheckingDisabled = false
+	values = parseQueryURL(t, &server, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}).Query()
+	for _, key := range []string{"edns_client_subnet", "do", "cd"} {
+		if values.Has(key) {
+			t.Errorf("parameter %s sent after it was removed", key)
+		}
+	}
+}
+
+func TestQueryURLForwardsFlags(t *testing.T) {
+	queries := make(chan url.Values, 4)
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		jsonAnswer(w, r)
+	})
+	client := newTestClient(t)
+	client.AddServer(dohServer("doh", stub))
+
+	plainM := newQuery("plain.example.com", dns.TypeA)
+	flaggedM := newQuery("flagged.example.com", dns.TypeA)
+	flaggedM.CheckingDisabled = true
+	flaggedM.SetEdns0(1232, true)
+	for _, test := range []struct {
+		queryM *dns.Msg
+		flag   string
+	}{
+		{plainM, ""},
+		{flaggedM, "1"},
+	} {
+		_, err := client.Resolve(test.queryM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := <-queries
+		if values.Get("do") != test.flag || values.Get("cd") != test.flag {
+			t.Errorf("%s sent do=%q cd=%q, want %q", test.queryM.Question[0].Name, values.Get("do"), values.Get("cd"), test.flag)
+		}
+	}
+}
+
+func TestDoHSessionResumption(t *testing.T) {
+	resumed := make(chan bool, 2)
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		resumed <- r.TLS.DidResume
+		jsonAnswer(w, r)
+	})
+	server := dohServer("doh", stub)
+	question := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	for i, want := range []bool{false, true} {
+		_, err := DoH(&server, question)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := <-resumed; got != want {
+			t.Errorf("request %d resumed %t, want %t", i, got, want)
+		}
+		// the next request needs a new connection
+		server.httpClient.CloseIdleConnections()
+		stub.CloseClientConnections()
+	}
+}
+
+func TestContextWrongServer(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+
+	var plainServer Server
+	plainServer.Init("192.0.2.1", 53)
+	_, err := DoHContext(context.Background(), &plainServer, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err == nil || err.Error() != "Invalid Port Number" {
+		t.Errorf("error %v, want Invalid Port Number", err)
+	}
+
+	var httpsServer Server
+	httpsServer.Init("dns.google/resolve", 443)
+	_, err = DNSContext(context.Background(), &httpsServer, newQuery("example.com", dns.TypeA))
+	if err == nil || err.Error() != "Invalid Port Number" {
+		t.Errorf("error %v, want Invalid Port Number", err)
+	}
+
+	logged := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.ErrorLevel {
+			logged++
+		}
+	}
+	if logged != 2 {
+		t.Errorf("%d errors logged, want one per call", logged)
+	}
+}
+
+func TestDoHResponseTooLarge(t *testing.T) {
+	// a valid json answer padded with a comment past the limit
+	oversized := func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprintf(w, `{"Status":0,"Question":[{"name":%q,"type":1}],"Answer":[{"name":%q,"type":1,"TTL":300,"data":"192.0.2.1"}],"Comment":%q}`,
+			name, name, strings.Repeat("x", 16384))
+	}
+	withLength := startStubDoH(t, oversized)
+	// flushing first sends the body chunked, without a Content-Length to reject it by
+	chunked := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		oversized(w, r)
+	})
+	question := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	for _, stub := range []*httptest.Server{withLength, chunked} {
+		server := dohServer("doh", stub)
+		_, err := DoH(&server, question)
+		if !errors.Is(err, ErrResponseTooLarge) {
+			t.Errorf("error %v, want ErrResponseTooLarge", err)
+		}
+	}
+
+	original := DOH_MAX_JSON_RESPONSE_SIZE
+	DOH_MAX_JSON_RESPONSE_SIZE = 32768
+	t.Cleanup(func() { DOH_MAX_JSON_RESPONSE_SIZE = original })
+	server := dohServer("doh", chunked)
+	responseMap, err := DoH(&server, question)
+	if err != nil || responseMap["Status"] != float64(0) {
+		t.Errorf("response %v error %v, want the answer within a raised limit", responseMap["Status"], err)
+	}
+
+	// wire format answers are bounded by the DNS message size only
+	large := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		query, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		var queryM dns.Msg
+		queryM.Unpack(query)
+		responseM, _ := manyAnswers(1000)(r.Context(), &queryM)
+		response, _ := responseM.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(response)
+	})
+	server = dohServer("doh", large)
+	responseM, err := DoHGetWire(&server, newQuery("example.com", dns.TypeA))
+	if err != nil || len(responseM.Answer) != 1000 {
+		t.Errorf("error %v, want the 1000 answers of a wire format body above the json limit", err)
+	}
+}
+
+// startConnectProxy runs an http proxy tunnelling CONNECT requests and counts them
+func startConnectProxy(t *testing.T) (*httptest.Server, *int32) {
+	var tunnels int32
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&tunnels, 1)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(proxyServer.Close)
+	return proxyServer, &tunnels
+}
+
+func TestDoHThroughHTTPProxy(t *testing.T) {
+	stub := startStubDoH(t, jsonAnswer)
+	proxyServer, tunnels := startConnectProxy(t)
+
+	server := dohServer("stub", stub)
+	err := server.SetProxy(proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustStub(&server)
+
+	responseM, err := server.Query(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseM.Answer) != 1 {
+		t.Fatalf("answer %v", responseM.Answer)
+	}
+	if atomic.LoadInt32(tunnels) == 0 {
+		t.Error("request did not go through the proxy")
+	}
+}
+
+func TestSetProxyValidation(t *testing.T) {
+	var server Server
+	server.Init("dns.example", 443)
+	for _, proxyURL := range []string{"ftp://127.0.0.1:21", "http://", "://bad"} {
+		if server.SetProxy(proxyURL) == nil {
+			t.Errorf("proxy %q accepted", proxyURL)
+		}
+	}
+
+	var tcpServer Server
+	tcpServer.Init("192.0.2.1", 53)
+	tcpServer.SetNet("tcp")
+	if tcpServer.SetProxy("http://127.0.0.1:8080") == nil {
+		t.Error("http proxy accepted for a tcp upstream")
+	}
+	if tcpServer.SetProxy("socks5://127.0.0.1:1080") != nil {
+		t.Error("socks5 proxy refused for a tcp upstream")
+	}
+}
+
+func TestUDPRefusesProxy(t *testing.T) {
+	var server Server
+	server.Init("192.0.2.1", 53)
+	if server.SetProxy("socks5://127.0.0.1:1080") != ErrProxyUnsupported {
+		t.Error("proxy accepted for a udp upstream")
+	}
+
+	// a proxy kept from a tcp transport is never bypassed
+	var switched Server
+	switched.Init("192.0.2.1", 53)
+	switched.SetNet("tcp")
+	switched.SetProxy("socks5://127.0.0.1:1080")
+	switched.SetNet("udp")
+	_, err := switched.Query(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != ErrProxyUnsupported {
+		t.Errorf("udp query with a proxy returned %v, want ErrProxyUnsupported", err)
+	}
+
+	_, err = newServer(upstreamConfig{Name: "udp", Upstream: "192.0.2.1", Port: 53, Proxy: "socks5://127.0.0.1:1080"})
+	if err != ErrProxyUnsupported {
+		t.Errorf("config with a proxied udp upstream returned %v", err)
+	}
+}
+
+func TestBusyUpstreamFailsOver(t *testing.T) {
+	wait := INFLIGHT_WAIT
+	INFLIGHT_WAIT = 10 * time.Millisecond
+	defer func() { INFLIGHT_WAIT = wait }()
+
+	client := newTestClient(t)
+	busy := stubServer("busy", staticTransport("192.0.2.1"))
+	busy.Upstream = "192.0.2.1"
+	busy.SetMaxInFlight(1)
+	client.AddServer(busy)
+	healthy := stubServer("healthy", staticTransport("192.0.2.2"))
+	healthy.Upstream = "192.0.2.2"
+	client.AddServer(healthy)
+
+	// a slow request holds the only slot, copies of the server share it
+	err := busy.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.release()
+
+	_, err = busy.Query(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != ErrUpstreamBusy {
+		t.Fatalf("query over the limit returned %v, want ErrUpstreamBusy", err)
+	}
+	for i := 0; i < 20; i++ {
+		responseM, err := client.Resolve(newQuery(fmt.Sprintf("host%d.example.com", i), dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := responseM.Answer[0].(*dns.A).A.String(); ip != "192.0.2.2" {
+			t.Errorf("answered %s, want the healthy upstream", ip)
+		}
+	}
+}
+
+// headerStub answers json queries and records the headers of the last request
+func headerStub(t *testing.T) (*httptest.Server, *atomic.Value) {
+	var header atomic.Value
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		header.Store(r.Header.Clone())
+		jsonAnswer(w, r)
+	})
+	return stub, &header
+}
+
+func TestConfigHeadersSent(t *testing.T) {
+	stub, header := headerStub(t)
+	server, err := newServer(upstreamConfig{
+		Name:     "private",
+		Upstream: strings.TrimPrefix(stub.URL, "https://") + "/resolve",
+		Port:     443,
+		Headers:  map[string]string{"X-Api-Key": "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustStub(&server)
+
+	_, err = server.Query(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := header.Load().(http.Header)
+	if sent.Get("X-Api-Key") != "secret" {
+		t.Errorf("X-Api-Key %q, want the configured value", sent.Get("X-Api-Key"))
+	}
+	if sent.Get("Accept") != "application/dns-json" {
+		t.Errorf("accept %q, want the default kept", sent.Get("Accept"))
+	}
+}
+
+func TestAuthorizationHeaderSent(t *testing.T) {
+	stub, header := headerStub(t)
+	client := newTestClient(t)
+	client.AddUpstreamWithHeaders("private", strings.TrimPrefix(stub.URL, "https://")+"/resolve", 443, map[string]string{"Authorization": "Bearer token"})
+	trustStub(&client.Resolvers[0])
+
+	_, err := client.Resolve(newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := header.Load().(http.Header).Get("Authorization"); auth != "Bearer token" {
+		t.Errorf("Authorization %q, want the configured token", auth)
+	}
+
+	redacted := redactHeaders(client.Resolvers[0].Header)
+	if redacted["Authorization"] != "REDACTED" || redacted["accept"] != "application/dns-json" {
+		t.Errorf("logged headers %v, want only the credential redacted", redacted)
+	}
+}
+
+func TestHostOverride(t *testing.T) {
+	var host atomic.Value
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		jsonAnswer(w, r)
+	})
+	server := dohServer("doh", stub)
+	_, err := server.Query(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Load() != strings.TrimPrefix(stub.URL, "https://") {
+		t.Errorf("Host %v without an override, want the upstream address", host.Load())
+	}
+
+	server.SetHost("dns.example")
+	trustStub(&server)
+	_, err = server.Query(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Load() != "dns.example" {
+		t.Errorf("Host %v, want dns.example", host.Load())
+	}
+	if name := server.httpClient.Transport.(*http.Transport).TLSClientConfig.ServerName; name != "dns.example" {
+		t.Errorf("TLS server name %q, want dns.example", name)
+	}
+}
+
+// wireAnswer answers RFC 8484 GET queries with an A record of 192.0.2.1
+func wireAnswer(w http.ResponseWriter, r *http.Request) {
+	query, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var queryM dns.Msg
+	err = queryM.Unpack(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, _ := answerA(&queryM, "192.0.2.1").Pack()
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(response)
+}
+
+func TestWireURLEncoding(t *testing.T) {
+	var server Server
+	server.Init("dns.example/dns-query?key=value", 443)
+	// bytes which base64 encodes to + and / and pads with =
+	query := []byte{0xfb, 0xff, 0xbf, 0x01}
+	raw, err := server.wireURL(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := u.Query().Get("dns")
+	if encoded != "-_-_AQ" {
+		t.Errorf("dns parameter %q, want unpadded base64url", encoded)
+	}
+	if u.Path != "/dns-query" || u.Query().Get("key") != "value" {
+		t.Errorf("url %s does not keep the upstream path and parameters", u)
+	}
+}
+
+func TestDoHGetWire(t *testing.T) {
+	var accept atomic.Value
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		accept.Store(r.Header.Get("Accept"))
+		wireAnswer(w, r)
+	})
+	server := dohServer("wire", stub)
+	err := server.SetMethod(DOH_WIRE_GET)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryM := newQuery("example.com", dns.TypeA)
+	responseM, err := server.Query(context.Background(), queryM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Id != queryM.Id {
+		t.Errorf("response id %d, want the query id %d", responseM.Id, queryM.Id)
+	}
+	if len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("answer %v", responseM.Answer)
+	}
+	if accept.Load() != "application/dns-message" {
+		t.Errorf("accept %v, want application/dns-message", accept.Load())
+	}
+}
+
+func TestDoHFallsBackToDNS(t *testing.T) {
+	stub := startStubDoH(t, jsonAnswer)
+	server := dohServer("blocked", stub)
+	// the DoH address refuses connections
+	stub.Close()
+	fallback := stubServer("plain", staticTransport("192.0.2.53"))
+	server.Fallback = &fallback
+
+	client := newTestClient(t)
+	client.AddServer(server)
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 1 {
+		t.Fatalf("response %v, want the fallback answer", responseM)
+	}
+	if a := responseM.Answer[0].(*dns.A); !a.A.Equal(net.ParseIP("192.0.2.53")) {
+		t.Errorf("answer %v, want 192.0.2.53 from the DNS fallback", a)
+	}
+}
+
+func TestDoHFallsBackToClientFallback(t *testing.T) {
+	stub := startStubDoH(t, jsonAnswer)
+	server := dohServer("blocked", stub)
+	// the DoH address refuses connections
+	stub.Close()
+	host, port := startStubDNS(t, func(w dns.ResponseWriter, queryM *dns.Msg) {
+		w.WriteMsg(answerA(queryM, "192.0.2.53"))
+	})
+
+	client := newTestClient(t)
+	client.AddServer(server)
+	client.AddFallback("plain", host, port)
+	client.Fallbacks[0].SetNet("udp")
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.53" {
+		t.Fatalf("response %v, want the answer of the fallback resolver", responseM)
+	}
+
+	// the fallback goes through the transport of the resolver like any exchange
+	client.Fallbacks[0].Transport = staticTransport("192.0.2.54")
+	responseM = resolveWire(t, client, newQuery("example.org", dns.TypeA))
+	if len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.54" {
+		t.Errorf("response %v, want the answer of the fallback transport", responseM)
+	}
+}
+
+func TestLocalAddrFixedPort(t *testing.T) {
+	var remote atomic.Value
+	addr, _ := startStubTCP(t, func(w dns.ResponseWriter, queryM *dns.Msg) {
+		remote.Store(w.RemoteAddr().String())
+		w.WriteMsg(answerA(queryM, "192.0.2.1"))
+	})
+	server := tcpUpstream(t, "stub", addr)
+	local := freeAddr(t, "tcp")
+	err := server.SetLocalAddr(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t)
+	client.AddServer(server)
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode %s, want NOERROR", dns.RcodeToString[responseM.Rcode])
+	}
+	if sent, _ := remote.Load().(string); sent != local {
+		t.Errorf("query sent from %s, want %s", sent, local)
+	}
+
+	for _, invalid := range []string{"127.0.0.1:70000", "not-an-ip:53", "127.0.0.1:x"} {
+		if server.SetLocalAddr(invalid) == nil {
+			t.Errorf("local address %s accepted", invalid)
+		}
+	}
+}
+
+func TestPaddedWireQueries(t *testing.T) {
+	var sizes []int
+	var lock sync.Mutex
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		query, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		lock.Lock()
+		sizes = append(sizes, len(query))
+		lock.Unlock()
+		wireAnswer(w, r)
+	})
+	server := dohServer("wire", stub)
+	err := server.SetMethod(DOH_WIRE_GET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetPadding(128)
+
+	for _, name := range []string{"a.com", "example.com", strings.Repeat("long.", 30) + "example.com"} {
+		queryM := newQuery(name, dns.TypeA)
+		// padding sent by the client is replaced
+		queryM.SetEdns0(1232, false)
+		queryM.IsEdns0().Option = append(queryM.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 7)})
+		_, err = server.Query(context.Background(), queryM)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sizes) != 3 {
+		t.Fatalf("%d queries sent, want 3", len(sizes))
+	}
+	for _, size := range sizes {
+		if size%128 != 0 {
+			t.Errorf("query of %d bytes, want a multiple of 128", size)
+		}
+	}
+	if sizes[2] <= 128 {
+		t.Errorf("long query padded to %d bytes, want the next block", sizes[2])
+	}
+}
+
+// udpUpstream returns a udp DNS upstream for the stub at host and port
+func udpUpstream(name string, host string, port int) Server {
+	var server Server
+	server.Name = name
+	server.Init(host, port)
+	server.SetNet("udp")
+	return server
+}
+
+func TestTruncatedRetriedOverTCP(t *testing.T) {
+	host, port := startStubDNS(t, func(w dns.ResponseWriter, queryM *dns.Msg) {
+		// the answer does not fit in a datagram
+		var responseM *dns.Msg = new(dns.Msg)
+		responseM.SetReply(queryM)
+		responseM.Truncated = true
+		w.WriteMsg(responseM)
+	})
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("tcp port of the udp stub taken: %v", err)
+	}
+	tcpServer := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, queryM *dns.Msg) {
+		responseM, _ := manyAnswers(100)(context.Background(), queryM)
+		w.WriteMsg(responseM)
+	})}
+	go tcpServer.ActivateAndServe()
+	t.Cleanup(func() { tcpServer.Shutdown() })
+
+	client := newTestClient(t)
+	client.AddServer(udpUpstream("stub", host, port))
+	responseM, err := client.Resolve(newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Truncated || len(responseM.Answer) != 100 {
+		t.Errorf("%d answers, truncated %v, want the 100 answers over tcp", len(responseM.Answer), responseM.Truncated)
+	}
+}
+
+func TestDNSReadTimeout(t *testing.T) {
+	host, port := startStubDNS(t, func(w dns.ResponseWriter, queryM *dns.Msg) {
+		// the answer is lost
+	})
+	server := udpUpstream("stub", host, port)
+	server.SetTimeouts(time.Second, 50*time.Millisecond, time.Second)
+	client := newTestClient(t)
+	client.AddServer(server)
+
+	start := time.Now()
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode %s, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("failed after %v, want the 50ms read timeout", elapsed)
+	}
+}
+
+func TestRandomPaddingParam(t *testing.T) {
+	var server Server
+	server.Init("dns.google/resolve", 443)
+	server.RandomPadding = true
+	question := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	paddings := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		u := parseQueryURL(t, &server, question)
+		padding := u.Query().Get("random_padding")
+		if padding == "" {
+			t.Fatalf("url %s without random_padding", u)
+		}
+		if u.Query().Get("ct") != "application/dns-json" {
+			t.Errorf("content type %q, want application/dns-json", u.Query().Get("ct"))
+		}
+		if len(u.String()) > DOH_MAX_URL_LENGTH {
+			t.Errorf("url of %d bytes, longer than %d", len(u.String()), DOH_MAX_URL_LENGTH)
+		}
+		paddings[padding] = true
+	}
+	if len(paddings) < 10 {
+		t.Errorf("%d distinct paddings in 20 queries, want them to vary", len(paddings))
+	}
+
+	// long names leave little room under the length limit
+	question.Name = strings.Repeat(strings.Repeat("a", 63)+".", 3) + "example.com."
+	server.RandomPadding = false
+	unpadded := parseQueryURL(t, &server, question)
+	if unpadded.Query().Has("random_padding") {
+		t.Errorf("url %s padded with RandomPadding off", unpadded)
+	}
+	defer func(limit int) { DOH_MAX_URL_LENGTH = limit }(DOH_MAX_URL_LENGTH)
+	// the content type parameter is added along with the padding
+	DOH_MAX_URL_LENGTH = len(unpadded.String()) + len("&ct=application%2Fdns-json&random_padding=") + 5
+	server.RandomPadding = true
+	for i := 0; i < 20; i++ {
+		if u := parseQueryURL(t, &server, question); len(u.String()) > DOH_MAX_URL_LENGTH {
+			t.Fatalf("url of %d bytes, longer than %d", len(u.String()), DOH_MAX_URL_LENGTH)
+		}
+	}
+}
+
+func TestCacheControlClampsTTL(t *testing.T) {
+	stub := startStubDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Age", "15")
+		// the record ttl is 300
+		wireAnswer(w, r)
+	})
+	server := dohServer("wire", stub)
+	err := server.SetMethod(DOH_WIRE_GET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	client.AddServer(server)
+
+	queryM := newQuery("example.com", dns.TypeA)
+	responseM := resolveWire(t, client, queryM)
+	if len(responseM.Answer) != 1 || responseM.Answer[0].Header().Ttl != 45 {
+		t.Fatalf("answers %v, want the ttl clamped to max-age minus age", responseM.Answer)
+	}
+	cachedM, ok := client.Cache.Get(cacheKey(queryM))
+	if !ok || cachedM.Answer[0].Header().Ttl > 45 {
+		t.Errorf("cached %v, want an entry of at most 45s", cachedM)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	for cacheControl, want := range map[string]int{
+		"max-age=60":             60,
+		"public, MAX-AGE=\"30\"": 30,
+		"no-store":               -1,
+		"max-age=x":              -1,
+	} {
+		header := http.Header{}
+		header.Set("Cache-Control", cacheControl)
+		maxAge, ok := freshness(header)
+		if (want < 0) == ok || (ok && int(maxAge) != want) {
+			t.Errorf("%s: freshness %d %v, want %d", cacheControl, maxAge, ok, want)
+		}
+	}
+}
+
+// startSOCKS5 serves a SOCKS5 proxy without authentication, recording the addresses it connects to
+func startSOCKS5(t *testing.T) (string, func() []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var lock sync.Mutex
+	var targets []string
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		// greeting: version, methods, answered with no authentication
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		// request: version, CONNECT, reserved, address type, address and port
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+			return
+		}
+		var host string
+		switch request[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 3:
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			name := make([]byte, length[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		case 4:
+			ip := make([]byte, 16)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		if _, err := io.ReadFull(conn, port); err != nil {
+			return
+		}
+		target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+		lock.Lock()
+		targets = append(targets, target)
+		lock.Unlock()
+
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), targets...)
+	}
+}
+
+func TestUpstreamProxySOCKS5(t *testing.T) {
+	socksAddr, targets := startSOCKS5(t)
+	addr, _ := startStubTCP(t, func(w dns.ResponseWriter, queryM *dns.Msg) {
+		w.WriteMsg(answerA(queryM, "192.0.2.1"))
+	})
+
+	client := newTestClient(t)
+	client.UpstreamProxy = "socks5://" + socksAddr
+	client.AddServer(tcpUpstream(t, "stub", addr))
+	proxyAddr := startProxy(t, client)
+
+	exchanger := dns.Client{Timeout: time.Second}
+	responseM, _, err := exchanger.Exchange(newQuery("example.com", dns.TypeA), proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseM.Answer) != 1 {
+		t.Errorf("answers %v, want the upstream answer", responseM.Answer)
+	}
+	connected := targets()
+	if len(connected) == 0 || connected[0] != addr {
+		t.Errorf("proxy connected to %v, want %s", connected, addr)
+	}
+}
+
+func TestDoHThroughSOCKS5(t *testing.T) {
+	socksAddr, targets := startSOCKS5(t)
+	stub := startStubDoH(t, jsonAnswer)
+	server := dohServer("stub", stub)
+	err := server.SetProxy("socks5://" + socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustStub(&server)
+
+	responseM, err := server.Query(context.Background(), newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseM.Answer) != 1 {
+		t.Errorf("answers %v, want the stub answer", responseM.Answer)
+	}
+	if connected := targets(); len(connected) != 1 || connected[0] != strings.TrimPrefix(stub.URL, "https://") {
+		t.Errorf("proxy connected to %v, want the stub", connected)
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Shard strategies
+var SHARD_RANDOM int = 0          // pick a random usable resolver, in proportion to its weight
+var SHARD_ROUND_ROBIN int = 1     // cycle through the resolvers
+var SHARD_CONSISTENT_HASH int = 2 // map each question to the same resolver
+
+// ErrNoResolvers is returned when a query arrives while no upstream resolver is configured
+var ErrNoResolvers = errors.New("No upstream resolver configured")
+
+// ErrUnknownResolver is returned when no resolver has the requested name
+var ErrUnknownResolver = errors.New("No resolver with that name")
+
+// number of points each resolver owns on the hash ring
+var HASH_RING_REPLICAS int = 100
+
+// hashRing maps hashed keys to resolver indexes
+type hashRing struct {
+	// resolvers the ring was built from
+	resolvers []Server
+
+	// sorted hashes of the ring points
+	hashes []uint32
+
+	// resolver index owning each point
+	owners map[uint32]int
+}
+
+// newHashRing places every resolver on the ring
+// points depend only on the resolver itself so adding or removing one
+// only moves the keys that resolver owns
+func newHashRing(resolvers []Server) *hashRing {
+	ring := &hashRing{
+		resolvers: resolvers,
+		owners:    make(map[uint32]int),
+	}
+	for i, resolver := range resolvers {
+		id := resolver.Name + "/" + resolver.Upstream + ":" + strconv.Itoa(resolver.Port)
+		for r := 0; r < HASH_RING_REPLICAS; r++ {
+			hash := crc32.ChecksumIEEE([]byte(id + "#" + strconv.Itoa(r)))
+			if _, ok := ring.owners[hash]; ok {
+				continue
+			}
+			ring.owners[hash] = i
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(a, b int) bool { return ring.hashes[a] < ring.hashes[b] })
+	return ring
+}
+
+// get returns the resolver owning key
+// Keys of an unhealthy resolver move to the next usable one on the ring,
+// and return to it once it recovers
+func (ring *hashRing) get(key string) *Server {
+	if len(ring.hashes) == 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= hash })
+	if i == len(ring.hashes) {
+		i = 0
+	}
+
+	owner := &ring.resolvers[ring.owners[ring.hashes[i]]]
+	for j := 0; j < len(ring.hashes); j++ {
+		resolver := &ring.resolvers[ring.owners[ring.hashes[(i+j)%len(ring.hashes)]]]
+		if resolver.stats.usable() {
+			return resolver
+		}
+	}
+	// no resolver is usable, keep the owner
+	return owner
+}
+
+// shard takes applies an algorithm to select one of the resolver for resolution
+// name is the question name, only consistent hashing uses it
+// Returns nil if there is no resolver
+func (client *Client) shard(name string) (resolver *Server) {
+	switch client.ShardStrategy {
+	case SHARD_ROUND_ROBIN:
+		resolvers := client.resolverList()
+		if len(resolvers) == 0 {
+			return nil
+		}
+		// the counter is taken before the increment so the first query goes to the first resolver
+		next := atomic.AddUint32(&client.roundRobin, 1) - 1
+		return &resolvers[int(next)%len(resolvers)]
+	case SHARD_CONSISTENT_HASH:
+		// differently cased names go to the same resolver
+		return client.hashRing().get(strings.ToLower(dns.Fqdn(name)))
+	default:
+		return weightedRandom(client.resolverList())
+	}
+}
+
+// hashRing returns the hash ring of the current resolvers
+// The ring is reset under resolversLock whenever the resolvers change, so it never maps to removed ones
+func (client *Client) hashRing() *hashRing {
+	client.resolversLock.RLock()
+	ring := client.ring
+	client.resolversLock.RUnlock()
+	if ring != nil {
+		return ring
+	}
+
+	client.resolversLock.Lock()
+	defer client.resolversLock.Unlock()
+	if client.ring == nil {
+		client.ring = newHashRing(client.Resolvers)
+	}
+	return client.ring
+}
+
+// weightedRandom picks a resolver at random in proportion to its weight, among the usable ones
+// If none is usable every resolver is a candidate, so that queries still go out (fail open)
+// Returns nil if there is no resolver
+func weightedRandom(resolvers []Server) *Server {
+	if len(resolvers) == 0 {
+		return nil
+	}
+	candidates := make([]int, 0, len(resolvers))
+	for i := range resolvers {
+		if resolvers[i].stats.usable() {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range resolvers {
+			candidates = append(candidates, i)
+		}
+	}
+
+	total := 0
+	for _, i := range candidates {
+		total += resolvers[i].weight()
+	}
+	pick := rand.Intn(total)
+	for _, i := range candidates {
+		pick -= resolvers[i].weight()
+		if pick < 0 {
+			return &resolvers[i]
+		}
+	}
+	return &resolvers[candidates[len(candidates)-1]]
+}
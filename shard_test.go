@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// newShardClient returns a client with count stub upstreams named r0, r1...
+func newShardClient(t *testing.T, count int) *Client {
+	client := newTestClient(t)
+	client.ShardStrategy = SHARD_CONSISTENT_HASH
+	for i := 0; i < count; i++ {
+		server := stubServer(fmt.Sprintf("r%d", i), staticTransport("192.0.2.1"))
+		server.Upstream = fmt.Sprintf("192.0.2.%d", i+1)
+		client.AddServer(server)
+	}
+	return client
+}
+
+func TestConsistentHashIgnoresCase(t *testing.T) {
+	client := newShardClient(t, 4)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		lower := client.shard(name).Name
+		if upper := client.shard(fmt.Sprintf("HOST%d.Example.COM", i)).Name; upper != lower {
+			t.Errorf("%s went to %s and %s depending on case", name, lower, upper)
+		}
+	}
+}
+
+func TestConsistentHashRemoveUpstream(t *testing.T) {
+	client := newShardClient(t, 4)
+	before := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		before[name] = client.shard(name).Name
+	}
+
+	client.RemoveUpstream("r2")
+	for name, owner := range before {
+		resolver := client.shard(name).Name
+		if resolver == "r2" {
+			t.Fatalf("%s still goes to the removed upstream", name)
+		}
+		if owner != "r2" && resolver != owner {
+			t.Errorf("%s moved from %s to %s although its upstream was kept", name, owner, resolver)
+		}
+	}
+}
+
+func TestRoundRobinStartsAtFirstResolver(t *testing.T) {
+	client := newShardClient(t, 3)
+	client.ShardStrategy = SHARD_ROUND_ROBIN
+	for i := 0; i < 6; i++ {
+		want := fmt.Sprintf("r%d", i%3)
+		if name := client.shard("example.com.").Name; name != want {
+			t.Errorf("query %d went to %s, want %s", i, name, want)
+		}
+	}
+}
+
+func TestConsistentHashStable(t *testing.T) {
+	client := newShardClient(t, 4)
+	owners := make(map[string]string)
+	used := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		owners[name] = client.shard(name).Name
+		used[owners[name]]++
+	}
+	if len(used) != 4 {
+		t.Errorf("names spread over %v, want every upstream used", used)
+	}
+	// the same name keeps its upstream, also in a client with the same upstreams
+	other := newShardClient(t, 4)
+	for name, owner := range owners {
+		for i := 0; i < 3; i++ {
+			if resolver := client.shard(name).Name; resolver != owner {
+				t.Fatalf("%s went to %s, then to %s", name, owner, resolver)
+			}
+		}
+		if resolver := other.shard(name).Name; resolver != owner {
+			t.Errorf("%s went to %s and %s in another client", name, owner, resolver)
+		}
+	}
+}
+
+func TestConsistentHashUnhealthyUpstream(t *testing.T) {
+	client := newShardClient(t, 4)
+	owners := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		owners[name] = client.shard(name).Name
+	}
+
+	r1 := &client.resolverList()[1]
+	for i := uint64(0); i < UNHEALTHY_FAILURES; i++ {
+		r1.stats.record(errors.New("Upstream unreachable"), 0)
+	}
+	for name, owner := range owners {
+		resolver := client.shard(name).Name
+		if resolver == "r1" || (owner != "r1" && resolver != owner) {
+			t.Errorf("%s went from %s to %s with r1 unhealthy", name, owner, resolver)
+		}
+	}
+
+	// names return to the upstream once it recovers
+	r1.stats.record(nil, 0)
+	for name, owner := range owners {
+		if resolver := client.shard(name).Name; resolver != owner {
+			t.Errorf("%s went to %s after r1 recovered, want %s", name, resolver, owner)
+		}
+	}
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	client := newShardClient(t, 0)
+	client.ShardStrategy = SHARD_RANDOM
+	weights := []int{1, 2, 7}
+	for i, weight := range weights {
+		server := stubServer(fmt.Sprintf("r%d", i), staticTransport("192.0.2.1"))
+		server.Upstream = fmt.Sprintf("192.0.2.%d", i+1)
+		server.SetWeight(weight)
+		client.AddServer(server)
+	}
+
+	const picks = 20000
+	counts := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		counts[client.shard("example.com.").Name]++
+	}
+	for i, weight := range weights {
+		name := fmt.Sprintf("r%d", i)
+		share := float64(counts[name]) / picks
+		want := float64(weight) / 10
+		if share < want-0.03 || share > want+0.03 {
+			t.Errorf("%s got %.3f of the queries, want about %.1f", name, share, want)
+		}
+	}
+
+	// unhealthy upstreams are skipped, unless none is left
+	resolvers := client.resolverList()
+	for i := range resolvers[:2] {
+		for j := uint64(0); j < UNHEALTHY_FAILURES; j++ {
+			resolvers[i].stats.record(errors.New("Upstream unreachable"), 0)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if name := client.shard("example.com.").Name; name != "r2" {
+			t.Fatalf("picked %s with r0 and r1 unhealthy", name)
+		}
+	}
+	for j := uint64(0); j < UNHEALTHY_FAILURES; j++ {
+		resolvers[2].stats.record(errors.New("Upstream unreachable"), 0)
+	}
+	if client.shard("example.com.") == nil {
+		t.Error("no upstream picked with every upstream unhealthy")
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
 	"os/signal"
 	"syscall"
 
+	log "github.com/sirupsen/logrus"
 	proxy "github.com/zyalm/DoH_Proxy"
 	// "proxy"
 )
@@ -11,14 +15,103 @@ import (
 var client proxy.Client = proxy.Client{}
 
 func main() {
-	client.Init("127.0.0.1", 53)
+	validate := flag.Bool("validate", false, "send a test query to every upstream and exit")
+	ready := flag.Bool("ready", false, "resolve a test query the way clients are answered and exit")
+	flag.Parse()
+
+	client.Init("127.0.0.1", 53, proxy.NewMemoryCache())
 	// For testing purposes, the port is set to a higher number to avoid sudo
-	// client.Init("127.0.0.1", 53533)
+	// client.Init("127.0.0.1", 53533, proxy.NewMemoryCache())
+	// To share the cache between multiple proxies, use redis instead
+	// client.Init("127.0.0.1", 53, proxy.NewRedisCache("127.0.0.1:6379", "", 0))
+	// Let other proxy processes bind the same port, the kernel balances queries between them
+	// client.ReusePort = true
+	// Additional addresses share the same workers, e.g. an unprivileged port
+	// client.AddListen("127.0.0.1", 5353)
+	// Answers can be rewritten before they are cached, e.g. to flatten CNAME chains
+	// client.AddRewriter(&proxy.CNAMEFlattener{})
+	// Or query the targets of CNAME chains the upstream left incomplete
+	// client.FlattenCNAME = true
+	// Middlewares wrap every resolution, e.g. to log or filter
+	// client.Use(func(next proxy.Handler) proxy.Handler { return next })
+	// Force the answers of some names, e.g. remap a retired name to its successor
+	// client.SetRewriteRules([]proxy.RewriteRule{{Name: "old.example.com", CNAME: "new.example.com"}})
+	// Answer from entries expired less than a minute ago while they are refreshed in the background
+	// client.StaleWhileRevalidate = time.Minute
+	// Queue up to 1024 queries for the workers, and answer SERVFAIL rather than dropping the oldest when full
+	// client.QueueDepth = 1024
+	// client.QueuePolicy = proxy.QUEUE_SERVFAIL
+	// Rotate the addresses of every answer, for clients which always use the first one
+	// client.ShuffleAnswers = true
+	// Clear the AD bit for clients which asked neither for DNSSEC nor for AD
+	// client.StripAD = true
+	// Refuse plaintext DNS upstreams so that a misconfiguration cannot leak queries
+	// client.DoHOnly = true
+	// Race each query on two resolvers and answer with the fastest
+	// client.RaceUpstreams = true
+	// Or try up to three resolvers in turn when one fails
+	// client.AttemptBudget = 3
+	// Reach the upstreams through a proxy, e.g. Tor
+	// client.UpstreamProxy = "socks5://127.0.0.1:9050"
+	// Randomize the case of names sent to plain DNS upstreams to detect spoofed answers
+	// client.Use0x20 = true
+	// Drop answers pointing public names at private addresses, except for internal names
+	// client.RebindProtection = true
+	// client.RebindAllowlist = []string{"corp.example"}
 	signal.Notify(client.ShutDownChan, syscall.SIGINT, syscall.SIGTERM)
-	client.AddUpstream("Google", "8.8.8.8/resolve", 443)       // dns.google.com
+	signal.Notify(client.ReloadChan, syscall.SIGHUP)
+	// Upstreams can be loaded from a json config file instead, reloaded on SIGHUP
+	// client.ConfigFile = "proxy.json"
+	// Static name to ip overrides in /etc/hosts format, also reloaded on SIGHUP
+	// client.HostsFile = "hosts"
+	// Internal names answered authoritatively from a zone file, also reloaded on SIGHUP
+	// client.ZoneFile = "internal.zone"
+	var google proxy.Server
+	google.Name = "Google"
+	google.Init("8.8.8.8/resolve", 443)
+	google.SetHost("dns.google")
+	// Retry over plain DNS if HTTPS to 8.8.8.8 is blocked
+	var googleDNS proxy.Server
+	googleDNS.Name = "Google"
+	googleDNS.Init("8.8.8.8", 53)
+	google.Fallback = &googleDNS
+	client.AddServer(google)                                   // dns.google.com
 	client.AddUpstream("Cloudflare", "1.1.1.1/dns-query", 443) // cloudflare-dns.com
 	client.AddUpstream("Quad9", "9.9.9.9:5053/dns-query", 443) // dns.quad9.net
 	client.AddUpstream("Google", "8.8.8.8", 53)
+	// Plain DNS fallbacks used when DoH fails, tried in order
+	client.AddFallback("Google", "8.8.4.4", 53)
+
+	if *validate {
+		ok := true
+		for _, result := range client.Validate() {
+			fmt.Printf("%s %s:%d ok=%t latency=%s %s\n", result.Name, result.Upstream, result.Port, result.OK, result.Latency, result.Error)
+			ok = ok && result.OK
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *ready {
+		if client.ConfigFile != "" {
+			err := client.LoadConfig(client.ConfigFile)
+			if err != nil {
+				log.WithFields(log.Fields{"Error": err}).Fatal("Proxy failed to load config")
+			}
+		}
+		err := client.Ready()
+		if err != nil {
+			fmt.Println("not ready:", err)
+			os.Exit(1)
+		}
+		fmt.Println("ready")
+		return
+	}
 
-	client.StartProxy()
+	err := client.StartProxy()
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err}).Fatal("Proxy failed to start")
+	}
 }
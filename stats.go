@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// number of consecutive failures after which an upstream is reported unhealthy
+var UNHEALTHY_FAILURES uint64 = 3
+
+// how long an unhealthy upstream is avoided before it gets a request again
+var UNHEALTHY_RETRY time.Duration = 30 * time.Second
+
+// clientStats counts client activity
+// counters are updated atomically by the workers
+type clientStats struct {
+	queries     uint64
+	cacheHits   uint64
+	cacheMisses uint64
+
+	// queries which joined an identical upstream resolution in flight
+	coalesced uint64
+
+	// queries answered from expired cache entries
+	staleServed uint64
+
+	// queries whose resolution panicked, answered with SERVFAIL
+	panics uint64
+
+	// queries dropped or refused because the lookup queue was full
+	dropped uint64
+
+	// dnstap frames dropped because the collector fell behind
+	dnstapDropped uint64
+
+	// answered queries by question type and by response code
+	byType     map[string]uint64
+	byRcode    map[string]uint64
+	countsLock sync.Mutex
+
+	// time the proxy started
+	start time.Time
+}
+
+// countResponse counts the question type of an answered query and the response code
+func (stats *clientStats) countResponse(queryM *dns.Msg, responseM *dns.Msg) {
+	qtype := "NONE"
+	if len(queryM.Question) > 0 {
+		qtype = typeName(queryM.Question[0].Qtype)
+	}
+	rcode, ok := dns.RcodeToString[responseM.Rcode]
+	if !ok {
+		rcode = "RCODE" + strconv.Itoa(responseM.Rcode)
+	}
+
+	stats.countsLock.Lock()
+	defer stats.countsLock.Unlock()
+	if stats.byType == nil {
+		stats.byType = make(map[string]uint64)
+		stats.byRcode = make(map[string]uint64)
+	}
+	stats.byType[qtype]++
+	stats.byRcode[rcode]++
+}
+
+// counts returns copies of the counters by question type and by response code
+func (stats *clientStats) counts() (map[string]uint64, map[string]uint64) {
+	stats.countsLock.Lock()
+	defer stats.countsLock.Unlock()
+	byType := make(map[string]uint64, len(stats.byType))
+	for qtype, count := range stats.byType {
+		byType[qtype] = count
+	}
+	byRcode := make(map[string]uint64, len(stats.byRcode))
+	for rcode, count := range stats.byRcode {
+		byRcode[rcode] = count
+	}
+	return byType, byRcode
+}
+
+// sumCounts adds up the counters of a map
+func sumCounts(counts map[string]uint64) uint64 {
+	var sum uint64
+	for _, count := range counts {
+		sum += count
+	}
+	return sum
+}
+
+// typeName returns the mnemonic of a record type, TYPEn for unknown types (RFC 3597)
+func typeName(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+// upstreamStats counts requests to one upstream
+// shared between copies of the server
+type upstreamStats struct {
+	requests            uint64
+	failures            uint64
+	consecutiveFailures uint64
+
+	// total time spent on requests, in nanoseconds
+	latency uint64
+
+	// time of the last failure, in unix nanoseconds
+	lastFailure int64
+
+	// Comment and edns_client_subnet of the last json response carrying them
+	jsonLock     sync.Mutex
+	comment      string
+	clientSubnet string
+}
+
+// recordJSON keeps the Comment and edns_client_subnet echo of a json response for the status endpoint
+func (stats *upstreamStats) recordJSON(responseMap map[string]interface{}) {
+	comment, hasComment := responseMap["Comment"].(string)
+	subnet, hasSubnet := responseMap["edns_client_subnet"].(string)
+	if stats == nil || !hasComment && !hasSubnet {
+		return
+	}
+	stats.jsonLock.Lock()
+	defer stats.jsonLock.Unlock()
+	if hasComment {
+		stats.comment = comment
+	}
+	if hasSubnet {
+		stats.clientSubnet = subnet
+	}
+}
+
+// record counts a request to the upstream, its outcome and how long it took
+// Cancelled requests, e.g. losers of a race, say nothing about the upstream and are not counted
+func (stats *upstreamStats) record(err error, elapsed time.Duration) {
+	if stats == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	atomic.AddUint64(&stats.requests, 1)
+	atomic.AddUint64(&stats.latency, uint64(elapsed))
+	if err != nil {
+		atomic.AddUint64(&stats.failures, 1)
+		atomic.AddUint64(&stats.consecutiveFailures, 1)
+		atomic.StoreInt64(&stats.lastFailure, time.Now().UnixNano())
+	} else {
+		atomic.StoreUint64(&stats.consecutiveFailures, 0)
+	}
+}
+
+// healthy reports whether the last requests to the upstream succeeded
+func (stats *upstreamStats) healthy() bool {
+	if stats == nil {
+		return true
+	}
+	return atomic.LoadUint64(&stats.consecutiveFailures) < UNHEALTHY_FAILURES
+}
+
+// usable reports whether the upstream may be selected
+// An unhealthy upstream is retried once UNHEALTHY_RETRY passed since its last failure
+func (stats *upstreamStats) usable() bool {
+	if stats.healthy() {
+		return true
+	}
+	lastFailure := time.Unix(0, atomic.LoadInt64(&stats.lastFailure))
+	return time.Since(lastFailure) > UNHEALTHY_RETRY
+}
+
+// UpstreamStatus is the status of one upstream
+// RecentFailures counts the failures since the last successful request
+type UpstreamStatus struct {
+	Name           string  `json:"name"`
+	Upstream       string  `json:"upstream"`
+	Port           int     `json:"port"`
+	Protocol       string  `json:"protocol"`
+	Requests       uint64  `json:"requests"`
+	Failures       uint64  `json:"failures"`
+	RecentFailures uint64  `json:"recent_failures"`
+	AvgLatencyMs   float64 `json:"avg_latency_ms"`
+	Healthy        bool    `json:"healthy"`
+
+	// Comment and edns_client_subnet echo of the last json answer carrying them
+	Comment      string `json:"comment,omitempty"`
+	ClientSubnet string `json:"client_subnet,omitempty"`
+}
+
+// Status is a snapshot of the client statistics
+type Status struct {
+	Uptime        string            `json:"uptime"`
+	Queries       uint64            `json:"queries"`
+	CacheSize     int               `json:"cache_size"`
+	CacheBytes    int               `json:"cache_bytes"`
+	CacheHits     uint64            `json:"cache_hits"`
+	CacheMisses   uint64            `json:"cache_misses"`
+	CacheHitRatio float64           `json:"cache_hit_ratio"`
+	Coalesced     uint64            `json:"coalesced"`
+	StaleServed   uint64            `json:"stale_served"`
+	Panics        uint64            `json:"panics"`
+	Dropped       uint64            `json:"dropped"`
+	DnstapDropped uint64            `json:"dnstap_dropped"`
+	QueryTypes    map[string]uint64 `json:"query_types"`
+	Rcodes        map[string]uint64 `json:"rcodes"`
+	NXDomainRatio float64           `json:"nxdomain_ratio"`
+	Workers       int               `json:"workers"`
+	Listeners     int               `json:"listeners"`
+	Upstreams     []UpstreamStatus  `json:"upstreams"`
+}
+
+// QueryStats is a snapshot of the client query counters
+// cheap enough to be taken and logged periodically
+type QueryStats struct {
+	Queries       uint64  `json:"queries"`
+	CacheHits     uint64  `json:"cache_hits"`
+	CacheMisses   uint64  `json:"cache_misses"`
+	CacheHitRatio float64 `json:"cache_hit_ratio"`
+	Coalesced     uint64  `json:"coalesced"`
+	StaleServed   uint64  `json:"stale_served"`
+}
+
+// Stats returns the current query counters of the client
+func (client *Client) Stats() QueryStats {
+	stats := QueryStats{
+		Queries:     atomic.LoadUint64(&client.stats.queries),
+		CacheHits:   atomic.LoadUint64(&client.stats.cacheHits),
+		CacheMisses: atomic.LoadUint64(&client.stats.cacheMisses),
+		Coalesced:   atomic.LoadUint64(&client.stats.coalesced),
+		StaleServed: atomic.LoadUint64(&client.stats.staleServed),
+	}
+	if lookups := stats.CacheHits + stats.CacheMisses; lookups > 0 {
+		stats.CacheHitRatio = float64(stats.CacheHits) / float64(lookups)
+	}
+	return stats
+}
+
+// Status collects the current statistics of the client
+func (client *Client) Status() Status {
+	status := Status{
+		Queries:       atomic.LoadUint64(&client.stats.queries),
+		CacheSize:     -1,
+		CacheHits:     atomic.LoadUint64(&client.stats.cacheHits),
+		CacheMisses:   atomic.LoadUint64(&client.stats.cacheMisses),
+		Coalesced:     atomic.LoadUint64(&client.stats.coalesced),
+		StaleServed:   atomic.LoadUint64(&client.stats.staleServed),
+		Panics:        atomic.LoadUint64(&client.stats.panics),
+		Dropped:       atomic.LoadUint64(&client.stats.dropped),
+		DnstapDropped: atomic.LoadUint64(&client.stats.dnstapDropped),
+		Workers:       client.Num,
+		Listeners:     client.ListenerCount * len(client.PCs),
+	}
+	status.QueryTypes, status.Rcodes = client.stats.counts()
+	if answered := sumCounts(status.Rcodes); answered > 0 {
+		status.NXDomainRatio = float64(status.Rcodes["NXDOMAIN"]) / float64(answered)
+	}
+	if !client.stats.start.IsZero() {
+		status.Uptime = time.Since(client.stats.start).Round(time.Second).String()
+	}
+	if lookups := status.CacheHits + status.CacheMisses; lookups > 0 {
+		status.CacheHitRatio = float64(status.CacheHits) / float64(lookups)
+	}
+	if sizer, ok := client.Cache.(interface{ Len() int }); ok {
+		status.CacheSize = sizer.Len()
+	}
+	if memoryCache, ok := client.Cache.(*MemoryCache); ok {
+		status.CacheBytes = memoryCache.Stats().Bytes
+	}
+
+	for _, resolver := range client.resolverList() {
+		upstream := UpstreamStatus{
+			Name:     resolver.Name,
+			Upstream: resolver.Upstream,
+			Port:     resolver.Port,
+			Protocol: resolver.protocol(),
+			Healthy:  resolver.stats.healthy(),
+		}
+		if resolver.stats != nil {
+			upstream.Requests = atomic.LoadUint64(&resolver.stats.requests)
+			upstream.Failures = atomic.LoadUint64(&resolver.stats.failures)
+			upstream.RecentFailures = atomic.LoadUint64(&resolver.stats.consecutiveFailures)
+			resolver.stats.jsonLock.Lock()
+			upstream.Comment = resolver.stats.comment
+			upstream.ClientSubnet = resolver.stats.clientSubnet
+			resolver.stats.jsonLock.Unlock()
+			if upstream.Requests > 0 {
+				latency := time.Duration(atomic.LoadUint64(&resolver.stats.latency) / upstream.Requests)
+				upstream.AvgLatencyMs = float64(latency.Microseconds()) / 1000
+			}
+		}
+		status.Upstreams = append(status.Upstreams, upstream)
+	}
+	return status
+}
+
+// StartAdmin serves the client status as json on /status at addr
+// It can be called before or after StartProxy
+func (client *Client) StartAdmin(addr string) error {
+	client.stopStatusServer()
+	client.StatusAddr = addr
+	return client.startStatusServer()
+}
+
+// startStatusServer serves the client status as json on StatusAddr
+// Returns an error if the address cannot be listened on
+func (client *Client) startStatusServer() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(client.Status())
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Failed to write status")
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := client.writeMetrics(w)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Failed to write metrics")
+		}
+	})
+
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		err := client.Ready()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+
+	listener, err := net.Listen("tcp", client.StatusAddr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:    client.StatusAddr,
+		Handler: mux,
+	}
+	client.statusServer = server
+	go func() {
+		log.WithFields(log.Fields{"Addr": client.StatusAddr}).Info("Client status server running")
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{"Error": err}).Error("Client status server failed")
+		}
+	}()
+	return nil
+}
+
+// stopStatusServer shuts down the status server
+func (client *Client) stopStatusServer() {
+	if client.statusServer == nil {
+		return
+	}
+	client.statusServer.Close()
+	client.statusServer = nil
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// getStatus fetches and decodes the json status served at addr
+func getStatus(t *testing.T, addr string) Status {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("content type %q", resp.Header.Get("Content-Type"))
+	}
+	var status Status
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+	for i := 0; i < 2; i++ {
+		_, err := client.Resolve(newQuery("example.com", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr := freeAddr(t, "tcp")
+	err := client.StartAdmin(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.stopStatusServer)
+
+	status := getStatus(t, addr)
+	if status.Queries != 2 || status.CacheHits != 1 || status.CacheMisses != 1 {
+		t.Errorf("%d queries, %d hits, %d misses, want 2, 1 and 1", status.Queries, status.CacheHits, status.CacheMisses)
+	}
+	if status.CacheHitRatio != 0.5 || status.CacheSize != 1 {
+		t.Errorf("hit ratio %v and cache size %d, want 0.5 and 1", status.CacheHitRatio, status.CacheSize)
+	}
+	if status.Workers != client.Num {
+		t.Errorf("%d workers, want %d", status.Workers, client.Num)
+	}
+	if len(status.Upstreams) != 1 {
+		t.Fatalf("%d upstreams, want 1", len(status.Upstreams))
+	}
+	upstream := status.Upstreams[0]
+	if upstream.Name != "stub" || upstream.Requests != 1 || !upstream.Healthy {
+		t.Errorf("upstream %+v, want one healthy request to stub", upstream)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	release := make(chan struct{})
+	var requests int32
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+
+	// identical queries in flight together share one upstream request
+	done := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := client.Resolve(newQuery("example.com", dns.TypeA))
+			done <- err
+		}()
+	}
+	for client.Stats().Queries < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := client.Resolve(newQuery("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := client.Stats()
+	if requests != 1 {
+		t.Errorf("%d upstream requests, want 1", requests)
+	}
+	if stats.Queries != 6 || stats.CacheMisses != 5 || stats.CacheHits != 1 || stats.Coalesced != 4 {
+		t.Errorf("stats %+v, want 6 queries, 5 misses, 1 hit and 4 coalesced", stats)
+	}
+	if stats.CacheHitRatio != 1.0/6 {
+		t.Errorf("hit ratio %v, want 1/6", stats.CacheHitRatio)
+	}
+}
+
+// getMetrics fetches the metrics served at addr and returns the samples by series
+// the test fails if a series is exported twice
+func getMetrics(t *testing.T, addr string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			t.Fatalf("malformed sample %q", line)
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		series := line[:i]
+		if _, ok := samples[series]; ok {
+			t.Errorf("duplicate series %s", series)
+		}
+		samples[series] = value
+	}
+	return samples
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	client := newTestClient(t)
+	transport := func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		responseM := answerA(queryM, "192.0.2.1")
+		if queryM.Question[0].Name == "missing.example.com." {
+			responseM.Rcode = dns.RcodeNameError
+		}
+		return responseM, nil
+	}
+	// the same upstream name on two addresses, and the first one added twice
+	first := stubServer("dup", transport)
+	second := stubServer("dup", transport)
+	second.Upstream = "192.0.2.2"
+	client.AddServer(first)
+	client.AddServer(second)
+	client.AddServer(stubServer("dup", transport))
+
+	resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	resolveWire(t, client, newQuery("example.com", dns.TypeAAAA))
+	resolveWire(t, client, newQuery("missing.example.com", dns.TypeA))
+
+	addr := freeAddr(t, "tcp")
+	err := client.StartAdmin(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.stopStatusServer)
+
+	samples := getMetrics(t, addr)
+	for series, want := range map[string]float64{
+		"doh_proxy_queries_total":                                                               3,
+		`doh_proxy_queries_by_type_total{qtype="A"}`:                                            2,
+		`doh_proxy_queries_by_type_total{qtype="AAAA"}`:                                         1,
+		`doh_proxy_responses_by_rcode_total{rcode="NOERROR"}`:                                   2,
+		`doh_proxy_responses_by_rcode_total{rcode="NXDOMAIN"}`:                                  1,
+		`doh_proxy_upstream_healthy{upstream="dup",protocol="transport",address="192.0.2.2:0"}`: 1,
+	} {
+		if samples[series] != want {
+			t.Errorf("%s = %v, want %v", series, samples[series], want)
+		}
+	}
+	requests := samples[`doh_proxy_upstream_requests_total{upstream="dup",protocol="transport",address="192.0.2.1:0"}`] +
+		samples[`doh_proxy_upstream_requests_total{upstream="dup",protocol="transport",address="192.0.2.2:0"}`]
+	if requests != 3 {
+		t.Errorf("%v upstream requests across both addresses, want 3", requests)
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer starts spans around each step of a resolution
+// Leave Client.Tracer nil to disable tracing
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced step of a resolution
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// noopTracer is used when no tracer is configured
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// otelTracer adapts an OpenTelemetry tracer to Tracer
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+// NewOtelTracer wraps an OpenTelemetry tracer for use as Client.Tracer
+func NewOtelTracer(tracer trace.Tracer) Tracer {
+	return &otelTracer{tracer: tracer}
+}
+
+func (t *otelTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, &otelSpan{span: span}
+}
+
+func (s *otelSpan) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case uint16:
+		s.span.SetAttributes(attribute.Int(key, int(v)))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (s *otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpan) End() {
+	s.span.End()
+}
+
+// tracer returns the configured tracer or a no-op tracer
+func (client *Client) tracer() Tracer {
+	if client.Tracer == nil {
+		return noopTracer{}
+	}
+	return client.Tracer
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Transport sends a query to an upstream and returns its answer
+// Server implements it for DoH and plain DNS, other protocols plug in through Server.Transport
+type Transport interface {
+	Query(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error)
+}
+
+// ErrUpstreamServFail is returned when an upstream answered SERVFAIL
+// so that fallbacks or stale answers can serve instead
+var ErrUpstreamServFail = errors.New("Upstream answered SERVFAIL")
+
+// Query sends the query over the transport of the server
+func (server *Server) Query(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	switch {
+	case server.Transport != nil:
+		err := server.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer server.release()
+		return server.Transport.Query(ctx, queryM)
+	case server.isDNS():
+		responseM, err := DNSContext(ctx, server, queryM)
+		if err == nil && responseM == nil {
+			err = errors.New("No response from DNS resolver")
+		}
+		return responseM, err
+	case server.Port != 443:
+		log.WithFields(log.Fields{"Resolver": server.Name, "Port": server.Port}).Error("Unsupported resolver")
+		return nil, errors.New("Unsupported resolver")
+	case server.isWire():
+		return DoHGetWireContext(ctx, server, queryM)
+	default:
+		return server.queryJSON(ctx, queryM)
+	}
+}
+
+// queryJSON resolves every question of the query with the DoH json API
+func (server *Server) queryJSON(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	// the client's DO and CD bits are sent as url parameters
+	dohServer := server
+	if wantsDNSSEC(queryM) && !server.DNSSEC || queryM.CheckingDisabled && !server.CheckingDisabled {
+		flagServer := *server
+		flagServer.DNSSEC = flagServer.DNSSEC || wantsDNSSEC(queryM)
+		flagServer.CheckingDisabled = flagServer.CheckingDisabled || queryM.CheckingDisabled
+		dohServer = &flagServer
+	}
+
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.Compress = true
+	responseM.SetReply(queryM)
+	authenticated := true
+	for _, question := range queryM.Question {
+		responseMap, err := DoHContext(ctx, dohServer, question)
+		if err != nil {
+			return nil, err
+		}
+
+		log.WithFields(log.Fields(responseMap)).Info("Response from DoH")
+
+		var answerM *dns.Msg = new(dns.Msg)
+		answerM.SetReply(queryM)
+		err = constructResponseMessage(answerM, responseMap)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Debug("Failed construct response message")
+			return nil, err
+		}
+		if answerM.Rcode == dns.RcodeServerFailure {
+			log.WithFields(log.Fields{"Resolver": server.Name}).Error("ServFail")
+			return nil, ErrUpstreamServFail
+		}
+
+		responseM.Rcode = answerM.Rcode
+		responseM.Truncated = responseM.Truncated || answerM.Truncated
+		responseM.RecursionAvailable = answerM.RecursionAvailable
+		// authenticated only if every answer is
+		authenticated = authenticated && answerM.AuthenticatedData
+		responseM.Answer = append(responseM.Answer, answerM.Answer...)
+		responseM.Ns = append(responseM.Ns, answerM.Ns...)
+		responseM.Extra = append(responseM.Extra, answerM.Extra...)
+	}
+	responseM.AuthenticatedData = authenticated
+	return responseM, nil
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// mockTransport records the queries it is sent and answers with response and err
+type mockTransport struct {
+	queries  []*dns.Msg
+	response func(queryM *dns.Msg) *dns.Msg
+	err      error
+}
+
+func (transport *mockTransport) Query(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+	transport.queries = append(transport.queries, queryM)
+	if transport.err != nil {
+		return nil, transport.err
+	}
+	return transport.response(queryM), nil
+}
+
+func TestMockTransport(t *testing.T) {
+	transport := &mockTransport{response: func(queryM *dns.Msg) *dns.Msg { return answerA(queryM, "192.0.2.7") }}
+	var server Server
+	server.Name = "mock"
+	// the port of the upstream does not matter once a transport is set
+	server.Init("192.0.2.1", 443)
+	server.Transport = transport
+
+	client := newTestClient(t)
+	client.AddServer(server)
+	responseM := resolveWire(t, client, newQuery("example.com", dns.TypeA))
+	if len(transport.queries) != 1 || transport.queries[0].Question[0].Name != "example.com." {
+		t.Fatalf("transport sent %v, want the example.com query", transport.queries)
+	}
+	if len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.7" {
+		t.Errorf("answers %v, want the transport answer", responseM.Answer)
+	}
+
+	transport.err = errors.New("transport down")
+	responseM = resolveWire(t, client, newQuery("example.org", dns.TypeA))
+	if responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode %s with a failing transport, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+	}
+}
+
+func TestNewDNSCryptTransport(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, ed25519.PublicKeySize)
+	stamp := []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, field := range [][]byte{[]byte("192.0.2.1"), key, []byte("2.dnscrypt-cert.example.com")} {
+		stamp = append(stamp, byte(len(field)))
+		stamp = append(stamp, field...)
+	}
+	transport, err := NewDNSCryptTransport("sdns://" + base64.RawURLEncoding.EncodeToString(stamp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.Addr != "192.0.2.1:443" || transport.ProviderName != "2.dnscrypt-cert.example.com." || !bytes.Equal(transport.ProviderKey, key) {
+		t.Errorf("transport %+v", transport)
+	}
+
+	for _, invalid := range []string{"https://example.com", "sdns://AQ", "sdns://" + base64.RawURLEncoding.EncodeToString(stamp[:20])} {
+		if _, err = NewDNSCryptTransport(invalid); err == nil {
+			t.Errorf("stamp %s accepted", invalid)
+		}
+	}
+}
+
+func TestDNSCryptPadding(t *testing.T) {
+	for _, size := range []int{0, 12, 63, 64, 200} {
+		query := bytes.Repeat([]byte{0x80}, size)
+		padded := dnscryptPad(query, 256)
+		if len(padded)%64 != 0 || len(padded) < 256 {
+			t.Errorf("%d bytes padded to %d", size, len(padded))
+		}
+		unpadded, err := dnscryptUnpad(padded)
+		if err != nil || !bytes.Equal(unpadded, query) {
+			t.Errorf("%d bytes unpadded to %d: %v", size, len(unpadded), err)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"strconv"
 	"strings"
@@ -10,19 +12,377 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// validateQuestion checks that the question name is a well formed domain name
+// labels are limited to 63 bytes and names to 255 bytes in wire format
+func validateQuestion(question dns.Question) error {
+	if _, ok := dns.IsDomainName(question.Name); !ok {
+		return errors.New("Invalid domain name")
+	}
+	name := dns.Fqdn(question.Name)
+	if len(name)+1 > 255 {
+		return errors.New("Domain name too long")
+	}
+	// walk the labels in place, every query goes through here
+	for offset := 0; offset < len(name)-1; {
+		next, _ := dns.NextLabel(name, offset)
+		if next-offset-1 > 63 {
+			return errors.New("Domain label too long")
+		}
+		offset = next
+	}
+	return nil
+}
+
+// replyTo gives a shared response, cached or resolved for another query, the id and question of queryM
+// the question keeps the casing the client sent
+// responseM is the caller's own copy, its question is overwritten rather than reallocated
+func replyTo(responseM *dns.Msg, queryM *dns.Msg) {
+	responseM.Id = queryM.Id
+	if len(responseM.Question) == len(queryM.Question) {
+		copy(responseM.Question, queryM.Question)
+		return
+	}
+	responseM.Question = append([]dns.Question(nil), queryM.Question...)
+}
+
+// formatErrorResponse builds a FORMERR reply to a query that failed to unpack
+// Returns nil if the query is too short to contain a header
+func formatErrorResponse(buffer []byte) *dns.Msg {
+	if len(buffer) < 12 {
+		return nil
+	}
+
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.Id = uint16(buffer[0])<<8 | uint16(buffer[1])
+	responseM.Opcode = int(buffer[2]>>3) & 0xF
+	responseM.Response = true
+	responseM.Rcode = dns.RcodeFormatError
+	return responseM
+}
+
+// udpSize returns the largest UDP response the client accepts
+// the EDNS buffer size if advertised, 512 otherwise
+func udpSize(queryM *dns.Msg) int {
+	opt := queryM.IsEdns0()
+	if opt == nil || opt.UDPSize() < dns.MinMsgSize {
+		return dns.MinMsgSize
+	}
+	return int(opt.UDPSize())
+}
+
+// packResponse packs the response for a client accepting at most size bytes
+// If the packed message is still larger, only the header, question and OPT record are sent with TC set
+func packResponse(responseM *dns.Msg, size int) ([]byte, error) {
+	responseBytes, err := responseM.Pack()
+	if err != nil || len(responseBytes) <= size {
+		return responseBytes, err
+	}
+
+	log.WithFields(log.Fields{"Size": len(responseBytes), "Limit": size}).Debug("Packed response too large, sending TC")
+	var truncatedM *dns.Msg = new(dns.Msg)
+	truncatedM.MsgHdr = responseM.MsgHdr
+	truncatedM.Truncated = true
+	truncatedM.Question = responseM.Question
+	if opt := responseM.IsEdns0(); opt != nil {
+		truncatedM.Extra = []dns.RR{opt}
+	}
+	return truncatedM.Pack()
+}
+
+// setEDE attaches an extended DNS error (RFC 8914) to the message
+// An OPT record is added if the message does not have one
+func setEDE(m *dns.Msg, code uint16, text string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  code,
+		ExtraText: text,
+	})
+}
+
+// minimizeResponse keeps only the answer section of a response
+// Negative answers keep the SOA of the authority section, which resolvers need for caching,
+// and the OPT record is kept in the additional section
+func minimizeResponse(responseM *dns.Msg) {
+	var ns []dns.RR
+	if negativeResponse(responseM) {
+		for _, rr := range responseM.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				ns = append(ns, rr)
+			}
+		}
+	}
+	responseM.Ns = ns
+
+	var extra []dns.RR
+	for _, rr := range responseM.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	responseM.Extra = extra
+}
+
+// shuffleAnswers randomizes the order of the A and AAAA records of the answer section
+// other records, e.g. the CNAMEs leading to the addresses, keep their position
+func shuffleAnswers(responseM *dns.Msg) {
+	var positions []int
+	for i, rr := range responseM.Answer {
+		if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
+			positions = append(positions, i)
+		}
+	}
+	rand.Shuffle(len(positions), func(i, j int) {
+		a, b := positions[i], positions[j]
+		responseM.Answer[a], responseM.Answer[b] = responseM.Answer[b], responseM.Answer[a]
+	})
+}
+
+// negativeResponse reports whether the response is NXDOMAIN or has no record of the question type
+// CNAMEs leading to the answer do not count as records of the question type
+func negativeResponse(responseM *dns.Msg) bool {
+	if responseM.Rcode == dns.RcodeNameError {
+		return true
+	}
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Question) == 0 {
+		return false
+	}
+	qtype := responseM.Question[0].Qtype
+	for _, rr := range responseM.Answer {
+		if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			return false
+		}
+	}
+	return true
+}
+
+// clampTTL lowers the ttl of every record above ttl to ttl, except OPT pseudo records
+func clampTTL(responseM *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{responseM.Answer, responseM.Ns, responseM.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
+
+// setTTL overwrites the ttl of every record in the message, except OPT pseudo records
+func setTTL(responseM *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{responseM.Answer, responseM.Ns, responseM.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = ttl
+		}
+	}
+}
+
+// constructSection builds the records of one section of a DoH json response
+// a missing section is empty, a malformed one is an error
+func constructSection(responseMap map[string]interface{}, key string) ([]dns.RR, error) {
+	section, ok := responseMap[key]
+	if !ok {
+		return nil, nil
+	}
+	answers, ok := section.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Response %s is %T, expected list", key, section)
+	}
+
+	var records []dns.RR
+	for _, answerInterface := range answers {
+		answer, ok := answerInterface.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Response %s entry is %T, expected object", key, answerInterface)
+		}
+
+		resourceBody, err := constructResource(answer)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, resourceBody)
+	}
+	return records, nil
+}
+
+// answerString returns a string field of a DoH json answer
+func answerString(answer map[string]interface{}, key string) (string, error) {
+	value, ok := answer[key]
+	if !ok {
+		return "", errors.New("Answer is missing " + key)
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("Answer %s is %T, expected string", key, value)
+	}
+	return str, nil
+}
+
+// answerNumber returns a numeric field of a DoH json answer
+func answerNumber(answer map[string]interface{}, key string) (float64, error) {
+	value, ok := answer[key]
+	if !ok {
+		return 0, errors.New("Answer is missing " + key)
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("Answer %s is %T, expected number", key, value)
+	}
+	return number, nil
+}
+
+// splitData splits the data of a DoH json answer into at least min fields
+func splitData(data string, min int) ([]string, error) {
+	fields := strings.Split(data, " ")
+	if len(fields) < min {
+		return nil, fmt.Errorf("Answer data has %d fields, expected %d: %s", len(fields), min, data)
+	}
+	return fields, nil
+}
+
+// parseNumbers parses the numeric fields of answer data, each an unsigned number of the matching bit size
+// Returns an error quoting the first malformed or out of range field
+func parseNumbers(fields []string, bits ...int) ([]uint64, error) {
+	numbers := make([]uint64, len(fields))
+	for i, field := range fields {
+		number, err := strconv.ParseUint(field, 10, bits[i])
+		if err != nil {
+			return nil, fmt.Errorf("Answer data %q is not a %d bit number", field, bits[i])
+		}
+		numbers[i] = number
+	}
+	return numbers, nil
+}
+
+// splitStrings splits data into character-strings separated by spaces
+// Each one is either quoted, e.g. "Intel Xeon", or a single word. Quotes are removed and escapes kept
+func splitStrings(data string) ([]string, error) {
+	var segments []string
+	i := 0
+	for i < len(data) {
+		if data[i] == ' ' || data[i] == '\t' {
+			i++
+			continue
+		}
+
+		var segment strings.Builder
+		quoted := data[i] == '"'
+		if quoted {
+			i++
+		}
+		closed := !quoted
+		for i < len(data) {
+			if data[i] == '\\' && i+1 < len(data) {
+				segment.WriteByte(data[i])
+				segment.WriteByte(data[i+1])
+				i += 2
+				continue
+			}
+			if quoted && data[i] == '"' {
+				closed = true
+				i++
+				break
+			}
+			if !quoted && (data[i] == ' ' || data[i] == '\t') {
+				break
+			}
+			segment.WriteByte(data[i])
+			i++
+		}
+		if !closed {
+			return nil, errors.New("Unterminated string: " + data)
+		}
+		segments = append(segments, segment.String())
+	}
+	return segments, nil
+}
+
+// splitTXT splits TXT data into its character-strings
+// data is either a sequence of quoted strings, e.g. "v=DKIM1; k=rsa; " "p=MIGf...",
+// or a single unquoted string. Escapes are kept in presentation format, as dns.TXT expects
+func splitTXT(data string) ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(data), "\"") {
+		return []string{data}, nil
+	}
+
+	var segments []string
+	i := 0
+	for i < len(data) {
+		if data[i] == ' ' || data[i] == '\t' {
+			i++
+			continue
+		}
+		if data[i] != '"' {
+			return nil, errors.New("Unquoted text between TXT strings: " + data)
+		}
+
+		var segment strings.Builder
+		i++
+		closed := false
+		for i < len(data) {
+			if data[i] == '\\' && i+1 < len(data) {
+				segment.WriteByte(data[i])
+				segment.WriteByte(data[i+1])
+				i += 2
+				continue
+			}
+			if data[i] == '"' {
+				closed = true
+				i++
+				break
+			}
+			segment.WriteByte(data[i])
+			i++
+		}
+		if !closed {
+			return nil, errors.New("Unterminated TXT string: " + data)
+		}
+		segments = append(segments, segment.String())
+	}
+	return segments, nil
+}
+
+// constructResource takes an answer from the DoH json response and construct a resource record
 func constructResource(answer map[string]interface{}) (dns.RR, error) {
+	name, err := answerString(answer, "name")
+	if err != nil {
+		return nil, err
+	}
+	rrtype, err := answerNumber(answer, "type")
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := answerNumber(answer, "TTL")
+	if err != nil {
+		return nil, err
+	}
+	data, err := answerString(answer, "data")
+	if err != nil {
+		return nil, err
+	}
+
 	var resourceHeader dns.RR_Header = dns.RR_Header{
-		Name:   dns.Fqdn(answer["name"].(string)),
-		Rrtype: uint16(answer["type"].(float64)),
+		Name:   dns.Fqdn(name),
+		Rrtype: uint16(rrtype),
 		Class:  dns.ClassINET,
-		Ttl:    uint32(answer["TTL"].(float64)),
+		Ttl:    uint32(ttl),
 	}
 
+	// some upstreams omit the trailing dot of names in data
+	// e.g. the target of a PTR answer for 4.4.8.8.in-addr.arpa
 	var resourceBody dns.RR
-	switch answer["type"].(float64) {
+	switch rrtype {
 	case 1:
 		// Type A
-		resourceIP := net.ParseIP(answer["data"].(string))
+		resourceIP := net.ParseIP(data)
+		if resourceIP == nil {
+			return nil, errors.New("Invalid A data: " + data)
+		}
 		resourceBody = &dns.A{
 			Hdr: resourceHeader,
 			A:   resourceIP,
@@ -32,25 +392,24 @@ func constructResource(answer map[string]interface{}) (dns.RR, error) {
 		// Type NS
 		resourceBody = &dns.NS{
 			Hdr: resourceHeader,
-			Ns:  answer["data"].(string),
+			Ns:  dns.Fqdn(data),
 		}
 		break
 	case 5:
 		// Type CNAME
 		resourceBody = &dns.CNAME{
 			Hdr:    resourceHeader,
-			Target: answer["data"].(string),
+			Target: dns.Fqdn(data),
 		}
 		break
 	case 6:
 		// Type SOA
-		resourceData := strings.Split(answer["data"].(string), " ")
+		resourceData, err := splitData(data, 7)
+		if err != nil {
+			return nil, err
+		}
 
-		serial, err := strconv.Atoi(resourceData[2])
-		refresh, err := strconv.Atoi(resourceData[3])
-		retry, err := strconv.Atoi(resourceData[4])
-		expire, err := strconv.Atoi(resourceData[5])
-		minTTL, err := strconv.Atoi(resourceData[6])
+		numbers, err := parseNumbers(resourceData[2:7], 32, 32, 32, 32, 32)
 		if err != nil {
 			log.WithFields(log.Fields{"Error": err}).Error("Failed to parse SOA data")
 			return nil, err
@@ -58,27 +417,47 @@ func constructResource(answer map[string]interface{}) (dns.RR, error) {
 
 		resourceBody = &dns.SOA{
 			Hdr:     resourceHeader,
-			Ns:      resourceData[0],
-			Mbox:    resourceData[1],
-			Serial:  uint32(serial),
-			Refresh: uint32(refresh),
-			Retry:   uint32(retry),
-			Expire:  uint32(expire),
-			Minttl:  uint32(minTTL),
+			Ns:      dns.Fqdn(resourceData[0]),
+			Mbox:    dns.Fqdn(resourceData[1]),
+			Serial:  uint32(numbers[0]),
+			Refresh: uint32(numbers[1]),
+			Retry:   uint32(numbers[2]),
+			Expire:  uint32(numbers[3]),
+			Minttl:  uint32(numbers[4]),
 		}
 		break
 	case 12:
 		// Type PTR
 		resourceBody = &dns.PTR{
 			Hdr: resourceHeader,
-			Ptr: answer["data"].(string),
+			Ptr: dns.Fqdn(data),
+		}
+		break
+	case 13:
+		// Type HINFO
+		// cpu and os are character-strings, quoted when they contain spaces
+		resourceData, err := splitStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(resourceData) != 2 {
+			return nil, errors.New("Invalid HINFO data: " + data)
+		}
+
+		resourceBody = &dns.HINFO{
+			Hdr: resourceHeader,
+			Cpu: resourceData[0],
+			Os:  resourceData[1],
 		}
 		break
 	case 15:
 		// Type MX
-		resourceData := strings.Split(answer["data"].(string), " ")
+		resourceData, err := splitData(data, 2)
+		if err != nil {
+			return nil, err
+		}
 
-		resourcePreference, err := strconv.Atoi(resourceData[0])
+		numbers, err := parseNumbers(resourceData[:1], 16)
 		if err != nil {
 			log.WithFields(log.Fields{"Error": err}).Error("Failed to parse MX data")
 			return nil, err
@@ -86,38 +465,65 @@ func constructResource(answer map[string]interface{}) (dns.RR, error) {
 
 		resourceBody = &dns.MX{
 			Hdr:        resourceHeader,
-			Preference: uint16(resourcePreference),
-			Mx:         resourceData[1],
+			Preference: uint16(numbers[0]),
+			Mx:         dns.Fqdn(resourceData[1]),
 		}
 		break
 	case 16:
 		// Type TXT
-		data, err := strconv.Unquote(answer["data"].(string))
+		resourceData, err := splitTXT(data)
 		if err != nil {
 			log.WithFields(log.Fields{"Error": err}).Error("Failed to parse TXT data")
 			return nil, err
 		}
-		resourceData := []string{data}
 
 		resourceBody = &dns.TXT{
 			Hdr: resourceHeader,
 			Txt: resourceData,
 		}
 		break
+	case 17:
+		// Type RP
+		resourceData, err := splitData(data, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		resourceBody = &dns.RP{
+			Hdr:  resourceHeader,
+			Mbox: dns.Fqdn(resourceData[0]),
+			Txt:  dns.Fqdn(resourceData[1]),
+		}
+		break
 	case 28:
 		// Type AAAA
-		resourceIP := net.ParseIP(answer["data"].(string))
+		resourceIP := net.ParseIP(data)
+		if resourceIP == nil {
+			return nil, errors.New("Invalid AAAA data: " + data)
+		}
 		resourceBody = &dns.AAAA{
 			Hdr:  resourceHeader,
 			AAAA: resourceIP,
 		}
 		break
+	case 29:
+		// Type LOC
+		// e.g. 52 22 23.000 N 4 53 32.000 E -2.00m 0.00m 10000.00m 10.00m
+		// the degree, meter and precision encodings of RFC 1876 are left to the miekg/dns parser
+		resourceLOC, err := constructGenericResource(resourceHeader, data)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err, "data": data}).Error("Failed to parse LOC data")
+			return nil, err
+		}
+		resourceBody = resourceLOC
+		break
 	case 33:
 		// Type SRV
-		resourceData := strings.Split(answer["data"].(string), " ")
-		priority, err := strconv.Atoi(resourceData[0])
-		weight, err := strconv.Atoi(resourceData[1])
-		port, err := strconv.Atoi(resourceData[2])
+		resourceData, err := splitData(data, 4)
+		if err != nil {
+			return nil, err
+		}
+		numbers, err := parseNumbers(resourceData[:3], 16, 16, 16)
 		if err != nil {
 			log.WithFields(log.Fields{"Error": err}).Error("Failed to parse SRV data")
 			return nil, err
@@ -125,44 +531,66 @@ func constructResource(answer map[string]interface{}) (dns.RR, error) {
 
 		resourceBody = &dns.SRV{
 			Hdr:      resourceHeader,
-			Priority: uint16(priority),
-			Weight:   uint16(weight),
-			Port:     uint16(port),
-			Target:   resourceData[3],
+			Priority: uint16(numbers[0]),
+			Weight:   uint16(numbers[1]),
+			Port:     uint16(numbers[2]),
+			Target:   dns.Fqdn(resourceData[3]),
+		}
+		break
+	case 43:
+		// Type DS
+		resourceData, err := splitData(data, 4)
+		if err != nil {
+			return nil, err
+		}
+
+		numbers, err := parseNumbers(resourceData[:3], 16, 8, 8)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Failed to parse DS data")
+			return nil, err
+		}
+
+		resourceBody = &dns.DS{
+			Hdr:        resourceHeader,
+			KeyTag:     uint16(numbers[0]),
+			Algorithm:  uint8(numbers[1]),
+			DigestType: uint8(numbers[2]),
+			Digest:     strings.Join(resourceData[3:], ""),
 		}
 		break
 	case 46:
 		// Type RRSIG
-		resourceData := strings.Split(answer["data"].(string), " ")
+		resourceData, err := splitData(data, 9)
+		if err != nil {
+			return nil, err
+		}
 
-		algorithm, err := strconv.Atoi(resourceData[1])
-		labels, err := strconv.Atoi(resourceData[2])
-		origTTL, err := strconv.Atoi(resourceData[3])
-		expiration, err := strconv.Atoi(resourceData[4])
-		inception, err := strconv.Atoi(resourceData[5])
-		keyTag, err := strconv.Atoi(resourceData[6])
+		numbers, err := parseNumbers(resourceData[1:7], 8, 8, 32, 32, 32, 16)
 		if err != nil {
-			log.WithFields(log.Fields{"Error": err}).Error("Failed to parse SOA data")
+			log.WithFields(log.Fields{"Error": err}).Error("Failed to parse RRSIG data")
 			return nil, err
 		}
 
 		resourceBody = &dns.RRSIG{
 			Hdr:         resourceHeader,
-			TypeCovered: dns.StringToType[resourceData[0]],
-			Algorithm:   uint8(algorithm),
-			Labels:      uint8(labels),
-			OrigTtl:     uint32(origTTL),
-			Expiration:  uint32(expiration),
-			Inception:   uint32(inception),
-			KeyTag:      uint16(keyTag),
-			SignerName:  resourceData[7],
-			Signature:   resourceData[8],
+			TypeCovered: dns.StringToType[strings.ToUpper(resourceData[0])],
+			Algorithm:   uint8(numbers[0]),
+			Labels:      uint8(numbers[1]),
+			OrigTtl:     uint32(numbers[2]),
+			Expiration:  uint32(numbers[3]),
+			Inception:   uint32(numbers[4]),
+			KeyTag:      uint16(numbers[5]),
+			SignerName:  dns.Fqdn(resourceData[7]),
+			Signature:   strings.Join(resourceData[8:], ""),
 		}
 		break
 	case 47:
 		// Type NSEC
-		resourceData := strings.Split(answer["data"].(string), " ")
-		nextDomain := resourceData[0]
+		resourceData, err := splitData(data, 1)
+		if err != nil {
+			return nil, err
+		}
+		nextDomain := dns.Fqdn(resourceData[0])
 
 		var typeBitMap []uint16
 		for _, t := range resourceData[1:] {
@@ -175,11 +603,74 @@ func constructResource(answer map[string]interface{}) (dns.RR, error) {
 			TypeBitMap: typeBitMap,
 		}
 		break
+	case 48:
+		// Type DNSKEY
+		resourceData, err := splitData(data, 4)
+		if err != nil {
+			return nil, err
+		}
+
+		numbers, err := parseNumbers(resourceData[:3], 16, 8, 8)
+		if err != nil {
+			log.WithFields(log.Fields{"Error": err}).Error("Failed to parse DNSKEY data")
+			return nil, err
+		}
+
+		resourceBody = &dns.DNSKEY{
+			Hdr:       resourceHeader,
+			Flags:     uint16(numbers[0]),
+			Protocol:  uint8(numbers[1]),
+			Algorithm: uint8(numbers[2]),
+			PublicKey: strings.Join(resourceData[3:], ""),
+		}
+		break
 	default:
-		log.WithFields(log.Fields{"data": answer["data"].(string),
-			"type": answer["type"].(float64)}).Error("Constructing DNS response. Type not supported")
-		return nil, errors.New("Type not supported")
+		resourceGeneric, err := constructGenericResource(resourceHeader, data)
+		if err != nil {
+			log.WithFields(log.Fields{"data": data,
+				"type": rrtype}).Error("Constructing DNS response. Type not supported")
+			return nil, errors.New("Type not supported")
+		}
+		resourceBody = resourceGeneric
 	}
 
 	return resourceBody, nil
 }
+
+// constructGenericResource builds a record of a type not handled by constructResource
+// data in the RFC 3597 "\# length hex" form is passed through as a generic record,
+// otherwise it is parsed as presentation format if miekg/dns knows the type
+func constructGenericResource(resourceHeader dns.RR_Header, data string) (dns.RR, error) {
+	if strings.HasPrefix(data, `\#`) {
+		fields := strings.Fields(data)
+		if len(fields) < 2 {
+			return nil, errors.New("Invalid generic rdata")
+		}
+		length, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		rdata := strings.Join(fields[2:], "")
+		if len(rdata) != 2*length {
+			return nil, errors.New("Generic rdata length mismatch")
+		}
+		return &dns.RFC3597{
+			Hdr:   resourceHeader,
+			Rdata: rdata,
+		}, nil
+	}
+
+	typeString, ok := dns.TypeToString[resourceHeader.Rrtype]
+	if !ok {
+		return nil, errors.New("Unknown type without generic rdata")
+	}
+	resourceBody, err := dns.NewRR(resourceHeader.Name + " " + strconv.Itoa(int(resourceHeader.Ttl)) + " IN " + typeString + " " + data)
+	if err != nil {
+		return nil, err
+	}
+	// nothing but a comment was parsed, e.g. from a name starting with ';'
+	if resourceBody == nil {
+		return nil, errors.New("No record in data: " + data)
+	}
+	return resourceBody, nil
+}
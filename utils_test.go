@@ -0,0 +1,396 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateQuestion(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"example.com.", true},
+		{"example.com", true},
+		{strings.Repeat("a", 63) + ".com.", true},
+		{strings.Repeat("a", 64) + ".com.", false},
+		{strings.Repeat(strings.Repeat("a", 60)+".", 5), false},
+		{"bad..name.", false},
+	}
+	for _, test := range tests {
+		err := validateQuestion(dns.Question{Name: test.name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		if (err == nil) != test.valid {
+			t.Errorf("validateQuestion(%q) = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestResolveRejectsInvalidNames(t *testing.T) {
+	client := newTestClient(t)
+	contacted := false
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		contacted = true
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+
+	for _, name := range []string{strings.Repeat("a", 64) + ".com.", "bad..name."} {
+		queryM := new(dns.Msg)
+		queryM.Question = []dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+		responseM, err := client.Resolve(queryM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseM.Rcode != dns.RcodeFormatError {
+			t.Errorf("%q answered %s, want FORMERR", name, dns.RcodeToString[responseM.Rcode])
+		}
+	}
+	if contacted {
+		t.Error("invalid names were sent upstream")
+	}
+}
+
+func TestResolveKeepsQuestionCase(t *testing.T) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	client.AddServer(stubServer("stub", staticTransport("192.0.2.1")))
+
+	for _, name := range []string{"Example.COM.", "eXample.com."} {
+		queryM := newQuery(name, dns.TypeA)
+		responseM, err := client.Resolve(queryM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queryM.Question[0].Name != name {
+			t.Errorf("query name changed to %q", queryM.Question[0].Name)
+		}
+		if responseM.Question[0].Name != name {
+			t.Errorf("response question %q, want %q", responseM.Question[0].Name, name)
+		}
+	}
+	if stats := client.Stats(); stats.CacheHits != 1 {
+		t.Errorf("%d cache hits, want differently cased names to share an entry", stats.CacheHits)
+	}
+}
+
+func TestSetEDE(t *testing.T) {
+	m := new(dns.Msg)
+	setEDE(m, dns.ExtendedErrorCodeFiltered, "Blocked")
+	ede := extendedError(m)
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeFiltered || ede.ExtraText != "Blocked" {
+		t.Fatalf("EDE %v, want filtered", ede)
+	}
+	if len(m.Extra) != 1 {
+		t.Errorf("%d additional records, want a single OPT", len(m.Extra))
+	}
+}
+
+func TestUpstreamFailureEDE(t *testing.T) {
+	client := newTestClient(t)
+	client.AddServer(stubServer("down", failingTransport(errors.New("Upstream unreachable"))))
+
+	queryM := newQuery("example.com", dns.TypeA)
+	queryM.SetEdns0(1232, false)
+	query, _ := queryM.Pack()
+	response, err := client.ResolveSync(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseM dns.Msg
+	err = responseM.Unpack(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseM.Rcode != dns.RcodeServerFailure {
+		t.Errorf("answered %s, want SERVFAIL", dns.RcodeToString[responseM.Rcode])
+	}
+	if ede := extendedError(&responseM); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNetworkError {
+		t.Errorf("EDE %v, want network error", ede)
+	}
+
+	// clients without EDNS get no OPT record
+	query, _ = newQuery("example.com", dns.TypeA).Pack()
+	response, _ = client.ResolveSync(query)
+	responseM = dns.Msg{}
+	responseM.Unpack(response)
+	if responseM.IsEdns0() != nil {
+		t.Error("EDE sent to a client without EDNS")
+	}
+}
+
+// jsonRecord returns a DoH json answer entry
+func jsonRecord(name string, rrtype uint16, data string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "type": float64(rrtype), "TTL": float64(300), "data": data}
+}
+
+func TestConstructUnknownType(t *testing.T) {
+	rr, err := constructResource(jsonRecord("example.com", 65280, `\# 4 0a000005`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic, ok := rr.(*dns.RFC3597)
+	if !ok || generic.Rdata != "0a000005" || generic.Hdr.Rrtype != 65280 {
+		t.Fatalf("record %v, want generic rdata of type 65280", rr)
+	}
+	var m dns.Msg
+	m.Answer = []dns.RR{rr}
+	_, err = m.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, data := range []string{"0a000005", `\# 4 0a00`, `\# x 0a000005`} {
+		_, err = constructResource(jsonRecord("example.com", 65280, data))
+		if err == nil {
+			t.Errorf("data %q of an unknown type was accepted", data)
+		}
+	}
+}
+
+func TestConstructGenericResourceWithoutRecord(t *testing.T) {
+	// the record is parsed as presentation format, where everything after ';' is a comment
+	rr, err := constructResource(jsonRecord(";", dns.TypeLOC, "52 22 23.000 N 4 53 32.000 E -2.00m"))
+	if err == nil {
+		t.Fatalf("comment only record returned %v", rr)
+	}
+}
+
+func TestConstructMalformedAnswer(t *testing.T) {
+	answers := []map[string]interface{}{
+		{"name": "example.com", "type": float64(1), "data": "192.0.2.1"},
+		{"name": "example.com", "type": "A", "TTL": float64(300), "data": "192.0.2.1"},
+		{"type": float64(1), "TTL": float64(300), "data": "192.0.2.1"},
+		{"name": "example.com", "type": float64(1), "TTL": float64(300), "data": float64(1)},
+	}
+	for _, answer := range answers {
+		rr, err := constructResource(answer)
+		if err == nil {
+			t.Errorf("answer %v constructed %v", answer, rr)
+		}
+	}
+}
+
+func TestConstructMalformedNumbers(t *testing.T) {
+	tests := []struct {
+		rrtype uint16
+		data   string
+		// indexes of the numeric fields of data
+		numbers []int
+	}{
+		{dns.TypeSOA, "ns.example.com. admin.example.com. 2024010101 7200 3600 1209600 300", []int{2, 3, 4, 5, 6}},
+		{dns.TypeMX, "10 mail.example.com.", []int{0}},
+		{dns.TypeSRV, "10 60 5060 sip.example.com.", []int{0, 1, 2}},
+		{dns.TypeDS, "12345 8 2 49FD46E6C4B45C55D4AC", []int{0, 1, 2}},
+		{dns.TypeRRSIG, "A 8 2 300 1700000000 1690000000 12345 example.com. c2lnbmF0dXJl", []int{1, 2, 3, 4, 5, 6}},
+		{dns.TypeDNSKEY, "257 3 8 AwEAAag=", []int{0, 1, 2}},
+	}
+	for _, test := range tests {
+		typeName := dns.TypeToString[test.rrtype]
+		_, err := constructResource(jsonRecord("example.com", test.rrtype, test.data))
+		if err != nil {
+			t.Errorf("valid %s data %q: %v", typeName, test.data, err)
+		}
+		for _, i := range test.numbers {
+			for _, bad := range []string{"x", "-1", "99999999999"} {
+				fields := strings.Split(test.data, " ")
+				fields[i] = bad
+				data := strings.Join(fields, " ")
+				rr, err := constructResource(jsonRecord("example.com", test.rrtype, data))
+				if err == nil {
+					t.Errorf("%s data %q constructed %v", typeName, data, rr)
+				}
+			}
+		}
+	}
+}
+
+func TestConstructMultiSegmentTXT(t *testing.T) {
+	key := strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA", 6)
+	data := `"v=DKIM1; k=rsa; p=` + key[:200] + `" "` + key[200:] + `" "say \"hi\""`
+	rr, err := constructResource(jsonRecord("selector._domainkey.example.com", dns.TypeTXT, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, ok := rr.(*dns.TXT)
+	if !ok || len(txt.Txt) != 3 {
+		t.Fatalf("record %v, want 3 TXT strings", rr)
+	}
+	if joined := strings.Join(txt.Txt[:2], ""); joined != "v=DKIM1; k=rsa; p="+key {
+		t.Errorf("DKIM key %q, want the segments joined", joined)
+	}
+
+	// the strings survive the wire format, escaped quotes included
+	var m dns.Msg
+	m.Answer = []dns.RR{rr}
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Unpack(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Answer[0].(*dns.TXT).Txt; got[2] != `say \"hi\"` || got[1] != key[200:] {
+		t.Errorf("unpacked TXT strings %q", got)
+	}
+}
+
+func TestConstructHINFO(t *testing.T) {
+	for data, want := range map[string][2]string{
+		`"Intel Xeon" "Linux 6.1"`: {"Intel Xeon", "Linux 6.1"},
+		`INTEL LINUX`:              {"INTEL", "LINUX"},
+		`"Intel Xeon" LINUX`:       {"Intel Xeon", "LINUX"},
+		`"RFC8482" ""`:             {"RFC8482", ""},
+	} {
+		rr, err := constructResource(jsonRecord("example.com", dns.TypeHINFO, data))
+		if err != nil {
+			t.Errorf("%s: %v", data, err)
+			continue
+		}
+		hinfo, ok := rr.(*dns.HINFO)
+		if !ok || hinfo.Cpu != want[0] || hinfo.Os != want[1] {
+			t.Errorf("%s: record %v, want cpu %q and os %q", data, rr, want[0], want[1])
+		}
+	}
+	for _, data := range []string{`"Intel Xeon"`, `"Intel Xeon" "Linux`, `x86 Linux extra`} {
+		_, err := constructResource(jsonRecord("example.com", dns.TypeHINFO, data))
+		if err == nil {
+			t.Errorf("invalid HINFO data %s accepted", data)
+		}
+	}
+}
+
+func TestConstructRP(t *testing.T) {
+	rr, err := constructResource(jsonRecord("example.com", dns.TypeRP, "admin.example.com info.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, ok := rr.(*dns.RP)
+	if !ok || rp.Mbox != "admin.example.com." || rp.Txt != "info.example.com." {
+		t.Errorf("record %v, want mbox admin.example.com. and txt info.example.com.", rr)
+	}
+}
+
+func TestConstructLOC(t *testing.T) {
+	data := "52 22 23.000 N 4 53 32.000 E -2.00m 0.00m 10000.00m 10.00m"
+	rr, err := constructResource(jsonRecord("example.com", dns.TypeLOC, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := rr.(*dns.LOC)
+	if !ok {
+		t.Fatalf("record %v, want LOC", rr)
+	}
+	// thousandths of arc seconds from the equator and the prime meridian, offset by 2^31 (RFC 1876)
+	if loc.Latitude != 1<<31+(52*3600+22*60+23)*1000 || loc.Longitude != 1<<31+(4*3600+53*60+32)*1000 {
+		t.Errorf("latitude %d longitude %d of %s", loc.Latitude, loc.Longitude, data)
+	}
+	// centimeters above 100000m below the reference spheroid
+	if loc.Altitude != 10000000-200 {
+		t.Errorf("altitude %d, want -2m", loc.Altitude)
+	}
+	if loc.Hdr.Name != "example.com." || loc.Hdr.Ttl != 300 {
+		t.Errorf("header %v, want example.com. with ttl 300", loc.Hdr)
+	}
+	_, err = constructResource(jsonRecord("example.com", dns.TypeLOC, "52 22 23.000 X 4 53 32.000 E"))
+	if err == nil {
+		t.Error("invalid LOC data accepted")
+	}
+}
+
+func TestMinimalResponses(t *testing.T) {
+	rr := func(data string) dns.RR {
+		record, err := dns.NewRR(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+	client := newTestClient(t)
+	client.MinimalResponses = true
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		responseM := answerA(queryM, "192.0.2.1")
+		if queryM.Question[0].Name == "missing.example.com." {
+			responseM.Rcode = dns.RcodeNameError
+			responseM.Answer = nil
+			responseM.Ns = append(responseM.Ns, rr("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 300"))
+		}
+		responseM.Ns = append(responseM.Ns, rr("example.com. 300 IN NS ns.example.com."))
+		responseM.Extra = append(responseM.Extra, rr("ns.example.com. 300 IN A 192.0.2.53"))
+		if queryM.IsEdns0() != nil {
+			responseM.SetEdns0(1232, false)
+		}
+		return responseM, nil
+	}))
+
+	queryM := newQuery("www.example.com", dns.TypeA)
+	queryM.SetEdns0(1232, false)
+	responseM := resolveWire(t, client, queryM)
+	if len(responseM.Answer) != 1 || len(responseM.Ns) != 0 {
+		t.Errorf("answer %v authority %v, want the answer alone", responseM.Answer, responseM.Ns)
+	}
+	if len(responseM.Extra) != 1 || responseM.IsEdns0() == nil {
+		t.Errorf("additional %v, want only the OPT record", responseM.Extra)
+	}
+
+	// negative answers keep their SOA for negative caching
+	responseM = resolveWire(t, client, newQuery("missing.example.com", dns.TypeA))
+	if len(responseM.Ns) != 1 || responseM.Ns[0].Header().Rrtype != dns.TypeSOA || len(responseM.Extra) != 0 {
+		t.Errorf("authority %v additional %v, want only the SOA", responseM.Ns, responseM.Extra)
+	}
+}
+
+func TestShuffleAnswersVaries(t *testing.T) {
+	client := newTestClient(t)
+	client.Cache = NewMemoryCache()
+	client.ShuffleAnswers = true
+	client.AddServer(stubServer("stub", manyAnswers(8)))
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5300}
+
+	orders := make(map[string]bool)
+	firsts := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		_, responseM := answerFrom(t, client, newQuery("example.com", dns.TypeA), addr)
+		if len(responseM.Answer) != 8 {
+			t.Fatalf("answers %v, want all 8 addresses", responseM.Answer)
+		}
+		var order []string
+		seen := make(map[string]bool)
+		for _, rr := range responseM.Answer {
+			order = append(order, rr.(*dns.A).A.String())
+			seen[rr.(*dns.A).A.String()] = true
+		}
+		if len(seen) != 8 {
+			t.Fatalf("answers %v, want every address once", order)
+		}
+		orders[strings.Join(order, " ")] = true
+		firsts[order[0]] = true
+	}
+	// responses after the first are cache hits, shuffled all the same
+	if len(orders) < 2 || len(firsts) < 2 {
+		t.Errorf("%d orders with %d first addresses over 50 responses, want the order to vary", len(orders), len(firsts))
+	}
+	if stats := client.Stats(); stats.CacheHits != 49 {
+		t.Errorf("%d cache hits, want 49", stats.CacheHits)
+	}
+}
+
+func TestShuffleAnswersKeepsCNAME(t *testing.T) {
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.Answer = append(responseM.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: "cdn.example.net.",
+	})
+	addressM, _ := manyAnswers(6)(context.Background(), newQuery("cdn.example.net", dns.TypeA))
+	responseM.Answer = append(responseM.Answer, addressM.Answer...)
+	for i := 0; i < 20; i++ {
+		shuffleAnswers(responseM)
+		if responseM.Answer[0].Header().Rrtype != dns.TypeCNAME {
+			t.Fatalf("answers %v, want the CNAME to keep its position", responseM.Answer)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Zone holds the records of a zone file, answered authoritatively instead of forwarded
+type Zone struct {
+	// apex of the zone, the SOA owner or the origin given to LoadZone
+	// names below it which are not in the zone get NXDOMAIN
+	Origin string
+
+	// SOA of the zone added to negative answers, nil when the file has none
+	SOA *dns.SOA
+
+	// records by lowercase owner name
+	records map[string][]dns.RR
+
+	// owner names and their ancestors down to the origin, for empty non-terminals
+	names map[string]bool
+}
+
+// LoadZone parses a zone file in master file format
+// origin is used for relative names when the file has no $ORIGIN, it may be empty if all names are absolute
+func LoadZone(path string, origin string) (*Zone, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Path": path}).Error("Failed to open zone file")
+		return nil, err
+	}
+	defer file.Close()
+
+	if origin != "" {
+		origin = dns.Fqdn(origin)
+	}
+	zone := &Zone{
+		Origin:  strings.ToLower(origin),
+		records: make(map[string][]dns.RR),
+		names:   make(map[string]bool),
+	}
+
+	var rrs []dns.RR
+	parser := dns.NewZoneParser(file, origin, path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA && zone.SOA == nil {
+			zone.SOA = soa
+			zone.Origin = strings.ToLower(soa.Hdr.Name)
+		}
+		rrs = append(rrs, rr)
+	}
+	err = parser.Err()
+	if err != nil {
+		log.WithFields(log.Fields{"Error": err, "Path": path}).Error("Failed to parse zone file")
+		return nil, err
+	}
+	if len(rrs) == 0 {
+		return nil, errors.New("Zone file " + path + " has no records")
+	}
+
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		if zone.Origin != "" && !dns.IsSubDomain(zone.Origin, owner) {
+			log.WithFields(log.Fields{"Name": owner, "Origin": zone.Origin}).Warn("Ignored record outside of the zone")
+			continue
+		}
+		zone.records[owner] = append(zone.records[owner], rr)
+		for name := owner; ; {
+			zone.names[name] = true
+			if name == zone.Origin || name == "." {
+				break
+			}
+			labels := dns.SplitDomainName(name)
+			name = dns.Fqdn(strings.Join(labels[1:], "."))
+		}
+	}
+
+	log.WithFields(log.Fields{"Path": path, "Origin": zone.Origin, "Records": len(rrs)}).Info("Zone file loaded")
+	return zone, nil
+}
+
+// contains reports whether the zone is authoritative for name
+func (zone *Zone) contains(name string) bool {
+	if zone.Origin == "" {
+		return zone.names[name] && !zone.delegated(name)
+	}
+	return dns.IsSubDomain(zone.Origin, name) && !zone.delegated(name)
+}
+
+// delegated reports whether name is at or below a zone cut, an NS record set owned by a name other than the origin
+// delegated names are sent upstream rather than answered with a referral the stub client cannot follow
+func (zone *Zone) delegated(name string) bool {
+	for name != zone.Origin && name != "." {
+		for _, rr := range zone.records[name] {
+			if rr.Header().Rrtype == dns.TypeNS {
+				return true
+			}
+		}
+		labels := dns.SplitDomainName(name)
+		name = dns.Fqdn(strings.Join(labels[1:], "."))
+	}
+	return false
+}
+
+// glue returns the addresses the zone holds for the targets of NS, MX and SRV records
+func (zone *Zone) glue(answers []dns.RR) []dns.RR {
+	var extra []dns.RR
+	seen := make(map[string]bool)
+	for _, rr := range answers {
+		var target string
+		switch record := rr.(type) {
+		case *dns.NS:
+			target = record.Ns
+		case *dns.MX:
+			target = record.Mx
+		case *dns.SRV:
+			target = record.Target
+		default:
+			continue
+		}
+		target = strings.ToLower(target)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		for _, address := range zone.records[target] {
+			if address.Header().Rrtype == dns.TypeA || address.Header().Rrtype == dns.TypeAAAA {
+				extra = append(extra, dns.Copy(address))
+			}
+		}
+	}
+	return extra
+}
+
+// Answer answers a query for a name of the zone with AA set
+// Returns false if the name is outside of the zone and the query should be sent upstream
+func (zone *Zone) Answer(queryM *dns.Msg) (*dns.Msg, bool) {
+	if len(queryM.Question) != 1 {
+		return nil, false
+	}
+	question := queryM.Question[0]
+	name := strings.ToLower(dns.Fqdn(question.Name))
+	if !zone.contains(name) {
+		return nil, false
+	}
+
+	var responseM *dns.Msg = new(dns.Msg)
+	responseM.SetReply(queryM)
+	responseM.Authoritative = true
+	responseM.RecursionAvailable = true
+
+	// follow CNAMEs inside the zone, at most once per name
+	seen := make(map[string]bool)
+	for !seen[name] {
+		seen[name] = true
+		var cname *dns.CNAME
+		var found bool
+		for _, rr := range zone.records[name] {
+			header := rr.Header()
+			if header.Class != question.Qclass && question.Qclass != dns.ClassANY {
+				continue
+			}
+			if header.Rrtype == question.Qtype || question.Qtype == dns.TypeANY {
+				responseM.Answer = append(responseM.Answer, dns.Copy(rr))
+				found = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if found || cname == nil {
+			break
+		}
+		responseM.Answer = append(responseM.Answer, dns.Copy(cname))
+		name = strings.ToLower(cname.Target)
+		if !zone.contains(name) {
+			// the target is resolved by the client
+			return responseM, true
+		}
+	}
+
+	if len(responseM.Answer) == 0 || responseM.Answer[len(responseM.Answer)-1].Header().Rrtype == dns.TypeCNAME {
+		if !zone.names[name] {
+			responseM.Rcode = dns.RcodeNameError
+		}
+		if zone.SOA != nil {
+			responseM.Ns = append(responseM.Ns, dns.Copy(zone.SOA))
+		}
+	}
+	responseM.Extra = append(responseM.Extra, zone.glue(responseM.Answer)...)
+	return responseM, true
+}
+
+// LoadZoneFile loads the zone file at path and answers its names authoritatively
+// The previously loaded zone is replaced
+func (client *Client) LoadZoneFile(path string, origin string) error {
+	zone, err := LoadZone(path, origin)
+	if err != nil {
+		return err
+	}
+	client.hostsLock.Lock()
+	client.zone = zone
+	client.hostsLock.Unlock()
+	return nil
+}
+
+// zoneAnswer answers a query from the loaded zone
+// Returns false if there is no zone or the name is outside of it
+func (client *Client) zoneAnswer(queryM *dns.Msg) (*dns.Msg, bool) {
+	client.hostsLock.RLock()
+	zone := client.zone
+	client.hostsLock.RUnlock()
+	if zone == nil {
+		return nil, false
+	}
+	return zone.Answer(queryM)
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN corp.example.
+$TTL 3600
+@	IN SOA ns1 hostmaster 2024010101 7200 3600 1209600 300
+@	IN NS ns1
+ns1	IN A 10.0.0.1
+www	IN A 10.0.0.5
+alias	IN CNAME www
+chain	IN CNAME alias
+@	IN MX 10 mail
+mail	IN A 10.0.0.25
+`
+
+// writeZone writes a zone file and returns its path
+func writeZone(t *testing.T, zone string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "corp.zone")
+	err := os.WriteFile(path, []byte(zone), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestZoneAnswers(t *testing.T) {
+	client := newTestClient(t)
+	var upstream int32
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&upstream, 1)
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+	err := client.LoadZoneFile(writeZone(t, testZone), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responseM := resolveWire(t, client, newQuery("www.corp.example", dns.TypeA))
+	if !responseM.Authoritative || len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "10.0.0.5" {
+		t.Errorf("response %v, want an authoritative 10.0.0.5", responseM)
+	}
+
+	responseM = resolveWire(t, client, newQuery("alias.corp.example", dns.TypeA))
+	if len(responseM.Answer) != 2 || responseM.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("answers %v, want the CNAME followed inside the zone", responseM.Answer)
+	}
+	responseM = resolveWire(t, client, newQuery("chain.corp.example", dns.TypeA))
+	if len(responseM.Answer) != 3 || responseM.Answer[2].(*dns.A).A.String() != "10.0.0.5" {
+		t.Errorf("answers %v, want both CNAMEs followed to the address", responseM.Answer)
+	}
+
+	responseM = resolveWire(t, client, newQuery("corp.example", dns.TypeMX))
+	if len(responseM.Answer) != 1 || len(responseM.Extra) != 1 {
+		t.Errorf("response %v, want the MX record with the address of mail", responseM)
+	}
+
+	// a missing name and a missing type are answered with the SOA
+	responseM = resolveWire(t, client, newQuery("missing.corp.example", dns.TypeA))
+	if responseM.Rcode != dns.RcodeNameError || len(responseM.Ns) != 1 {
+		t.Errorf("rcode %s authority %v, want NXDOMAIN with the SOA", dns.RcodeToString[responseM.Rcode], responseM.Ns)
+	}
+	responseM = resolveWire(t, client, newQuery("www.corp.example", dns.TypeAAAA))
+	if responseM.Rcode != dns.RcodeSuccess || len(responseM.Answer) != 0 || len(responseM.Ns) != 1 {
+		t.Errorf("rcode %s answers %v, want NODATA with the SOA", dns.RcodeToString[responseM.Rcode], responseM.Answer)
+	}
+	if upstream != 0 {
+		t.Errorf("%d queries for zone names sent upstream", upstream)
+	}
+
+	// names outside of the zone fall through
+	responseM = resolveWire(t, client, newQuery("www.example.com", dns.TypeA))
+	if responseM.Authoritative || upstream != 1 {
+		t.Errorf("response %v after %d upstream queries, want the upstream answer", responseM, upstream)
+	}
+}
+
+func TestZoneDelegation(t *testing.T) {
+	client := newTestClient(t)
+	var upstream int32
+	client.AddServer(stubServer("stub", func(ctx context.Context, queryM *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&upstream, 1)
+		return answerA(queryM, "192.0.2.1"), nil
+	}))
+	zone := testZone + `lab	IN NS ns.lab
+ns.lab	IN A 10.0.0.53
+`
+	err := client.LoadZoneFile(writeZone(t, zone), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// names at or below the cut are forwarded rather than answered with a referral
+	for _, name := range []string{"lab.corp.example", "host.lab.corp.example"} {
+		responseM := resolveWire(t, client, newQuery(name, dns.TypeA))
+		if responseM.Authoritative || len(responseM.Answer) != 1 || responseM.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Errorf("response %v for %s, want the upstream answer", responseM, name)
+		}
+	}
+	if upstream != 2 {
+		t.Errorf("%d upstream queries, want the 2 delegated names", upstream)
+	}
+
+	// the NS records of the origin come with the address of the name server
+	responseM := resolveWire(t, client, newQuery("corp.example", dns.TypeNS))
+	if !responseM.Authoritative || len(responseM.Answer) != 1 || len(responseM.Extra) != 1 {
+		t.Fatalf("response %v, want the NS record with glue", responseM)
+	}
+	if a, ok := responseM.Extra[0].(*dns.A); !ok || a.A.String() != "10.0.0.1" {
+		t.Errorf("glue %v, want ns1 A 10.0.0.1", responseM.Extra[0])
+	}
+	if upstream != 2 {
+		t.Errorf("%d upstream queries, want the origin answered from the zone", upstream)
+	}
+}